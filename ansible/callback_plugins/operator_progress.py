@@ -0,0 +1,127 @@
+# Reports task progress of an ansible-runner run to the ansible operator's
+# event API, so the operator can show the running task in the status of the
+# resource being reconciled.
+from __future__ import (absolute_import, division, print_function)
+__metaclass__ = type
+
+DOCUMENTATION = '''
+    callback: operator_progress
+    type: aggregate
+    short_description: Report task progress to the ansible operator
+    description:
+      - Posts an operator_task_progress event to the operator's event API at
+        the start of every task, with the number of tasks in the playbook.
+      - Does nothing unless ANSIBLE_OPERATOR_EVENT_SOCKET and
+        ANSIBLE_OPERATOR_EVENT_PATH are set, which the operator does for
+        every run.
+'''
+
+import datetime
+import json
+import os
+import socket
+import uuid
+
+from ansible.plugins.callback import CallbackBase
+
+try:
+    import httplib
+except ImportError:
+    import http.client as httplib
+
+
+class UnixHTTPConnection(httplib.HTTPConnection):
+
+    def __init__(self, socket_path, timeout=5):
+        httplib.HTTPConnection.__init__(self, 'localhost', timeout=timeout)
+        self.socket_path = socket_path
+
+    def connect(self):
+        sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        sock.settimeout(self.timeout)
+        sock.connect(self.socket_path)
+        self.sock = sock
+
+
+def _count_tasks(blocks):
+    count = 0
+    for block in blocks:
+        # rescue sections only run when a task fails
+        for attr in ('block', 'always'):
+            for item in getattr(block, attr, None) or []:
+                if hasattr(item, 'block'):
+                    count += _count_tasks([item])
+                elif item.action != 'meta':
+                    count += 1
+    return count
+
+
+class CallbackModule(CallbackBase):
+
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'aggregate'
+    CALLBACK_NAME = 'operator_progress'
+    CALLBACK_NEEDS_WHITELIST = True
+
+    def __init__(self):
+        super(CallbackModule, self).__init__()
+        self.socket_path = os.environ.get('ANSIBLE_OPERATOR_EVENT_SOCKET')
+        self.url_path = os.environ.get('ANSIBLE_OPERATOR_EVENT_PATH')
+        self.play = ''
+        self.task_number = 0
+        self.total_tasks = 0
+        self.warned = False
+
+    def v2_playbook_on_start(self, playbook):
+        # The total is an estimate: tasks of dynamic includes are only known
+        # once they run, and tasks skipped for a host still count.
+        try:
+            for play in playbook.get_plays():
+                self.total_tasks += _count_tasks(play.compile())
+        except Exception:
+            self.total_tasks = 0
+
+    def v2_playbook_on_play_start(self, play):
+        self.play = play.get_name()
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._task_started(task)
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._task_started(task)
+
+    def _task_started(self, task):
+        self.task_number += 1
+        role = ''
+        if task._role is not None:
+            role = task._role.get_name()
+        self._post({
+            'task': task.get_name(),
+            'role': role,
+            'play': self.play,
+            'task_number': self.task_number,
+            'total_tasks': self.total_tasks,
+        })
+
+    def _post(self, event_data):
+        if not self.socket_path or not self.url_path:
+            return
+        event = {
+            'uuid': str(uuid.uuid4()),
+            'counter': self.task_number,
+            'event': 'operator_task_progress',
+            'event_data': event_data,
+            'pid': os.getpid(),
+            'created': datetime.datetime.utcnow().isoformat(),
+        }
+        try:
+            conn = UnixHTTPConnection(self.socket_path)
+            conn.request('POST', self.url_path, json.dumps(event),
+                         {'Content-Type': 'application/json'})
+            conn.getresponse().read()
+            conn.close()
+        except Exception as e:
+            # Progress reporting must never fail the run.
+            if not self.warned:
+                self._display.warning('unable to report task progress to the operator: %s' % e)
+                self.warned = True
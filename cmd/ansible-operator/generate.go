@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/rbac"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// runGenerate runs the generate subcommand with args, the arguments that
+// follow "generate".
+func runGenerate(args []string) error {
+	if len(args) == 0 || args[0] != "rbac" {
+		return fmt.Errorf("usage: ansible-operator generate rbac [flags]")
+	}
+	fs := flag.NewFlagSet("generate rbac", flag.ExitOnError)
+	watches := fs.String("watches", watchesFile, "Watches file to generate the RBAC rules for; roles are discovered if it does not exist")
+	roles := fs.String("roles-path", rolesDir, "Directory in which roles referenced by name are looked up")
+	name := fs.String("name", "ansible-operator", "Name of the generated role")
+	namespace := fs.String("namespace", "", "Generate a Role in this namespace instead of a ClusterRole")
+	proxyRBAC := fs.Bool("proxy-enforce-rbac", false, "Generate the rules of an operator run with --proxy-enforce-rbac")
+	fs.Parse(args[1:])
+
+	var runners map[schema.GroupVersionKind]runner.Runner
+	var err error
+	if _, statErr := os.Stat(*watches); os.IsNotExist(statErr) {
+		runners, err = runner.NewFromRolesDir(*roles)
+	} else {
+		runners, err = runner.NewFromWatches(*watches)
+	}
+	if err != nil {
+		return err
+	}
+
+	s := rbac.NewScanner(*roles)
+	s.ProxyRBAC = *proxyRBAC
+	if err := s.ScanWatches(runners); err != nil {
+		return err
+	}
+	for _, w := range s.Warnings() {
+		logrus.Warn(w)
+	}
+
+	var out interface{} = s.ClusterRole(*name)
+	if *namespace != "" {
+		out = s.Role(*name, *namespace)
+	}
+	b, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("---\n%s", b)
+	return nil
+}
@@ -2,15 +2,31 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	sdkVersion "github.com/operator-framework/operator-sdk/version"
+	"github.com/water-hole/ansible-operator/pkg/artifacts"
 	"github.com/water-hole/ansible-operator/pkg/controller"
+	"github.com/water-hole/ansible-operator/pkg/crd"
+	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/logging"
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	"github.com/water-hole/ansible-operator/pkg/operator"
+	"github.com/water-hole/ansible-operator/pkg/operatorcondition"
 	proxy "github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/restmapper"
 	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"github.com/water-hole/ansible-operator/pkg/tracing"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
@@ -25,11 +41,102 @@ func printVersion() {
 	logrus.Infof("operator-sdk Version: %v", sdkVersion.Version)
 }
 
+const (
+	// imageDir is where the operator's image keeps its Ansible content.
+	imageDir    = "/opt/ansible"
+	watchesFile = imageDir + "/watches.yaml"
+	rolesDir    = imageDir + "/roles"
+)
+
+var (
+	dynamicWatches  = flag.Bool("dynamic-watches", false, "Start and stop controllers at runtime from AnsibleWatch resources")
+	directReads     = flag.Bool("direct-reads", false, "Read custom resources from the API server instead of the cache when reconciling")
+	crdsDir         = flag.String("crds-dir", "", "Directory of CRD manifests to install at startup, before starting the controllers")
+	maxWorkers      = flag.Int("max-workers", 1, "Number of resources of each kind reconciled at once, unless set in the watch")
+	namespacesCM    = flag.String("namespaces-configmap", "", "Reconcile only the namespaces listed in this ConfigMap, given as namespace/name")
+	serverSideApply = flag.Bool("server-side-apply", false, "Write status and finalizers with server-side apply; requires Kubernetes 1.16 or later")
+	metricsAddr     = flag.String("metrics-addr", ":8383", "Address the metrics endpoint binds to; empty disables it")
+	tracingEndpoint = flag.String("tracing-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP endpoint to export spans of reconciles to, e.g. http://otel-collector:4318")
+	proxyRBAC       = flag.Bool("proxy-enforce-rbac", false, "Authorize the requests of playbooks run as a ServiceAccount with SubjectAccessReviews instead of impersonating it")
+	trackingLabels  = flag.String("tracking-label-prefix", "", "Label resources created by playbooks with their owner's kind, name and namespace hash, below this prefix")
+	statsdAddr      = flag.String("statsd-addr", "", "Send metrics of runs and tasks over StatsD to this host:port")
+	dogstatsd       = flag.Bool("dogstatsd", false, "Tag the StatsD metrics and send events for failures, for DogStatsD")
+	statsdTags      = flag.String("statsd-tags", "", "Comma-separated key:value tags added to every DogStatsD metric")
+	local           = flag.Bool("local", false, "Run outside the cluster for development, with watches.yaml and roles from the current directory")
+	reload          = flag.Duration("reload-interval", 2*time.Second, "With --local, how often roles and playbooks are checked for changes, which reconcile their resources; 0 disables it")
+	syncPeriod      = flag.Duration("sync-period", 10*time.Hour, "How often the manager's cache lists every watched resource again, which reconciles them all; 0 disables it")
+	noProxy         = flag.Bool("no-proxy", false, "Run playbooks against the API server directly, and set the owner of the resources they apply after each run")
+	proxyPort       = flag.Int("proxy-port", 8888, "Port of the proxy playbooks talk to the API server through")
+	proxyCache      = flag.Bool("proxy-cache-reads", false, "Serve the reads of single objects of the kinds the operator watches, through the proxy, from the operator's cache")
+	lintContent     = flag.Bool("lint-content", false, "Check every playbook and role with ansible-playbook --syntax-check at startup, and exit if any is broken")
+	ansibleLint     = flag.Bool("ansible-lint", false, "With --lint-content, also check the playbooks and roles with ansible-lint")
+	cleanup         = flag.Bool("cleanup", false, "Run the finalizer of every CR that has it and remove it, then exit; run before uninstalling the operator")
+	runDir          = flag.String("run-dir", "", "Directory the private data dirs of runs are created in, e.g. a memory-backed volume; defaults to $TMPDIR")
+	removeRunDirs   = flag.Bool("remove-run-dirs", false, "Give every run its own private data dir, and remove it once the run has ended")
+	runDirMaxBytes  = flag.Int64("run-dir-max-bytes", 0, "Fail runs before they start while the private data dirs hold more than this many bytes; 0 disables it")
+	logFormat       = flag.String("log-format", "text", "Format of the logs: text, or ndjson to write logs and the job events of runs to stdout as JSON lines")
+	araServer       = flag.String("ara-server", "", "URL of an ARA API server to record every run to, with ARA's callback plugin")
+	araPlugins      = flag.String("ara-callback-plugins", "", "Directory of ARA's callback plugin; defaults to the output of python3 -m ara.setup.callback_plugins")
+	maxEventSize    = flag.Int64("max-event-size", eventapi.DefaultLimits.MaxEventSize, "Size in bytes of the largest job event of a run kept whole; larger events are reduced to their task and host; 0 is unlimited")
+	maxEventField   = flag.Int("max-event-field-size", eventapi.DefaultLimits.MaxFieldSize, "Length in bytes strings in the results of job events are truncated to; 0 is unlimited")
+	ansibleJobsDir  = flag.String("ansible-jobs-dir", "", "Directory of the playbooks AnsibleJob resources may run once, by file name without extension")
+	schedules       = flag.Bool("ansible-schedules", false, "Run AnsibleJobs and resources of watches on the cron schedules of AnsibleSchedule resources")
+	handoffCM       = flag.String("handoff-configmap", "", "Hand the resources queued and running over to the next operator through this ConfigMap, given as namespace/name")
+	watchesCM       = flag.String("watches-configmap", "", "Read the watches from this ConfigMap, given as namespace/name, instead of the watches file, and reconfigure the controllers as it changes")
+	defaultingAddr  = flag.String("defaulting-webhook-addr", "", "Serve a mutating admission webhook on this address that sets the defaults of the roles in the spec of resources; empty disables it")
+	webhookCertDir  = flag.String("webhook-cert-dir", "/etc/webhook/certs", "Directory of the tls.crt and tls.key the webhooks and the runs API are served with")
+	runsAPIAddr     = flag.String("runs-api-addr", "", "Serve the last runs of the operator at /runs on this address, over TLS, to users allowed to get /runs; empty disables it")
+	grafanaURL      = flag.String("grafana-url", "", "Post an annotation to this Grafana as every run starts and finishes, with the token in $GRAFANA_TOKEN")
+	grafanaBoards   = flag.String("grafana-dashboards", "", "Comma-separated UIDs of the Grafana dashboards annotated; defaults to annotations of the organization")
+	grafanaTags     = flag.String("grafana-tags", "", "Comma-separated tags added to every Grafana annotation")
+	artifactsURL    = flag.String("artifacts-url", "", "URL of an S3-compatible bucket to upload the artifacts of every run to")
+)
+
 func main() {
-	flag.Parse()
-	logf.SetLogger(logf.ZapLogger(false))
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		if err := runGenerate(os.Args[2:]); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "new-api" {
+		if err := runNewAPI(os.Args[2:]); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		// ansible-operator run [flags] is the same as ansible-operator [flags]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	var ndjson *logging.LockedWriter
+	switch *logFormat {
+	case "text":
+		logf.SetLogger(logf.ZapLogger(false))
+	case "ndjson":
+		ndjson = logging.NewLockedWriter(os.Stdout)
+		logging.UseNDJSON(ndjson)
+		logf.SetLogger(logging.Logr())
+	default:
+		log.Fatalf("unknown --log-format %q, must be text or ndjson", *logFormat)
+	}
 
-	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{})
+	cfg := config.GetConfigOrDie()
+	if *crdsDir != "" {
+		if err := crd.Install(cfg, *crdsDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mapper, err := restmapper.NewDynamicRESTMapper(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mgr, err := manager.New(cfg, manager.Options{
+		MapperProvider: func(*rest.Config) (meta.RESTMapper, error) { return mapper, nil },
+		SyncPeriod:     syncPeriod,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -38,14 +145,37 @@ func main() {
 	done := make(chan error)
 
 	// start the proxy
-	proxy.RunProxy(done, proxy.Options{
-		Address:    "localhost",
-		Port:       8888,
-		KubeConfig: mgr.GetConfig(),
-	})
+	var cachedKinds *proxy.KindSet
+	if *proxyCache && !*noProxy {
+		cachedKinds = proxy.NewKindSet()
+	}
+	identities := proxy.NewIdentities()
+	if *noProxy {
+		if *proxyRBAC {
+			log.Fatal("--proxy-enforce-rbac requires the proxy")
+		}
+		logrus.Info("Not starting the proxy; owners are set on resources after each run")
+	} else {
+		proxy.RunProxy(done, proxy.Options{
+			Address:     "localhost",
+			Port:        *proxyPort,
+			KubeConfig:  mgr.GetConfig(),
+			EnforceRBAC: *proxyRBAC,
+			Identities:  identities,
+			Cache:       mgr.GetCache(),
+			CachedKinds: cachedKinds,
+			RESTMapper:  mapper,
+
+			TrackingLabelPrefix: *trackingLabels,
+		})
+	}
+
+	if *metricsAddr != "" {
+		go func() { done <- metrics.Serve(*metricsAddr) }()
+	}
 
 	// start the operator
-	go runSDK(done, mgr)
+	go runSDK(done, mgr, mapper, ndjson, cachedKinds, identities)
 
 	// wait for either to finish
 	err = <-done
@@ -56,25 +186,202 @@ func main() {
 	}
 }
 
-func runSDK(done chan error, mgr manager.Manager) {
+func runSDK(done chan error, mgr manager.Manager, mapper *restmapper.DynamicRESTMapper, ndjson *logging.LockedWriter, cachedKinds *proxy.KindSet, identities *proxy.Identities) {
 	namespace := "default"
-	watches, err := runner.NewFromWatches("/opt/ansible/watches.yaml")
-	if err != nil {
+	b := operator.NewBuilder(mgr).WithNamespace(namespace).WithRESTMapper(mapper)
+	b.WithProxyURL(fmt.Sprintf("http://localhost:%d", *proxyPort))
+	if *noProxy {
+		b.WithoutProxy(*trackingLabels)
+	} else {
+		b.WithProxyIdentities(identities)
+	}
+	if cachedKinds != nil {
+		b.WithCachedKinds(cachedKinds)
+	}
+	watches, roles := watchesFile, rolesDir
+	if *local {
+		wd, err := os.Getwd()
+		if err != nil {
+			done <- err
+			return
+		}
+		logrus.Infof("Running locally, with the watches and roles in %s", wd)
+		watches, roles = filepath.Join(wd, "watches.yaml"), filepath.Join(wd, "roles")
+		b.WithRelocatedPaths(imageDir, wd)
+		if *reload > 0 {
+			b.WithReload(*reload)
+		}
+	}
+	if *watchesCM != "" {
+		parts := strings.SplitN(*watchesCM, "/", 2)
+		if len(parts) != 2 {
+			done <- fmt.Errorf("--watches-configmap must be namespace/name, got %q", *watchesCM)
+			return
+		}
+		b.WithWatchesConfigMap(parts[0], parts[1])
+	} else if _, err := os.Stat(watches); os.IsNotExist(err) {
+		logrus.Infof("No watches file at %s, discovering roles in %s", watches, roles)
+		if err := b.WithRolesDir(roles); err != nil {
+			logrus.Error("Failed to discover roles")
+			done <- err
+			return
+		}
+	} else if err := b.WithWatchesFile(watches); err != nil {
 		logrus.Error("Failed to get watches")
 		done <- err
 		return
 	}
+	upgradeable, underOLM, err := operatorcondition.NewTracker(mgr.GetClient())
+	if err != nil {
+		logrus.Error("Failed to set up OperatorCondition tracking")
+		done <- err
+		return
+	}
+	if underOLM {
+		logrus.Info("Running under OLM, reporting the Upgradeable condition")
+		b.WithUpgradeable(upgradeable)
+	}
+	if *dynamicWatches {
+		b.WithDynamicWatches()
+	}
+	if *ansibleJobsDir != "" {
+		if err := b.WithAnsibleJobsDir(*ansibleJobsDir); err != nil {
+			logrus.Error("Failed to get the playbooks of AnsibleJobs")
+			done <- err
+			return
+		}
+	}
+	if *schedules {
+		b.WithAnsibleSchedules()
+	}
+	if *defaultingAddr != "" {
+		b.WithDefaultingWebhook(*defaultingAddr, *webhookCertDir)
+	}
+	if *runsAPIAddr != "" {
+		b.WithRunsAPI(*runsAPIAddr, *webhookCertDir)
+	}
+	if *directReads {
+		b.WithDirectReads()
+	}
+	b.WithMaxWorkers(*maxWorkers)
+	if *serverSideApply {
+		b.WithServerSideApply()
+	}
+	if *namespacesCM != "" {
+		parts := strings.SplitN(*namespacesCM, "/", 2)
+		if len(parts) != 2 {
+			done <- fmt.Errorf("--namespaces-configmap must be namespace/name, got %q", *namespacesCM)
+			return
+		}
+		namespaces, err := controller.NewNamespaceList(mgr.GetConfig(), parts[0], parts[1])
+		if err == nil {
+			err = mgr.Add(namespaces)
+		}
+		if err != nil {
+			logrus.Error("Failed to set up the namespace list")
+			done <- err
+			return
+		}
+		b.WithNamespaceList(namespaces)
+	}
+	var handoff *controller.Handoff
+	if *handoffCM != "" {
+		parts := strings.SplitN(*handoffCM, "/", 2)
+		if len(parts) != 2 {
+			done <- fmt.Errorf("--handoff-configmap must be namespace/name, got %q", *handoffCM)
+			return
+		}
+		handoff, err = controller.NewHandoff(mgr.GetConfig(), parts[0], parts[1])
+		if err == nil {
+			err = mgr.Add(handoff)
+		}
+		if err != nil {
+			logrus.Error("Failed to set up the handoff")
+			done <- err
+			return
+		}
+		b.WithHandoff(handoff)
+	}
+	if *runDir != "" || *removeRunDirs || *runDirMaxBytes > 0 {
+		b.WithRunDirs(runner.RunDirs{Path: *runDir, Remove: *removeRunDirs, MaxBytes: *runDirMaxBytes})
+	}
+	if *araServer != "" {
+		plugins := *araPlugins
+		if plugins == "" {
+			plugins, err = runner.ARACallbackPlugins()
+			if err != nil {
+				logrus.Error("Failed to set up ARA")
+				done <- err
+				return
+			}
+		}
+		b.WithARA(runner.ARA{Server: *araServer, CallbackPlugins: plugins})
+	}
+	b.WithEventLimits(eventapi.Limits{MaxEventSize: *maxEventSize, MaxFieldSize: *maxEventField})
+	if *artifactsURL != "" {
+		uploader, err := artifacts.NewS3UploaderFromEnv(*artifactsURL)
+		if err != nil {
+			logrus.Error("Failed to set up artifact uploads")
+			done <- err
+			return
+		}
+		b.WithArtifactUploader(uploader)
+	}
+	if ndjson != nil {
+		b.WithEventHandlers(events.NewNDJSONEventHandler(ndjson))
+	}
+	if *statsdAddr != "" {
+		o := events.StatsdOptions{Address: *statsdAddr, DogStatsD: *dogstatsd}
+		if *statsdTags != "" {
+			o.Tags = strings.Split(*statsdTags, ",")
+		}
+		handler, err := events.NewStatsdEventHandler(o)
+		if err != nil {
+			logrus.Error("Failed to set up StatsD")
+			done <- err
+			return
+		}
+		b.WithEventHandlers(handler)
+	}
+	if *grafanaURL != "" {
+		o := events.GrafanaOptions{URL: *grafanaURL, Token: os.Getenv("GRAFANA_TOKEN")}
+		if *grafanaBoards != "" {
+			o.DashboardUIDs = strings.Split(*grafanaBoards, ",")
+		}
+		if *grafanaTags != "" {
+			o.Tags = strings.Split(*grafanaTags, ",")
+		}
+		handler, err := events.NewGrafanaEventHandler(o)
+		if err != nil {
+			logrus.Error("Failed to set up Grafana annotations")
+			done <- err
+			return
+		}
+		b.WithEventHandlers(handler)
+	}
 	rand.Seed(time.Now().Unix())
 	c := signals.SetupSignalHandler()
+	if *tracingEndpoint != "" {
+		b.WithTracer(tracing.NewTracer(*tracingEndpoint, "ansible-operator", c))
+	}
 
-	for gvk, runner := range watches {
-		controller.Add(mgr, controller.Options{
-			GVK:         gvk,
-			Namespace:   namespace,
-			Runner:      runner,
-			StopChannel: c,
-		})
+	if *lintContent {
+		b.WithContentLint(runner.LintOptions{AnsibleLint: *ansibleLint})
+	}
+	if *cleanup {
+		done <- b.Cleanup()
+		return
+	}
+	if err := b.Build(c); err != nil {
+		done <- err
+		return
+	}
+	err = mgr.Start(c)
+	if handoff != nil {
+		if err := handoff.Close(); err != nil {
+			logrus.Errorf("Failed to write the handoff state: %v", err)
+		}
 	}
-	log.Fatal(mgr.Start(c))
+	log.Fatal(err)
 	done <- nil
 }
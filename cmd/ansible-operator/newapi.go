@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/rbac"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// runNewAPI runs the new-api subcommand with args, the arguments that follow
+// "new-api". It adds a watch for a new GVK to the operator in a directory laid
+// out like /opt/ansible: an entry in watches.yaml, a role skeleton under
+// roles/, and a CRD, a sample CR and RBAC rules under deploy/.
+func runNewAPI(args []string) error {
+	fs := flag.NewFlagSet("new-api", flag.ExitOnError)
+	group := fs.String("group", "", "API group of the new kind, e.g. app.example.com")
+	version := fs.String("version", "v1alpha1", "API version of the new kind")
+	kind := fs.String("kind", "", "New kind, e.g. Database")
+	dir := fs.String("dir", ".", "Directory holding watches.yaml and roles/, laid out as they are in the operator's image")
+	fs.Parse(args)
+	if *group == "" || *kind == "" {
+		return fmt.Errorf("usage: ansible-operator new-api --group <group> --version <version> --kind <Kind> [--dir <dir>]")
+	}
+	if strings.ToUpper((*kind)[:1]) != (*kind)[:1] {
+		return fmt.Errorf("kind %q must start with an upper-case letter", *kind)
+	}
+	gvk := schema.GroupVersionKind{Group: *group, Version: *version, Kind: *kind}
+	role := strings.ToLower(gvk.Kind)
+	rolePath := filepath.Join(*dir, "roles", role)
+	if _, err := os.Stat(rolePath); err == nil {
+		return fmt.Errorf("role %s already exists", rolePath)
+	}
+
+	plural, singular := meta.UnsafeGuessKindToResource(gvk)
+	files := []struct {
+		path    string
+		content string
+	}{
+		{filepath.Join(rolePath, "tasks", "main.yml"), fmt.Sprintf("---\n# tasks file for %s\n", role)},
+		{filepath.Join(rolePath, "defaults", "main.yml"), fmt.Sprintf("---\n# defaults file for %s\n", role)},
+		{filepath.Join(rolePath, "meta", "main.yml"), fmt.Sprintf(roleMeta, role)},
+		{filepath.Join(*dir, "deploy", role+"_crd.yaml"), fmt.Sprintf(crdTemplate, plural.Resource, gvk.Group, gvk.Kind, singular.Resource, gvk.Version)},
+		{filepath.Join(*dir, "deploy", role+"_cr.yaml"), fmt.Sprintf(crTemplate, gvk.GroupVersion(), gvk.Kind, role)},
+	}
+	for _, f := range files {
+		if err := writeNewFile(f.path, []byte(f.content)); err != nil {
+			return err
+		}
+	}
+	entry := fmt.Sprintf("- version: %s\n  group: %s\n  kind: %s\n  role: %s\n", gvk.Version, gvk.Group, gvk.Kind, imageDir+"/roles/"+role)
+	watchesPath := filepath.Join(*dir, "watches.yaml")
+	watches, err := ioutil.ReadFile(watchesPath)
+	if os.IsNotExist(err) {
+		watches = []byte("---\n")
+	} else if err != nil {
+		return err
+	}
+	if len(watches) > 0 && watches[len(watches)-1] != '\n' {
+		watches = append(watches, '\n')
+	}
+	before, err := runner.WatchGVKs(watches)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", watchesPath, err)
+	}
+	watches = append(watches, entry...)
+	// appending only adds the entry to a list at the end of the file, not
+	// e.g. to a watches list followed by defaults
+	if after, err := runner.WatchGVKs(watches); err != nil || len(after) != len(before)+1 || after[len(after)-1] != gvk {
+		return fmt.Errorf("cannot append %v to %s; add this entry to its watches by hand:\n%s", gvk, watchesPath, entry)
+	}
+	if err := ioutil.WriteFile(watchesPath, watches, 0644); err != nil {
+		return err
+	}
+	logrus.Infof("Added %v to %s", gvk, watchesPath)
+
+	rbacPath := filepath.Join(*dir, "deploy", role+"_rbac.yaml")
+	absRolePath, err := filepath.Abs(rolePath)
+	if err != nil {
+		return err
+	}
+	r, err := runner.NewForRole(absRolePath, gvk, nil)
+	if err != nil {
+		return err
+	}
+	s := rbac.NewScanner(filepath.Join(*dir, "roles"))
+	if err := s.ScanWatches(map[schema.GroupVersionKind]runner.Runner{gvk: r}); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(s.ClusterRole(role + "-operator"))
+	if err != nil {
+		return err
+	}
+	return writeNewFile(rbacPath, append([]byte("---\n"), b...))
+}
+
+// writeNewFile writes b to path, creating the directories it is in. It fails
+// rather than overwrite an existing file.
+func writeNewFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	logrus.Infof("Created %s", path)
+	return f.Close()
+}
+
+const roleMeta = `---
+galaxy_info:
+  author: your name
+  description: reconciles %s resources with the ansible operator
+  license: Apache-2.0
+  min_ansible_version: 2.6
+  galaxy_tags: []
+dependencies: []
+`
+
+const crdTemplate = `apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: %[1]s.%[2]s
+spec:
+  group: %[2]s
+  names:
+    kind: %[3]s
+    listKind: %[3]sList
+    plural: %[1]s
+    singular: %[4]s
+  scope: Namespaced
+  version: %[5]s
+`
+
+const crTemplate = `apiVersion: "%s"
+kind: "%s"
+metadata:
+  name: "example-%s"
+spec: {}
+`
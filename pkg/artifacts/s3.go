@@ -0,0 +1,221 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// S3Uploader uploads the artifacts of every run, as a gzipped tarball, to a
+// bucket of an S3-compatible object store. Requests are signed with AWS
+// signature version 4.
+type S3Uploader struct {
+	// BucketURL is the path-style URL of the bucket, optionally followed by
+	// a key prefix, e.g. https://s3.us-east-1.amazonaws.com/bucket/prefix.
+	BucketURL *url.URL
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// NewS3UploaderFromEnv returns an S3Uploader for bucketURL, with the
+// credentials and region in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_REGION. The region defaults to us-east-1.
+func NewS3UploaderFromEnv(bucketURL string) (*S3Uploader, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("artifact bucket URL must be http or https: %s", bucketURL)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("artifact bucket URL has no bucket: %s", bucketURL)
+	}
+	s := &S3Uploader{
+		BucketURL: u,
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to upload artifacts")
+	}
+	return s, nil
+}
+
+// Upload stores the artifacts in dir of the run ident of the resource
+// namespace/name as <group>/<version>/<kind>/<namespace>/<name>/<ident>.tar.gz
+// below the bucket URL.
+func (s *S3Uploader) Upload(gvk schema.GroupVersionKind, namespace, name, ident, dir string) error {
+	body, err := tarball(dir)
+	if err != nil {
+		return err
+	}
+	u := s.objectURL(gvk, namespace, name, ident)
+	key := u.Path
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unable to upload %s: %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	logrus.Debugf("uploaded artifacts of run %s to %s", ident, u.String())
+	return nil
+}
+
+// ArtifactURL returns the URL the artifacts of the run ident of the resource
+// namespace/name are uploaded to.
+func (s *S3Uploader) ArtifactURL(gvk schema.GroupVersionKind, namespace, name, ident string) string {
+	u := s.objectURL(gvk, namespace, name, ident)
+	return u.String()
+}
+
+func (s *S3Uploader) objectURL(gvk schema.GroupVersionKind, namespace, name, ident string) url.URL {
+	group := gvk.Group
+	if group == "" {
+		group = "core"
+	}
+	key := path.Join(s.BucketURL.Path, group, gvk.Version, gvk.Kind, namespace, name, ident+".tar.gz")
+	u := *s.BucketURL
+	u.Path = key
+	u.RawPath = uriEscape(key)
+	return u
+}
+
+// sign adds the headers of an AWS signature version 4 to req.
+func (s *S3Uploader) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("content-type:%s\nhost:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.Header.Get("Content-Type"), req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEscape escapes p as signature version 4 requires: everything but
+// unreserved characters and slashes is percent-encoded.
+func uriEscape(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// tarball returns the files below dir as a gzipped tar archive.
+func tarball(dir string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
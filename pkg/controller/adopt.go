@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/proxy/kubeconfig"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// adopt gives the resources a run for owner applied, as reported by its k8s
+// tasks, what the proxy would have injected into them: an owner reference to
+// owner for those in its namespace, the tracking annotations for those in
+// other namespaces or at cluster scope, and the tracking labels below labelPrefix, if set, for
+// all but the former. It is used when playbooks reach the
+// API server without the proxy. Failures are logged, and do not fail the run.
+func adopt(c client.Client, owner *unstructured.Unstructured, deps []dependent, labelPrefix string) {
+	ref := metav1.OwnerReference{
+		APIVersion: owner.GetAPIVersion(),
+		Kind:       owner.GetKind(),
+		Name:       owner.GetName(),
+		UID:        owner.GetUID(),
+	}
+	o := kubeconfig.Owner{OwnerReference: ref, Namespace: owner.GetNamespace()}
+	labels := map[string]string{}
+	if labelPrefix != "" {
+		labels = proxy.TrackingLabels(labelPrefix, o)
+	}
+	annotations := proxy.TrackingAnnotations(o)
+	seen := map[dependentKey]bool{}
+	for _, dep := range deps {
+		if seen[dep.key] {
+			continue
+		}
+		seen[dep.key] = true
+		sameNamespace := owner.GetNamespace() == "" || dep.key.Namespace == owner.GetNamespace()
+		if !sameNamespace && len(labels) == 0 && !crossScope(owner, dep.key) {
+			continue
+		}
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(dep.key.GVK)
+			key := types.NamespacedName{Namespace: dep.key.Namespace, Name: dep.key.Name}
+			if err := c.Get(context.TODO(), key, u); err != nil {
+				return err
+			}
+			if u.GetUID() == owner.GetUID() {
+				return nil
+			}
+			changed := false
+			if sameNamespace && !hasOwner(u, ref) {
+				u.SetOwnerReferences(append(u.GetOwnerReferences(), ref))
+				changed = true
+			}
+			if !sameNamespace {
+				l := u.GetLabels()
+				if l == nil {
+					l = map[string]string{}
+				}
+				for k, v := range labels {
+					if l[k] != v {
+						l[k] = v
+						changed = true
+					}
+				}
+				u.SetLabels(l)
+			}
+			if crossScope(owner, dep.key) {
+				a := u.GetAnnotations()
+				if a == nil {
+					a = map[string]string{}
+				}
+				for k, v := range annotations {
+					if a[k] != v {
+						a[k] = v
+						changed = true
+					}
+				}
+				u.SetAnnotations(a)
+			}
+			if !changed {
+				return nil
+			}
+			return c.Update(context.TODO(), u)
+		})
+		if err != nil {
+			logrus.Warningf("unable to set the owner of %v %s/%s: %v", dep.key.GVK, dep.key.Namespace, dep.key.Name, err)
+		}
+	}
+}
+
+func hasOwner(u *unstructured.Unstructured, ref metav1.OwnerReference) bool {
+	for _, r := range u.GetOwnerReferences() {
+		if r.UID == ref.UID {
+			return true
+		}
+	}
+	return false
+}
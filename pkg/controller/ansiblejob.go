@@ -0,0 +1,298 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/proxy/kubeconfig"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// AnsibleJobGVK is the GVK of the namespaced resource whose instances run a
+// playbook declared to the operator once, e.g. for operational tasks such as
+// a backup or a rotation of credentials.
+var AnsibleJobGVK = schema.GroupVersionKind{
+	Group:   "operator.ansible.io",
+	Version: "v1alpha1",
+	Kind:    "AnsibleJob",
+}
+
+// The phases of an AnsibleJob, in status.phase.
+const (
+	AnsibleJobRunning   = "Running"
+	AnsibleJobSucceeded = "Succeeded"
+	AnsibleJobFailed    = "Failed"
+)
+
+// maxAnsibleJobStdout is the size of the end of the output of a run kept in
+// status.stdout.
+const maxAnsibleJobStdout = 32 * 1024
+
+// AnsibleJobOptions - options for the AnsibleJob controller
+type AnsibleJobOptions struct {
+	// Template holds the options of the runs of AnsibleJobs, e.g. their run
+	// directories.
+	Template Options
+	// Playbooks maps the names AnsibleJobs may set in spec.playbook to the
+	// paths of the playbooks.
+	Playbooks map[string]string
+}
+
+// AnsibleJobPlaybooks returns the playbooks in dir, by their file names
+// without extension, for AnsibleJobOptions.Playbooks.
+func AnsibleJobPlaybooks(dir string) (map[string]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	playbooks := map[string]string{}
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if f.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		playbooks[strings.TrimSuffix(f.Name(), ext)] = filepath.Join(dir, f.Name())
+	}
+	return playbooks, nil
+}
+
+// AddAnsibleJobController - Creates the controller that runs the playbook
+// of every AnsibleJob once.
+func AddAnsibleJobController(mgr manager.Manager, options AnsibleJobOptions) error {
+	logrus.Infof("Watching %s/%v, %s for %d playbooks", AnsibleJobGVK.Group, AnsibleJobGVK.Version, AnsibleJobGVK.Kind, len(options.Playbooks))
+	mgr.GetScheme().AddKnownTypeWithName(AnsibleJobGVK, &unstructured.Unstructured{})
+	metav1.AddToGroupVersion(mgr.GetScheme(), AnsibleJobGVK.GroupVersion())
+
+	r := &ansibleJobReconciler{
+		client:     mgr.GetClient(),
+		restConfig: mgr.GetConfig(),
+		template:   options.Template,
+		playbooks:  options.Playbooks,
+	}
+	c, err := controller.New("ansiblejob-controller", mgr, controller.Options{
+		Reconciler:              r,
+		MaxConcurrentReconciles: options.Template.MaxWorkers,
+	})
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(AnsibleJobGVK)
+	if err := c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+	// gives r the controller's queue, to requeue AnsibleJobs at the end of
+	// their TTL
+	return c.Watch(r, &crthandler.EnqueueRequestForObject{})
+}
+
+// ansibleJobReconciler - object to reconcile AnsibleJob resources
+type ansibleJobReconciler struct {
+	client     client.Client
+	restConfig *rest.Config
+	template   Options
+	playbooks  map[string]string
+	mutex      sync.Mutex
+	queue      workqueue.RateLimitingInterface
+}
+
+// Start implements source.Source
+func (r *ansibleJobReconciler) Start(_ crthandler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.queue = q
+	return nil
+}
+
+// Reconcile - run the playbook of an AnsibleJob that has not run yet, or
+// delete one whose TTL after it finished has passed.
+func (r *ansibleJobReconciler) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(AnsibleJobGVK)
+	err := r.client.Get(context.TODO(), request.NamespacedName, u)
+	if apierrors.IsNotFound(err) {
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if u.GetDeletionTimestamp() != nil {
+		return reconcile.Result{}, nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"component": "ansiblejob",
+		"namespace": u.GetNamespace(),
+		"name":      u.GetName(),
+	})
+
+	status := statusAsMap(u)
+	switch phase, _ := status["phase"].(string); phase {
+	case AnsibleJobSucceeded, AnsibleJobFailed:
+		return r.expire(u, log)
+	case AnsibleJobRunning:
+		// Runs hold the worker of their AnsibleJob until they end, so
+		// this one was cut short.
+		return reconcile.Result{}, r.finish(u, AnsibleJobFailed, "the operator stopped during the run", nil, "")
+	}
+
+	name, _, _ := unstructured.NestedString(u.Object, "spec", "playbook")
+	path, ok := r.playbooks[name]
+	if !ok {
+		return reconcile.Result{}, r.finish(u, AnsibleJobFailed, fmt.Sprintf("unknown playbook %q", name), nil, "")
+	}
+	vars, _, err := unstructured.NestedMap(u.Object, "spec", "vars")
+	if err != nil {
+		return reconcile.Result{}, r.finish(u, AnsibleJobFailed, fmt.Sprintf("invalid spec.vars: %v", err), nil, "")
+	}
+	if err := r.start(u); err != nil {
+		return reconcile.Result{}, err
+	}
+	log.Infof("Running playbook %s", name)
+	phase, message, stats, stdout := r.run(u, path, vars, log)
+	if err := r.finish(u, phase, message, stats, stdout); err != nil {
+		return reconcile.Result{}, err
+	}
+	return r.expire(u, log)
+}
+
+// start sets u Running, with the time the run starts.
+func (r *ansibleJobReconciler) start(u *unstructured.Unstructured) error {
+	status := statusAsMap(u)
+	status["phase"] = AnsibleJobRunning
+	status["startTime"] = time.Now().UTC().Format(time.RFC3339)
+	return r.client.Update(context.TODO(), u)
+}
+
+// run runs the playbook at path for u with vars, and returns the phase u ends
+// up in, a message if it failed, the stats and the end of the output.
+func (r *ansibleJobReconciler) run(u *unstructured.Unstructured, path string, vars map[string]interface{}, log logrus.FieldLogger) (string, string, *eventapi.StatsEventData, string) {
+	rn, err := runner.NewForPlaybook(path, AnsibleJobGVK, nil)
+	if err != nil {
+		return AnsibleJobFailed, err.Error(), nil, ""
+	}
+	options := r.template
+	options.GVK = AnsibleJobGVK
+	options.Runner = rn
+	configureRunner(options)
+	// The playbooks use the operator's credentials; what they create is not
+	// owned by the AnsibleJob, so it outlives its TTL.
+	kc, err := kubeconfig.CreateDirect(r.restConfig, u.GetNamespace())
+	if err != nil {
+		return AnsibleJobFailed, err.Error(), nil, ""
+	}
+	defer os.Remove(kc.Name())
+	eventChan, err := rn.Run(context.TODO(), u, kc.Name(), vars)
+	if err != nil {
+		return AnsibleJobFailed, err.Error(), nil, ""
+	}
+	logger := events.NewLoggingEventHandler(options.LoggingLevel)
+	stdout := ""
+	var stats *eventapi.StatsEventData
+	for event := range eventChan {
+		logger.Handle(u, event)
+		if event.StdOut != "" {
+			stdout += event.StdOut + "\n"
+			if len(stdout) > maxAnsibleJobStdout {
+				stdout = stdout[len(stdout)-maxAnsibleJobStdout:]
+			}
+		}
+		if event.Event == "playbook_on_stats" {
+			statusEvent := eventapi.StatusJobEvent{}
+			if data, err := json.Marshal(event); err == nil && json.Unmarshal(data, &statusEvent) == nil {
+				stats = &statusEvent.EventData
+			}
+		}
+	}
+	if stats == nil {
+		return AnsibleJobFailed, "did not receive playbook_on_stats event", nil, stdout
+	}
+	if !isSuccessfulRun(eventapi.StatusJobEvent{EventData: *stats}) {
+		return AnsibleJobFailed, "the playbook failed", stats, stdout
+	}
+	return AnsibleJobSucceeded, "", stats, stdout
+}
+
+// finish writes the outcome of the run of u to its status.
+func (r *ansibleJobReconciler) finish(u *unstructured.Unstructured, phase, message string, stats *eventapi.StatsEventData, stdout string) error {
+	status := statusAsMap(u)
+	status["phase"] = phase
+	status["completionTime"] = time.Now().UTC().Format(time.RFC3339)
+	if message != "" {
+		status["message"] = message
+	}
+	if stdout != "" {
+		status["stdout"] = stdout
+	}
+	if stats != nil {
+		m := map[string]interface{}{}
+		for name, counts := range map[string]map[string]int{
+			"ok":       stats.Ok,
+			"changed":  stats.Changed,
+			"failures": stats.Failures,
+			"skipped":  stats.Skipped,
+		} {
+			hosts := map[string]interface{}{}
+			for host, n := range counts {
+				hosts[host] = int64(n)
+			}
+			m[name] = hosts
+		}
+		status["stats"] = m
+	}
+	return r.client.Update(context.TODO(), u)
+}
+
+// expire deletes u once spec.ttlSecondsAfterFinished has passed since it
+// finished, or requeues it for then.
+func (r *ansibleJobReconciler) expire(u *unstructured.Unstructured, log logrus.FieldLogger) (reconcile.Result, error) {
+	ttl, ok, _ := unstructured.NestedInt64(u.Object, "spec", "ttlSecondsAfterFinished")
+	if !ok {
+		return reconcile.Result{}, nil
+	}
+	completion, _, _ := unstructured.NestedString(u.Object, "status", "completionTime")
+	finished, err := time.Parse(time.RFC3339, completion)
+	if err != nil {
+		finished = time.Now()
+	}
+	if left := time.Until(finished.Add(time.Duration(ttl) * time.Second)); left > 0 {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.queue != nil {
+			r.queue.AddAfter(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}}, left)
+		}
+		return reconcile.Result{}, nil
+	}
+	log.Info("Deleting AnsibleJob, its TTL has passed")
+	if err := r.client.Delete(context.TODO(), u); err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
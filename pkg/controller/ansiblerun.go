@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnsibleRunGVK is the GVK of the namespaced resource recording a run of a
+// resource of a watch with ansibleRuns.
+var AnsibleRunGVK = schema.GroupVersionKind{
+	Group:   "operator.ansible.io",
+	Version: "v1alpha1",
+	Kind:    "AnsibleRun",
+}
+
+// The labels of AnsibleRuns, selecting those of a resource.
+const (
+	AnsibleRunOwnerUIDLabel  = "operator.ansible.io/owner-uid"
+	AnsibleRunOwnerKindLabel = "operator.ansible.io/owner-kind"
+	AnsibleRunOwnerNameLabel = "operator.ansible.io/owner-name"
+)
+
+// newAnsibleRun returns the AnsibleRun of the run of u that started at
+// started and ended with result, in namespace. Its spec holds the inputs of
+// the run, its status the outcome.
+func newAnsibleRun(u *unstructured.Unstructured, namespace string, started time.Time, result RunResult) *unstructured.Unstructured {
+	run := &unstructured.Unstructured{}
+	run.SetGroupVersionKind(AnsibleRunGVK)
+	run.SetNamespace(namespace)
+	run.SetName(ansibleRunName(u.GetName(), result.Ident))
+	run.SetLabels(map[string]string{
+		AnsibleRunOwnerUIDLabel:  string(u.GetUID()),
+		AnsibleRunOwnerKindLabel: u.GetKind(),
+		AnsibleRunOwnerNameLabel: labelValue(u.GetName()),
+	})
+	if namespace == u.GetNamespace() {
+		// deleted along with u
+		run.SetOwnerReferences([]metav1.OwnerReference{*metav1.NewControllerRef(u, u.GroupVersionKind())})
+	}
+	owner := map[string]interface{}{
+		"apiVersion": u.GetAPIVersion(),
+		"kind":       u.GetKind(),
+		"name":       u.GetName(),
+		"uid":        string(u.GetUID()),
+	}
+	if u.GetNamespace() != "" {
+		owner["namespace"] = u.GetNamespace()
+	}
+	run.Object["spec"] = map[string]interface{}{
+		"owner":      owner,
+		"ident":      result.Ident,
+		"generation": u.GetGeneration(),
+		"specHash":   specHash(u),
+		"finalizer":  result.Finalizer,
+	}
+	status := result.RunRecord.toMap()
+	delete(status, "ident")
+	if !started.IsZero() {
+		status["startTime"] = started.UTC().Format(time.RFC3339)
+	}
+	if result.Completion != "" {
+		status["completionTime"] = result.Completion
+		delete(status, "completion")
+	}
+	stats := map[string]interface{}{}
+	for name, counts := range map[string]map[string]int{
+		"ok":       result.Stats.Ok,
+		"changed":  result.Stats.Changed,
+		"failures": result.Stats.Failures,
+		"skipped":  result.Stats.Skipped,
+	} {
+		total := int64(0)
+		for _, n := range counts {
+			total += int64(n)
+		}
+		stats[name] = total
+	}
+	status["stats"] = stats
+	run.Object["status"] = status
+	return run
+}
+
+// ansibleRunName returns the name of the AnsibleRun of the run ident of the
+// resource name.
+func ansibleRunName(name, ident string) string {
+	if max := 253 - len(ident) - 1; len(name) > max {
+		name = strings.TrimRight(name[:max], "-.")
+	}
+	return name + "-" + ident
+}
+
+// labelValue returns s cut to the length of a label value.
+func labelValue(s string) string {
+	if len(s) > 63 {
+		s = strings.TrimRight(s[:63], "-.")
+	}
+	return s
+}
+
+// recordAnsibleRun creates the AnsibleRun of the run of u with c, and deletes
+// the oldest AnsibleRuns of u beyond the limit of settings.
+func recordAnsibleRun(c client.Client, u *unstructured.Unstructured, settings runner.AnsibleRuns, started time.Time, result RunResult) error {
+	namespace := u.GetNamespace()
+	if namespace == "" {
+		namespace = settings.Namespace
+	}
+	if namespace == "" {
+		return nil
+	}
+	run := newAnsibleRun(u, namespace, started, result)
+	if err := c.Create(context.TODO(), run); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(AnsibleRunGVK.GroupVersion().WithKind(AnsibleRunGVK.Kind + "List"))
+	opts := &client.ListOptions{
+		Namespace:     namespace,
+		LabelSelector: labels.SelectorFromSet(labels.Set{AnsibleRunOwnerUIDLabel: string(u.GetUID())}),
+	}
+	if err := c.List(context.TODO(), opts, list); err != nil {
+		return err
+	}
+	if len(list.Items) <= settings.Limit {
+		return nil
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		ti, tj := list.Items[i].GetCreationTimestamp(), list.Items[j].GetCreationTimestamp()
+		if ti.Equal(&tj) {
+			return list.Items[i].GetName() < list.Items[j].GetName()
+		}
+		return ti.Before(&tj)
+	})
+	for i := range list.Items[:len(list.Items)-settings.Limit] {
+		old := &list.Items[i]
+		if err := c.Delete(context.TODO(), old); err != nil && !apierrors.IsNotFound(err) {
+			logrus.Errorf("Failed to delete AnsibleRun %s/%s: %v", old.GetNamespace(), old.GetName(), err)
+		}
+	}
+	return nil
+}
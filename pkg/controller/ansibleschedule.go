@@ -0,0 +1,326 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// AnsibleScheduleGVK is the GVK of the namespaced resource whose instances
+// run a playbook declared to the operator, or a resource of a watch, on a
+// cron schedule.
+var AnsibleScheduleGVK = schema.GroupVersionKind{
+	Group:   "operator.ansible.io",
+	Version: "v1alpha1",
+	Kind:    "AnsibleSchedule",
+}
+
+// AnsibleScheduleLabel is set on the AnsibleJobs an AnsibleSchedule creates,
+// to its name.
+const AnsibleScheduleLabel = "operator.ansible.io/schedule"
+
+// The concurrency policies of AnsibleSchedules, in spec.concurrencyPolicy.
+const (
+	// ConcurrencyAllow starts a run even while earlier ones are running.
+	ConcurrencyAllow = "Allow"
+	// ConcurrencyForbid skips a run while an earlier one is running.
+	ConcurrencyForbid = "Forbid"
+)
+
+const (
+	// scheduleInterval is how often schedules are checked for runs due.
+	scheduleInterval = 15 * time.Second
+	// maxMissedSchedules bounds the times a schedule is walked through to
+	// find the last one missed, e.g. while the operator was down; only that
+	// one runs.
+	maxMissedSchedules = 1000
+	// The numbers of finished AnsibleJobs kept per schedule by default.
+	defaultSuccessfulHistoryLimit = 3
+	defaultFailedHistoryLimit     = 1
+)
+
+// AnsibleScheduleOptions - options for the scheduler of AnsibleSchedules
+type AnsibleScheduleOptions struct {
+	// Namespace is the namespace AnsibleSchedules are read from, all if
+	// empty.
+	Namespace string
+}
+
+// AddAnsibleScheduler - Adds the runnable that runs AnsibleSchedules to mgr.
+// The AnsibleJobs of schedules of playbooks are run by the AnsibleJob
+// controller.
+func AddAnsibleScheduler(mgr manager.Manager, options AnsibleScheduleOptions) error {
+	logrus.Infof("Watching %s/%v, %s", AnsibleScheduleGVK.Group, AnsibleScheduleGVK.Version, AnsibleScheduleGVK.Kind)
+	mgr.GetScheme().AddKnownTypeWithName(AnsibleScheduleGVK, &unstructured.Unstructured{})
+	metav1.AddToGroupVersion(mgr.GetScheme(), AnsibleScheduleGVK.GroupVersion())
+	return mgr.Add(&scheduler{mgr: mgr, namespace: options.Namespace})
+}
+
+// scheduler checks every scheduleInterval which AnsibleSchedules are due,
+// and runs them.
+type scheduler struct {
+	mgr       manager.Manager
+	namespace string
+	client    client.Client
+}
+
+// Start runs the schedules until stop is closed. Failures are logged rather
+// than stopping the operator.
+func (s *scheduler) Start(stop <-chan struct{}) error {
+	// Read from the API server: schedules are only read every
+	// scheduleInterval, which does not warrant informers.
+	c, err := client.New(s.mgr.GetConfig(), client.Options{Scheme: s.mgr.GetScheme()})
+	if err != nil {
+		return err
+	}
+	s.client = c
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		s.sync(time.Now().UTC())
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync runs the schedules due at now.
+func (s *scheduler) sync(now time.Time) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(AnsibleScheduleGVK.GroupVersion().WithKind(AnsibleScheduleGVK.Kind + "List"))
+	if err := s.client.List(context.TODO(), &client.ListOptions{Namespace: s.namespace}, list); err != nil {
+		logrus.Errorf("Failed to list AnsibleSchedules: %v", err)
+		return
+	}
+	for i := range list.Items {
+		u := &list.Items[i]
+		if u.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if err := s.syncSchedule(u, now); err != nil {
+			logrus.Errorf("Failed to run AnsibleSchedule %s/%s: %v", u.GetNamespace(), u.GetName(), err)
+		}
+	}
+}
+
+// syncSchedule runs u, if it is due at now, and updates its status.
+func (s *scheduler) syncSchedule(u *unstructured.Unstructured, now time.Time) error {
+	before := map[string]interface{}{}
+	for k, v := range statusAsMap(u) {
+		before[k] = v
+	}
+	status := statusAsMap(u)
+	delete(status, "message")
+	err := s.run(u, status, now)
+	if err != nil {
+		status["message"] = err.Error()
+	}
+	if !reflect.DeepEqual(before, status) {
+		if uerr := s.client.Update(context.TODO(), u); uerr != nil {
+			return uerr
+		}
+	}
+	return err
+}
+
+// run runs u if it is due at now, recording in status the time it last ran
+// and its runs still active.
+func (s *scheduler) run(u *unstructured.Unstructured, status map[string]interface{}, now time.Time) error {
+	spec, _ := u.Object["spec"].(map[string]interface{})
+	expr, _ := spec["schedule"].(string)
+	schedule, err := parseCronSchedule(expr)
+	if err != nil {
+		return err
+	}
+	policy, _ := spec["concurrencyPolicy"].(string)
+	if policy == "" {
+		policy = ConcurrencyAllow
+	}
+	if policy != ConcurrencyAllow && policy != ConcurrencyForbid {
+		return fmt.Errorf("unknown concurrencyPolicy %q; must be %s or %s", policy, ConcurrencyAllow, ConcurrencyForbid)
+	}
+	template, hasPlaybook := spec["jobTemplate"].(map[string]interface{})
+	ref, hasRef := spec["resourceRef"].(map[string]interface{})
+	if hasPlaybook == hasRef {
+		return fmt.Errorf("exactly one of spec.jobTemplate and spec.resourceRef must be set")
+	}
+
+	active := false
+	if hasPlaybook {
+		names, err := s.history(u, spec)
+		if err != nil {
+			return err
+		}
+		active = len(names) > 0
+		if active {
+			status["active"] = names
+		} else {
+			delete(status, "active")
+		}
+	} else if active, err = s.pending(u, ref); err != nil {
+		return err
+	}
+
+	if suspend, _ := spec["suspend"].(bool); suspend {
+		return nil
+	}
+	last := u.GetCreationTimestamp().Time
+	if t, err := time.Parse(time.RFC3339, fmt.Sprint(status["lastScheduleTime"])); err == nil {
+		last = t
+	}
+	due := schedule.next(last)
+	if due.IsZero() || due.After(now) {
+		return nil
+	}
+	for i := 0; i < maxMissedSchedules; i++ {
+		n := schedule.next(due)
+		if n.IsZero() || n.After(now) {
+			break
+		}
+		due = n
+	}
+	status["lastScheduleTime"] = due.Format(time.RFC3339)
+	if active && policy == ConcurrencyForbid {
+		logrus.Infof("AnsibleSchedule %s/%s is still running, skipping its run of %s", u.GetNamespace(), u.GetName(), due.Format(time.RFC3339))
+		return nil
+	}
+	if hasPlaybook {
+		return s.createJob(u, template, due)
+	}
+	return s.reconcileNow(u, ref, due)
+}
+
+// createJob creates the AnsibleJob of the run of u at due, from template.
+func (s *scheduler) createJob(u *unstructured.Unstructured, template map[string]interface{}, due time.Time) error {
+	job := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": template,
+	}}
+	job.SetGroupVersionKind(AnsibleJobGVK)
+	job.SetNamespace(u.GetNamespace())
+	job.SetName(scheduledJobName(u.GetName(), due))
+	job.SetLabels(map[string]string{AnsibleScheduleLabel: labelValue(u.GetName())})
+	job.SetOwnerReferences([]metav1.OwnerReference{*metav1.NewControllerRef(u, AnsibleScheduleGVK)})
+	logrus.Infof("AnsibleSchedule %s/%s is due, creating AnsibleJob %s", u.GetNamespace(), u.GetName(), job.GetName())
+	if err := s.client.Create(context.TODO(), job); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// scheduledJobName returns the name of the AnsibleJob of the run of the
+// schedule name at due, unique per scheduled time.
+func scheduledJobName(name string, due time.Time) string {
+	suffix := fmt.Sprintf("-%d", due.Unix()/60)
+	if max := 253 - len(suffix); len(name) > max {
+		name = name[:max]
+	}
+	return name + suffix
+}
+
+// history returns the names of the AnsibleJobs of u still running, and
+// deletes the oldest finished ones beyond the history limits of spec.
+func (s *scheduler) history(u *unstructured.Unstructured, spec map[string]interface{}) ([]interface{}, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(AnsibleJobGVK.GroupVersion().WithKind(AnsibleJobGVK.Kind + "List"))
+	opts := &client.ListOptions{
+		Namespace:     u.GetNamespace(),
+		LabelSelector: labels.SelectorFromSet(labels.Set{AnsibleScheduleLabel: labelValue(u.GetName())}),
+	}
+	if err := s.client.List(context.TODO(), opts, list); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		ti, tj := list.Items[i].GetCreationTimestamp(), list.Items[j].GetCreationTimestamp()
+		if ti.Equal(&tj) {
+			return list.Items[i].GetName() < list.Items[j].GetName()
+		}
+		return tj.Before(&ti)
+	})
+	limits := map[string]int64{
+		AnsibleJobSucceeded: historyLimit(spec, "successfulJobsHistoryLimit", defaultSuccessfulHistoryLimit),
+		AnsibleJobFailed:    historyLimit(spec, "failedJobsHistoryLimit", defaultFailedHistoryLimit),
+	}
+	kept := map[string]int64{}
+	active := []interface{}{}
+	for i := range list.Items {
+		job := &list.Items[i]
+		phase, _, _ := unstructured.NestedString(job.Object, "status", "phase")
+		limit, finished := limits[phase]
+		if !finished {
+			active = append(active, job.GetName())
+			continue
+		}
+		if kept[phase] < limit {
+			kept[phase]++
+			continue
+		}
+		if err := s.client.Delete(context.TODO(), job); err != nil && !apierrors.IsNotFound(err) {
+			logrus.Errorf("Failed to delete AnsibleJob %s/%s: %v", job.GetNamespace(), job.GetName(), err)
+		}
+	}
+	return active, nil
+}
+
+func historyLimit(spec map[string]interface{}, name string, def int64) int64 {
+	if n, ok := spec[name].(int64); ok && n >= 0 {
+		return n
+	}
+	return def
+}
+
+// target returns the resource of u's spec.resourceRef ref, in the namespace
+// of u.
+func (s *scheduler) target(u *unstructured.Unstructured, ref map[string]interface{}) (*unstructured.Unstructured, error) {
+	apiVersion, _ := ref["apiVersion"].(string)
+	kind, _ := ref["kind"].(string)
+	name, _ := ref["name"].(string)
+	if apiVersion == "" || kind == "" || name == "" {
+		return nil, fmt.Errorf("spec.resourceRef must set apiVersion, kind and name")
+	}
+	target := &unstructured.Unstructured{}
+	target.SetAPIVersion(apiVersion)
+	target.SetKind(kind)
+	err := s.client.Get(context.TODO(), types.NamespacedName{Namespace: u.GetNamespace(), Name: name}, target)
+	return target, err
+}
+
+// pending reports whether the last run of the resource of ref was requested
+// and has not run yet.
+func (s *scheduler) pending(u *unstructured.Unstructured, ref map[string]interface{}) (bool, error) {
+	target, err := s.target(u, ref)
+	if err != nil {
+		return false, err
+	}
+	return reconcileNowRequested(target), nil
+}
+
+// reconcileNow runs the resource of ref, by setting its
+// ReconcileNowAnnotation to due.
+func (s *scheduler) reconcileNow(u *unstructured.Unstructured, ref map[string]interface{}, due time.Time) error {
+	target, err := s.target(u, ref)
+	if err != nil {
+		return err
+	}
+	annotations := target.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ReconcileNowAnnotation] = due.Format(time.RFC3339)
+	target.SetAnnotations(annotations)
+	logrus.Infof("AnsibleSchedule %s/%s is due, running %s %s", u.GetNamespace(), u.GetName(), target.GetKind(), target.GetName())
+	return s.client.Update(context.TODO(), target)
+}
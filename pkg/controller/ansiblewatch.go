@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// AnsibleWatchGVK is the GVK of the cluster-scoped resource whose instances
+// declare watches at runtime. Each instance's spec.watches holds entries in
+// the same format as the watches file.
+var AnsibleWatchGVK = schema.GroupVersionKind{
+	Group:   "operator.ansible.io",
+	Version: "v1alpha1",
+	Kind:    "AnsibleWatch",
+}
+
+// AnsibleWatchOptions - options for the AnsibleWatch controller
+type AnsibleWatchOptions struct {
+	// Template holds the options used for each controller started from an
+	// AnsibleWatch. Its GVK and Runner are set per watch.
+	Template Options
+	// StaticGVKs are the GVKs already watched from the watches file. An
+	// AnsibleWatch may not declare them.
+	StaticGVKs []schema.GroupVersionKind
+}
+
+// AddAnsibleWatchController - Creates the controller that starts and stops
+// ansible controllers as AnsibleWatch resources change.
+func AddAnsibleWatchController(mgr manager.Manager, options AnsibleWatchOptions) error {
+	logrus.Infof("Watching %s/%v, %s for dynamic watches", AnsibleWatchGVK.Group, AnsibleWatchGVK.Version, AnsibleWatchGVK.Kind)
+	mgr.GetScheme().AddKnownTypeWithName(AnsibleWatchGVK, &unstructured.Unstructured{})
+	metav1.AddToGroupVersion(mgr.GetScheme(), AnsibleWatchGVK.GroupVersion())
+
+	r := &ansibleWatchReconciler{
+		mgr:      mgr,
+		client:   mgr.GetClient(),
+		template: options.Template,
+		static:   map[schema.GroupVersionKind]bool{},
+		active:   map[schema.GroupVersionKind]*dynamicController{},
+	}
+	for _, gvk := range options.StaticGVKs {
+		r.static[gvk] = true
+	}
+	c, err := controller.New("ansiblewatch-controller", mgr, controller.Options{
+		Reconciler: r,
+	})
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(AnsibleWatchGVK)
+	return c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{})
+}
+
+// dynamicController is an ansible controller started for an AnsibleWatch.
+type dynamicController struct {
+	// owner is the name of the AnsibleWatch that declared the watch.
+	owner string
+	// hash identifies the watch entry the controller was started from.
+	hash string
+	stop chan struct{}
+}
+
+// ansibleWatchReconciler - object to reconcile AnsibleWatch resources
+type ansibleWatchReconciler struct {
+	mgr      manager.Manager
+	client   client.Client
+	template Options
+	static   map[schema.GroupVersionKind]bool
+	mutex    sync.Mutex
+	active   map[schema.GroupVersionKind]*dynamicController
+}
+
+// desiredWatch is a parsed entry of an AnsibleWatch's spec.watches.
+type desiredWatch struct {
+	runner runner.Runner
+	hash   string
+}
+
+// Reconcile - start and stop controllers to match an AnsibleWatch.
+func (r *ansibleWatchReconciler) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(AnsibleWatchGVK)
+	err := r.client.Get(context.TODO(), request.NamespacedName, u)
+	if apierrors.IsNotFound(err) {
+		r.stopOwnedBy(request.Name, nil)
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if u.GetDeletionTimestamp() != nil {
+		r.stopOwnedBy(u.GetName(), nil)
+		return reconcile.Result{}, nil
+	}
+
+	watchErrors := []string{}
+	desired := map[schema.GroupVersionKind]desiredWatch{}
+	entries, _, err := unstructured.NestedSlice(u.Object, "spec", "watches")
+	if err != nil {
+		watchErrors = append(watchErrors, fmt.Sprintf("invalid spec.watches: %v", err))
+	}
+	for _, entry := range entries {
+		gvk, dw, err := parseWatchEntry(entry)
+		if err != nil {
+			watchErrors = append(watchErrors, err.Error())
+			continue
+		}
+		if r.static[gvk] {
+			watchErrors = append(watchErrors, fmt.Sprintf("%v is already watched by the operator", gvk))
+			continue
+		}
+		if dc, ok := r.active[gvk]; ok && dc.owner != u.GetName() {
+			watchErrors = append(watchErrors, fmt.Sprintf("%v is already watched by AnsibleWatch %s", gvk, dc.owner))
+			continue
+		}
+		if _, ok := desired[gvk]; ok {
+			watchErrors = append(watchErrors, fmt.Sprintf("duplicate GVK: %v", gvk))
+			continue
+		}
+		desired[gvk] = dw
+	}
+
+	r.stopOwnedBy(u.GetName(), desired)
+
+	requeue := false
+	for gvk, dw := range desired {
+		if _, ok := r.active[gvk]; ok {
+			continue
+		}
+		options := r.template
+		options.GVK = gvk
+		options.Runner = dw.runner
+		stop := make(chan struct{})
+		options.StopChannel = stop
+		if _, err := add(r.mgr, options); err != nil {
+			close(stop)
+			logrus.Errorf("failed to start controller for %v: %v", gvk, err)
+			watchErrors = append(watchErrors, fmt.Sprintf("failed to start controller for %v: %v", gvk, err))
+			requeue = true
+			continue
+		}
+		r.active[gvk] = &dynamicController{owner: u.GetName(), hash: dw.hash, stop: stop}
+	}
+
+	watching := []string{}
+	for gvk, dc := range r.active {
+		if dc.owner == u.GetName() {
+			watching = append(watching, gvk.String())
+		}
+	}
+	sort.Strings(watching)
+	sort.Strings(watchErrors)
+	if err := r.updateStatus(u, watching, watchErrors); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{Requeue: requeue}, nil
+}
+
+// stopOwnedBy stops the controllers started for the AnsibleWatch named owner
+// that are not in keep, or whose watch entry has changed.
+func (r *ansibleWatchReconciler) stopOwnedBy(owner string, keep map[schema.GroupVersionKind]desiredWatch) {
+	for gvk, dc := range r.active {
+		if dc.owner != owner {
+			continue
+		}
+		if dw, ok := keep[gvk]; ok && dw.hash == dc.hash {
+			continue
+		}
+		logrus.Infof("Stopping controller for %v from AnsibleWatch %s", gvk, owner)
+		close(dc.stop)
+		delete(r.active, gvk)
+	}
+}
+
+func (r *ansibleWatchReconciler) updateStatus(u *unstructured.Unstructured, watching, watchErrors []string) error {
+	status := map[string]interface{}{}
+	if len(watching) > 0 {
+		status["watching"] = toInterfaceSlice(watching)
+	}
+	if len(watchErrors) > 0 {
+		status["errors"] = toInterfaceSlice(watchErrors)
+	}
+	if reflect.DeepEqual(u.Object["status"], status) {
+		return nil
+	}
+	u.Object["status"] = status
+	err := r.client.Update(context.TODO(), u)
+	if !apierrors.IsConflict(err) {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fresh := &unstructured.Unstructured{}
+		fresh.SetGroupVersionKind(AnsibleWatchGVK)
+		if err := r.client.Get(context.TODO(), types.NamespacedName{Name: u.GetName()}, fresh); err != nil {
+			return err
+		}
+		fresh.Object["status"] = status
+		return r.client.Update(context.TODO(), fresh)
+	})
+}
+
+// parseWatchEntry builds the runner for a single watch entry.
+func parseWatchEntry(entry interface{}) (schema.GroupVersionKind, desiredWatch, error) {
+	b, err := json.Marshal([]interface{}{entry})
+	if err != nil {
+		return schema.GroupVersionKind{}, desiredWatch{}, err
+	}
+	runners, err := runner.NewFromWatchesData(b)
+	if err != nil {
+		return schema.GroupVersionKind{}, desiredWatch{}, err
+	}
+	for gvk, rn := range runners {
+		return gvk, desiredWatch{runner: rn, hash: fmt.Sprintf("%x", sha256.Sum256(b))}, nil
+	}
+	return schema.GroupVersionKind{}, desiredWatch{}, fmt.Errorf("empty watch entry")
+}
+
+func toInterfaceSlice(in []string) []interface{} {
+	out := make([]interface{}, len(in))
+	for i, s := range in {
+		out[i] = s
+	}
+	return out
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// FieldManager is the field manager of the operator's server-side applies.
+const FieldManager = "ansible-operator"
+
+// applyPatchType is the patch type of server-side apply.
+const applyPatchType types.PatchType = "application/apply-patch+yaml"
+
+// applyWriter writes only the fields the operator owns with server-side
+// apply, as FieldManager. Fields set by playbooks or users are left alone,
+// and writes don't fail on conflicts with them.
+type applyWriter struct {
+	*patchWriter
+}
+
+// newApplyWriter returns an applyWriter for resources of gvk. finalizer is
+// the finalizer the operator adds to them, if any. mapper may be nil, in
+// which case the resource name is guessed from the kind.
+func newApplyWriter(c client.Reader, cfg *rest.Config, gvk schema.GroupVersionKind, mapper meta.RESTMapper, finalizer string) (*applyWriter, error) {
+	w, err := newPatchWriter(c, cfg, gvk, mapper, finalizer)
+	if err != nil {
+		return nil, err
+	}
+	return &applyWriter{patchWriter: w}, nil
+}
+
+func (w *applyWriter) writeStatus(u *unstructured.Unstructured) error {
+	return w.apply(u)
+}
+
+func (w *applyWriter) writeFinalizers(u *unstructured.Unstructured) error {
+	if w.finalizer != "" && u.GetDeletionTimestamp() != nil && !contains(u.GetFinalizers(), w.finalizer) {
+		// Leaving the finalizer out of an apply only removes it if no other
+		// manager owns it, e.g. one that added it before server-side apply
+		// was enabled.
+		return w.patchWriter.writeFinalizers(u)
+	}
+	return w.apply(u)
+}
+
+// apply applies the finalizer and the status fields the operator owns. Each
+// apply must hold all of them, as fields left out are removed.
+func (w *applyWriter) apply(u *unstructured.Unstructured) error {
+	metadata := map[string]interface{}{
+		"name":      u.GetName(),
+		"namespace": u.GetNamespace(),
+	}
+	if w.finalizer != "" && contains(u.GetFinalizers(), w.finalizer) {
+		metadata["finalizers"] = []interface{}{w.finalizer}
+	}
+	applied := map[string]interface{}{
+		"apiVersion": u.GetAPIVersion(),
+		"kind":       u.GetKind(),
+		"metadata":   metadata,
+	}
+	status, err := ownedStatus(u)
+	if err != nil {
+		return err
+	}
+	if status != nil {
+		applied["status"] = status
+	}
+	req := w.client.Patch(applyPatchType).
+		Param("fieldManager", FieldManager).
+		Param("force", "true")
+	return patchResource(req, w.resource, u, applied)
+}
@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// SpecValidCondition is the type of the condition reporting whether the spec
+// of a resource is valid for the argument specs of its roles.
+const SpecValidCondition = "SpecValid"
+
+// specValidator is implemented by runners that can check a spec against the
+// argument specs of their roles.
+type specValidator interface {
+	HasArgumentSpecs() bool
+	ValidateSpec(u *unstructured.Unstructured, extraVars map[string]interface{}) error
+}
+
+// validateSpec checks the spec of u against the argument specs of the roles
+// of the watch. It returns false if there are none to check it against.
+func (r *AnsibleOperatorReconciler) validateSpec(u *unstructured.Unstructured, extraVars map[string]interface{}) (condition, bool) {
+	sv, ok := r.Runner.(specValidator)
+	if !ok || !sv.HasArgumentSpecs() {
+		return condition{}, false
+	}
+	c := condition{Type: SpecValidCondition, Status: "True", Reason: "Valid"}
+	if err := sv.ValidateSpec(u, extraVars); err != nil {
+		c.Status, c.Reason, c.Message = "False", "InvalidSpec", err.Error()
+	}
+	return c, true
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// NeedsApprovalCondition is the type of the condition set on resources of
+// watches with a canary, whose check-mode run predicted more changes than
+// the watch allows.
+const NeedsApprovalCondition = "NeedsApproval"
+
+// ApproveAnnotation, set to a new value on a resource that needs approval,
+// runs it regardless of the changes its check-mode run predicted. The value
+// last handled is kept in status.approved.
+const ApproveAnnotation = "operator.ansible.io/approve"
+
+// approvalRequested reports whether the ApproveAnnotation of u was set to a
+// value no run has handled yet.
+func approvalRequested(u *unstructured.Unstructured) bool {
+	nonce := u.GetAnnotations()[ApproveAnnotation]
+	if nonce == "" {
+		return false
+	}
+	status, _ := u.Object["status"].(map[string]interface{})
+	return status["approved"] != nonce
+}
+
+// checkRun runs the content of the watch for u in check mode, and returns
+// its NeedsApproval condition: True if it predicted more changed tasks than
+// canary allows.
+func (r *AnsibleOperatorReconciler) checkRun(ctx context.Context, u *unstructured.Unstructured, canary runner.Canary, kubeconfigPath string, extraVars map[string]interface{}, env map[string]string) (condition, error) {
+	er, ok := r.Runner.(envRunner)
+	if !ok {
+		return condition{}, fmt.Errorf("%v cannot run in check mode", r.GVK)
+	}
+	checkEnv := map[string]string{runner.CheckModeEnv: "true"}
+	for k, v := range env {
+		checkEnv[k] = v
+	}
+	// a run of its own, so its artifacts do not mix with the real run's
+	checkEnv[runner.IdentEnv] = runner.NewIdent()
+	eventChan, err := er.RunWithEnv(ctx, u, kubeconfigPath, extraVars, checkEnv)
+	if err != nil {
+		return condition{}, err
+	}
+	statusEvent := eventapi.StatusJobEvent{}
+	for event := range eventChan {
+		if event.Event == "playbook_on_stats" {
+			data, err := json.Marshal(event)
+			if err == nil {
+				err = json.Unmarshal(data, &statusEvent)
+			}
+			if err != nil {
+				return condition{}, err
+			}
+		}
+	}
+	if statusEvent.Event == "" {
+		return condition{}, errors.New("did not receive playbook_on_stats event from the check-mode run")
+	}
+	changes := 0
+	for _, n := range statusEvent.EventData.Changed {
+		changes += n
+	}
+	c := condition{Type: NeedsApprovalCondition, Status: "False", Reason: "WithinThreshold", Negative: true}
+	c.Message = fmt.Sprintf("the check-mode run predicted %d changed tasks, of at most %d", changes, canary.MaxChanges)
+	if changes > canary.MaxChanges {
+		c.Status = "True"
+		c.Reason = "TooManyChanges"
+		c.Message = fmt.Sprintf("the check-mode run predicted %d changed tasks, more than the %d allowed; set the %s annotation to a new value to run anyway", changes, canary.MaxChanges, ApproveAnnotation)
+	}
+	return c, nil
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Cleanup prepares the operator's uninstall: it runs the finalizer of
+// options.Runner for every resource of options.GVK that still has it, even
+// if the resource is not being deleted, and removes the finalizer once it
+// succeeded, so that no resource is left that cannot be deleted without the
+// operator. Resources whose finalizer fails keep it, and are reported in
+// the returned error.
+func Cleanup(cfg *rest.Config, options Options) error {
+	finalizer, ok := options.Runner.GetFinalizer()
+	if !ok {
+		return nil
+	}
+	var mapper meta.RESTMapper
+	if options.RESTMapper != nil {
+		mapper = options.RESTMapper
+	}
+	c, err := client.New(cfg, client.Options{Mapper: mapper})
+	if err != nil {
+		return err
+	}
+	w, err := newPatchWriter(c, cfg, options.GVK, mapper, finalizer)
+	if err != nil {
+		return err
+	}
+	configureRunner(options)
+	if err := configureJobs(options.Runner, cfg); err != nil {
+		return err
+	}
+	h := &AnsibleOperatorReconciler{
+		Client:        c,
+		GVK:           options.GVK,
+		Runner:        options.Runner,
+		EventHandlers: append(options.EventHandlers, events.NewLoggingEventHandler(options.LoggingLevel)),
+		ProxyURL:      options.ProxyURL,
+		NoProxy:       options.NoProxy,
+		RESTConfig:    cfg,
+		writer:        w,
+	}
+
+	ul := &unstructured.UnstructuredList{}
+	ul.SetGroupVersionKind(options.GVK)
+	if err := c.List(context.TODO(), nil, ul); err != nil {
+		return err
+	}
+	failed := []string{}
+	for i := range ul.Items {
+		u := &ul.Items[i]
+		if !contains(u.GetFinalizers(), finalizer) || !reconciles(options.Runner, u) {
+			continue
+		}
+		logrus.Infof("Running finalizer %s of %v %s/%s", finalizer, options.GVK.Kind, u.GetNamespace(), u.GetName())
+		if err := h.finalize(u, finalizer); err != nil {
+			logrus.Errorf("unable to clean up %s/%s: %v", u.GetNamespace(), u.GetName(), err)
+			failed = append(failed, fmt.Sprintf("%s/%s", u.GetNamespace(), u.GetName()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("the finalizer of %d %v resources failed, they keep it: %v", len(failed), options.GVK.Kind, failed)
+	}
+	return nil
+}
+
+// finalize runs the finalizer for u, and removes it from u if the run
+// succeeded.
+func (r *AnsibleOperatorReconciler) finalize(u *unstructured.Unstructured, finalizer string) error {
+	run := u.DeepCopy()
+	if run.GetDeletionTimestamp() == nil {
+		// the runner runs the finalizer for resources being deleted
+		now := metav1.Now()
+		run.SetDeletionTimestamp(&now)
+	}
+	kubeconfigPath, removeKubeconfig, err := r.kubeconfigFor(u)
+	if err != nil {
+		return err
+	}
+	defer removeKubeconfig()
+	extraVars, secretVars, err := resolveExtraVarsFrom(r.Client, u.GetNamespace(), r.Runner.GetExtraVarsFrom())
+	if err != nil {
+		return err
+	}
+	ctx := runner.WithRedactedVars(context.TODO(), secretVars...)
+	if c, ok := r.Runner.GetCredentials(); ok {
+		rc, err := runCredentials(r.Client, u, c)
+		if err != nil {
+			return err
+		}
+		ctx = runner.WithRunCredentials(ctx, rc)
+	}
+	eventChan, err := r.Runner.Run(ctx, run, kubeconfigPath, extraVars)
+	if err != nil {
+		return err
+	}
+	stats := eventapi.StatusJobEvent{}
+	// The handlers may outlive the run, and the later writes to u.
+	handled := u.DeepCopy()
+	for event := range eventChan {
+		for _, eHandler := range r.EventHandlers {
+			go handleEvent(eHandler, handled, event)
+		}
+		if event.Event == "playbook_on_stats" {
+			if data, err := json.Marshal(event); err == nil {
+				json.Unmarshal(data, &stats)
+			}
+		}
+	}
+	if stats.Event == "" {
+		return fmt.Errorf("did not receive playbook_on_stats event")
+	}
+	if !isSuccessfulRun(stats) {
+		return fmt.Errorf("finalizer run failed")
+	}
+	u.SetFinalizers(withFinalizer(u.GetFinalizers(), finalizer, false))
+	return r.resourceWriter().writeFinalizers(u)
+}
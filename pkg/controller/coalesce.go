@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// coalescer merges the events for a resource that arrive while a run of it
+// is in progress into a single follow-up run, which reads the resource as it
+// is once the run ends. The queue already holds a key once however often it
+// is added; the coalescer drops the periodic reconciles, which the run in
+// progress answers, and lets a failed run leave its retry to the follow-up.
+type coalescer struct {
+	running func(types.NamespacedName) bool
+	mutex   sync.Mutex
+	// merged counts the events of each running resource.
+	merged map[types.NamespacedName]int
+	// followUps are the running resources an event queued a run for.
+	followUps map[types.NamespacedName]bool
+}
+
+func newCoalescer(running func(types.NamespacedName) bool) *coalescer {
+	return &coalescer{
+		running:   running,
+		merged:    map[types.NamespacedName]int{},
+		followUps: map[types.NamespacedName]bool{},
+	}
+}
+
+// controller returns c, with the sources it watches coalesced.
+func (c *coalescer) controller(ctrl controller.Controller) controller.Controller {
+	return &coalescingController{Controller: ctrl, coalescer: c}
+}
+
+// source returns s with its events coalesced. Periodic events are dropped
+// while a run is in progress, others queue the follow-up run.
+func (c *coalescer) source(s source.Source, periodic bool) source.Source {
+	return &coalescingSource{Source: s, coalescer: c, periodic: periodic}
+}
+
+// runStarted clears what was merged for nn; the events so far are answered
+// by the run starting.
+func (c *coalescer) runStarted(nn types.NamespacedName) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.merged, nn)
+	delete(c.followUps, nn)
+}
+
+// runFinished returns the number of events for nn during its run, and
+// whether they queued a follow-up run.
+func (c *coalescer) runFinished(nn types.NamespacedName) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.merged[nn], c.followUps[nn]
+}
+
+// drop records an event for item and reports whether it is to be dropped.
+func (c *coalescer) drop(item interface{}, periodic bool) bool {
+	req, ok := item.(reconcile.Request)
+	if !ok || !c.running(req.NamespacedName) {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.merged[req.NamespacedName]++
+	if !periodic {
+		c.followUps[req.NamespacedName] = true
+	}
+	return periodic
+}
+
+type coalescingController struct {
+	controller.Controller
+	coalescer *coalescer
+}
+
+// Watch implements controller.Controller
+func (c *coalescingController) Watch(src source.Source, h crthandler.EventHandler, prct ...predicate.Predicate) error {
+	if _, ok := src.(*coalescingSource); !ok {
+		src = c.coalescer.source(src, false)
+	}
+	return c.Controller.Watch(src, h, prct...)
+}
+
+type coalescingSource struct {
+	source.Source
+	coalescer *coalescer
+	periodic  bool
+}
+
+// Start implements source.Source
+func (s *coalescingSource) Start(h crthandler.EventHandler, q workqueue.RateLimitingInterface, prct ...predicate.Predicate) error {
+	return s.Source.Start(h, &coalescingQueue{RateLimitingInterface: q, source: s}, prct...)
+}
+
+// InjectFunc passes the fields the controller sets on its sources on to the
+// source wrapped.
+func (s *coalescingSource) InjectFunc(f inject.Func) error {
+	return f(s.Source)
+}
+
+type coalescingQueue struct {
+	workqueue.RateLimitingInterface
+	source *coalescingSource
+}
+
+func (q *coalescingQueue) Add(item interface{}) {
+	if !q.source.coalescer.drop(item, q.source.periodic) {
+		q.RateLimitingInterface.Add(item)
+	}
+}
+
+func (q *coalescingQueue) AddRateLimited(item interface{}) {
+	if !q.source.coalescer.drop(item, q.source.periodic) {
+		q.RateLimitingInterface.AddRateLimited(item)
+	}
+}
+
+func (q *coalescingQueue) AddAfter(item interface{}, duration time.Duration) {
+	if !q.source.coalescer.drop(item, q.source.periodic) {
+		q.RateLimitingInterface.AddAfter(item, duration)
+	}
+}
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
@@ -8,13 +9,24 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/operatorcondition"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/restmapper"
 	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"github.com/water-hole/ansible-operator/pkg/tracing"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
@@ -24,52 +36,434 @@ type Options struct {
 	LoggingLevel  events.LogLevel
 	Runner        runner.Runner
 	Namespace     string
-	GVK           schema.GroupVersionKind
+	// Namespaces, if set, limits the resources reconciled to those in the
+	// namespaces it lists.
+	Namespaces *NamespaceList
+	GVK        schema.GroupVersionKind
+	// DirectReads makes the reconciler get resources from the API server
+	// instead of the manager's cache.
+	DirectReads bool
+	// MaxWorkers is the number of resources reconciled at once, unless the
+	// runner sets its own. Defaults to 1.
+	MaxWorkers int
+	// Upgradeable is set when running under OLM so that the controller can
+	// hold back operator upgrades while runs are in flight.
+	Upgradeable *operatorcondition.Tracker
+	// RESTMapper, if set, is checked for GVK before the controller is
+	// created, and reset while waiting for it to be served. It should be the
+	// manager's RESTMapper.
+	RESTMapper *restmapper.DynamicRESTMapper
+	// ServerSideApply writes status and finalizers with server-side apply,
+	// as FieldManager, instead of merge patches.
+	ServerSideApply bool
+	// Tracer, if set, records spans of every run.
+	Tracer *tracing.Tracer
+	// ArtifactUploader, if set, uploads the artifacts of every run of a
+	// runner that accepts one.
+	ArtifactUploader runner.ArtifactUploader
+	// RunDirs, if set, is where a runner that accepts it writes the private
+	// data dirs of its runs.
+	RunDirs *runner.RunDirs
+	// CachedKinds, if set, is given the kinds the controller has informers
+	// for, which the proxy may serve reads of from the cache.
+	CachedKinds *proxy.KindSet
+	// ARA, if set, is the ARA server a runner that accepts it records its
+	// runs to.
+	ARA *runner.ARA
+	// EventLimits, if set, bound the size of the events of the runs of a
+	// runner that accepts them.
+	EventLimits *eventapi.Limits
+	// ProxyURL is the URL of the operator's proxy; see
+	// AnsibleOperatorReconciler.
+	ProxyURL string
+	// Identities are those of the operator's proxy; see
+	// AnsibleOperatorReconciler.
+	Identities *proxy.Identities
+	// ReloadInterval, if set, is how often the playbooks and roles of the
+	// runner are checked for changes, which reconcile every resource of the
+	// GVK. It is meant for development.
+	ReloadInterval time.Duration
+	// NoProxy runs playbooks without the proxy; see
+	// AnsibleOperatorReconciler.
+	NoProxy             bool
+	TrackingLabelPrefix string
+	// Middleware wraps the reconciler of the controller, e.g. for metrics or
+	// guardrails around every reconcile. The first listed wraps all others.
+	Middleware []Middleware
+	// Handoff, if set, records the resources queued and running, for the
+	// operator taking over from this one, and resumes those the operator
+	// before it left.
+	Handoff *Handoff
+	// PreReconcile and PostReconcile are called around every run; see
+	// AnsibleOperatorReconciler.
+	PreReconcile  func(u *unstructured.Unstructured) error
+	PostReconcile func(u *unstructured.Unstructured, result RunResult)
 	//StopChannel is need to deal with the bug:
 	// https://github.com/kubernetes-sigs/controller-runtime/issues/103
 	StopChannel <-chan struct{}
 }
 
-// Add - Creates a new ansible operator controller and adds it to the manager
-func Add(mgr manager.Manager, options Options) {
-	logrus.Infof("Watching %s/%v, %s, %s", options.GVK.Group, options.GVK.Version, options.GVK.Kind, options.Namespace)
-	if options.EventHandlers == nil {
-		options.EventHandlers = []events.EventHandler{}
+// Middleware wraps a reconciler with behaviour of its own, calling next to
+// reconcile.
+type Middleware func(next reconcile.Reconciler) reconcile.Reconciler
+
+// Add - Creates a new ansible operator controller and adds it to the manager.
+// If options.RESTMapper is set and the GVK is not served yet, e.g. because
+// its CRD is not installed, the controller is created once it is, and Add
+// returns a nil controller.
+func Add(mgr manager.Manager, options Options) (controller.Controller, error) {
+	if options.GVK.Kind == "" || options.GVK.Version == "" {
+		return nil, fmt.Errorf("invalid GVK %v: kind and version are required", options.GVK)
 	}
-	eventHandlers := append(options.EventHandlers, events.NewLoggingEventHandler(options.LoggingLevel))
+	if options.Runner == nil {
+		return nil, fmt.Errorf("no runner given for %v", options.GVK)
+	}
+	if !available(options) {
+		logrus.Warningf("%v is not served by the API server, is its CRD installed? Its controller will start once it is", options.GVK)
+		go addWhenAvailable(mgr, options)
+		return nil, nil
+	}
+	return add(mgr, options)
+}
 
-	h := &AnsibleOperatorReconciler{
-		Client:        mgr.GetClient(),
-		GVK:           options.GVK,
-		Runner:        options.Runner,
-		EventHandlers: eventHandlers,
+// checkServiceAccountScope returns an error if the runs of the cluster-scoped
+// gvk act as a ServiceAccount without a namespace, which would default to
+// that of the resource. kubeconfigFor fails the runs of such resources
+// without a RESTMapper to check with.
+func checkServiceAccountScope(mapper meta.RESTMapper, gvk schema.GroupVersionKind, r runner.Runner) error {
+	sa, ok := r.GetServiceAccount()
+	if !ok || sa.Namespace != "" {
+		return nil
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return fmt.Errorf("serviceAccount namespace must be set for cluster-scoped %v", gvk)
 	}
+	return nil
+}
 
-	// Register the GVK with the schema
-	mgr.GetScheme().AddKnownTypeWithName(options.GVK, &unstructured.Unstructured{})
+// MustAdd is Add, exiting the process if the controller cannot be created.
+//
+// Deprecated: use Add and handle its error.
+func MustAdd(mgr manager.Manager, options Options) {
+	if _, err := Add(mgr, options); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// add creates the controller. If options.StopChannel is closed before the
+// manager stops, the controller stops with it.
+func add(mgr manager.Manager, options Options) (controller.Controller, error) {
+	logrus.Infof("Watching %s/%v, %s, %s", options.GVK.Group, options.GVK.Version, options.GVK.Kind, options.Namespace)
+	h, err := NewReconciler(mgr, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.RESTMapper != nil {
+		if err := checkServiceAccountScope(options.RESTMapper, options.GVK, options.Runner); err != nil {
+			return nil, err
+		}
+	}
+	reader := h.Reader
+
+	// Register the GVK with the schema, unless a Go type was registered for
+	// it; the cache and client read it as unstructured either way.
+	if !mgr.GetScheme().Recognizes(options.GVK) {
+		mgr.GetScheme().AddKnownTypeWithName(options.GVK, &unstructured.Unstructured{})
+	}
 	metav1.AddToGroupVersion(mgr.GetScheme(), schema.GroupVersion{
 		Group:   options.GVK.Group,
 		Version: options.GVK.Version,
 	})
 
+	var m manager.Manager = mgr
+	if options.StopChannel != nil {
+		m = &stoppableManager{Manager: mgr, stop: options.StopChannel}
+	}
+	// The middleware listed first wraps all others.
+	var rec reconcile.Reconciler = h
+	for i := len(options.Middleware) - 1; i >= 0; i-- {
+		rec = options.Middleware[i](rec)
+	}
+	h.handoff = options.Handoff.watch(options.GVK)
+	rec = h.handoff.reconciler(rec)
+	latency := newLatencyTracker(options.GVK)
+	rec = latency.reconciler(rec)
+	// Panics fail the reconcile rather than the operator.
+	rec = recoverPanics(h, rec)
 	//Create new controller runtime controller and set the controller to watch GVK.
-	c, err := controller.New(fmt.Sprintf("%v-controller", strings.ToLower(options.GVK.Kind)), mgr, controller.Options{
-		Reconciler: h,
+	workers := options.MaxWorkers
+	if w := options.Runner.GetMaxWorkers(); w > 0 {
+		workers = w
+	}
+	c, err := newController(fmt.Sprintf("%v-controller", strings.ToLower(options.GVK.Kind)), options.GVK, m, controller.Options{
+		Reconciler:              rec,
+		MaxConcurrentReconciles: workers,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	if h.handoff != nil {
+		if err := c.Watch(h.handoff, &crthandler.EnqueueRequestForObject{}); err != nil {
+			return nil, err
+		}
+	}
+	// Events arriving during a run of a resource are merged into one
+	// follow-up run.
+	watcher := h.coalescer.controller(h.handoff.controller(latency.controller(c)))
 	u := &unstructured.Unstructured{}
 	u.SetGroupVersionKind(options.GVK)
-	if err := c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{}); err != nil {
-		log.Fatal(err)
+	// Runs in progress are cancelled as the controller stops, or as their
+	// resource is deleted or, if the watch preempts stale runs, changed.
+	ctx, cancel := context.WithCancel(context.Background())
+	h.ctx = ctx
+	if err := m.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		<-stop
+		cancel()
+		return nil
+	})); err != nil {
+		cancel()
+		return nil, err
+	}
+	predicates := []predicate.Predicate{cancelRuns(h), ignoreStatusUpdates}
+	if options.Namespaces != nil {
+		predicates = append(predicates, options.Namespaces.predicate())
+		ns := &namespaceSource{list: options.Namespaces, gvk: options.GVK, reader: reader}
+		if err := watcher.Watch(ns, &crthandler.EnqueueRequestForObject{}); err != nil {
+			return nil, err
+		}
+	}
+	if options.Runner.GetFieldSelector() != nil || len(options.Runner.GetRequireAnnotations()) != 0 {
+		predicates = append(predicates, selectionPredicate(options.Runner))
+	}
+	if err := watcher.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{}, predicates...); err != nil {
+		return nil, err
+	}
+	options.CachedKinds.Add(options.GVK)
+	if err := watchTriggers(mgr, watcher, options.GVK, options.Runner.GetTriggers(), options.CachedKinds); err != nil {
+		return nil, err
+	}
+	if err := watchOwned(mgr, watcher, options.GVK, options.Runner.GetWatchedResources(), options.CachedKinds); err != nil {
+		return nil, err
+	}
+	if options.Runner.GetWatchDependentResources() {
+		h.dependents = newDependentTracker(mgr.GetCache())
+		h.dependents.kinds = options.CachedKinds
+		if err := watcher.Watch(h.dependents, &crthandler.EnqueueRequestForObject{}); err != nil {
+			return nil, err
+		}
+	}
+	if interval := options.Runner.GetCooldown(); interval > 0 {
+		h.cooldown = newCooldown(interval)
+		if err := watcher.Watch(h.cooldown, &crthandler.EnqueueRequestForObject{}); err != nil {
+			return nil, err
+		}
+	}
+	if options.ReloadInterval > 0 {
+		rs := &reloadSource{
+			gvk:      options.GVK,
+			reader:   reader,
+			paths:    options.Runner.GetPaths(),
+			interval: options.ReloadInterval,
+			stop:     options.StopChannel,
+		}
+		if err := watcher.Watch(rs, &crthandler.EnqueueRequestForObject{}); err != nil {
+			return nil, err
+		}
 	}
 	r := NewReconcileLoop(time.Duration(time.Minute)*1, options.GVK, mgr.GetClient())
 	r.Stop = options.StopChannel
+	r.Cache = mgr.GetCache()
 	cs := &source.Channel{Source: r.Source}
 	cs.InjectStopChannel(options.StopChannel)
-	if err := c.Watch(cs, &crthandler.EnqueueRequestForObject{}); err != nil {
-		log.Fatal(err)
+	periodic := []predicate.Predicate{}
+	if n := options.Runner.GetSuspendPeriodicAfter(); n > 0 {
+		h.quiet = newQuietTracker(n)
+		periodic = append(periodic, h.quiet.predicate())
+	}
+	// Periodic resyncs wait for the queue to drain, behind deletions and
+	// changes.
+	if err := watcher.Watch(h.coalescer.source(newLowPrioritySource(cs, options.StopChannel), true), &crthandler.EnqueueRequestForObject{}, periodic...); err != nil {
+		return nil, err
+	}
+	if sample, ok := options.Runner.GetDefaultCR(); ok {
+		d := &defaultCRCreator{mgr: mgr, sample: sample, namespace: options.Namespace}
+		if options.RESTMapper != nil {
+			d.mapper = options.RESTMapper
+		}
+		if err := m.Add(d); err != nil {
+			return nil, err
+		}
 	}
 	r.Start()
+	go reportFleet(options.GVK, reader, h, options.StopChannel)
+	reportWatch(options.GVK, options.Runner, workers, options.StopChannel)
+	return c, nil
+}
+
+// NewReconciler returns the reconciler the controller Add creates would use
+// for options, for embedders wrapping it or adding it to a controller of
+// their own. Features backed by watches of the controller, i.e. dependent
+// watches, cooldowns and suspending the periodic reconcile, are only set up by
+// Add.
+func NewReconciler(mgr manager.Manager, options Options) (*AnsibleOperatorReconciler, error) {
+	if options.EventHandlers == nil {
+		options.EventHandlers = []events.EventHandler{}
+	}
+	eventHandlers := append(options.EventHandlers, events.NewLoggingEventHandler(options.LoggingLevel))
+
+	configureRunner(options)
+	if err := configureJobs(options.Runner, mgr.GetConfig()); err != nil {
+		return nil, err
+	}
+
+	var reader client.Reader = mgr.GetCache()
+	if options.DirectReads {
+		reader = mgr.GetClient()
+	}
+	h := &AnsibleOperatorReconciler{
+		Client:        mgr.GetClient(),
+		Reader:        reader,
+		GVK:           options.GVK,
+		Runner:        options.Runner,
+		EventHandlers: eventHandlers,
+		Upgradeable:   options.Upgradeable,
+		Recorder:      mgr.GetRecorder(fmt.Sprintf("%v-controller", strings.ToLower(options.GVK.Kind))),
+		Namespaces:    options.Namespaces,
+		Tracer:        options.Tracer,
+		ProxyURL:      options.ProxyURL,
+		Identities:    options.Identities,
+		NoProxy:       options.NoProxy,
+		RESTConfig:    mgr.GetConfig(),
+
+		PreReconcile:        options.PreReconcile,
+		PostReconcile:       options.PostReconcile,
+		TrackingLabelPrefix: options.TrackingLabelPrefix,
+	}
+	h.coalescer = newCoalescer(h.isRunning)
+	h.taskFailures = newTaskFailures()
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return nil, err
+	}
+	h.terminating = newTerminatingNamespaces(clientset)
+
+	finalizer, _ := options.Runner.GetFinalizer()
+	var mapper meta.RESTMapper
+	if options.RESTMapper != nil {
+		mapper = options.RESTMapper
+	}
+	if options.Runner.GetPruneDependents() {
+		c, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mapper})
+		if err != nil {
+			return nil, err
+		}
+		h.pruneClient = c
+	}
+	if _, ok := options.Runner.GetAnsibleRuns(); ok {
+		c, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mapper})
+		if err != nil {
+			return nil, err
+		}
+		h.runsClient = c
+	}
+	if options.ServerSideApply {
+		w, err := newApplyWriter(mgr.GetClient(), mgr.GetConfig(), options.GVK, mapper, finalizer)
+		if err != nil {
+			return nil, err
+		}
+		h.writer = w
+	} else {
+		w, err := newPatchWriter(mgr.GetClient(), mgr.GetConfig(), options.GVK, mapper, finalizer)
+		if err != nil {
+			return nil, err
+		}
+		h.writer = w
+	}
+	return h, nil
+}
+
+// configureRunner passes the options runners may accept on to
+// options.Runner.
+func configureRunner(options Options) {
+	if options.ArtifactUploader != nil {
+		if r, ok := options.Runner.(interface {
+			SetArtifactUploader(runner.ArtifactUploader)
+		}); ok {
+			r.SetArtifactUploader(options.ArtifactUploader)
+		}
+	}
+	if options.RunDirs != nil {
+		if r, ok := options.Runner.(interface {
+			SetRunDirs(runner.RunDirs)
+		}); ok {
+			r.SetRunDirs(*options.RunDirs)
+		}
+	}
+	if options.ARA != nil {
+		if r, ok := options.Runner.(interface {
+			SetARA(runner.ARA)
+		}); ok {
+			r.SetARA(*options.ARA)
+		}
+	}
+	if options.EventLimits != nil {
+		if r, ok := options.Runner.(interface {
+			SetEventLimits(eventapi.Limits)
+		}); ok {
+			r.SetEventLimits(*options.EventLimits)
+		}
+	}
+}
+
+// configureJobs sets the client the Jobs of runs are created with, if the
+// runner runs Jobs.
+func configureJobs(r runner.Runner, cfg *rest.Config) error {
+	jr, ok := r.(interface {
+		RunsJobs() bool
+		SetJobClient(kubernetes.Interface)
+	})
+	if !ok || !jr.RunsJobs() {
+		return nil
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	jr.SetJobClient(clientset)
+	return nil
+}
+
+// stoppableManager starts the runnables added to it with a stop channel that
+// is closed when either the manager or stop is closed. The informers backing
+// a stopped controller's watches stay in the manager's cache.
+type stoppableManager struct {
+	manager.Manager
+	stop <-chan struct{}
+}
+
+func (m *stoppableManager) Add(r manager.Runnable) error {
+	if err := m.Manager.SetFields(r); err != nil {
+		return err
+	}
+	return m.Manager.Add(manager.RunnableFunc(func(mgrStop <-chan struct{}) error {
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-mgrStop:
+			case <-m.stop:
+			}
+			close(stop)
+		}()
+		if err := r.Start(stop); err != nil {
+			return err
+		}
+		// The manager treats any runnable returning as fatal, so wait for
+		// the manager itself to stop.
+		<-mgrStop
+		return nil
+	}))
 }
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// cooldown holds back runs of a resource until interval has passed since its
+// last run ended. Requests arriving in the meantime are requeued for the end
+// of the cooldown, where the queue merges them into a single run.
+//
+// It is added to the controller as a source, which gives it the controller's
+// queue.
+type cooldown struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	queue    workqueue.RateLimitingInterface
+	lastRun  map[types.NamespacedName]time.Time
+}
+
+func newCooldown(interval time.Duration) *cooldown {
+	return &cooldown{interval: interval, lastRun: map[types.NamespacedName]time.Time{}}
+}
+
+// Start implements source.Source
+func (c *cooldown) Start(_ crthandler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.queue = q
+	return nil
+}
+
+// hold reports whether a run of nn must wait for its cooldown, and if so
+// requeues nn for its end.
+func (c *cooldown) hold(nn types.NamespacedName) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	last, ok := c.lastRun[nn]
+	if !ok || c.queue == nil {
+		return false
+	}
+	remaining := c.interval - time.Since(last)
+	if remaining <= 0 {
+		return false
+	}
+	logrus.Debugf("%v ran %v ago, delaying its next run by %v", nn, time.Since(last).Round(time.Second), remaining.Round(time.Second))
+	c.queue.AddAfter(reconcile.Request{NamespacedName: nn}, remaining)
+	return true
+}
+
+// ran records that a run of nn has ended.
+func (c *cooldown) ran(nn types.NamespacedName) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastRun[nn] = time.Now()
+}
+
+// forget drops the last run of nn, e.g. once it has been deleted.
+func (c *cooldown) forget(nn types.NamespacedName) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.lastRun, nn)
+}
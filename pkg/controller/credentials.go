@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// runCredentials reads the credentials Secret of u, so that every run logs in
+// with what the Secret holds as it starts.
+func runCredentials(c client.Client, u *unstructured.Unstructured, creds *runner.Credentials) (runner.RunCredentials, error) {
+	rc := runner.RunCredentials{}
+	key := types.NamespacedName{Namespace: creds.SecretNamespace, Name: creds.SecretName}
+	if creds.SpecField != "" {
+		v, found, err := unstructured.NestedString(u.Object, creds.SpecFieldPath()...)
+		if err != nil {
+			return rc, fmt.Errorf("invalid credentials field %s: %v", creds.SpecField, err)
+		}
+		if found && v != "" {
+			key = specSecretKey(u, v, creds.SecretNamespace)
+		}
+	}
+	if key.Name == "" {
+		return rc, fmt.Errorf("no credentials Secret set in %s", creds.SpecField)
+	}
+	if key.Namespace == "" {
+		key.Namespace = u.GetNamespace()
+	}
+
+	secret := &unstructured.Unstructured{}
+	secret.SetGroupVersionKind(secretGVK)
+	if err := c.Get(context.TODO(), key, secret); err != nil {
+		return rc, fmt.Errorf("unable to get credentials Secret %v: %v", key, err)
+	}
+	for _, k := range []struct {
+		key   string
+		value func([]byte)
+	}{
+		{creds.SSHPrivateKeyKey, func(b []byte) { rc.SSHPrivateKey = b }},
+		{creds.UsernameKey, func(b []byte) { rc.Username = string(b) }},
+		{creds.PasswordKey, func(b []byte) { rc.Password = string(b) }},
+		{creds.BecomePasswordKey, func(b []byte) { rc.BecomePassword = string(b) }},
+	} {
+		encoded, found, err := unstructured.NestedString(secret.Object, "data", k.key)
+		if err != nil || !found {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return rc, fmt.Errorf("invalid %s in credentials Secret %v: %v", k.key, key, err)
+		}
+		k.value(b)
+	}
+	return rc, nil
+}
+
+// specSecretKey returns the key of the Secret named in the spec of u. Its
+// namespace is that of u, whatever the secretNamespace of the watch, so that
+// a resource only selects the Secrets of its own namespace; the Secrets of
+// cluster-scoped resources are in secretNamespace.
+func specSecretKey(u *unstructured.Unstructured, name, secretNamespace string) types.NamespacedName {
+	if u.GetNamespace() != "" {
+		return types.NamespacedName{Namespace: u.GetNamespace(), Name: name}
+	}
+	return types.NamespacedName{Namespace: secretNamespace, Name: name}
+}
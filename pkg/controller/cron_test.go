@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+1800)
+	tests := []struct {
+		schedule string
+		from     time.Time
+		want     time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 10, 14, 10, 7, 30, 0, time.UTC), time.Date(2026, 10, 14, 10, 15, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2026, 10, 14, 10, 59, 30, 0, time.UTC), time.Date(2026, 10, 14, 11, 0, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2026, 10, 14, 11, 0, 0, 0, time.UTC), time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)},
+		{"15 3 * * *", time.Date(2026, 10, 14, 10, 1, 0, 0, ist), time.Date(2026, 10, 15, 3, 15, 0, 0, ist)},
+		{"5 */2 * * *", time.Date(2026, 10, 14, 9, 10, 0, 0, ist), time.Date(2026, 10, 14, 10, 5, 0, 0, ist)},
+		{"0 0 13 * 5", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */2 * 1", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * */2", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * 2 *", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2027, 2, 1, 8, 30, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCronSchedule(tt.schedule)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q): %v", tt.schedule, err)
+			continue
+		}
+		if got := c.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q after %v: got %v, want %v", tt.schedule, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	for _, s := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@often",
+	} {
+		if _, err := parseCronSchedule(s); err == nil {
+			t.Errorf("parseCronSchedule(%q) succeeded, want an error", s)
+		}
+	}
+}
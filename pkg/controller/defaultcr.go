@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// defaultCRCreator creates the default CR of a watch once the manager
+// starts, unless a resource of its GVK exists in the namespaces watched.
+type defaultCRCreator struct {
+	mgr       manager.Manager
+	mapper    meta.RESTMapper
+	sample    *unstructured.Unstructured
+	namespace string
+}
+
+// Start creates the default CR, then blocks until stop is closed, as the
+// manager treats a runnable returning as fatal. Failures are logged rather
+// than stopping the operator.
+func (d *defaultCRCreator) Start(stop <-chan struct{}) error {
+	if err := d.create(); err != nil {
+		logrus.Errorf("Failed to create the default %v: %v", d.sample.GroupVersionKind(), err)
+	}
+	<-stop
+	return nil
+}
+
+func (d *defaultCRCreator) create() error {
+	gvk := d.sample.GroupVersionKind()
+	if d.mapper == nil {
+		m, err := apiutil.NewDiscoveryRESTMapper(d.mgr.GetConfig())
+		if err != nil {
+			return err
+		}
+		d.mapper = m
+	}
+	mapping, err := d.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	if !namespaced {
+		d.sample.SetNamespace("")
+	} else if d.sample.GetNamespace() == "" {
+		if d.namespace == "" {
+			return fmt.Errorf("%s sets no namespace, and all namespaces are watched", d.sample.GetName())
+		}
+		d.sample.SetNamespace(d.namespace)
+	}
+	// Read from the API server, as the cache may not have synced yet.
+	c, err := client.New(d.mgr.GetConfig(), client.Options{Scheme: d.mgr.GetScheme(), Mapper: d.mapper})
+	if err != nil {
+		return err
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk)
+	opts := &client.ListOptions{}
+	if namespaced && d.namespace != "" {
+		opts.Namespace = d.namespace
+	}
+	if err := c.List(context.TODO(), opts, list); err != nil {
+		return err
+	}
+	if len(list.Items) != 0 {
+		logrus.Debugf("%d %v exist, not creating the default one", len(list.Items), gvk)
+		return nil
+	}
+	err = c.Create(context.TODO(), d.sample)
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Created the default %v %s/%s", gvk, d.sample.GetNamespace(), d.sample.GetName())
+	return nil
+}
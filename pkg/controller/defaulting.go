@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// DefaultingWebhookPath is the path the defaulting webhook is served at.
+const DefaultingWebhookPath = "/default"
+
+// specDefaulter is implemented by runners that know the defaults of their
+// roles before a run.
+type specDefaulter interface {
+	SpecDefaults(spec map[string]interface{}) map[string]interface{}
+}
+
+// DefaultingWebhookOptions - options for the mutating admission webhook
+// setting the defaults of the roles in the spec of resources
+type DefaultingWebhookOptions struct {
+	// Addr is the address the webhook is served on, over TLS.
+	Addr string
+	// CertDir holds the tls.crt and tls.key the webhook is served with.
+	// They are read again when tls.crt changes, e.g. as it is renewed.
+	CertDir string
+	// Runners are those of the GVKs defaulted; resources of other GVKs are
+	// admitted as they are.
+	Runners map[schema.GroupVersionKind]runner.Runner
+}
+
+// AddDefaultingWebhook serves a mutating admission webhook at
+// DefaultingWebhookPath, setting the fields of the spec of resources created
+// and updated that the roles of their watch default in defaults/main.yml, and
+// the spec leaves unset. The spec then shows the variables the run gets,
+// extra vars aside. Templated defaults are not set.
+func AddDefaultingWebhook(mgr manager.Manager, options DefaultingWebhookOptions) error {
+	return mgr.Add(&defaultingWebhook{
+		addr:    options.Addr,
+		certs:   &certReloader{dir: options.CertDir},
+		runners: options.Runners,
+	})
+}
+
+type defaultingWebhook struct {
+	addr    string
+	certs   *certReloader
+	runners map[schema.GroupVersionKind]runner.Runner
+}
+
+// Start implements manager.Runnable. It serves the webhook until stop is
+// closed.
+func (d *defaultingWebhook) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(DefaultingWebhookPath, d)
+	server := &http.Server{
+		Addr:      d.addr,
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: d.certs.getCertificate},
+	}
+	go func() {
+		<-stop
+		server.Close()
+	}()
+	logrus.Infof("Serving the defaulting webhook on %s%s", d.addr, DefaultingWebhookPath)
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// certReloader serves the tls.crt and tls.key of dir to TLS servers.
+type certReloader struct {
+	dir     string
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+}
+
+// getCertificate returns the certificate of dir, loading it again when
+// tls.crt has changed since it was last loaded.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certFile := filepath.Join(c.dir, "tls.crt")
+	fi, err := os.Stat(certFile)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cert != nil && fi.ModTime().Equal(c.certMod) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(c.dir, "tls.key"))
+	if err != nil {
+		return nil, err
+	}
+	c.cert, c.certMod = &cert, fi.ModTime()
+	return c.cert, nil
+}
+
+// admissionReview is an AdmissionReview of admission.k8s.io, v1beta1 or v1,
+// with the fields the webhook uses.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID               `json:"uid"`
+	Kind      metav1.GroupVersionKind `json:"kind"`
+	Operation string                  `json:"operation"`
+	Object    json.RawMessage         `json:"object,omitempty"`
+}
+
+type admissionResponse struct {
+	UID       types.UID      `json:"uid"`
+	Allowed   bool           `json:"allowed"`
+	Result    *metav1.Status `json:"status,omitempty"`
+	Patch     []byte         `json:"patch,omitempty"`
+	PatchType string         `json:"patchType,omitempty"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// ServeHTTP admits the resource of the AdmissionReview of the request, with
+// a JSON patch setting its defaults.
+func (d *defaultingWebhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	review := admissionReview{}
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "expected an AdmissionReview request", http.StatusBadRequest)
+		return
+	}
+	response := &admissionResponse{UID: review.Request.UID, Allowed: true}
+	patch, err := d.defaults(review.Request)
+	if err != nil {
+		// the resource is admitted as it is, and its run gets the defaults
+		// from ansible
+		logrus.Warningf("Unable to default %v: %v", review.Request.Kind, err)
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if len(patch) != 0 {
+		response.Patch, response.PatchType = patch, "JSONPatch"
+	}
+	review.Request, review.Response = nil, response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logrus.Warningf("Unable to write the response of the defaulting webhook: %v", err)
+	}
+}
+
+// defaults returns the JSON patch setting the defaults of the resource of
+// req, nil if it has none to set.
+func (d *defaultingWebhook) defaults(req *admissionRequest) ([]byte, error) {
+	if req.Operation != "CREATE" && req.Operation != "UPDATE" {
+		return nil, nil
+	}
+	gvk := schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}
+	sd, ok := d.runners[gvk].(specDefaulter)
+	if !ok {
+		return nil, nil
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(req.Object, &obj); err != nil {
+		return nil, err
+	}
+	var spec map[string]interface{}
+	switch s := obj["spec"].(type) {
+	case nil:
+	case map[string]interface{}:
+		spec = s
+	default:
+		return nil, fmt.Errorf("spec is not an object")
+	}
+	defaults := sd.SpecDefaults(spec)
+	if len(defaults) == 0 {
+		return nil, nil
+	}
+	if spec == nil {
+		return json.Marshal([]patchOperation{{Op: "add", Path: "/spec", Value: defaults}})
+	}
+	keys := []string{}
+	for k := range defaults {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ops := []patchOperation{}
+	for _, k := range keys {
+		ops = append(ops, patchOperation{Op: "add", Path: "/spec/" + escapePointer(k), Value: defaults[k]})
+	}
+	return json.Marshal(ops)
+}
+
+// escapePointer escapes key as a token of a JSON pointer.
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,210 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RetryAnnotation, set to a new value on a degraded resource, retries its
+// runs.
+const RetryAnnotation = "operator.ansible.io/retry"
+
+// DegradedCondition is the type of the condition set on resources whose
+// runs keep failing.
+const DegradedCondition = "Degraded"
+
+// FailureStreak - the consecutive failed runs of a resource, for its spec
+// with hash SpecHash and the value Retry of its RetryAnnotation, written to
+// status.failureStreak.
+type FailureStreak struct {
+	Count    int    `json:"count"`
+	SpecHash string `json:"specHash"`
+	Retry    string `json:"retry,omitempty"`
+}
+
+func failureStreakFromStatus(u *unstructured.Unstructured) *FailureStreak {
+	status, ok := u.Object["status"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	m, ok := status["failureStreak"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	s := &FailureStreak{}
+	if c, ok := toFloat(m["count"]); ok {
+		s.Count = int(c)
+	}
+	s.SpecHash, _ = m["specHash"].(string)
+	s.Retry, _ = m["retry"].(string)
+	return s
+}
+
+func (s FailureStreak) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"count":    int64(s.Count),
+		"specHash": s.SpecHash,
+	}
+	if s.Retry != "" {
+		m["retry"] = s.Retry
+	}
+	return m
+}
+
+// current reports whether the streak is of the current spec of u and its
+// RetryAnnotation. Any change of either starts a new streak.
+func (s *FailureStreak) current(u *unstructured.Unstructured) bool {
+	return s != nil && s.SpecHash == specHash(u) && s.Retry == u.GetAnnotations()[RetryAnnotation]
+}
+
+// isDegraded reports whether the last maxFailures runs of u, for its current
+// spec, failed.
+func isDegraded(u *unstructured.Unstructured, maxFailures int) bool {
+	s := failureStreakFromStatus(u)
+	return s.current(u) && s.Count >= maxFailures
+}
+
+// recordOutcome updates the failure streak in the status of u after a run,
+// and returns its Degraded condition. It reports whether the status changed,
+// and whether u is now degraded.
+func recordOutcome(u *unstructured.Unstructured, successful bool, maxFailures int) (c condition, changed, degraded bool) {
+	old := failureStreakFromStatus(u)
+	var streak *FailureStreak
+	if !successful {
+		streak = &FailureStreak{Count: 1, SpecHash: specHash(u), Retry: u.GetAnnotations()[RetryAnnotation]}
+		if old.current(u) {
+			streak.Count = old.Count + 1
+		}
+	}
+	degraded = streak != nil && streak.Count >= maxFailures
+
+	status := statusAsMap(u)
+	if streak == nil {
+		changed = old != nil
+		delete(status, "failureStreak")
+	} else {
+		changed = true
+		setStatusField(status, "failureStreak", streak.toMap())
+	}
+
+	c = condition{Type: DegradedCondition, Status: "False", Reason: "RunSucceeded", Negative: true}
+	switch {
+	case degraded:
+		c.Status = "True"
+		c.Reason = "RepeatedFailures"
+		c.Message = fmt.Sprintf("the last %d runs failed; retries are stopped until the spec changes or the %s annotation is set to a new value", streak.Count, RetryAnnotation)
+	case streak != nil:
+		c.Reason = "RunFailed"
+		c.Message = fmt.Sprintf("%d of at most %d consecutive runs failed", streak.Count, maxFailures)
+	}
+	return c, changed, degraded
+}
+
+// writeConditions sets conds in the conditions of u, merged into those of
+// its latest copy, and records an Event for every condition that turned
+// into a failure, with the ident of the run if any. It reports whether any
+// condition changed.
+func (r *AnsibleOperatorReconciler) writeConditions(u *unstructured.Unstructured, conds []condition, ident string) bool {
+	conditions := r.currentConditions(u)
+	changed := false
+	for _, c := range conds {
+		var transitioned bool
+		conditions, transitioned = setCondition(conditions, c)
+		if transitioned && c.failure() {
+			logrus.WithFields(logrus.Fields{"uid": string(u.GetUID()), "job": ident}).Warnf("%s/%s: %s", u.GetNamespace(), u.GetName(), c.Message)
+			if r.Recorder != nil {
+				msg := c.Message
+				if ident != "" {
+					msg = fmt.Sprintf("%s (run %s)", c.Message, ident)
+				}
+				r.Recorder.Event(u, "Warning", c.Type, msg)
+			}
+		}
+		changed = changed || transitioned
+	}
+	setStatusField(statusAsMap(u), "conditions", conditions)
+	return changed
+}
+
+// currentConditions returns the conditions of the latest copy of u, as
+// playbooks may have set theirs during the run.
+func (r *AnsibleOperatorReconciler) currentConditions(u *unstructured.Unstructured) []interface{} {
+	fresh := &unstructured.Unstructured{}
+	fresh.SetGroupVersionKind(u.GroupVersionKind())
+	key := types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}
+	if err := r.Client.Get(context.TODO(), key, fresh); err != nil {
+		fresh = u
+	}
+	status, _ := fresh.Object["status"].(map[string]interface{})
+	conditions, _ := status["conditions"].([]interface{})
+	return conditions
+}
+
+// condition - a status condition, as in the API conventions.
+type condition struct {
+	Type    string
+	Status  string
+	Reason  string
+	Message string
+	// Negative conditions, such as Degraded, report a failure when True.
+	Negative bool
+}
+
+func (c condition) failure() bool {
+	return (c.Status == "True") == c.Negative
+}
+
+// setCondition sets c in conditions, keeping its lastTransitionTime if its
+// status did not change. It reports whether the condition changed.
+func setCondition(conditions []interface{}, c condition) ([]interface{}, bool) {
+	updated := map[string]interface{}{
+		"type":               c.Type,
+		"status":             c.Status,
+		"reason":             c.Reason,
+		"message":            c.Message,
+		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+	}
+	result := []interface{}{}
+	found, changed := false, true
+	for _, existing := range conditions {
+		m, ok := existing.(map[string]interface{})
+		if !ok || m["type"] != c.Type {
+			result = append(result, existing)
+			continue
+		}
+		found = true
+		if m["status"] == c.Status {
+			if t, ok := m["lastTransitionTime"]; ok {
+				updated["lastTransitionTime"] = t
+			}
+			changed = m["reason"] != c.Reason || m["message"] != c.Message
+		}
+		result = append(result, updated)
+	}
+	if !found {
+		result = append(result, updated)
+	}
+	return result, changed
+}
+
+// statusAsMap returns the status of u as a map, converting a ResourceStatus
+// set by the reconciler, and sets it on u.
+func statusAsMap(u *unstructured.Unstructured) map[string]interface{} {
+	if status, ok := u.Object["status"].(map[string]interface{}); ok {
+		return status
+	}
+	status := map[string]interface{}{}
+	if u.Object["status"] != nil {
+		if b, err := json.Marshal(u.Object["status"]); err == nil {
+			json.Unmarshal(b, &status)
+		}
+	}
+	u.Object["status"] = status
+	return status
+}
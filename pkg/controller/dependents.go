@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// k8sModules are the modules whose results are recorded as dependents.
+var k8sModules = map[string]bool{
+	"k8s":           true,
+	"k8s_raw":       true,
+	"openshift_raw": true,
+}
+
+// dependentKey identifies a resource managed by a playbook.
+type dependentKey struct {
+	GVK       schema.GroupVersionKind
+	Namespace string
+	Name      string
+}
+
+// dependent is a resource as a playbook last applied it.
+type dependent struct {
+	key     dependentKey
+	desired map[string]interface{}
+}
+
+// dependentTracker records the resources each run applied, watches them and
+// requeues their owner as soon as one of them is edited away from what the
+// run applied, or deleted. Changes made while a run of the owner is in
+// progress are ignored, since the run is converging them.
+//
+// It is added to the controller as a source, which gives it the controller's
+// queue; watches for new kinds are added to the cache's informers directly,
+// as the controller does not accept new watches once started.
+type dependentTracker struct {
+	cache   cache.Cache
+	mutex   sync.Mutex
+	queue   workqueue.RateLimitingInterface
+	owners  map[dependentKey]types.NamespacedName
+	desired map[types.NamespacedName]map[dependentKey]map[string]interface{}
+	running map[types.NamespacedName]bool
+	watched map[schema.GroupVersionKind]bool
+	// kinds, if set, is given the kinds watched.
+	kinds *proxy.KindSet
+}
+
+func newDependentTracker(c cache.Cache) *dependentTracker {
+	return &dependentTracker{
+		cache:   c,
+		owners:  map[dependentKey]types.NamespacedName{},
+		desired: map[types.NamespacedName]map[dependentKey]map[string]interface{}{},
+		running: map[types.NamespacedName]bool{},
+		watched: map[schema.GroupVersionKind]bool{},
+	}
+}
+
+// Start implements source.Source
+func (d *dependentTracker) Start(_ crthandler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queue = q
+	return nil
+}
+
+// runStarted records that a run of owner is in progress.
+func (d *dependentTracker) runStarted(owner types.NamespacedName) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.running[owner] = true
+}
+
+// runFinished records the dependents applied by a run of owner. After a
+// successful run they replace those of earlier runs; a failed run may not
+// have reached every task, so its dependents are added to them.
+func (d *dependentTracker) runFinished(owner types.NamespacedName, deps []dependent, successful bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.running, owner)
+	if successful {
+		d.forgetLocked(owner)
+	}
+	if d.desired[owner] == nil {
+		d.desired[owner] = map[dependentKey]map[string]interface{}{}
+	}
+	for _, dep := range deps {
+		d.desired[owner][dep.key] = dep.desired
+		d.owners[dep.key] = owner
+		if err := d.watchLocked(dep.key.GVK); err != nil {
+			logrus.Warningf("unable to watch dependent %v of %v: %v", dep.key.GVK, owner, err)
+		}
+	}
+}
+
+// forget drops the dependents of owner, e.g. once it has been deleted.
+func (d *dependentTracker) forget(owner types.NamespacedName) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.forgetLocked(owner)
+	delete(d.running, owner)
+}
+
+func (d *dependentTracker) forgetLocked(owner types.NamespacedName) {
+	for key := range d.desired[owner] {
+		if d.owners[key] == owner {
+			delete(d.owners, key)
+		}
+	}
+	delete(d.desired, owner)
+}
+
+func (d *dependentTracker) watchLocked(gvk schema.GroupVersionKind) error {
+	if d.watched[gvk] {
+		return nil
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	i, err := d.cache.GetInformer(u)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Watching dependent resources of kind %v", gvk)
+	i.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) { d.changed(gvk, obj, false) },
+		DeleteFunc: func(obj interface{}) { d.changed(gvk, obj, true) },
+	})
+	d.watched[gvk] = true
+	d.kinds.Add(gvk)
+	return nil
+}
+
+// changed requeues the owner of obj if obj was deleted or has drifted from
+// what its owner's last run applied.
+func (d *dependentTracker) changed(gvk schema.GroupVersionKind, obj interface{}, deleted bool) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	key := dependentKey{GVK: gvk, Namespace: m.GetNamespace(), Name: m.GetName()}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	owner, ok := d.owners[key]
+	if !ok || d.running[owner] || d.queue == nil {
+		return
+	}
+	if !deleted {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok || !drifted(d.desired[owner][key], u.Object) {
+			return
+		}
+	}
+	logrus.Infof("Dependent %v %s/%s of %v was changed, requeueing", gvk, key.Namespace, key.Name, owner)
+	req := reconcile.Request{NamespacedName: owner}
+	// Skip any backoff the owner is in, so drift is corrected right away.
+	d.queue.Forget(req)
+	d.queue.Add(req)
+}
+
+// drifted reports whether actual differs from any field of desired, other
+// than status and metadata besides labels and annotations.
+func drifted(desired, actual map[string]interface{}) bool {
+	for k, v := range desired {
+		switch k {
+		case "status":
+			continue
+		case "metadata":
+			dm, _ := v.(map[string]interface{})
+			am, _ := actual["metadata"].(map[string]interface{})
+			for _, f := range []string{"labels", "annotations"} {
+				if want, ok := dm[f]; ok && !isSubset(want, am[f]) {
+					return true
+				}
+			}
+			continue
+		}
+		if !isSubset(v, actual[k]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubset reports whether every field set in want has the same value in got.
+// Numbers are compared by value, as want is decoded from a job event and got
+// from the API server.
+func isSubset(want, got interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		gm, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !isSubset(v, gm[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		gs, ok := got.([]interface{})
+		if !ok || len(gs) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !isSubset(w[i], gs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if wn, ok := toFloat(want); ok {
+		gn, ok := toFloat(got)
+		return ok && wn == gn
+	}
+	return reflect.DeepEqual(want, got)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// dependentFromEvent returns the resource applied by a k8s module task, as
+// reported in its result.
+func dependentFromEvent(e eventapi.JobEvent) (dependent, bool) {
+	if e.Event != "runner_on_ok" {
+		return dependent{}, false
+	}
+	action, _ := e.EventData["task_action"].(string)
+	if !k8sModules[action[strings.LastIndex(action, ".")+1:]] || isAbsentTask(e.EventData["task_args"]) {
+		return dependent{}, false
+	}
+	res, ok := e.EventData["res"].(map[string]interface{})
+	if !ok {
+		return dependent{}, false
+	}
+	result, ok := res["result"].(map[string]interface{})
+	if !ok {
+		return dependent{}, false
+	}
+	u := &unstructured.Unstructured{Object: result}
+	if u.GetKind() == "" || u.GetName() == "" {
+		return dependent{}, false
+	}
+	return dependent{
+		key: dependentKey{
+			GVK:       u.GroupVersionKind(),
+			Namespace: u.GetNamespace(),
+			Name:      u.GetName(),
+		},
+		desired: result,
+	}, true
+}
+
+// isAbsentTask reports whether the task arguments delete the resource.
+func isAbsentTask(args interface{}) bool {
+	switch a := args.(type) {
+	case string:
+		return strings.Contains(a, "state=absent")
+	case map[string]interface{}:
+		return a["state"] == "absent"
+	}
+	return false
+}
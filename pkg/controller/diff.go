@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// maxDiffs is the maximum number of resources kept in status.lastDiff.
+	maxDiffs = 20
+	// maxDiffChanges is the maximum number of changed fields kept per
+	// resource.
+	maxDiffChanges = 50
+	// maxDiffText is the maximum length of a textual diff kept per resource.
+	maxDiffText = 2048
+)
+
+// ResourceDiff - what a task of a run changed, as reported by ansible's diff
+// mode.
+type ResourceDiff struct {
+	Task string `json:"task"`
+	// Resource is "Kind namespace/name" for tasks of the k8s modules.
+	Resource string `json:"resource,omitempty"`
+	// Changes are the paths of the fields that were added, removed or changed.
+	Changes []string `json:"changes,omitempty"`
+	// Diff is the textual diff reported by modules that do not manage
+	// structured data, such as template.
+	Diff string `json:"diff,omitempty"`
+}
+
+// NewResourceDiffFromJobEvent returns the diff reported by a changed task. ok
+// is false if e reports no diff.
+func NewResourceDiffFromJobEvent(e eventapi.JobEvent) (ResourceDiff, bool) {
+	if e.Event != "runner_on_ok" {
+		return ResourceDiff{}, false
+	}
+	res, ok := e.EventData["res"].(map[string]interface{})
+	if !ok || res["changed"] != true {
+		return ResourceDiff{}, false
+	}
+	diffs := []interface{}{}
+	switch d := res["diff"].(type) {
+	case map[string]interface{}:
+		diffs = append(diffs, d)
+	case []interface{}:
+		diffs = d
+	default:
+		return ResourceDiff{}, false
+	}
+
+	rd := ResourceDiff{}
+	rd.Task, _ = e.EventData["task"].(string)
+	if result, ok := res["result"].(map[string]interface{}); ok {
+		u := &unstructured.Unstructured{Object: result}
+		if u.GetKind() != "" {
+			rd.Resource = fmt.Sprintf("%s %s/%s", u.GetKind(), u.GetNamespace(), u.GetName())
+		}
+	}
+	changes := []string{}
+	text := []string{}
+	for _, d := range diffs {
+		dm, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if prepared, ok := dm["prepared"].(string); ok {
+			text = append(text, prepared)
+			continue
+		}
+		before, bok := dm["before"]
+		after, aok := dm["after"]
+		if !bok && !aok {
+			continue
+		}
+		// text in before/after, e.g. from the copy module, has no fields
+		beforeText, bstr := before.(string)
+		afterText, astr := after.(string)
+		if bstr || astr {
+			if beforeText != afterText {
+				text = append(text, fmt.Sprintf("--- before\n+++ after\n-%s\n+%s", beforeText, afterText))
+			}
+			continue
+		}
+		fieldChanges(before, after, "", &changes)
+	}
+	if len(changes) == 0 && len(text) == 0 {
+		return ResourceDiff{}, false
+	}
+	sort.Strings(changes)
+	if len(changes) > maxDiffChanges {
+		changes = append(changes[:maxDiffChanges], fmt.Sprintf("... and %d more", len(changes)-maxDiffChanges))
+	}
+	rd.Changes = changes
+	rd.Diff = strings.Join(text, "\n")
+	if len(rd.Diff) > maxDiffText {
+		rd.Diff = rd.Diff[:maxDiffText] + "\n... truncated"
+	}
+	return rd, true
+}
+
+// fieldChanges appends the paths below path at which before and after
+// differ. Fields that only changed metadata the API server maintains are
+// skipped.
+func fieldChanges(before, after interface{}, path string, out *[]string) {
+	bm, bok := before.(map[string]interface{})
+	am, aok := after.(map[string]interface{})
+	if !bok || !aok {
+		if !isSubset(before, after) || !isSubset(after, before) {
+			if path == "" {
+				path = "."
+			}
+			*out = append(*out, path)
+		}
+		return
+	}
+	keys := map[string]bool{}
+	for k := range bm {
+		keys[k] = true
+	}
+	for k := range am {
+		keys[k] = true
+	}
+	for k := range keys {
+		p := path + "." + k
+		if serverMaintained[p] {
+			continue
+		}
+		bv, inBefore := bm[k]
+		av, inAfter := am[k]
+		switch {
+		case !inBefore:
+			*out = append(*out, p+" (added)")
+		case !inAfter:
+			*out = append(*out, p+" (removed)")
+		default:
+			fieldChanges(bv, av, p, out)
+		}
+	}
+}
+
+// serverMaintained are the fields that change on every write.
+var serverMaintained = map[string]bool{
+	".metadata.resourceVersion":   true,
+	".metadata.generation":        true,
+	".metadata.managedFields":     true,
+	".metadata.creationTimestamp": true,
+	".metadata.uid":               true,
+	".metadata.selfLink":          true,
+	".status":                     true,
+}
+
+// summary describes d in a single line, for an Event.
+func (d ResourceDiff) summary() string {
+	what := d.Resource
+	if what == "" {
+		what = fmt.Sprintf("task %q", d.Task)
+	}
+	if len(d.Changes) == 0 {
+		return fmt.Sprintf("%s changed", what)
+	}
+	return fmt.Sprintf("%s changed: %s", what, strings.Join(d.Changes, ", "))
+}
+
+// limitDiffs keeps the last maxDiffs diffs of a run.
+func limitDiffs(diffs []ResourceDiff) []ResourceDiff {
+	if len(diffs) > maxDiffs {
+		return diffs[len(diffs)-maxDiffs:]
+	}
+	return diffs
+}
+
+func (d ResourceDiff) toMap() map[string]interface{} {
+	m := map[string]interface{}{"task": d.Task}
+	if d.Resource != "" {
+		m["resource"] = d.Resource
+	}
+	if len(d.Changes) > 0 {
+		m["changes"] = toInterfaceSlice(d.Changes)
+	}
+	if d.Diff != "" {
+		m["diff"] = d.Diff
+	}
+	return m
+}
+
+// resourceDiffsFromSlice converts status.lastDiff as read from the API
+// server back into ResourceDiffs.
+func resourceDiffsFromSlice(v interface{}) []ResourceDiff {
+	items, _ := v.([]interface{})
+	diffs := []ResourceDiff{}
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		d := ResourceDiff{}
+		d.Task, _ = m["task"].(string)
+		d.Resource, _ = m["resource"].(string)
+		d.Diff, _ = m["diff"].(string)
+		changes, _ := m["changes"].([]interface{})
+		for _, c := range changes {
+			if s, ok := c.(string); ok {
+				d.Changes = append(d.Changes, s)
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
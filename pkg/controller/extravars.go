@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/paramconv"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	configMapGVK = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secretGVK    = schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+)
+
+// resolveExtraVarsFrom reads the data of each source and merges it into a
+// single map of extra vars. Later sources override earlier ones. It also
+// returns the names of the vars read from Secrets, to be redacted.
+func resolveExtraVarsFrom(c client.Client, namespace string, sources []runner.ExtraVarsSource) (map[string]interface{}, []string, error) {
+	extraVars := map[string]interface{}{}
+	secretVars := []string{}
+	for _, s := range sources {
+		ref, gvk, isSecret := s.ConfigMapRef, configMapGVK, false
+		if s.SecretRef != nil {
+			ref, gvk, isSecret = s.SecretRef, secretGVK, true
+		}
+		key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+		if key.Namespace == "" {
+			key.Namespace = namespace
+		}
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		err := c.Get(context.TODO(), key, u)
+		if apierrors.IsNotFound(err) && ref.Optional {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get %s %v for extra vars: %v", gvk.Kind, key, err)
+		}
+		data, _, err := unstructured.NestedStringMap(u.Object, "data")
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid data in %s %v: %v", gvk.Kind, key, err)
+		}
+		for k, v := range data {
+			if isSecret {
+				decoded, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid data for key %s in Secret %v: %v", k, key, err)
+				}
+				v = string(decoded)
+				secretVars = append(secretVars, k)
+			}
+			extraVars[k] = v
+		}
+	}
+	return extraVars, secretVars, nil
+}
+
+// annotationVars returns the annotations of u starting with prefix as extra
+// vars, named by the rest of the annotation in snake_case, with dots and
+// dashes turned into underscores: vars.ansible.operator/logLevel sets
+// log_level. It returns nil if prefix is empty.
+func annotationVars(u *unstructured.Unstructured, prefix string) map[string]interface{} {
+	if prefix == "" {
+		return nil
+	}
+	vars := map[string]interface{}{}
+	for k, v := range u.GetAnnotations() {
+		name := strings.TrimPrefix(k, prefix)
+		if name == k || name == "" {
+			continue
+		}
+		name = strings.NewReplacer(".", "_", "-", "_").Replace(paramconv.ToSnake(name))
+		vars[name] = v
+	}
+	return vars
+}
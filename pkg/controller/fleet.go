@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fleetInterval is the time between two counts of the resources of a GVK.
+const fleetInterval = 30 * time.Second
+
+// The states a resource is counted in, in order of precedence.
+const (
+	stateRunning    = "running"
+	stateFailed     = "failed"
+	stateSuccessful = "successful"
+	statePending    = "pending"
+)
+
+var fleetStates = []string{stateRunning, stateFailed, stateSuccessful, statePending}
+
+var resourcesByState = metrics.NewGaugeVec("ansible_operator_resources",
+	"Number of custom resources reconciled by the operator, per kind and state.",
+	"group", "version", "kind", "state")
+
+var generationLagGauge = metrics.NewGaugeVec("ansible_operator_generation_lag",
+	"Number of generations of a custom resource no run has applied successfully yet.",
+	"group", "version", "kind", "namespace", "name")
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(resourcesByState, generationLagGauge)
+}
+
+// reportFleet counts the resources of gvk in each state every fleetInterval
+// until stop is closed.
+func reportFleet(gvk schema.GroupVersionKind, reader client.Reader, h *AnsibleOperatorReconciler, stop <-chan struct{}) {
+	ticker := time.NewTicker(fleetInterval)
+	defer ticker.Stop()
+	lagging := map[types.NamespacedName]bool{}
+	for {
+		select {
+		case <-ticker.C:
+			ul := &unstructured.UnstructuredList{}
+			ul.SetGroupVersionKind(gvk)
+			if err := reader.List(context.TODO(), nil, ul); err != nil {
+				logrus.Debugf("unable to count resources of %v: %v", gvk, err)
+				continue
+			}
+			counts := map[string]int{}
+			seen := map[types.NamespacedName]bool{}
+			for i := range ul.Items {
+				u := &ul.Items[i]
+				if !reconciles(h.Runner, u) {
+					continue
+				}
+				counts[fleetState(u, h)]++
+				nn := types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}
+				generationLagGauge.Set(float64(generationLag(u)), gvk.Group, gvk.Version, gvk.Kind, nn.Namespace, nn.Name)
+				seen[nn] = true
+			}
+			for nn := range lagging {
+				if !seen[nn] {
+					generationLagGauge.Delete(gvk.Group, gvk.Version, gvk.Kind, nn.Namespace, nn.Name)
+				}
+			}
+			lagging = seen
+			for _, state := range fleetStates {
+				resourcesByState.Set(float64(counts[state]), gvk.Group, gvk.Version, gvk.Kind, state)
+			}
+		case <-stop:
+			for _, state := range fleetStates {
+				resourcesByState.Delete(gvk.Group, gvk.Version, gvk.Kind, state)
+			}
+			for nn := range lagging {
+				generationLagGauge.Delete(gvk.Group, gvk.Version, gvk.Kind, nn.Namespace, nn.Name)
+			}
+			return
+		}
+	}
+}
+
+func fleetState(u *unstructured.Unstructured, h *AnsibleOperatorReconciler) string {
+	if h.isRunning(types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}) {
+		return stateRunning
+	}
+	status, ok := u.Object["status"].(map[string]interface{})
+	if !ok {
+		return statePending
+	}
+	if failures, ok := toFloat(status["failures"]); ok && failures > 0 {
+		return stateFailed
+	}
+	if _, ok := status["completion"]; !ok {
+		return statePending
+	}
+	return stateSuccessful
+}
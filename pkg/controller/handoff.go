@@ -0,0 +1,370 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// handoffInterval is how often the work in flight is written to the
+// ConfigMap of a Handoff.
+const handoffInterval = 5 * time.Second
+
+// handoffKey is the key of the ConfigMap of a Handoff holding its state.
+const handoffKey = "state.json"
+
+// Handoff hands the work in flight of the ansible controllers over to the
+// operator that takes over from this one, e.g. after an upgrade or a
+// reschedule, through a ConfigMap. It records the resources queued or running
+// for every GVK, with the idents of the runs in progress. The operator
+// taking over runs those first, and skips its first run of the resources
+// that were idle and whose last successful run applied their current spec,
+// instead of running every resource again.
+//
+// Idle resources are only skipped if the state was written as this operator
+// stopped; after a crash every resource runs again, as without a Handoff.
+type Handoff struct {
+	client          kubernetes.Interface
+	namespace, name string
+	mutex           sync.Mutex
+	// previous is the state the operator before this one left.
+	previous handoffState
+	// watches are the GVKs tracked by this operator.
+	watches map[string]*watchHandoff
+	written *handoffState
+}
+
+// handoffState - the state of a Handoff, as written to its ConfigMap.
+type handoffState struct {
+	// Clean is set if the state was written as the operator stopped.
+	Clean bool `json:"clean"`
+	// Watches holds the pending resources of every GVK, by GVK.
+	Watches map[string]map[string]string `json:"watches"`
+}
+
+// NewHandoff returns a Handoff writing its state to the ConfigMap
+// namespace/name, having read the state the operator before this one left
+// in it.
+func NewHandoff(cfg *rest.Config, namespace, name string) (*Handoff, error) {
+	c, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h := &Handoff{client: c, namespace: namespace, name: name, watches: map[string]*watchHandoff{}}
+	cm, err := c.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data := cm.Data[handoffKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &h.previous); err != nil {
+			logrus.Warnf("Ignoring the state in ConfigMap %s/%s: %v", namespace, name, err)
+			h.previous = handoffState{}
+		}
+	}
+	if !h.previous.Clean {
+		logrus.Infof("The operator before this one did not stop cleanly, running every resource again")
+	}
+	return h, nil
+}
+
+// Start writes the state every handoffInterval until stop is closed.
+func (h *Handoff) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(handoffInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := h.save(false); err != nil {
+				logrus.Errorf("Failed to write the handoff state: %v", err)
+			}
+		}
+	}
+}
+
+// Close writes the state as the operator stops, for the operator taking
+// over.
+func (h *Handoff) Close() error {
+	return h.save(true)
+}
+
+func (h *Handoff) save(clean bool) error {
+	h.mutex.Lock()
+	state := handoffState{Clean: clean, Watches: map[string]map[string]string{}}
+	for gvk, w := range h.watches {
+		state.Watches[gvk] = w.snapshot()
+	}
+	if h.written != nil && reflect.DeepEqual(*h.written, state) {
+		h.mutex.Unlock()
+		return nil
+	}
+	h.mutex.Unlock()
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	cms := h.client.CoreV1().ConfigMaps(h.namespace)
+	cm, err := cms.Get(h.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: h.namespace, Name: h.name}}
+		cm.Data = map[string]string{handoffKey: string(b)}
+		_, err = cms.Create(cm)
+	} else if err == nil {
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[handoffKey] = string(b)
+		_, err = cms.Update(cm)
+	}
+	if err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.written = &state
+	h.mutex.Unlock()
+	return nil
+}
+
+// watch returns the handoff of the controller of gvk.
+func (h *Handoff) watch(gvk schema.GroupVersionKind) *watchHandoff {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := gvk.String()
+	w := &watchHandoff{pending: map[types.NamespacedName]*pendingRun{}, resumed: map[types.NamespacedName]bool{}}
+	if previous, ok := h.previous.Watches[key]; ok {
+		w.previous = map[types.NamespacedName]string{}
+		for k, ident := range previous {
+			w.previous[handoffName(k)] = ident
+		}
+		w.clean = h.previous.Clean
+	}
+	h.watches[key] = w
+	return w
+}
+
+// watchHandoff tracks the pending resources of a controller, and resumes
+// those the operator before this one left.
+type watchHandoff struct {
+	mutex sync.Mutex
+	seq   int64
+	// pending are the resources queued or running.
+	pending map[types.NamespacedName]*pendingRun
+	// previous are the resources pending when the operator before this one
+	// stopped, with the idents of their runs; nil if it did not track the
+	// GVK.
+	previous map[types.NamespacedName]string
+	clean    bool
+	// resumed are the resources reconciled since this operator started.
+	resumed map[types.NamespacedName]bool
+}
+
+type pendingRun struct {
+	// queued is the sequence number of the last time the resource was
+	// queued.
+	queued int64
+	ident  string
+}
+
+func handoffName(key string) types.NamespacedName {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return types.NamespacedName{Namespace: key[:i], Name: key[i+1:]}
+	}
+	return types.NamespacedName{Name: key}
+}
+
+func (w *watchHandoff) snapshot() map[string]string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	m := map[string]string{}
+	for nn, p := range w.pending {
+		m[nn.String()] = p.ident
+	}
+	return m
+}
+
+// queued records that nn was queued.
+func (w *watchHandoff) queued(item interface{}) {
+	req, ok := item.(reconcile.Request)
+	if !ok {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.seq++
+	p, ok := w.pending[req.NamespacedName]
+	if !ok {
+		p = &pendingRun{}
+		w.pending[req.NamespacedName] = p
+	}
+	p.queued = w.seq
+}
+
+// begin records that a reconcile of nn starts, and returns the sequence
+// number end is to be called with.
+func (w *watchHandoff) begin(nn types.NamespacedName) int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.seq++
+	if _, ok := w.pending[nn]; !ok {
+		// requeued by the controller after a failure
+		w.pending[nn] = &pendingRun{}
+	}
+	return w.seq
+}
+
+// runStarted records the ident of the run of nn in progress.
+func (w *watchHandoff) runStarted(nn types.NamespacedName, ident string) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if p, ok := w.pending[nn]; ok {
+		p.ident = ident
+	}
+}
+
+// end records that the reconcile of nn that began at seq ended. nn stays
+// pending if it failed, or if it was queued again meanwhile.
+func (w *watchHandoff) end(nn types.NamespacedName, seq int64, done bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	p, ok := w.pending[nn]
+	if !ok {
+		return
+	}
+	p.ident = ""
+	if done && p.queued < seq {
+		delete(w.pending, nn)
+	}
+}
+
+// idle reports whether the operator before this one left nn idle, the first
+// time nn is reconciled since this one started.
+func (w *watchHandoff) idle(nn types.NamespacedName) bool {
+	if w == nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.resumed[nn] {
+		return false
+	}
+	w.resumed[nn] = true
+	if w.previous == nil || !w.clean {
+		return false
+	}
+	_, pending := w.previous[nn]
+	return !pending
+}
+
+// reconciler returns next, recording the reconciles of resources.
+func (w *watchHandoff) reconciler(next reconcile.Reconciler) reconcile.Reconciler {
+	if w == nil {
+		return next
+	}
+	return reconcile.Func(func(request reconcile.Request) (reconcile.Result, error) {
+		seq := w.begin(request.NamespacedName)
+		result, err := next.Reconcile(request)
+		w.end(request.NamespacedName, seq, err == nil && !result.Requeue)
+		return result, err
+	})
+}
+
+// controller returns ctrl, recording the resources its sources queue. The
+// handoff itself is to be watched by ctrl before any other source.
+func (w *watchHandoff) controller(ctrl controller.Controller) controller.Controller {
+	if w == nil {
+		return ctrl
+	}
+	return &handoffController{Controller: ctrl, handoff: w}
+}
+
+// Start implements source.Source, queueing the resources the operator
+// before this one left pending ahead of the others; it is the first source
+// watched.
+func (w *watchHandoff) Start(_ crthandler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	w.mutex.Lock()
+	previous := w.previous
+	w.mutex.Unlock()
+	for nn, ident := range previous {
+		if ident != "" {
+			logrus.Infof("Run %s of %v was in progress when the operator before this one stopped, running it again", ident, nn)
+		}
+		req := reconcile.Request{NamespacedName: nn}
+		w.queued(req)
+		q.Add(req)
+	}
+	return nil
+}
+
+type handoffController struct {
+	controller.Controller
+	handoff *watchHandoff
+}
+
+// Watch implements controller.Controller
+func (c *handoffController) Watch(src source.Source, h crthandler.EventHandler, prct ...predicate.Predicate) error {
+	return c.Controller.Watch(&handoffSource{Source: src, handoff: c.handoff}, h, prct...)
+}
+
+type handoffSource struct {
+	source.Source
+	handoff *watchHandoff
+}
+
+// Start implements source.Source
+func (s *handoffSource) Start(h crthandler.EventHandler, q workqueue.RateLimitingInterface, prct ...predicate.Predicate) error {
+	return s.Source.Start(h, &handoffQueue{RateLimitingInterface: q, handoff: s.handoff}, prct...)
+}
+
+// InjectFunc passes the fields the controller sets on its sources on to the
+// source wrapped.
+func (s *handoffSource) InjectFunc(f inject.Func) error {
+	return f(s.Source)
+}
+
+type handoffQueue struct {
+	workqueue.RateLimitingInterface
+	handoff *watchHandoff
+}
+
+func (q *handoffQueue) Add(item interface{}) {
+	q.handoff.queued(item)
+	q.RateLimitingInterface.Add(item)
+}
+
+func (q *handoffQueue) AddRateLimited(item interface{}) {
+	q.handoff.queued(item)
+	q.RateLimitingInterface.AddRateLimited(item)
+}
+
+func (q *handoffQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.handoff.queued(item)
+	q.RateLimitingInterface.AddAfter(item, duration)
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+)
+
+// defaultHistoryLimit is the number of runs kept in status.history, unless
+// the watch sets its own limit.
+const defaultHistoryLimit = 10
+
+// RunRecord - the outcome of a run, kept in status.history.
+type RunRecord struct {
+	// Ident is the ansible-runner ident of the run, naming its artifacts.
+	Ident string `json:"ident,omitempty"`
+	// Result is successful or failed.
+	Result   string `json:"result"`
+	Duration string `json:"duration,omitempty"`
+	Changed  int    `json:"changed"`
+	// FailingTask is the first task that failed, if any.
+	FailingTask string `json:"failingTask,omitempty"`
+	// Reason is the RunError reason of a failed run.
+	Reason     string `json:"reason,omitempty"`
+	Completion string `json:"completion,omitempty"`
+}
+
+// RunResult - the outcome of a run, as passed to PostReconcile.
+type RunResult struct {
+	RunRecord
+	Successful bool
+	// Finalizer is set for runs of the finalizer of a deleted resource.
+	Finalizer bool
+	// Stats are the final stats of the run.
+	Stats eventapi.StatsEventData
+	// Error is why the run failed, if it did.
+	Error *RunError
+}
+
+// runRecorder builds the RunRecord of a run from its job events.
+type runRecorder struct {
+	record  RunRecord
+	started time.Time
+}
+
+func (rr *runRecorder) handle(e eventapi.JobEvent) {
+	if rr.started.IsZero() {
+		rr.started = e.Created.Time
+	}
+	if rr.record.Ident == "" {
+		rr.record.Ident = e.RunnerIdent
+	}
+	if rr.record.FailingTask == "" && (e.Event == "runner_on_failed" || e.Event == "runner_on_unreachable") {
+		if ignored, _ := e.EventData["ignore_errors"].(bool); !ignored {
+			rr.record.FailingTask, _ = e.EventData["task"].(string)
+		}
+	}
+}
+
+// finish returns the record of the run that ended with stats.
+func (rr *runRecorder) finish(stats eventapi.StatusJobEvent) RunRecord {
+	record := rr.record
+	record.Result = "successful"
+	if !isSuccessfulRun(stats) {
+		record.Result = "failed"
+	}
+	for _, n := range stats.EventData.Changed {
+		record.Changed += n
+	}
+	if !rr.started.IsZero() {
+		record.Duration = stats.Created.Sub(rr.started).Round(time.Second).String()
+	}
+	record.Completion = stats.Created.UTC().Format(time.RFC3339)
+	return record
+}
+
+func (r RunRecord) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"result":  r.Result,
+		"changed": int64(r.Changed),
+	}
+	for k, v := range map[string]string{"ident": r.Ident, "duration": r.Duration, "failingTask": r.FailingTask, "reason": r.Reason, "completion": r.Completion} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// runRecordsFromSlice converts status.history as read from the API server
+// back into RunRecords. Entries written by older versions of the operator,
+// with the task counts of a run, are converted too.
+func runRecordsFromSlice(v interface{}) []RunRecord {
+	items, _ := v.([]interface{})
+	records := []RunRecord{}
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		r := RunRecord{}
+		r.Ident, _ = m["ident"].(string)
+		r.Result, _ = m["result"].(string)
+		r.Duration, _ = m["duration"].(string)
+		r.FailingTask, _ = m["failingTask"].(string)
+		r.Reason, _ = m["reason"].(string)
+		r.Completion, _ = m["completion"].(string)
+		if n, ok := toFloat(m["changed"]); ok {
+			r.Changed = int(n)
+		}
+		if r.Result == "" {
+			r.Result = "successful"
+			if n, ok := toFloat(m["failures"]); ok && n > 0 {
+				r.Result = "failed"
+			}
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// appendHistory appends record to the history in status, keeping the last
+// limit runs.
+func appendHistory(status map[string]interface{}, record RunRecord, limit int) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	records := append(runRecordsFromSlice(status["history"]), record)
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	history := []interface{}{}
+	for _, r := range records {
+		history = append(history, r.toMap())
+	}
+	setStatusField(status, "history", history)
+}
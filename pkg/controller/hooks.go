@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The types of the conditions reporting the result of each hook.
+const (
+	PreHookCondition       = "PreHookSucceeded"
+	PostHookCondition      = "PostHookSucceeded"
+	OnFailureHookCondition = "OnFailureHookSucceeded"
+)
+
+// hookRunner is implemented by runners that can run the hook playbooks of
+// their watch.
+type hookRunner interface {
+	RunHook(ctx context.Context, path string, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}, env map[string]string) (chan eventapi.JobEvent, error)
+}
+
+// runHook runs the hook playbook at path for u, and returns the condition
+// reporting its result.
+func (r *AnsibleOperatorReconciler) runHook(ctx context.Context, conditionType, path string, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}, env map[string]string) condition {
+	c := condition{Type: conditionType, Status: "True", Reason: "Succeeded"}
+	hr, ok := r.Runner.(hookRunner)
+	if !ok {
+		c.Status, c.Reason, c.Message = "False", "Unsupported", "the runner of the watch cannot run hooks"
+		return c
+	}
+	// Hooks are runs of their own, whose idents extend that of the run.
+	hookEnv := map[string]string{}
+	for k, v := range env {
+		hookEnv[k] = v
+	}
+	if ident := env[runner.IdentEnv]; ident != "" {
+		hookEnv[runner.IdentEnv] = fmt.Sprintf("%s-%s", ident, strings.ToLower(strings.TrimSuffix(conditionType, "Succeeded")))
+	}
+	eventChan, err := hr.RunHook(ctx, path, u, kubeconfig, extraVars, hookEnv)
+	if err != nil {
+		c.Status, c.Reason, c.Message = "False", "Failed", fmt.Sprintf("hook %s could not be run: %v", path, err)
+		return c
+	}
+	stats := eventapi.StatusJobEvent{}
+	// The handlers may outlive the run, and the later writes to u.
+	handled := u.DeepCopy()
+	for event := range eventChan {
+		for _, eHandler := range r.EventHandlers {
+			go handleEvent(eHandler, handled, event)
+		}
+		if event.Event == "playbook_on_stats" {
+			if data, err := json.Marshal(event); err == nil {
+				json.Unmarshal(data, &stats)
+			}
+		}
+	}
+	switch {
+	case stats.Event == "":
+		c.Status, c.Reason, c.Message = "False", "Failed", fmt.Sprintf("hook %s did not complete", path)
+	case !isSuccessfulRun(stats):
+		c.Status, c.Reason, c.Message = "False", "Failed", fmt.Sprintf("hook %s failed", path)
+	}
+	logrus.Debugf("hook %s of %s/%s: %s", path, u.GetNamespace(), u.GetName(), c.Reason)
+	return c
+}
+
+// isSuccessfulRun reports whether a run with final stats s had no failures.
+func isSuccessfulRun(s eventapi.StatusJobEvent) bool {
+	for _, count := range s.EventData.Failures {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
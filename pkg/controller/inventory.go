@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The metrics describing the configuration of the operator, for dashboards
+// of a fleet of operators to spot those configured differently.
+var (
+	watchesGauge = metrics.NewGaugeVec("ansible_operator_watches",
+		"Number of watches the operator runs controllers for.")
+	watchInfo = metrics.NewGaugeVec("ansible_operator_watch_info",
+		"Configuration of a watch the operator runs a controller for; always 1.",
+		"group", "version", "kind", "backend", "watch_dependent_resources", "finalizer", "one_shot")
+	watchWorkers = metrics.NewGaugeVec("ansible_operator_watch_max_workers",
+		"Number of resources of a watch reconciled at once.",
+		"group", "version", "kind")
+	buildInfo = metrics.NewGaugeVec("ansible_operator_build_info",
+		"Versions of ansible and ansible-runner the operator runs playbooks with; always 1.",
+		"ansible_version", "ansible_runner_version")
+	collectionInfo = metrics.NewGaugeVec("ansible_operator_collection_info",
+		"Version of an ansible collection installed in the operator; always 1.",
+		"collection", "version")
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(watchesGauge, watchInfo, watchWorkers, buildInfo, collectionInfo)
+}
+
+var (
+	inventoryMutex sync.Mutex
+	// watchInfos counts the controllers reporting each set of labels of
+	// watchInfo, as a controller restarted by an AnsibleWatch may start
+	// before the one it replaces stops.
+	watchInfos = map[string]int{}
+)
+
+// reportWatch reports the configuration of the controller of gvk, running r
+// with workers, until stop is closed.
+func reportWatch(gvk schema.GroupVersionKind, r runner.Runner, workers int, stop <-chan struct{}) {
+	_, finalizer := r.GetFinalizer()
+	labels := []string{
+		gvk.Group, gvk.Version, gvk.Kind,
+		r.GetBackend(),
+		strconv.FormatBool(r.GetWatchDependentResources()),
+		strconv.FormatBool(finalizer),
+		strconv.FormatBool(r.GetOneShot()),
+	}
+	key := strings.Join(labels, "\xff")
+	inventoryMutex.Lock()
+	watchInfos[key]++
+	watchInfo.Set(1, labels...)
+	watchWorkers.Set(float64(workers), gvk.Group, gvk.Version, gvk.Kind)
+	watchesGauge.Add(1)
+	inventoryMutex.Unlock()
+	if stop == nil {
+		return
+	}
+	go func() {
+		<-stop
+		inventoryMutex.Lock()
+		defer inventoryMutex.Unlock()
+		watchesGauge.Add(-1)
+		if watchInfos[key]--; watchInfos[key] > 0 {
+			return
+		}
+		delete(watchInfos, key)
+		watchInfo.Delete(labels...)
+		for k := range watchInfos {
+			if strings.HasPrefix(k, strings.Join(labels[:3], "\xff")+"\xff") {
+				// another controller of gvk is running
+				return
+			}
+		}
+		watchWorkers.Delete(gvk.Group, gvk.Version, gvk.Kind)
+	}()
+}
+
+// ReportVersions detects the versions of ansible, ansible-runner and the
+// collections the operator runs playbooks with, and reports them in the
+// ansible_operator_build_info and ansible_operator_collection_info metrics.
+func ReportVersions() {
+	v := runner.DetectVersions()
+	buildInfo.Set(1, v.Ansible, v.AnsibleRunner)
+	for name, version := range v.Collections {
+		collectionInfo.Set(1, name, version)
+	}
+}
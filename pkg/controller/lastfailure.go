@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+)
+
+const (
+	// failureOutputBefore and failureOutputAfter are the lines of stdout kept
+	// before and after the failure, the failure's own lines included in
+	// those before it.
+	failureOutputBefore = 20
+	failureOutputAfter  = 10
+	// maxFailureOutput bounds the output in bytes, dropping its first lines.
+	maxFailureOutput = 4096
+)
+
+// LastFailure - the failure of the last run of a resource, written to
+// status.lastFailure so that it can be triaged without access to the logs
+// of the operator. It is removed by the next successful run.
+type LastFailure struct {
+	Reason  string `json:"reason"`
+	Task    string `json:"task,omitempty"`
+	Module  string `json:"module,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Output is the stdout of ansible around the failure.
+	Output string `json:"output,omitempty"`
+	// Run is the ident of the run, naming its artifacts.
+	Run  string `json:"run"`
+	Time string `json:"time"`
+}
+
+func newLastFailure(err *RunError, output, ident string) LastFailure {
+	return LastFailure{
+		Reason:  err.Reason,
+		Task:    err.Task,
+		Module:  err.Module,
+		Host:    err.Host,
+		Message: err.Message,
+		Output:  output,
+		Run:     ident,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func (f LastFailure) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"reason": f.Reason,
+		"run":    f.Run,
+		"time":   f.Time,
+	}
+	for k, v := range map[string]string{"task": f.Task, "module": f.Module, "host": f.Host, "message": f.Message, "output": f.Output} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// failureOutput keeps the stdout of a run around its failure: the last
+// lines before it, then the first lines after it.
+type failureOutput struct {
+	lines []string
+	after int
+}
+
+// add adds the stdout of e, failed reporting whether the run has failed.
+func (o *failureOutput) add(e eventapi.JobEvent, failed bool) {
+	out := strings.TrimRight(ansiCode.ReplaceAllString(e.StdOut, ""), "\r\n")
+	if strings.TrimSpace(out) == "" {
+		return
+	}
+	lines := strings.Split(out, "\n")
+	if !failed {
+		o.lines = append(o.lines, lines...)
+		if len(o.lines) > failureOutputBefore {
+			o.lines = o.lines[len(o.lines)-failureOutputBefore:]
+		}
+		return
+	}
+	if n := failureOutputAfter - o.after; n < len(lines) {
+		lines = lines[:n]
+	}
+	o.lines = append(o.lines, lines...)
+	o.after += len(lines)
+}
+
+// String returns the output, at most maxFailureOutput bytes of it.
+func (o *failureOutput) String() string {
+	s := strings.Join(o.lines, "\n")
+	if len(s) > maxFailureOutput {
+		s = "..." + s[len(s)-maxFailureOutput:]
+	}
+	return s
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// NamespacesKey is the key of the ConfigMap read by a NamespaceList. Its
+// value lists namespaces separated by commas or whitespace.
+const NamespacesKey = "namespaces"
+
+// NamespaceList - the namespaces whose resources are reconciled, read from a
+// ConfigMap and updated as it changes. Until the ConfigMap has been read, or
+// while it does not exist, no namespace is in the list.
+//
+// It is a manager.Runnable, and must be added to the manager to follow the
+// ConfigMap.
+type NamespaceList struct {
+	clientset kubernetes.Interface
+	configMap types.NamespacedName
+
+	mutex      sync.RWMutex
+	namespaces sets.String
+	onAdded    []func(namespaces []string)
+}
+
+// NewNamespaceList returns a NamespaceList reading the ConfigMap
+// namespace/name.
+func NewNamespaceList(cfg *rest.Config, namespace, name string) (*NamespaceList, error) {
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &NamespaceList{
+		clientset:  clientset,
+		configMap:  types.NamespacedName{Namespace: namespace, Name: name},
+		namespaces: sets.NewString(),
+	}, nil
+}
+
+// Contains reports whether resources in namespace are reconciled.
+func (l *NamespaceList) Contains(namespace string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.namespaces.Has(namespace)
+}
+
+// Start implements manager.Runnable. It watches the ConfigMap until stop is
+// closed.
+func (l *NamespaceList) Start(stop <-chan struct{}) error {
+	lw := toolscache.NewListWatchFromClient(l.clientset.CoreV1().RESTClient(), "configmaps", l.configMap.Namespace,
+		fields.OneTermEqualSelector("metadata.name", l.configMap.Name))
+	_, informer := toolscache.NewInformer(lw, &corev1.ConfigMap{}, 0, toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { l.set(obj) },
+		UpdateFunc: func(_, obj interface{}) { l.set(obj) },
+		DeleteFunc: func(interface{}) { l.set(nil) },
+	})
+	logrus.Infof("Reading the namespaces to watch from ConfigMap %v", l.configMap)
+	informer.Run(stop)
+	return nil
+}
+
+func (l *NamespaceList) set(obj interface{}) {
+	namespaces := sets.NewString()
+	if cm, ok := obj.(*corev1.ConfigMap); ok {
+		namespaces.Insert(strings.FieldsFunc(cm.Data[NamespacesKey], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\n' || r == '\t'
+		})...)
+	} else {
+		logrus.Warningf("ConfigMap %v was deleted, no namespace is watched", l.configMap)
+	}
+
+	l.mutex.Lock()
+	added := namespaces.Difference(l.namespaces).List()
+	removed := l.namespaces.Difference(namespaces).List()
+	l.namespaces = namespaces
+	listeners := append([]func([]string){}, l.onAdded...)
+	l.mutex.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	logrus.Infof("Watching namespaces %v; added %v, removed %v", namespaces.List(), added, removed)
+	if len(added) > 0 {
+		for _, f := range listeners {
+			f(added)
+		}
+	}
+}
+
+// whenAdded calls f with the namespaces added to the list whenever it
+// changes.
+func (l *NamespaceList) whenAdded(f func(namespaces []string)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onAdded = append(l.onAdded, f)
+}
+
+// predicate drops the events of resources in namespaces outside the list.
+func (l *NamespaceList) predicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return l.Contains(e.Meta.GetNamespace()) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return l.Contains(e.MetaNew.GetNamespace()) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return l.Contains(e.Meta.GetNamespace()) },
+		GenericFunc: func(e event.GenericEvent) bool { return l.Contains(e.Meta.GetNamespace()) },
+	}
+}
+
+// namespaceSource enqueues the resources of a GVK in namespaces added to a
+// NamespaceList, whose events were dropped before.
+type namespaceSource struct {
+	list   *NamespaceList
+	gvk    schema.GroupVersionKind
+	reader client.Reader
+}
+
+// Start implements source.Source
+func (s *namespaceSource) Start(_ crthandler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	s.list.whenAdded(func(namespaces []string) {
+		for _, ns := range namespaces {
+			ul := &unstructured.UnstructuredList{}
+			ul.SetGroupVersionKind(s.gvk)
+			if err := s.reader.List(context.TODO(), client.InNamespace(ns), ul); err != nil {
+				logrus.Warningf("unable to list %v in added namespace %s: %v", s.gvk, ns, err)
+				continue
+			}
+			for _, u := range ul.Items {
+				q.Add(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}})
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// watchOwned watches the dependent kinds a watch lists in watchedResources,
+// and requeues the resources of gvk owning, by an owner reference, those
+// created, changed or deleted. Unlike watchDependentResources, any change
+// but that of the status requeues the owner, and the kinds are watched from
+// the start rather than as runs apply them.
+func watchOwned(mgr manager.Manager, c controller.Controller, gvk schema.GroupVersionKind, dependents []schema.GroupVersionKind, kinds *proxy.KindSet) error {
+	owner := &unstructured.Unstructured{}
+	owner.SetGroupVersionKind(gvk)
+	for _, dgvk := range dependents {
+		logrus.Infof("Watching %v as dependents of %v", dgvk, gvk)
+		if !mgr.GetScheme().Recognizes(dgvk) {
+			mgr.GetScheme().AddKnownTypeWithName(dgvk, &unstructured.Unstructured{})
+			metav1.AddToGroupVersion(mgr.GetScheme(), dgvk.GroupVersion())
+		}
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(dgvk)
+		if err := c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForOwner{OwnerType: owner}, ignoreStatusUpdates); err != nil {
+			return err
+		}
+		kinds.Add(dgvk)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// ignoreStatusUpdates filters out updates of a watched resource that only
+// changed its status, or metadata the API server maintains. The operator's
+// own status writes would otherwise requeue the resource, and every run
+// that writes status would be followed by another run.
+var ignoreStatusUpdates = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldU, ok := e.ObjectOld.(*unstructured.Unstructured)
+		if !ok {
+			return true
+		}
+		newU, ok := e.ObjectNew.(*unstructured.Unstructured)
+		if !ok {
+			return true
+		}
+		if reflect.DeepEqual(relevantContent(oldU), relevantContent(newU)) {
+			logrus.Debugf("ignoring status-only update of %v %s/%s", newU.GroupVersionKind(), newU.GetNamespace(), newU.GetName())
+			return false
+		}
+		return true
+	},
+}
+
+// relevantContent returns the parts of u whose changes call for a run: all
+// top-level fields but status and metadata, and the metadata users set.
+func relevantContent(u *unstructured.Unstructured) map[string]interface{} {
+	content := map[string]interface{}{}
+	for k, v := range u.Object {
+		if k != "status" && k != "metadata" {
+			content[k] = v
+		}
+	}
+	content["metadata"] = map[string]interface{}{
+		"labels":            u.GetLabels(),
+		"annotations":       u.GetAnnotations(),
+		"finalizers":        u.GetFinalizers(),
+		"deletionTimestamp": u.GetDeletionTimestamp(),
+		"ownerReferences":   u.GetOwnerReferences(),
+	}
+	return content
+}
+
+// selectionPredicate filters out events of resources that r does not
+// reconcile, as decided by reconciles.
+func selectionPredicate(r runner.Runner) predicate.Predicate {
+	matches := func(obj interface{}) bool {
+		u, ok := obj.(*unstructured.Unstructured)
+		return !ok || reconciles(r, u)
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return matches(e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return matches(e.ObjectNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return matches(e.Object) },
+		GenericFunc: func(e event.GenericEvent) bool { return matches(e.Object) },
+	}
+}
+
+// reconciles reports whether r reconciles u: whether u matches its field
+// selector and carries its required annotations.
+func reconciles(r runner.Runner, u *unstructured.Unstructured) bool {
+	return selects(r.GetFieldSelector(), u) && runner.HasAnnotations(u, r.GetRequireAnnotations())
+}
+
+// selects reports whether u matches sel; a nil sel matches everything.
+func selects(sel fields.Selector, u *unstructured.Unstructured) bool {
+	return sel == nil || sel.Matches(runner.ObjectFields(u))
+}
+
+// cancelRuns cancels the run of a resource in progress once the resource is
+// deleted, so that its finalizer, if any, runs without waiting for it, and,
+// for watches preempting stale runs, once its spec changes. It filters out
+// no events.
+func cancelRuns(r *AnsibleOperatorReconciler) predicate.Predicate {
+	preempt := r.Runner.GetPreemptStaleRuns()
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			nn := types.NamespacedName{Namespace: e.MetaNew.GetNamespace(), Name: e.MetaNew.GetName()}
+			switch {
+			case e.MetaOld.GetDeletionTimestamp() == nil && e.MetaNew.GetDeletionTimestamp() != nil:
+				r.cancelRun(nn, "the resource is being deleted")
+			case preempt && e.MetaNew.GetDeletionTimestamp() == nil:
+				r.preemptStaleRun(nn, e.MetaNew.GetGeneration())
+			}
+			return true
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			r.cancelRun(types.NamespacedName{Namespace: e.Meta.GetNamespace(), Name: e.Meta.GetName()}, "the resource was deleted")
+			return true
+		},
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// releaseInterval is how often a lowPrioritySource checks whether the queue
+// has drained.
+const releaseInterval = 50 * time.Millisecond
+
+// lowPrioritySource holds back the events of the source it wraps, the
+// periodic resyncs, while the controller's queue has requests waiting, so
+// deletions and changes are run before them when the workers are all busy.
+// Events held are released one at a time, in order, whenever the queue is
+// empty; an event for a resource already held is merged into it.
+type lowPrioritySource struct {
+	source.Source
+	stop <-chan struct{}
+
+	mutex   sync.Mutex
+	queue   workqueue.RateLimitingInterface
+	pending []interface{}
+	held    map[interface{}]bool
+}
+
+func newLowPrioritySource(s source.Source, stop <-chan struct{}) *lowPrioritySource {
+	return &lowPrioritySource{Source: s, stop: stop, held: map[interface{}]bool{}}
+}
+
+// Start implements source.Source
+func (s *lowPrioritySource) Start(h crthandler.EventHandler, q workqueue.RateLimitingInterface, prct ...predicate.Predicate) error {
+	s.mutex.Lock()
+	s.queue = q
+	s.mutex.Unlock()
+	go s.releaseLoop()
+	return s.Source.Start(h, &lowPriorityQueue{RateLimitingInterface: q, source: s}, prct...)
+}
+
+// InjectStopChannel is called by the controller, if stop was not set.
+func (s *lowPrioritySource) InjectStopChannel(stop <-chan struct{}) error {
+	if s.stop == nil {
+		s.stop = stop
+	}
+	return nil
+}
+
+// InjectFunc passes the fields the controller sets on its sources on to the
+// source wrapped.
+func (s *lowPrioritySource) InjectFunc(f inject.Func) error {
+	return f(s.Source)
+}
+
+func (s *lowPrioritySource) hold(item interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.held[item] {
+		return
+	}
+	s.held[item] = true
+	s.pending = append(s.pending, item)
+}
+
+func (s *lowPrioritySource) releaseLoop() {
+	ticker := time.NewTicker(releaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.release()
+		}
+	}
+}
+
+// release adds the next event held to the queue, if it is empty.
+func (s *lowPrioritySource) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 || s.queue.Len() != 0 {
+		return
+	}
+	item := s.pending[0]
+	s.pending = s.pending[1:]
+	delete(s.held, item)
+	s.queue.Add(item)
+}
+
+type lowPriorityQueue struct {
+	workqueue.RateLimitingInterface
+	source *lowPrioritySource
+}
+
+func (q *lowPriorityQueue) Add(item interface{}) {
+	q.source.hold(item)
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// progressInterval is the minimum time between two updates of status.lastTask
+// and status.progress while a run is in progress.
+const progressInterval = 5 * time.Second
+
+// progressReporter writes the task a run is executing to the status of the
+// resource being reconciled.
+type progressReporter struct {
+	writer resourceWriter
+	u      *unstructured.Unstructured
+	last   time.Time
+	// latest is the most recent task reported, written with the final status
+	// of the run.
+	latest *TaskProgress
+	// disabled stops updates for the rest of the run once one has failed,
+	// e.g. because the resource was deleted.
+	disabled bool
+}
+
+func (p *progressReporter) report(t TaskProgress) {
+	p.latest = &t
+	if p.disabled || time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	statusMap, ok := p.u.Object["status"].(map[string]interface{})
+	if !ok {
+		statusMap = map[string]interface{}{}
+	}
+	setStatusField(statusMap, "lastTask", t.toMap())
+	setStatusField(statusMap, "progress", NewRunProgress(t, false).toMap())
+	p.u.Object["status"] = statusMap
+	if err := p.writer.writeStatus(p.u); err != nil {
+		logrus.Warnf("unable to update task progress of %s/%s: %v", p.u.GetNamespace(), p.u.GetName(), err)
+		p.disabled = true
+	}
+}
+
+// final returns the progress to write with the final status of the run, or
+// nil if no task was reported.
+func (p *progressReporter) final() *RunProgress {
+	if p.latest == nil {
+		return nil
+	}
+	final := NewRunProgress(*p.latest, true)
+	return &final
+}
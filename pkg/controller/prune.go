@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PruneFinalizer is set on the resources of watches with pruneDependents,
+// so their dependents in other namespaces and at cluster scope are deleted
+// along with them.
+const PruneFinalizer = "operator.ansible.io/prune-dependents"
+
+// prunedStatusField is the field of status listing the dependents to prune.
+const prunedStatusField = "crossNamespaceDependents"
+
+// crossScope reports whether key is a dependent in another namespace than
+// owner, or a cluster-scoped dependent of a namespaced owner, which it cannot
+// have an owner reference to.
+func crossScope(owner *unstructured.Unstructured, key dependentKey) bool {
+	return owner.GetNamespace() != "" && key.Namespace != owner.GetNamespace()
+}
+
+// recordPrunable adds the dependents in deps that are in other namespaces
+// than u, or cluster-scoped, to the list in u's status, as they are not
+// garbage collected with u. Entries are only removed by pruning, so a run that skipped a task does
+// not lose track of what an earlier run created.
+func recordPrunable(u *unstructured.Unstructured, deps []dependent) {
+	status := statusAsMap(u)
+	keys := map[dependentKey]bool{}
+	for _, key := range prunableKeys(u) {
+		keys[key] = true
+	}
+	for _, dep := range deps {
+		if crossScope(u, dep.key) {
+			keys[dep.key] = true
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	list := []interface{}{}
+	for key := range keys {
+		apiVersion, kind := key.GVK.ToAPIVersionAndKind()
+		list = append(list, map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       kind,
+			"namespace":  key.Namespace,
+			"name":       key.Name,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return fmt.Sprint(list[i]) < fmt.Sprint(list[j])
+	})
+	setStatusField(status, prunedStatusField, list)
+}
+
+// prunableKeys returns the dependents listed in u's status.
+func prunableKeys(u *unstructured.Unstructured) []dependentKey {
+	status, _ := u.Object["status"].(map[string]interface{})
+	list, _ := status[prunedStatusField].([]interface{})
+	keys := []dependentKey{}
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		apiVersion, _ := m["apiVersion"].(string)
+		kind, _ := m["kind"].(string)
+		namespace, _ := m["namespace"].(string)
+		name, _ := m["name"].(string)
+		if kind == "" || name == "" {
+			continue
+		}
+		keys = append(keys, dependentKey{
+			GVK:       schema.FromAPIVersionAndKind(apiVersion, kind),
+			Namespace: namespace,
+			Name:      name,
+		})
+	}
+	return keys
+}
+
+// pruneDependents deletes the dependents listed in u's status that still
+// carry the tracking annotation with u's UID, so that objects recreated by
+// others since are left alone.
+func pruneDependents(c client.Client, u *unstructured.Unstructured) error {
+	for _, key := range prunableKeys(u) {
+		dep := &unstructured.Unstructured{}
+		dep.SetGroupVersionKind(key.GVK)
+		err := c.Get(context.TODO(), types.NamespacedName{Namespace: key.Namespace, Name: key.Name}, dep)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if dep.GetAnnotations()[proxy.OwnerUIDAnnotation] != string(u.GetUID()) {
+			logrus.Debugf("%v %s/%s is no longer owned by %s/%s, not pruning it", key.GVK, key.Namespace, key.Name, u.GetNamespace(), u.GetName())
+			continue
+		}
+		logrus.Infof("Pruning %v %s/%s of %s/%s", key.GVK, key.Namespace, key.Name, u.GetNamespace(), u.GetName())
+		if err := c.Delete(context.TODO(), dep); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFinalizer adds or removes finalizer on the resource u names, with an
+// update, and sets u to the resource as written.
+func setFinalizer(c client.Client, u *unstructured.Unstructured, finalizer string, present bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fresh := &unstructured.Unstructured{}
+		fresh.SetGroupVersionKind(u.GroupVersionKind())
+		key := types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}
+		if err := c.Get(context.TODO(), key, fresh); err != nil {
+			return err
+		}
+		if contains(fresh.GetFinalizers(), finalizer) != present {
+			fresh.SetFinalizers(withFinalizer(fresh.GetFinalizers(), finalizer, present))
+			if err := c.Update(context.TODO(), fresh); err != nil {
+				return err
+			}
+		}
+		u.Object = fresh.Object
+		return nil
+	})
+}
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// latencyBuckets are the buckets of the latency histograms, in seconds; runs
+// often take minutes.
+var latencyBuckets = []float64{0.1, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// The metrics of the work queues of the ansible controllers, to spot
+// backlogs before resources go visibly stale.
+var (
+	queueDepth = metrics.NewGaugeVec("ansible_operator_queue_depth",
+		"Resources waiting in the queue of a controller.",
+		"group", "version", "kind")
+	queueAdds = metrics.NewCounterVec("ansible_operator_queue_adds_total",
+		"Resources added to the queue of a controller.",
+		"group", "version", "kind")
+	queueRetries = metrics.NewCounterVec("ansible_operator_queue_retries_total",
+		"Resources added back to the queue of a controller after a delay, e.g. to retry a failed run.",
+		"group", "version", "kind")
+	queueLatency = metrics.NewHistogramVec("ansible_operator_queue_latency_seconds",
+		"Time resources wait in the queue of a controller before they are reconciled.",
+		latencyBuckets, "group", "version", "kind")
+	queueWorkDuration = metrics.NewHistogramVec("ansible_operator_queue_work_duration_seconds",
+		"Time a controller takes to reconcile a resource, runs included.",
+		latencyBuckets, "group", "version", "kind")
+	reconcileLatency = metrics.NewHistogramVec("ansible_operator_reconcile_latency_seconds",
+		"Time from the first event queueing a resource to the end of its reconcile.",
+		latencyBuckets, "group", "version", "kind")
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(queueDepth, queueAdds, queueRetries, queueLatency, queueWorkDuration, reconcileLatency)
+	workqueue.SetProvider(queueMetricsProvider{})
+}
+
+var (
+	// queueMetricsMutex is held while a controller of an ansible watch is
+	// created; the metrics of its queue are labelled with queueGVK.
+	queueMetricsMutex sync.Mutex
+	queueGVK          *schema.GroupVersionKind
+)
+
+// newController creates the controller of gvk. The metrics of its queue are
+// labelled with gvk rather than the name of the controller, which is the
+// same for kinds of different groups.
+func newController(name string, gvk schema.GroupVersionKind, m manager.Manager, options controller.Options) (controller.Controller, error) {
+	queueMetricsMutex.Lock()
+	defer queueMetricsMutex.Unlock()
+	queueGVK = &gvk
+	defer func() { queueGVK = nil }()
+	return controller.New(name, m, options)
+}
+
+// queueMetricsProvider records the metrics of the queues of the controllers
+// newController creates; those of other queues are dropped.
+type queueMetricsProvider struct{}
+
+type gaugeMetric struct {
+	vec    *metrics.GaugeVec
+	labels []string
+}
+
+func (g gaugeMetric) Inc() { g.vec.Add(1, g.labels...) }
+func (g gaugeMetric) Dec() { g.vec.Add(-1, g.labels...) }
+
+type counterMetric struct {
+	vec    *metrics.CounterVec
+	labels []string
+}
+
+func (c counterMetric) Inc() { c.vec.Inc(c.labels...) }
+
+// microsecondsMetric observes the microseconds the queue reports in
+// seconds.
+type microsecondsMetric struct {
+	vec    *metrics.HistogramVec
+	labels []string
+}
+
+func (h microsecondsMetric) Observe(v float64) { h.vec.Observe(v/1e6, h.labels...) }
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Observe(float64) {}
+
+func queueLabels() ([]string, bool) {
+	if queueGVK == nil {
+		return nil, false
+	}
+	return []string{queueGVK.Group, queueGVK.Version, queueGVK.Kind}, true
+}
+
+func (queueMetricsProvider) NewDepthMetric(string) workqueue.GaugeMetric {
+	if labels, ok := queueLabels(); ok {
+		queueDepth.Add(0, labels...)
+		return gaugeMetric{vec: queueDepth, labels: labels}
+	}
+	return noopMetric{}
+}
+
+func (queueMetricsProvider) NewAddsMetric(string) workqueue.CounterMetric {
+	if labels, ok := queueLabels(); ok {
+		return counterMetric{vec: queueAdds, labels: labels}
+	}
+	return noopMetric{}
+}
+
+func (queueMetricsProvider) NewLatencyMetric(string) workqueue.SummaryMetric {
+	if labels, ok := queueLabels(); ok {
+		return microsecondsMetric{vec: queueLatency, labels: labels}
+	}
+	return noopMetric{}
+}
+
+func (queueMetricsProvider) NewWorkDurationMetric(string) workqueue.SummaryMetric {
+	if labels, ok := queueLabels(); ok {
+		return microsecondsMetric{vec: queueWorkDuration, labels: labels}
+	}
+	return noopMetric{}
+}
+
+func (queueMetricsProvider) NewRetriesMetric(string) workqueue.CounterMetric {
+	if labels, ok := queueLabels(); ok {
+		return counterMetric{vec: queueRetries, labels: labels}
+	}
+	return noopMetric{}
+}
+
+// latencyTracker records, for every resource, the time of the first event
+// queueing it since its last reconcile started, and observes the time from
+// it to the end of the reconcile in ansible_operator_reconcile_latency_seconds.
+// Reconciles retrying a failed run or delayed on purpose, e.g. by a cooldown,
+// are not observed.
+type latencyTracker struct {
+	labels []string
+	mutex  sync.Mutex
+	queued map[types.NamespacedName]time.Time
+}
+
+func newLatencyTracker(gvk schema.GroupVersionKind) *latencyTracker {
+	return &latencyTracker{
+		labels: []string{gvk.Group, gvk.Version, gvk.Kind},
+		queued: map[types.NamespacedName]time.Time{},
+	}
+}
+
+func (l *latencyTracker) record(item interface{}) {
+	req, ok := item.(reconcile.Request)
+	if !ok {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.queued[req.NamespacedName]; !ok {
+		l.queued[req.NamespacedName] = time.Now()
+	}
+}
+
+// reconciler returns next, observing the latency of its reconciles.
+func (l *latencyTracker) reconciler(next reconcile.Reconciler) reconcile.Reconciler {
+	return reconcile.Func(func(request reconcile.Request) (reconcile.Result, error) {
+		l.mutex.Lock()
+		queued, ok := l.queued[request.NamespacedName]
+		delete(l.queued, request.NamespacedName)
+		l.mutex.Unlock()
+		result, err := next.Reconcile(request)
+		if ok {
+			reconcileLatency.Observe(time.Since(queued).Seconds(), l.labels...)
+		}
+		return result, err
+	})
+}
+
+// controller returns ctrl, recording the events its sources queue.
+func (l *latencyTracker) controller(ctrl controller.Controller) controller.Controller {
+	return &latencyController{Controller: ctrl, latency: l}
+}
+
+type latencyController struct {
+	controller.Controller
+	latency *latencyTracker
+}
+
+// Watch implements controller.Controller
+func (c *latencyController) Watch(src source.Source, h crthandler.EventHandler, prct ...predicate.Predicate) error {
+	return c.Controller.Watch(&latencySource{Source: src, latency: c.latency}, h, prct...)
+}
+
+type latencySource struct {
+	source.Source
+	latency *latencyTracker
+}
+
+// Start implements source.Source
+func (s *latencySource) Start(h crthandler.EventHandler, q workqueue.RateLimitingInterface, prct ...predicate.Predicate) error {
+	return s.Source.Start(h, &latencyQueue{RateLimitingInterface: q, latency: s.latency}, prct...)
+}
+
+// InjectFunc passes the fields the controller sets on its sources on to the
+// source wrapped.
+func (s *latencySource) InjectFunc(f inject.Func) error {
+	return f(s.Source)
+}
+
+type latencyQueue struct {
+	workqueue.RateLimitingInterface
+	latency *latencyTracker
+}
+
+func (q *latencyQueue) Add(item interface{}) {
+	q.latency.record(item)
+	q.RateLimitingInterface.Add(item)
+}
+
+func (q *latencyQueue) AddRateLimited(item interface{}) {
+	q.latency.record(item)
+	q.RateLimitingInterface.AddRateLimited(item)
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// quietTracker suspends the periodic reconcile of a resource once a number
+// of consecutive runs of it have succeeded without changing anything. Runs
+// triggered otherwise, e.g. by a change of the spec or of a dependent
+// resource, still happen, and the periodic reconcile resumes as soon as one
+// of them changes something or the spec changes.
+type quietTracker struct {
+	after int
+	mutex sync.Mutex
+	runs  map[types.NamespacedName]quietState
+}
+
+type quietState struct {
+	// idleRuns is the number of consecutive successful runs that changed
+	// nothing, for the spec with hash specHash.
+	idleRuns int
+	specHash string
+}
+
+func newQuietTracker(after int) *quietTracker {
+	return &quietTracker{after: after, runs: map[types.NamespacedName]quietState{}}
+}
+
+// ran records the end of a run of u. idle is true if the run succeeded
+// without changing anything.
+func (q *quietTracker) ran(u *unstructured.Unstructured, idle bool) {
+	nn := types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}
+	hash := specHash(u)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	state := q.runs[nn]
+	wasQuiet := state.idleRuns >= q.after
+	if !idle || state.specHash != hash {
+		state = quietState{specHash: hash}
+	}
+	if idle {
+		state.idleRuns++
+	}
+	q.runs[nn] = state
+	switch isQuiet := state.idleRuns >= q.after; {
+	case isQuiet && !wasQuiet:
+		logrus.Infof("%v has not changed in %d runs, suspending its periodic reconcile", nn, state.idleRuns)
+	case !isQuiet && wasQuiet:
+		logrus.Infof("%v changed, resuming its periodic reconcile", nn)
+	}
+}
+
+// suspended reports whether the periodic reconcile of nn is suspended.
+func (q *quietTracker) suspended(nn types.NamespacedName) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.runs[nn].idleRuns >= q.after
+}
+
+// forget drops the state of a resource that no longer exists.
+func (q *quietTracker) forget(nn types.NamespacedName) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.runs, nn)
+}
+
+// predicate filters out the periodic reconciles of suspended resources.
+func (q *quietTracker) predicate() predicate.Predicate {
+	return predicate.Funcs{
+		GenericFunc: func(e event.GenericEvent) bool {
+			return !q.suspended(types.NamespacedName{Namespace: e.Meta.GetNamespace(), Name: e.Meta.GetName()})
+		},
+	}
+}
+
+// isIdleRun reports whether a run with final stats s changed nothing.
+func isIdleRun(s eventapi.StatusJobEvent) bool {
+	for _, count := range s.EventData.Changed {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -4,87 +4,405 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/operatorcondition"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
 	"github.com/water-hole/ansible-operator/pkg/proxy/kubeconfig"
 	"github.com/water-hole/ansible-operator/pkg/runner"
 	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"github.com/water-hole/ansible-operator/pkg/tracing"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// DefaultProxyURL is the URL of the operator's proxy, as started by the
+// ansible-operator command.
+const DefaultProxyURL = "http://localhost:8888"
+
 // AnsibleOperatorReconciler - object to reconcile runner requests
 type AnsibleOperatorReconciler struct {
-	GVK           schema.GroupVersionKind
-	Runner        runner.Runner
-	Client        client.Client
+	GVK    schema.GroupVersionKind
+	Runner runner.Runner
+	Client client.Client
+	// Reader is used to get the resource being reconciled. It defaults to
+	// Client, but is normally the manager's cache.
+	Reader        client.Reader
 	EventHandlers []events.EventHandler
+	// Upgradeable, if set, reports in-flight runs and playbook requests to
+	// OLM through the operator's OperatorCondition.
+	Upgradeable *operatorcondition.Tracker
+	// Recorder, if set, records an Event for every resource a run changed
+	// in diff mode.
+	Recorder record.EventRecorder
+	// Tracer, if set, records a span for every run, with child spans for
+	// its plays and tasks.
+	Tracer *tracing.Tracer
+	// Namespaces, if set, lists the namespaces whose resources are
+	// reconciled. Requests for other namespaces are dropped.
+	Namespaces *NamespaceList
+	// ProxyURL is the URL of the operator's proxy, which playbooks talk to
+	// the API server through. It defaults to DefaultProxyURL.
+	ProxyURL string
+	// Identities, shared with the proxy, are issued the ServiceAccount the
+	// runs of a runner with one act as.
+	Identities *proxy.Identities
+	// NoProxy, if set, runs playbooks with a kubeconfig reaching the API
+	// server directly with RESTConfig, and sets the owner of the resources
+	// they apply after each run; see adopt. TrackingLabelPrefix is the
+	// prefix of the labels set on those in other namespaces.
+	NoProxy             bool
+	RESTConfig          *rest.Config
+	TrackingLabelPrefix string
+	// PreReconcile, if set, is called with the resource before every run.
+	// If it returns an error, the resource is not run, and requeued with
+	// backoff.
+	PreReconcile func(u *unstructured.Unstructured) error
+	// PostReconcile, if set, is called after every run that completed, with
+	// the resource as written and the result of the run.
+	PostReconcile func(u *unstructured.Unstructured, result RunResult)
+	// writer persists status and finalizers. Add sets it to patch them; it
+	// defaults to updating the whole resource with Client.
+	writer resourceWriter
+	// dependents, if set, requeues resources whose dependents drift.
+	dependents *dependentTracker
+	// cooldown, if set, spaces the runs of each resource.
+	cooldown *cooldown
+	// quiet, if set, suspends the periodic reconcile of idle resources.
+	quiet *quietTracker
+	// coalescer, if set, merges the events arriving during a run.
+	coalescer *coalescer
+	// taskFailures, if set, records an Event for every failed task.
+	taskFailures *taskFailures
+	// handoff, if set, records the runs in progress for the operator taking
+	// over from this one.
+	handoff *watchHandoff
+	// pruneClient reads and deletes the dependents pruned, in any
+	// namespace, bypassing the cache.
+	pruneClient client.Client
+	// runsClient, if set, creates and deletes the AnsibleRuns of runs,
+	// bypassing the cache.
+	runsClient client.Client
+	// terminating, if set, skips the runs of resources in namespaces being
+	// deleted.
+	terminating *terminatingNamespaces
+
+	// ctx is the context runs are started with; Add cancels it once the
+	// controller stops. It defaults to context.Background().
+	ctx       context.Context
+	runsMutex sync.Mutex
+	// runs are the resources a run is in progress for.
+	runs map[types.NamespacedName]activeRun
+}
+
+// activeRun - a run in progress.
+type activeRun struct {
+	cancel context.CancelFunc
+	// generation is the generation of the spec the run applies; 0 for
+	// finalizer runs, which are not preempted.
+	generation int64
 }
 
 // Reconcile - handle the event.
 func (r *AnsibleOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	if r.Namespaces != nil && !r.Namespaces.Contains(request.Namespace) {
+		logrus.Debugf("namespace %s is not watched, skipping %v", request.Namespace, request.NamespacedName)
+		return reconcile.Result{}, nil
+	}
 	u := &unstructured.Unstructured{}
 	u.SetGroupVersionKind(r.GVK)
-	err := r.Client.Get(context.TODO(), request.NamespacedName, u)
+	reader := r.Reader
+	if reader == nil {
+		reader = r.Client
+	}
+	err := reader.Get(context.TODO(), request.NamespacedName, u)
 	if apierrors.IsNotFound(err) {
+		if r.Upgradeable != nil {
+			r.Upgradeable.Forget(r.upgradeableKey(request.Namespace, request.Name))
+		}
+		if r.dependents != nil {
+			r.dependents.forget(request.NamespacedName)
+		}
+		if r.cooldown != nil {
+			r.cooldown.forget(request.NamespacedName)
+		}
+		if r.quiet != nil {
+			r.quiet.forget(request.NamespacedName)
+		}
+		r.taskFailures.forget(request.NamespacedName)
 		return reconcile.Result{}, nil
 	}
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
+	log := logrus.WithFields(logrus.Fields{
+		"component": "reconciler",
+		"gvk":       r.GVK.String(),
+		"namespace": u.GetNamespace(),
+		"name":      u.GetName(),
+		"uid":       string(u.GetUID()),
+	})
+	handedOverIdle := r.handoff.idle(request.NamespacedName)
+
+	if !reconciles(r.Runner, u) {
+		log.Debugf("%v does not match the field selector or required annotations of the watch, skipping", request.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+
 	deleted := u.GetDeletionTimestamp() != nil
 	finalizer, finalizerExists := r.Runner.GetFinalizer()
 	pendingFinalizers := u.GetFinalizers()
 	// If the resource is being deleted we don't want to add the finalizer again
 	if finalizerExists && !deleted && !contains(pendingFinalizers, finalizer) {
-		logrus.Debugf("Adding finalizer %s to resource", finalizer)
+		log.Debugf("Adding finalizer %s to resource", finalizer)
 		finalizers := append(pendingFinalizers, finalizer)
 		u.SetFinalizers(finalizers)
-		err := r.Client.Update(context.TODO(), u)
+		err := r.resourceWriter().writeFinalizers(u)
 		return reconcile.Result{}, err
 	}
+	prune := r.Runner.GetPruneDependents()
+	if prune && !deleted && !contains(pendingFinalizers, PruneFinalizer) {
+		if err := setFinalizer(r.Client, u, PruneFinalizer, true); err != nil {
+			return reconcile.Result{}, err
+		}
+		pendingFinalizers = u.GetFinalizers()
+	}
+	if deleted && contains(pendingFinalizers, PruneFinalizer) && !(finalizerExists && contains(pendingFinalizers, finalizer)) {
+		// The finalizer of the watch, if any, has run.
+		if err := pruneDependents(r.pruneClient, u); err != nil {
+			log.Errorf("Pruning dependents failed: %v", err)
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, setFinalizer(r.Client, u, PruneFinalizer, false)
+	}
 	if !contains(pendingFinalizers, finalizer) && deleted {
-		logrus.Info("Resource is terminated, skipping reconcilation")
+		log.Info("Resource is terminated, skipping reconcilation")
+		return reconcile.Result{}, nil
+	}
+	if !deleted && r.terminating.contains(u.GetNamespace()) {
+		log.Debugf("namespace %s is being deleted, skipping %v until it is deleted with it", u.GetNamespace(), request.NamespacedName)
 		return reconcile.Result{}, nil
 	}
+	forced := reconcileNowRequested(u)
+	if forced {
+		log.Infof("%s is set to a new value, running right away", ReconcileNowAnnotation)
+	}
+	if r.Runner.GetOneShot() && !deleted && !forced && hasRun(u) {
+		log.Debugf("%v has already run for its current spec, skipping", request.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+	if handedOverIdle && !deleted && !forced && hasRun(u) {
+		log.Debugf("%v was idle when the operator before this one stopped, and has run for its current spec, skipping", request.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+	maxFailures := r.Runner.GetMaxFailures()
+	if maxFailures > 0 && !deleted && !forced && isDegraded(u, maxFailures) {
+		log.Debugf("%v is degraded, skipping reconciliation until its spec or %s annotation changes", request.NamespacedName, RetryAnnotation)
+		return reconcile.Result{}, nil
+	}
+	if f := terminalFailureFromStatus(u); !deleted && !forced && f.current(u) {
+		log.Debugf("%v failed with a terminal error (%s) for its current spec, skipping", request.NamespacedName, f.Reason)
+		return reconcile.Result{}, nil
+	}
+	if r.cooldown != nil && !deleted {
+		if !forced && r.cooldown.hold(request.NamespacedName) {
+			return reconcile.Result{}, nil
+		}
+		defer r.cooldown.ran(request.NamespacedName)
+	}
 
 	s := u.Object["spec"]
 	_, ok := s.(map[string]interface{})
 	if !ok {
-		logrus.Warnf("spec was not found")
+		log.Warnf("spec was not found")
 		u.Object["spec"] = map[string]interface{}{}
 		r.Client.Update(context.TODO(), u)
 		return reconcile.Result{Requeue: true}, nil
 	}
-	ownerRef := metav1.OwnerReference{
-		APIVersion: u.GetAPIVersion(),
-		Kind:       u.GetKind(),
-		Name:       u.GetName(),
-		UID:        u.GetUID(),
+	if r.PreReconcile != nil {
+		if err := r.PreReconcile(u); err != nil {
+			log.Infof("Run declined: %v", err)
+			return reconcile.Result{}, err
+		}
 	}
-
-	kc, err := kubeconfig.Create(ownerRef, "http://localhost:8888", u.GetNamespace())
+	// Every log line, Event and span of the run carries its ident.
+	ident := runner.NewIdent()
+	log = log.WithField("job", ident)
+	kubeconfigPath, removeKubeconfig, err := r.kubeconfigFor(u)
+	if err != nil {
+		log.Error(err.Error())
+		return reconcile.Result{}, err
+	}
+	defer removeKubeconfig()
+	extraVars, secretVars, err := resolveExtraVarsFrom(r.Client, u.GetNamespace(), r.Runner.GetExtraVarsFrom())
 	if err != nil {
+		log.Error(err.Error())
 		return reconcile.Result{}, err
 	}
-	defer os.Remove(kc.Name())
-	eventChan, err := r.Runner.Run(u, kc.Name())
+	for k, v := range annotationVars(u, r.Runner.GetAnnotationVarsPrefix()) {
+		extraVars[k] = v
+	}
+	var creds *runner.RunCredentials
+	if c, ok := r.Runner.GetCredentials(); ok {
+		rc, err := runCredentials(r.Client, u, c)
+		if err != nil {
+			log.Error(err.Error())
+			return reconcile.Result{}, err
+		}
+		creds = &rc
+	}
+	conds := []condition{}
+	if c, ok := r.validateSpec(u, extraVars); ok && !deleted {
+		if c.failure() {
+			// The run would fail the same way until the spec changes.
+			log.Info(c.Message)
+			if r.writeConditions(u, []condition{c}, ident) {
+				err = r.resourceWriter().writeStatus(u)
+			}
+			return reconcile.Result{}, err
+		}
+		conds = append(conds, c)
+	}
+	if r.Upgradeable != nil {
+		r.Upgradeable.RunStarted()
+		defer r.Upgradeable.RunFinished()
+	}
+	deps := []dependent{}
+	depsComplete := false
+	if r.dependents != nil {
+		r.dependents.runStarted(request.NamespacedName)
+		defer func() { r.dependents.runFinished(request.NamespacedName, deps, depsComplete) }()
+	}
+	r.coalescer.runStarted(request.NamespacedName)
+	generation := u.GetGeneration()
+	if deleted {
+		generation = 0
+	}
+	ctx := r.startRun(request.NamespacedName, generation)
+	if creds != nil {
+		ctx = runner.WithRunCredentials(ctx, *creds)
+	}
+	if len(secretVars) > 0 {
+		ctx = runner.WithRedactedVars(ctx, secretVars...)
+	}
+	r.handoff.runStarted(request.NamespacedName, ident)
+	defer r.finishRun(request.NamespacedName)
+	span := r.Tracer.Start(fmt.Sprintf("reconcile %s", r.GVK.Kind), nil)
+	span.SetAttribute("k8s.namespace.name", u.GetNamespace())
+	span.SetAttribute("k8s.resource.name", u.GetName())
+	span.SetAttribute("k8s.resource.kind", r.GVK.Kind)
+	span.SetAttribute("k8s.resource.uid", string(u.GetUID()))
+	span.SetAttribute("ansible.runner.ident", ident)
+	defer span.End()
+	spans := &runSpans{tracer: r.Tracer, root: span}
+	defer spans.finish()
+	env := map[string]string{runner.IdentEnv: ident}
+	if span != nil {
+		env["TRACEPARENT"] = span.Traceparent()
+	}
+	hooks := r.Runner.GetHooks()
+	if !deleted && hooks.Pre != "" {
+		pre := r.runHook(ctx, PreHookCondition, hooks.Pre, u, kubeconfigPath, extraVars, env)
+		conds = append(conds, pre)
+		if ctx.Err() != nil {
+			return r.cancelled(log, span)
+		}
+		if pre.failure() {
+			span.SetError(pre.Message)
+			if hooks.OnFailure != "" {
+				conds = append(conds, r.runHook(ctx, OnFailureHookCondition, hooks.OnFailure, u, kubeconfigPath, extraVars, env))
+			}
+			if r.writeConditions(u, conds, ident) {
+				err = r.resourceWriter().writeStatus(u)
+			}
+			return reconcile.Result{Requeue: true}, err
+		}
+	}
+	if canary, ok := r.Runner.GetCanary(); ok && !deleted {
+		if approvalRequested(u) {
+			log.Infof("%s is set to a new value, running without a check-mode run", ApproveAnnotation)
+			conds = append(conds, condition{Type: NeedsApprovalCondition, Status: "False", Reason: "Approved", Message: "the run was approved", Negative: true})
+		} else {
+			c, err := r.checkRun(ctx, u, canary, kubeconfigPath, extraVars, env)
+			if ctx.Err() != nil {
+				return r.cancelled(log, span)
+			}
+			if err != nil {
+				span.SetError(err.Error())
+				return reconcile.Result{}, err
+			}
+			if c.failure() {
+				// Held back until approved, or until a later check-mode
+				// run predicts fewer changes.
+				log.Info(c.Message)
+				if r.writeConditions(u, append(conds, c), ident) {
+					err = r.resourceWriter().writeStatus(u)
+				}
+				return reconcile.Result{}, err
+			}
+			conds = append(conds, c)
+		}
+	}
+	var eventChan chan eventapi.JobEvent
+	if er, ok := r.Runner.(envRunner); ok && len(env) > 0 {
+		eventChan, err = er.RunWithEnv(ctx, u, kubeconfigPath, extraVars, env)
+	} else {
+		eventChan, err = r.Runner.Run(ctx, u, kubeconfigPath, extraVars)
+	}
 	if err != nil {
+		span.SetError(err.Error())
 		return reconcile.Result{}, err
 	}
 
 	// iterate events from ansible, looking for the final one
 	statusEvent := eventapi.StatusJobEvent{}
+	progress := &progressReporter{writer: r.resourceWriter(), u: u}
+	diffs := []ResourceDiff{}
+	recorder := &runRecorder{}
+	classifier := &failureClassifier{}
+	applied := []dependent{}
+	// The handlers run alongside the writes of progress and status to u.
+	handled := u.DeepCopy()
 	for event := range eventChan {
 		for _, eHandler := range r.EventHandlers {
-			go eHandler.Handle(u, event)
+			go handleEvent(eHandler, handled, event)
+		}
+		spans.handle(event)
+		recorder.handle(event)
+		classifier.handle(event)
+		if r.Upgradeable != nil {
+			if upgradeable, message, found := operatorcondition.UpgradeableFromEvent(event); found {
+				r.Upgradeable.SetBlocked(r.upgradeableKey(u.GetNamespace(), u.GetName()), !upgradeable, message)
+			}
+		}
+		if r.dependents != nil || r.NoProxy || prune {
+			if dep, ok := dependentFromEvent(event); ok {
+				applied = append(applied, dep)
+			}
+		}
+		if diff, ok := NewResourceDiffFromJobEvent(event); ok {
+			diffs = append(diffs, diff)
+			if r.Recorder != nil {
+				r.Recorder.Event(u, "Normal", "Changed", fmt.Sprintf("%s (run %s)", diff.summary(), ident))
+			}
+		}
+		r.taskFailures.handle(r.Recorder, u, event, ident)
+		if task, ok := NewTaskProgressFromJobEvent(event); ok {
+			progress.report(task)
+			continue
 		}
 		if event.Event == "playbook_on_stats" {
 			// convert to StatusJobEvent; would love a better way to do this
@@ -98,14 +416,33 @@ func (r *AnsibleOperatorReconciler) Reconcile(request reconcile.Request) (reconc
 			}
 		}
 	}
+	if ctx.Err() != nil {
+		return r.cancelled(log, span)
+	}
 	if statusEvent.Event == "" {
+		if IsTerminal(classifier.err) && !deleted {
+			// e.g. a syntax error; running again fails the same way
+			log.Error(classifier.err.Error())
+			span.SetError(classifier.err.Error())
+			failure := newTerminalFailure(u, classifier.err)
+			setStatusField(statusAsMap(u), "terminalFailure", failure.toMap())
+			setStatusField(statusAsMap(u), "lastFailure", newLastFailure(classifier.err, classifier.output.String(), ident).toMap())
+			r.writeConditions(u, append(conds, failure.condition()), ident)
+			return reconcile.Result{}, r.resourceWriter().writeStatus(u)
+		}
 		err := errors.New("did not receive playbook_on_stats event")
-		logrus.Error(err.Error())
+		log.Error(err.Error())
 		return reconcile.Result{}, err
 	}
+	if r.dependents != nil {
+		deps = applied
+	}
+	if r.NoProxy && !deleted {
+		adopt(r.Client, u, applied, r.TrackingLabelPrefix)
+	}
 
 	// We only want to update the CustomResource once, so we'll track changes and do it at the end
-	var needsUpdate bool
+	var needsUpdate, removeFinalizer bool
 	runSuccessful := true
 	for _, count := range statusEvent.EventData.Failures {
 		if count > 0 {
@@ -113,6 +450,33 @@ func (r *AnsibleOperatorReconciler) Reconcile(request reconcile.Request) (reconc
 			break
 		}
 	}
+	depsComplete = runSuccessful
+	var runErr *RunError
+	if !runSuccessful {
+		runErr = classifier.err
+		if runErr == nil {
+			runErr = &RunError{Reason: ReasonModuleError}
+		}
+		log.Infof("Run failed: %v", runErr)
+	}
+	terminal := IsTerminal(runErr) && !deleted
+	hooksFailed := false
+	if !deleted {
+		if runSuccessful && hooks.Post != "" {
+			post := r.runHook(ctx, PostHookCondition, hooks.Post, u, kubeconfigPath, extraVars, env)
+			conds = append(conds, post)
+			hooksFailed = post.failure()
+		}
+		if (!runSuccessful || hooksFailed) && hooks.OnFailure != "" {
+			conds = append(conds, r.runHook(ctx, OnFailureHookCondition, hooks.OnFailure, u, kubeconfigPath, extraVars, env))
+		}
+	}
+	if r.quiet != nil {
+		r.quiet.ran(u, runSuccessful && isIdleRun(statusEvent))
+	}
+	if !runSuccessful {
+		span.SetError("run failed")
+	}
 	// The finalizer has run successfully, time to remove it
 	if deleted && finalizerExists && runSuccessful {
 		finalizers := []string{}
@@ -122,32 +486,290 @@ func (r *AnsibleOperatorReconciler) Reconcile(request reconcile.Request) (reconc
 			}
 		}
 		u.SetFinalizers(finalizers)
-		needsUpdate = true
+		removeFinalizer = true
 	}
 
 	statusMap, ok := u.Object["status"].(map[string]interface{})
+	lastSuccessful := successfulRunFromMap(statusMap["lastSuccessful"])
+	if runSuccessful && !deleted {
+		applied := NewSuccessfulRun(u)
+		lastSuccessful = &applied
+	}
 	if !ok {
 		u.Object["status"] = ResourceStatus{
-			Status: NewStatusFromStatusJobEvent(statusEvent),
+			Status:   NewStatusFromStatusJobEvent(statusEvent),
+			LastTask: progress.latest,
+			Progress: progress.final(),
+			LastDiff: limitDiffs(diffs),
+
+			LastSuccessful: lastSuccessful,
 		}
-		logrus.Infof("adding status for the first time")
+		log.Infof("adding status for the first time")
 		needsUpdate = true
 	} else {
 		// Need to conver the map[string]interface into a resource status.
 		if update, status := UpdateResourceStatus(statusMap, statusEvent); update {
+			status.LastTask = progress.latest
+			status.Progress = progress.final()
+			if len(diffs) > 0 {
+				status.LastDiff = limitDiffs(diffs)
+			} else if _, ok := statusMap["lastDiff"]; ok {
+				status.LastDiff = resourceDiffsFromSlice(statusMap["lastDiff"])
+			}
+			status.LastSuccessful = lastSuccessful
 			u.Object["status"] = status
 			needsUpdate = true
+		} else {
+			if progress.latest != nil && !reflect.DeepEqual(statusMap["lastTask"], progress.latest.toMap()) {
+				setStatusField(statusMap, "lastTask", progress.latest.toMap())
+				needsUpdate = true
+			}
+			if final := progress.final(); final != nil && !reflect.DeepEqual(statusMap["progress"], final.toMap()) {
+				setStatusField(statusMap, "progress", final.toMap())
+				needsUpdate = true
+			}
+			if len(diffs) > 0 {
+				lastDiff := []interface{}{}
+				for _, d := range limitDiffs(diffs) {
+					lastDiff = append(lastDiff, d.toMap())
+				}
+				setStatusField(statusMap, "lastDiff", lastDiff)
+				needsUpdate = true
+			}
+			if runSuccessful && !deleted {
+				setStatusField(statusMap, "lastSuccessful", lastSuccessful.toMap())
+				needsUpdate = true
+			}
 		}
 	}
+	// A rebuilt status keeps what earlier runs recorded.
+	keepStatusFields(u, statusMap, prunedStatusField, "failureStreak")
+	if prune && !deleted {
+		recordPrunable(u, applied)
+	}
+	record := recorder.finish(statusEvent)
+	if runErr != nil {
+		record.Reason = runErr.Reason
+	}
+	appendHistory(statusAsMap(u), record, r.Runner.GetHistoryLimit())
+	if nonce := u.GetAnnotations()[ReconcileNowAnnotation]; nonce != "" {
+		setStatusField(statusAsMap(u), "reconcileNow", nonce)
+	}
+	if nonce := u.GetAnnotations()[ApproveAnnotation]; nonce != "" && !deleted {
+		setStatusField(statusAsMap(u), "approved", nonce)
+	}
+	needsUpdate = true
+	degraded := false
+	if maxFailures > 0 && !deleted {
+		c, changed, isDegraded := recordOutcome(u, runSuccessful, maxFailures)
+		conds = append(conds, c)
+		degraded = isDegraded
+		needsUpdate = needsUpdate || changed
+	}
+	if terminal {
+		failure := newTerminalFailure(u, runErr)
+		setStatusField(statusAsMap(u), "terminalFailure", failure.toMap())
+		conds = append(conds, failure.condition())
+	} else if runSuccessful {
+		delete(statusAsMap(u), "terminalFailure")
+	}
+	if runErr != nil {
+		setStatusField(statusAsMap(u), "lastFailure", newLastFailure(runErr, classifier.output.String(), ident).toMap())
+	} else if runSuccessful {
+		delete(statusAsMap(u), "lastFailure")
+	}
+	if len(conds) > 0 && r.writeConditions(u, conds, ident) {
+		needsUpdate = true
+	}
 	if needsUpdate {
-		err = r.Client.Update(context.TODO(), u)
+		err = r.resourceWriter().writeStatus(u)
 	}
-	if !runSuccessful {
+	if err == nil && removeFinalizer {
+		// u now holds the finalizers as written with the status
+		u.SetFinalizers(withFinalizer(u.GetFinalizers(), finalizer, false))
+		err = r.resourceWriter().writeFinalizers(u)
+	}
+	result := RunResult{
+		RunRecord:  record,
+		Successful: runSuccessful,
+		Finalizer:  deleted,
+		Stats:      statusEvent.EventData,
+		Error:      runErr,
+	}
+	if r.PostReconcile != nil {
+		r.PostReconcile(u, result)
+	}
+	if settings, ok := r.Runner.GetAnsibleRuns(); ok && r.runsClient != nil {
+		if err := recordAnsibleRun(r.runsClient, u, settings, recorder.started, result); err != nil {
+			log.Errorf("Failed to record the run as an AnsibleRun: %v", err)
+		}
+	}
+	merged, followUp := r.coalescer.runFinished(request.NamespacedName)
+	if followUp {
+		log.Debugf("%d events during the run, merged into one follow-up run", merged)
+	} else if merged > 0 {
+		log.Debugf("%d periodic reconciles during the run, dropped", merged)
+	}
+	if (!runSuccessful || hooksFailed) && !degraded && !terminal {
+		if followUp {
+			// The follow-up run, of the resource as it is now, is the retry.
+			if err != nil {
+				log.Error(err.Error())
+			}
+			return reconcile.Result{}, nil
+		}
 		return reconcile.Result{Requeue: true}, err
 	}
 	return reconcile.Result{}, err
 }
 
+// kubeconfigFor writes the kubeconfig the playbooks of a run for u use, and
+// returns its path and a func removing it.
+func (r *AnsibleOperatorReconciler) kubeconfigFor(u *unstructured.Unstructured) (string, func(), error) {
+	ownerRef := metav1.OwnerReference{
+		APIVersion: u.GetAPIVersion(),
+		Kind:       u.GetKind(),
+		Name:       u.GetName(),
+		UID:        u.GetUID(),
+	}
+	sa, impersonate := r.Runner.GetServiceAccount()
+	var kc *os.File
+	var err error
+	password := ""
+	if r.NoProxy {
+		if impersonate {
+			return "", nil, fmt.Errorf("%v runs playbooks as a ServiceAccount, which requires the proxy", r.GVK)
+		}
+		kc, err = kubeconfig.CreateDirect(r.RESTConfig, u.GetNamespace())
+	} else {
+		if impersonate {
+			if r.Identities == nil {
+				return "", nil, fmt.Errorf("%v runs playbooks as a ServiceAccount, which requires the proxy's identities", r.GVK)
+			}
+			if sa.Namespace == "" && u.GetNamespace() == "" {
+				return "", nil, fmt.Errorf("serviceAccount namespace must be set for cluster-scoped %v", r.GVK)
+			}
+			if password, err = r.Identities.Issue(u.GetUID(), sa.Username(u.GetNamespace())); err != nil {
+				return "", nil, err
+			}
+		} else if r.Identities.Required() {
+			// The run acts as the operator, with a password of its own.
+			if password, err = r.Identities.Issue(u.GetUID(), ""); err != nil {
+				return "", nil, err
+			}
+		}
+		proxyURL := r.ProxyURL
+		if proxyURL == "" {
+			proxyURL = DefaultProxyURL
+		}
+		kc, err = kubeconfig.CreateImpersonating(ownerRef, proxyURL, u.GetNamespace(), password)
+	}
+	remove := func() {
+		if password != "" {
+			r.Identities.Revoke(password)
+		}
+		if kc != nil {
+			os.Remove(kc.Name())
+		}
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	if t, ok := r.Runner.GetTargetCluster(); ok {
+		path, err := targetClusterKubeconfig(r.Client, u, t)
+		if err != nil {
+			remove()
+			return "", nil, err
+		}
+		if path != "" {
+			return path, func() { remove(); os.Remove(path) }, nil
+		}
+	}
+	return kc.Name(), remove, nil
+}
+
+// startRun records that a run of nn applying generation is in progress, and
+// returns its context, done once cancelRun is called for nn or the
+// controller stops.
+func (r *AnsibleOperatorReconciler) startRun(nn types.NamespacedName, generation int64) context.Context {
+	parent := r.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	r.runsMutex.Lock()
+	defer r.runsMutex.Unlock()
+	if r.runs == nil {
+		r.runs = map[types.NamespacedName]activeRun{}
+	}
+	r.runs[nn] = activeRun{cancel: cancel, generation: generation}
+	return ctx
+}
+
+// finishRun records that the run of nn ended.
+func (r *AnsibleOperatorReconciler) finishRun(nn types.NamespacedName) {
+	r.runsMutex.Lock()
+	defer r.runsMutex.Unlock()
+	if run, ok := r.runs[nn]; ok {
+		run.cancel()
+		delete(r.runs, nn)
+	}
+}
+
+// cancelRun cancels the run of nn in progress, if any, for reason.
+func (r *AnsibleOperatorReconciler) cancelRun(nn types.NamespacedName, reason string) {
+	r.runsMutex.Lock()
+	defer r.runsMutex.Unlock()
+	if run, ok := r.runs[nn]; ok {
+		logrus.Infof("Cancelling the run of %v %v: %s", r.GVK.Kind, nn, reason)
+		run.cancel()
+	}
+}
+
+// preemptStaleRun cancels the run of nn in progress, if it applies a
+// generation older than generation.
+func (r *AnsibleOperatorReconciler) preemptStaleRun(nn types.NamespacedName, generation int64) {
+	r.runsMutex.Lock()
+	defer r.runsMutex.Unlock()
+	// Checked and cancelled under one lock, so a run of the new generation
+	// started meanwhile is never the one cancelled.
+	if run, ok := r.runs[nn]; ok && run.generation > 0 && run.generation < generation {
+		logrus.Infof("Cancelling the run of %v %v: generation %d of the spec replaces generation %d", r.GVK.Kind, nn, generation, run.generation)
+		run.cancel()
+	}
+}
+
+func (r *AnsibleOperatorReconciler) isRunning(nn types.NamespacedName) bool {
+	r.runsMutex.Lock()
+	defer r.runsMutex.Unlock()
+	_, ok := r.runs[nn]
+	return ok
+}
+
+// cancelled ends a reconcile whose run was cancelled. The resource was
+// deleted or its spec changed, which queued it again, or the controller
+// stopped.
+func (r *AnsibleOperatorReconciler) cancelled(log logrus.FieldLogger, span *tracing.Span) (reconcile.Result, error) {
+	log.Info("Run cancelled")
+	span.SetError("run cancelled")
+	return reconcile.Result{}, nil
+}
+
+func (r *AnsibleOperatorReconciler) resourceWriter() resourceWriter {
+	if r.writer == nil {
+		finalizer, _ := r.Runner.GetFinalizer()
+		return updateWriter{client: r.Client, finalizer: finalizer}
+	}
+	return r.writer
+}
+
+// upgradeableKey identifies a resource of this reconciler's GVK to the
+// Upgradeable tracker.
+func (r *AnsibleOperatorReconciler) upgradeableKey(namespace, name string) string {
+	return fmt.Sprintf("%s %s/%s", r.GVK.Kind, namespace, name)
+}
+
 func contains(l []string, s string) bool {
 	for _, elem := range l {
 		if elem == s {
@@ -156,3 +778,18 @@ func contains(l []string, s string) bool {
 	}
 	return false
 }
+
+// keepStatusFields copies fields from old, the status of u before the run,
+// into its status if they are missing, e.g. because the status was rebuilt
+// from the stats of the run.
+func keepStatusFields(u *unstructured.Unstructured, old map[string]interface{}, fields ...string) {
+	status := statusAsMap(u)
+	for _, f := range fields {
+		if _, ok := status[f]; ok {
+			continue
+		}
+		if v, ok := old[f]; ok {
+			setStatusField(status, f, v)
+		}
+	}
+}
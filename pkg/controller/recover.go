@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// PanickedCondition is the type of the condition set on resources whose
+// last reconcile panicked.
+const PanickedCondition = "ReconcilePanicked"
+
+// maxPanicStack is the length in bytes the stack traces of panics are
+// truncated to in conditions and Events.
+const maxPanicStack = 4096
+
+var reconcilePanics = metrics.NewCounterVec("ansible_operator_reconcile_panics_total",
+	"Reconciles of a controller that panicked, and were failed instead.",
+	"group", "version", "kind")
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(reconcilePanics)
+}
+
+// panicRecovery turns the panics of reconciles into failed reconciles, which
+// are retried with backoff, rather than crashing the operator with every
+// other controller. The panic and its stack trace are logged, and set in
+// the PanickedCondition of the resource with a Warning Event; the condition
+// is set to False by the next reconcile that does not panic.
+type panicRecovery struct {
+	r        *AnsibleOperatorReconciler
+	mutex    sync.Mutex
+	panicked map[types.NamespacedName]bool
+}
+
+// recoverPanics returns next, failing the reconciles that panic.
+func recoverPanics(r *AnsibleOperatorReconciler, next reconcile.Reconciler) reconcile.Reconciler {
+	p := &panicRecovery{r: r, panicked: map[types.NamespacedName]bool{}}
+	return reconcile.Func(func(request reconcile.Request) (result reconcile.Result, err error) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				p.recovered(request.NamespacedName)
+				return
+			}
+			result, err = reconcile.Result{}, fmt.Errorf("reconcile of %v panicked: %v", request.NamespacedName, v)
+			p.record(request.NamespacedName, v, debug.Stack())
+		}()
+		return next.Reconcile(request)
+	})
+}
+
+// record logs the panic v of the reconcile of nn, and sets it in its
+// condition.
+func (p *panicRecovery) record(nn types.NamespacedName, v interface{}, stack []byte) {
+	logrus.Errorf("Reconcile of %v %v panicked: %v\n%s", p.r.GVK, nn, v, stack)
+	reconcilePanics.Inc(p.r.GVK.Group, p.r.GVK.Version, p.r.GVK.Kind)
+	p.mutex.Lock()
+	p.panicked[nn] = true
+	p.mutex.Unlock()
+	if len(stack) > maxPanicStack {
+		stack = append(stack[:maxPanicStack], "..."...)
+	}
+	p.writeCondition(nn, condition{
+		Type:     PanickedCondition,
+		Status:   "True",
+		Reason:   "Panic",
+		Message:  fmt.Sprintf("reconcile panicked: %v\n%s", v, stack),
+		Negative: true,
+	})
+}
+
+// recovered sets the condition of nn to False if its last reconcile
+// panicked.
+func (p *panicRecovery) recovered(nn types.NamespacedName) {
+	p.mutex.Lock()
+	panicked := p.panicked[nn]
+	delete(p.panicked, nn)
+	p.mutex.Unlock()
+	if !panicked {
+		return
+	}
+	p.writeCondition(nn, condition{Type: PanickedCondition, Status: "False", Reason: "Reconciled", Negative: true})
+}
+
+func (p *panicRecovery) writeCondition(nn types.NamespacedName, c condition) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(p.r.GVK)
+	if err := p.r.Client.Get(context.TODO(), nn, u); err != nil {
+		// deleted, or to be retried by the next reconcile
+		return
+	}
+	if p.r.writeConditions(u, []condition{c}, "") {
+		if err := p.r.resourceWriter().writeStatus(u); err != nil {
+			logrus.Warningf("Unable to write the %s condition of %v: %v", PanickedCondition, nn, err)
+		}
+	}
+}
+
+// handleEvent passes event on to h, logging rather than crashing the
+// operator if h panics.
+func handleEvent(h events.EventHandler, u *unstructured.Unstructured, event eventapi.JobEvent) {
+	defer func() {
+		if v := recover(); v != nil {
+			logrus.Errorf("Event handler panicked on the event %s of %s/%s: %v\n%s", event.UUID, u.GetNamespace(), u.GetName(), v, debug.Stack())
+		}
+	}()
+	h.Handle(u, event)
+}
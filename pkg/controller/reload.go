@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reloadSource enqueues every resource of a GVK when the playbooks or roles
+// it runs change on disk, so that edits are applied without touching the
+// resources. It polls the modification times of the files below paths: a
+// role is watched as a whole, and a playbook with the directory it is in, for
+// the roles and files it includes.
+type reloadSource struct {
+	gvk      schema.GroupVersionKind
+	reader   client.Reader
+	paths    []string
+	interval time.Duration
+	stop     <-chan struct{}
+}
+
+// Start implements source.Source
+func (s *reloadSource) Start(_ crthandler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	dirs := reloadDirs(s.paths)
+	last := latestChange(dirs)
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			changed := latestChange(dirs)
+			if !changed.After(last) {
+				continue
+			}
+			last = changed
+			logrus.Infof("Content of %v changed, reconciling its resources", s.gvk)
+			ul := &unstructured.UnstructuredList{}
+			ul.SetGroupVersionKind(s.gvk)
+			if err := s.reader.List(context.TODO(), &client.ListOptions{}, ul); err != nil {
+				logrus.Warningf("unable to list %v to reload: %v", s.gvk, err)
+				continue
+			}
+			for _, u := range ul.Items {
+				q.Add(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}})
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadDirs returns the directories to watch for paths: roles themselves,
+// and the directories playbooks are in.
+func reloadDirs(paths []string) []string {
+	seen := map[string]bool{}
+	dirs := []string{}
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			p = filepath.Dir(p)
+		}
+		if !seen[p] {
+			seen[p] = true
+			dirs = append(dirs, p)
+		}
+	}
+	return dirs
+}
+
+// latestChange returns the latest modification time of the files and
+// directories below dirs, skipping hidden ones such as .git. Directories are
+// included so that removed files count as changes.
+func latestChange(dirs []string) time.Time {
+	latest := time.Time{}
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if path != dir && strings.HasPrefix(fi.Name(), ".") {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fi.ModTime().After(latest) {
+				latest = fi.ModTime()
+			}
+			return nil
+		})
+	}
+	return latest
+}
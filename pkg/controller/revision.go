@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// RerunAnnotation, set to a new value on a resource of a one-shot watch,
+// runs its playbook again.
+const RerunAnnotation = "operator.ansible.io/rerun"
+
+// ReconcileNowAnnotation, set to a new value on a resource, runs it right
+// away, even if its watch is one-shot and it has run, it is degraded, or it is
+// in its cooldown. The value last handled is kept in status.reconcileNow.
+const ReconcileNowAnnotation = "operator.ansible.io/reconcile-now"
+
+// reconcileNowRequested reports whether the ReconcileNowAnnotation of u was
+// set to a value no run has handled yet.
+func reconcileNowRequested(u *unstructured.Unstructured) bool {
+	nonce := u.GetAnnotations()[ReconcileNowAnnotation]
+	if nonce == "" {
+		return false
+	}
+	status, _ := u.Object["status"].(map[string]interface{})
+	return status["reconcileNow"] != nonce
+}
+
+// SuccessfulRun - the revision of a resource the last successful run
+// applied, written to status.lastSuccessful.
+type SuccessfulRun struct {
+	Generation int64  `json:"generation"`
+	SpecHash   string `json:"specHash"`
+	Time       string `json:"time"`
+	// Rerun is the value of the RerunAnnotation at the time of the run.
+	Rerun string `json:"rerun,omitempty"`
+}
+
+// NewSuccessfulRun returns the revision of u, which a run has just applied.
+func NewSuccessfulRun(u *unstructured.Unstructured) SuccessfulRun {
+	return SuccessfulRun{
+		Generation: u.GetGeneration(),
+		SpecHash:   specHash(u),
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Rerun:      u.GetAnnotations()[RerunAnnotation],
+	}
+}
+
+// specHash returns the SHA-256 of the JSON encoding of the spec of u.
+func specHash(u *unstructured.Unstructured) string {
+	spec, err := json.Marshal(u.Object["spec"])
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(spec)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// successfulRunFromMap converts status.lastSuccessful as read from the API
+// server back into a SuccessfulRun, or nil if it is not set.
+func successfulRunFromMap(v interface{}) *SuccessfulRun {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	s := &SuccessfulRun{}
+	if g, ok := toFloat(m["generation"]); ok {
+		s.Generation = int64(g)
+	}
+	s.SpecHash, _ = m["specHash"].(string)
+	s.Time, _ = m["time"].(string)
+	s.Rerun, _ = m["rerun"].(string)
+	return s
+}
+
+func (s SuccessfulRun) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"generation": s.Generation,
+		"specHash":   s.SpecHash,
+		"time":       s.Time,
+	}
+	if s.Rerun != "" {
+		m["rerun"] = s.Rerun
+	}
+	return m
+}
+
+// hasRun reports whether a run has succeeded for the current spec of u, and
+// since its RerunAnnotation was last changed. The spec hash is compared
+// rather than the generation, which CRDs without a status subresource also
+// increment on status writes.
+func hasRun(u *unstructured.Unstructured) bool {
+	status, ok := u.Object["status"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	s := successfulRunFromMap(status["lastSuccessful"])
+	return s != nil && s.SpecHash == specHash(u) && s.Rerun == u.GetAnnotations()[RerunAnnotation]
+}
+
+// generationLag returns the number of generations of u no run has applied
+// successfully yet, or its generation if none ever did.
+func generationLag(u *unstructured.Unstructured) int64 {
+	applied := int64(0)
+	if status, ok := u.Object["status"].(map[string]interface{}); ok {
+		if s := successfulRunFromMap(status["lastSuccessful"]); s != nil {
+			applied = s.Generation
+		}
+	}
+	if lag := u.GetGeneration() - applied; lag > 0 {
+		return lag
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The reasons runs fail for, in RunError.Reason.
+const (
+	// ReasonModuleError - a task failed.
+	ReasonModuleError = "ModuleError"
+	// ReasonUnreachable - a host could not be reached.
+	ReasonUnreachable = "Unreachable"
+	// ReasonTimeout - a task timed out.
+	ReasonTimeout = "Timeout"
+	// ReasonInvalidSpec - a fail, assert or validate_argument_spec task
+	// rejected the input of the run.
+	ReasonInvalidSpec = "InvalidSpec"
+	// ReasonSyntaxError - ansible could not load the playbook or a role.
+	ReasonSyntaxError = "SyntaxError"
+)
+
+// RunError - why a run failed, classified from its job events.
+type RunError struct {
+	Reason  string
+	Task    string
+	Module  string
+	Host    string
+	Message string
+}
+
+func (e *RunError) Error() string {
+	msg := e.Reason
+	if e.Task != "" {
+		msg += fmt.Sprintf(": task %q", e.Task)
+		if e.Host != "" {
+			msg += " on " + e.Host
+		}
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Terminal reports whether the run fails the same way until the spec or
+// the content of the watch changes, so retrying is pointless. Other
+// failures are retried with backoff.
+func (e *RunError) Terminal() bool {
+	return e.Reason == ReasonInvalidSpec || e.Reason == ReasonSyntaxError
+}
+
+// IsTerminal reports whether err is a terminal RunError.
+func IsTerminal(err error) bool {
+	e, ok := err.(*RunError)
+	return ok && e.Terminal()
+}
+
+// specModules are the modules rejecting the input of a run.
+var specModules = map[string]bool{
+	"fail":                                   true,
+	"assert":                                 true,
+	"validate_argument_spec":                 true,
+	"ansible.builtin.fail":                   true,
+	"ansible.builtin.assert":                 true,
+	"ansible.builtin.validate_argument_spec": true,
+}
+
+var (
+	timedOut = regexp.MustCompile(`(?i)timed out|timeout`)
+	ansiCode = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// failureClassifier finds the RunError of a run in its job events: the first
+// task failure, or the error ansible printed before running anything. It
+// keeps the output of ansible around it.
+type failureClassifier struct {
+	err    *RunError
+	output failureOutput
+}
+
+func (f *failureClassifier) handle(e eventapi.JobEvent) {
+	f.output.add(e, f.err != nil)
+	if f.err != nil {
+		return
+	}
+	switch e.Event {
+	case "runner_on_failed", "runner_on_unreachable":
+		if ignored, _ := e.EventData["ignore_errors"].(bool); ignored {
+			return
+		}
+		err := &RunError{Reason: ReasonModuleError, Message: taskError(e)}
+		err.Task, _ = e.EventData["task"].(string)
+		err.Host, _ = e.EventData["host"].(string)
+		action, _ := e.EventData["task_action"].(string)
+		err.Module = action
+		switch {
+		case e.Event == "runner_on_unreachable":
+			err.Reason = ReasonUnreachable
+		case specModules[action]:
+			err.Reason = ReasonInvalidSpec
+		case timedOut.MatchString(err.Message):
+			err.Reason = ReasonTimeout
+		}
+		if len(err.Message) > maxTaskErrorLength {
+			err.Message = err.Message[:maxTaskErrorLength] + "..."
+		}
+		f.err = err
+	case "verbose":
+		// e.g. "ERROR! 'hsots' is not a valid attribute for a Play"
+		out := strings.TrimSpace(ansiCode.ReplaceAllString(e.StdOut, ""))
+		if strings.HasPrefix(out, "ERROR!") {
+			msg := strings.TrimSpace(strings.TrimPrefix(out, "ERROR!"))
+			if len(msg) > maxTaskErrorLength {
+				msg = msg[:maxTaskErrorLength] + "..."
+			}
+			f.err = &RunError{Reason: ReasonSyntaxError, Message: msg}
+		}
+	}
+}
+
+// TerminalFailure - the terminal RunError of the last run of a resource,
+// written to status.terminalFailure. The resource is not run again until its
+// spec or RetryAnnotation changes, or the operator restarts, e.g. with fixed
+// content.
+type TerminalFailure struct {
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+	SpecHash string `json:"specHash"`
+	Retry    string `json:"retry,omitempty"`
+	// Instance identifies the operator process that recorded the failure.
+	Instance string `json:"instance"`
+}
+
+// operatorInstance identifies this operator process in TerminalFailures.
+var operatorInstance = runner.NewIdent()
+
+func newTerminalFailure(u *unstructured.Unstructured, err *RunError) TerminalFailure {
+	return TerminalFailure{
+		Reason:   err.Reason,
+		Message:  err.Error(),
+		SpecHash: specHash(u),
+		Retry:    u.GetAnnotations()[RetryAnnotation],
+		Instance: operatorInstance,
+	}
+}
+
+func terminalFailureFromStatus(u *unstructured.Unstructured) *TerminalFailure {
+	status, _ := u.Object["status"].(map[string]interface{})
+	m, ok := status["terminalFailure"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	f := &TerminalFailure{}
+	f.Reason, _ = m["reason"].(string)
+	f.Message, _ = m["message"].(string)
+	f.SpecHash, _ = m["specHash"].(string)
+	f.Retry, _ = m["retry"].(string)
+	f.Instance, _ = m["instance"].(string)
+	return f
+}
+
+func (f TerminalFailure) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"reason":   f.Reason,
+		"message":  f.Message,
+		"specHash": f.SpecHash,
+		"instance": f.Instance,
+	}
+	if f.Retry != "" {
+		m["retry"] = f.Retry
+	}
+	return m
+}
+
+// current reports whether the failure still holds for u: neither its spec
+// nor its RetryAnnotation changed, and this operator recorded it.
+func (f *TerminalFailure) current(u *unstructured.Unstructured) bool {
+	return f != nil && f.Instance == operatorInstance && f.SpecHash == specHash(u) && f.Retry == u.GetAnnotations()[RetryAnnotation]
+}
+
+// condition returns the Degraded condition of the failure.
+func (f TerminalFailure) condition() condition {
+	return condition{
+		Type:     DegradedCondition,
+		Status:   "True",
+		Reason:   f.Reason,
+		Message:  fmt.Sprintf("%s; retries are stopped until the spec changes or the %s annotation is set to a new value", f.Message, RetryAnnotation),
+		Negative: true,
+	}
+}
@@ -0,0 +1,307 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// RunsAPIPath is the path the runs API is served at.
+const RunsAPIPath = "/runs"
+
+const (
+	// maxLoggedRuns is the number of runs a RunLog keeps.
+	maxLoggedRuns = 1000
+	// defaultRunsListed is the number of runs listed unless the request sets
+	// a limit.
+	defaultRunsListed = 100
+	// runsReviewTTL is how long the authentication and authorization of a
+	// token are reused.
+	runsReviewTTL = 10 * time.Second
+)
+
+// RunSummary - a run, as listed by the runs API.
+type RunSummary struct {
+	Group     string `json:"group"`
+	Version   string `json:"version"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Generation is that of the resource as the run applied it.
+	Generation int64 `json:"generation"`
+	RunRecord  `json:",inline"`
+	// Finalizer is set for runs of the finalizer of a deleted resource.
+	Finalizer bool `json:"finalizer,omitempty"`
+	// Artifacts links to the artifacts of the run, if they are uploaded to
+	// a store that has links.
+	Artifacts string `json:"artifacts,omitempty"`
+}
+
+// artifactLinker is implemented by ArtifactUploaders whose artifacts can be
+// linked to.
+type artifactLinker interface {
+	ArtifactURL(gvk schema.GroupVersionKind, namespace, name, ident string) string
+}
+
+// RunLog - the last runs of every controller, newest last, as listed by the
+// runs API.
+type RunLog struct {
+	mutex sync.RWMutex
+	runs  []RunSummary
+	// linker, if set, links the runs to their artifacts.
+	linker artifactLinker
+}
+
+// NewRunLog returns a RunLog linking runs to the artifacts uploaded by
+// artifacts, if it can.
+func NewRunLog(artifacts runner.ArtifactUploader) *RunLog {
+	l := &RunLog{}
+	l.linker, _ = artifacts.(artifactLinker)
+	return l
+}
+
+// Record adds the run of u with result to the log; it can be passed as the
+// PostReconcile of controllers.
+func (l *RunLog) Record(u *unstructured.Unstructured, result RunResult) {
+	gvk := u.GroupVersionKind()
+	s := RunSummary{
+		Group:      gvk.Group,
+		Version:    gvk.Version,
+		Kind:       gvk.Kind,
+		Namespace:  u.GetNamespace(),
+		Name:       u.GetName(),
+		Generation: u.GetGeneration(),
+		RunRecord:  result.RunRecord,
+		Finalizer:  result.Finalizer,
+	}
+	if l.linker != nil && s.Ident != "" {
+		s.Artifacts = l.linker.ArtifactURL(gvk, s.Namespace, s.Name, s.Ident)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.runs = append(l.runs, s)
+	if len(l.runs) > maxLoggedRuns {
+		l.runs = append([]RunSummary(nil), l.runs[len(l.runs)-maxLoggedRuns:]...)
+	}
+}
+
+// runFilter - the runs a request to the runs API lists.
+type runFilter struct {
+	namespace, name, kind, result string
+	limit                         int
+}
+
+func (f runFilter) matches(s RunSummary) bool {
+	kind := s.Kind
+	if strings.Contains(f.kind, ".") {
+		kind = s.Kind + "." + s.Group
+	}
+	return (f.namespace == "" || f.namespace == s.Namespace) &&
+		(f.name == "" || f.name == s.Name) &&
+		(f.kind == "" || strings.EqualFold(f.kind, kind)) &&
+		(f.result == "" || f.result == s.Result)
+}
+
+// list returns the last runs matching f, newest first.
+func (l *RunLog) list(f runFilter) []RunSummary {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	runs := []RunSummary{}
+	for i := len(l.runs) - 1; i >= 0 && len(runs) < f.limit; i-- {
+		if f.matches(l.runs[i]) {
+			runs = append(runs, l.runs[i])
+		}
+	}
+	return runs
+}
+
+// RunsAPIOptions - options for the HTTP API listing the last runs of the
+// operator
+type RunsAPIOptions struct {
+	// Addr is the address the API is served on, over TLS.
+	Addr string
+	// CertDir holds the tls.crt and tls.key the API is served with. They are
+	// read again when tls.crt changes.
+	CertDir string
+	// Log is the log of the runs listed, which the controllers must record
+	// their runs in.
+	Log *RunLog
+}
+
+// AddRunsAPI serves the runs of options.Log at RunsAPIPath, as JSON, newest
+// first, filtered by the namespace, name, kind (Kind or Kind.group) and
+// result query parameters, at most limit of them. Requests must carry the
+// bearer token of a user allowed to get the non-resource URL /runs, as
+// checked with a TokenReview and a SubjectAccessReview.
+func AddRunsAPI(mgr manager.Manager, options RunsAPIOptions) error {
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	return mgr.Add(&runsAPI{
+		addr:      options.Addr,
+		certs:     &certReloader{dir: options.CertDir},
+		log:       options.Log,
+		clientset: clientset,
+		reviews:   map[string]runsReview{},
+	})
+}
+
+type runsAPI struct {
+	addr      string
+	certs     *certReloader
+	log       *RunLog
+	clientset kubernetes.Interface
+
+	mutex   sync.Mutex
+	reviews map[string]runsReview
+}
+
+// runsReview is the outcome of the review of a token.
+type runsReview struct {
+	user    string
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+// Start implements manager.Runnable. It serves the API until stop is
+// closed.
+func (a *runsAPI) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(RunsAPIPath, a)
+	server := &http.Server{
+		Addr:      a.addr,
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: a.certs.getCertificate},
+	}
+	go func() {
+		<-stop
+		server.Close()
+	}()
+	logrus.Infof("Serving the runs API on %s%s", a.addr, RunsAPIPath)
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (a *runsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+		return
+	}
+	review, err := a.review(token)
+	if err != nil {
+		logrus.Errorf("Unable to review a request to the runs API: %v", err)
+		http.Error(w, "unable to authenticate the request", http.StatusInternalServerError)
+		return
+	}
+	if review.user == "" {
+		http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	if !review.allowed {
+		msg := fmt.Sprintf("%s cannot get %s", review.user, RunsAPIPath)
+		if review.reason != "" {
+			msg += ": " + review.reason
+		}
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+
+	q := req.URL.Query()
+	f := runFilter{
+		namespace: q.Get("namespace"),
+		name:      q.Get("name"),
+		kind:      q.Get("kind"),
+		result:    q.Get("result"),
+		limit:     defaultRunsListed,
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		f.limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"runs": a.log.list(f)}); err != nil {
+		logrus.Warningf("Unable to write the response of the runs API: %v", err)
+	}
+}
+
+// review authenticates token, and authorizes its user to get RunsAPIPath.
+// The user of the review is empty if token is invalid.
+func (a *runsAPI) review(token string) (runsReview, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	a.mutex.Lock()
+	r, ok := a.reviews[key]
+	a.mutex.Unlock()
+	if ok && time.Now().Before(r.expires) {
+		return r, nil
+	}
+
+	tr, err := a.clientset.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return r, err
+	}
+	r = runsReview{}
+	if tr.Status.Authenticated {
+		user := tr.Status.User
+		extra := map[string]authorizationv1.ExtraValue{}
+		for k, v := range user.Extra {
+			extra[k] = authorizationv1.ExtraValue(v)
+		}
+		sar, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:                  user.Username,
+				UID:                   user.UID,
+				Groups:                user.Groups,
+				Extra:                 extra,
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{Path: RunsAPIPath, Verb: "get"},
+			},
+		})
+		if err != nil {
+			return r, err
+		}
+		r.user, r.allowed, r.reason = user.Username, sar.Status.Allowed, sar.Status.Reason
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	for k, c := range a.reviews {
+		if now.After(c.expires) {
+			delete(a.reviews, k)
+		}
+	}
+	r.expires = now.Add(runsReviewTTL)
+	a.reviews[key] = r
+	return r, nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 )
@@ -18,6 +19,9 @@ type ReconcileLoop struct {
 	GVK      schema.GroupVersionKind
 	Interval time.Duration
 	Client   client.Client
+	// Cache, if set, is listed instead of the API server once the informer
+	// for the GVK has synced.
+	Cache cache.Cache
 }
 
 // NewReconcileLoop - loop for a GVK.
@@ -42,15 +46,16 @@ func (r *ReconcileLoop) Start() {
 				// List all object for the GVK
 				ul := &unstructured.UnstructuredList{}
 				ul.SetGroupVersionKind(r.GVK)
-				err := r.Client.List(context.Background(), nil, ul)
+				err := r.reader().List(context.Background(), nil, ul)
 				if err != nil {
 					logrus.Warningf("unable to list resources for GV: %v during reconcilation", r.GVK)
 					continue
 				}
-				for _, u := range ul.Items {
+				for i := range ul.Items {
+					u := &ul.Items[i]
 					e := event.GenericEvent{
-						Meta:   &u,
-						Object: &u,
+						Meta:   u,
+						Object: u,
 					}
 					r.Source <- e
 				}
@@ -60,3 +65,19 @@ func (r *ReconcileLoop) Start() {
 		}
 	}()
 }
+
+// reader returns the cache if its informer for the GVK has synced, and the
+// client otherwise.
+func (r *ReconcileLoop) reader() client.Reader {
+	if r.Cache == nil {
+		return r.Client
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(r.GVK)
+	i, err := r.Cache.GetInformer(u)
+	if err != nil || !i.HasSynced() {
+		logrus.Debugf("cache for %v is not synced, listing from the API server", r.GVK)
+		return r.Client
+	}
+	return r.Cache
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// targetClusterKubeconfig writes the kubeconfig of the cluster that u should
+// be reconciled against to a temporary file and returns its path. An empty
+// path means that u is reconciled against the local cluster.
+func targetClusterKubeconfig(c client.Client, u *unstructured.Unstructured, t *runner.TargetCluster) (string, error) {
+	key := types.NamespacedName{Namespace: t.SecretNamespace, Name: t.SecretName}
+	if t.SpecField != "" {
+		v, found, err := unstructured.NestedString(u.Object, t.SpecFieldPath()...)
+		if err != nil {
+			return "", fmt.Errorf("invalid target cluster field %s: %v", t.SpecField, err)
+		}
+		if found && v != "" {
+			key = specSecretKey(u, v, t.SecretNamespace)
+		}
+	}
+	if key.Name == "" {
+		return "", nil
+	}
+	if key.Namespace == "" {
+		key.Namespace = u.GetNamespace()
+	}
+
+	secret := &unstructured.Unstructured{}
+	secret.SetGroupVersionKind(secretGVK)
+	if err := c.Get(context.TODO(), key, secret); err != nil {
+		return "", fmt.Errorf("unable to get target cluster Secret %v: %v", key, err)
+	}
+	encoded, found, err := unstructured.NestedString(secret.Object, "data", t.Key)
+	if err != nil || !found {
+		return "", fmt.Errorf("target cluster Secret %v has no key %s", key, t.Key)
+	}
+	kubeconfig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid kubeconfig in target cluster Secret %v: %v", key, err)
+	}
+
+	file, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(kubeconfig); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// TaskFailedReason is the reason of the Events recorded for failed tasks.
+const TaskFailedReason = "TaskFailed"
+
+const (
+	// taskFailureBurst is the number of Events of failed tasks a resource
+	// gets at once, after which it gets one every taskFailureInterval.
+	taskFailureBurst    = 5
+	taskFailureInterval = time.Minute
+	// maxTaskErrorLength bounds the error message quoted in an Event.
+	maxTaskErrorLength = 512
+)
+
+// taskFailures records a Warning Event on a resource for every task of its
+// runs that failed, naming the task, its module, its host and its error, so
+// failures show in kubectl describe. Events are rate-limited per resource so
+// a loop failing for every item does not flood the API server.
+type taskFailures struct {
+	mutex    sync.Mutex
+	limiters map[types.NamespacedName]*rate.Limiter
+}
+
+func newTaskFailures() *taskFailures {
+	return &taskFailures{limiters: map[types.NamespacedName]*rate.Limiter{}}
+}
+
+// handle records the Event of e on u, if e is of a failed task.
+func (t *taskFailures) handle(recorder record.EventRecorder, u *unstructured.Unstructured, e eventapi.JobEvent, ident string) {
+	if t == nil || recorder == nil {
+		return
+	}
+	if e.Event != "runner_on_failed" && e.Event != "runner_on_unreachable" {
+		return
+	}
+	if ignored, _ := e.EventData["ignore_errors"].(bool); ignored {
+		return
+	}
+	if !t.allow(types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}) {
+		return
+	}
+	recorder.Event(u, "Warning", TaskFailedReason, taskFailureMessage(e, ident))
+}
+
+func (t *taskFailures) allow(nn types.NamespacedName) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, ok := t.limiters[nn]
+	if !ok {
+		l = rate.NewLimiter(rate.Every(taskFailureInterval), taskFailureBurst)
+		t.limiters[nn] = l
+	}
+	return l.Allow()
+}
+
+// forget drops the rate limit of nn, once it is deleted.
+func (t *taskFailures) forget(nn types.NamespacedName) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.limiters, nn)
+}
+
+// taskFailureMessage returns the message of the Event of the failed task of
+// e, e.g. `task "create deployment" (k8s) failed on localhost: ...`.
+func taskFailureMessage(e eventapi.JobEvent, ident string) string {
+	task, _ := e.EventData["task"].(string)
+	action, _ := e.EventData["task_action"].(string)
+	host, _ := e.EventData["host"].(string)
+	verb := "failed"
+	if e.Event == "runner_on_unreachable" {
+		verb = "is unreachable"
+	}
+	msg := fmt.Sprintf("task %q", task)
+	if action != "" {
+		msg += fmt.Sprintf(" (%s)", action)
+	}
+	if host != "" {
+		msg += fmt.Sprintf(" %s on %s", verb, host)
+	} else {
+		msg += " " + verb
+	}
+	if err := taskError(e); err != "" {
+		if len(err) > maxTaskErrorLength {
+			err = err[:maxTaskErrorLength] + "..."
+		}
+		msg += ": " + err
+	}
+	return fmt.Sprintf("%s (run %s)", msg, ident)
+}
+
+// taskError returns the error a failed task reported in its result.
+func taskError(e eventapi.JobEvent) string {
+	res, _ := e.EventData["res"].(map[string]interface{})
+	for _, key := range []string{"msg", "reason", "stderr"} {
+		if s, ok := res[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
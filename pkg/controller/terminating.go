@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// namespaceCheckInterval is how long the state of a namespace is assumed to
+// stay as it was read.
+const namespaceCheckInterval = 30 * time.Second
+
+// terminatingNamespaces reports the namespaces being deleted, whose
+// resources are not run but to run their finalizer: the runs would fail
+// against a namespace half torn down. Namespaces are read from the API
+// server as needed, rather than watched, so the operator needs no access to
+// the namespaces it does not reconcile resources in.
+type terminatingNamespaces struct {
+	client  kubernetes.Interface
+	mutex   sync.Mutex
+	checked map[string]namespaceCheck
+	warned  bool
+}
+
+type namespaceCheck struct {
+	terminating bool
+	at          time.Time
+}
+
+func newTerminatingNamespaces(client kubernetes.Interface) *terminatingNamespaces {
+	return &terminatingNamespaces{client: client, checked: map[string]namespaceCheck{}}
+}
+
+// contains reports whether namespace is being deleted. Namespaces that
+// cannot be read are assumed active.
+func (t *terminatingNamespaces) contains(namespace string) bool {
+	if t == nil || namespace == "" {
+		return false
+	}
+	t.mutex.Lock()
+	c, ok := t.checked[namespace]
+	t.mutex.Unlock()
+	if ok && time.Since(c.at) < namespaceCheckInterval {
+		return c.terminating
+	}
+
+	ns, err := t.client.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c = namespaceCheck{at: time.Now()}
+	switch {
+	case apierrors.IsNotFound(err):
+		c.terminating = true
+	case err != nil:
+		if !t.warned {
+			logrus.Warnf("Unable to read namespace %s, resources in terminating namespaces are run: %v", namespace, err)
+			t.warned = true
+		}
+	default:
+		c.terminating = ns.GetDeletionTimestamp() != nil || ns.Status.Phase == corev1.NamespaceTerminating
+	}
+	t.checked[namespace] = c
+	return c.terminating
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"github.com/water-hole/ansible-operator/pkg/tracing"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// envRunner is implemented by runners that accept extra environment
+// variables for a run.
+type envRunner interface {
+	RunWithEnv(ctx context.Context, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}, env map[string]string) (chan eventapi.JobEvent, error)
+}
+
+// runSpans records a span for every play and task of a run, as children of
+// the reconcile's span, timed by the job events.
+type runSpans struct {
+	tracer *tracing.Tracer
+	root   *tracing.Span
+	play   *tracing.Span
+	task   *tracing.Span
+}
+
+func (s *runSpans) handle(e eventapi.JobEvent) {
+	if s.tracer == nil {
+		return
+	}
+	t := e.Created.Time
+	switch e.Event {
+	case "playbook_on_play_start":
+		s.endTask(t)
+		s.endPlay(t)
+		name, _ := e.EventData["play"].(string)
+		s.play = s.tracer.StartAt(fmt.Sprintf("play %s", name), s.root, t)
+	case "playbook_on_task_start", "playbook_on_handler_task_start":
+		s.endTask(t)
+		parent := s.play
+		if parent == nil {
+			parent = s.root
+		}
+		name, _ := e.EventData["task"].(string)
+		s.task = s.tracer.StartAt(fmt.Sprintf("task %s", name), parent, t)
+		for _, k := range []string{"role", "task_action"} {
+			if v, ok := e.EventData[k].(string); ok && v != "" {
+				s.task.SetAttribute("ansible."+k, v)
+			}
+		}
+	case "runner_on_failed":
+		if e.EventData["ignore_errors"] == true {
+			return
+		}
+		msg := "task failed"
+		if res, ok := e.EventData["res"].(map[string]interface{}); ok {
+			if m, ok := res["msg"].(string); ok {
+				msg = m
+			}
+		}
+		s.task.SetError(msg)
+		s.play.SetError(msg)
+	case "playbook_on_stats":
+		s.endTask(t)
+		s.endPlay(t)
+	}
+}
+
+// finish ends the spans still open, e.g. when the run was cut short.
+func (s *runSpans) finish() {
+	now := time.Now()
+	s.endTask(now)
+	s.endPlay(now)
+}
+
+func (s *runSpans) endTask(t time.Time) {
+	s.task.EndAt(t)
+	s.task = nil
+}
+
+func (s *runSpans) endPlay(t time.Time) {
+	s.play.EndAt(t)
+	s.play = nil
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// watchTriggers adds a watch to c for each of the runner's triggers, and
+// their kinds to kinds.
+func watchTriggers(mgr manager.Manager, c controller.Controller, gvk schema.GroupVersionKind, triggers []runner.Trigger, kinds *proxy.KindSet) error {
+	for _, t := range triggers {
+		selector, err := t.LabelSelector()
+		if err != nil {
+			return err
+		}
+		tgvk := t.GroupVersionKind()
+		logrus.Infof("Watching %v as a trigger for %v", tgvk, gvk)
+		mgr.GetScheme().AddKnownTypeWithName(tgvk, &unstructured.Unstructured{})
+		metav1.AddToGroupVersion(mgr.GetScheme(), tgvk.GroupVersion())
+
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(tgvk)
+		m := &triggerMapper{
+			trigger:  t,
+			selector: selector,
+			primary:  gvk,
+			client:   mgr.GetClient(),
+		}
+		if err := c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestsFromMapFunc{ToRequests: m}); err != nil {
+			return err
+		}
+		kinds.Add(tgvk)
+	}
+	return nil
+}
+
+// triggerMapper maps an event on a trigger resource to requests for the
+// primary resources it affects.
+type triggerMapper struct {
+	trigger  runner.Trigger
+	selector labels.Selector
+	primary  schema.GroupVersionKind
+	client   client.Client
+}
+
+// Map implements handler.Mapper
+func (m *triggerMapper) Map(o crthandler.MapObject) []reconcile.Request {
+	if m.trigger.Name != "" && o.Meta.GetName() != m.trigger.Name {
+		return nil
+	}
+	if !m.selector.Matches(labels.Set(o.Meta.GetLabels())) {
+		return nil
+	}
+
+	switch m.trigger.Mapping {
+	case runner.MappingLabel:
+		name := o.Meta.GetLabels()[m.trigger.Label]
+		if name == "" {
+			return nil
+		}
+		return []reconcile.Request{newRequest(o.Meta.GetNamespace(), name)}
+	case runner.MappingJSONPath:
+		return m.mapJSONPath(o)
+	default:
+		return []reconcile.Request{newRequest(o.Meta.GetNamespace(), o.Meta.GetName())}
+	}
+}
+
+// mapJSONPath finds the primary resources in the trigger's namespace that
+// refer to the trigger by name.
+func (m *triggerMapper) mapJSONPath(o crthandler.MapObject) []reconcile.Request {
+	ul := &unstructured.UnstructuredList{}
+	ul.SetGroupVersionKind(m.primary)
+	if err := m.client.List(context.TODO(), client.InNamespace(o.Meta.GetNamespace()), ul); err != nil {
+		logrus.Warningf("unable to list %v to map trigger %s/%s: %v", m.primary, o.Meta.GetNamespace(), o.Meta.GetName(), err)
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, u := range ul.Items {
+		for _, v := range m.trigger.JSONPathValues(u.Object) {
+			if v == o.Meta.GetName() {
+				requests = append(requests, newRequest(u.GetNamespace(), u.GetName()))
+				break
+			}
+		}
+	}
+	return requests
+}
+
+func newRequest(namespace, name string) reconcile.Request {
+	return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}
+}
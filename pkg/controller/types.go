@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"time"
+
 	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
 )
 
@@ -82,8 +84,93 @@ func NewStatusFromMap(sm map[string]interface{}) Status {
 
 type ResourceStatus struct {
 	Status         `json:",inline"`
-	FailureMessage string   `json:"reason,omitempty"`
-	History        []Status `json:"history,omitempty"`
+	FailureMessage string         `json:"reason,omitempty"`
+	History        []RunRecord    `json:"history,omitempty"`
+	LastTask       *TaskProgress  `json:"lastTask,omitempty"`
+	Progress       *RunProgress   `json:"progress,omitempty"`
+	LastDiff       []ResourceDiff `json:"lastDiff,omitempty"`
+	LastSuccessful *SuccessfulRun `json:"lastSuccessful,omitempty"`
+}
+
+// TaskProgress - the task a run is executing, or last executed, as reported
+// by the operator_progress callback plugin.
+type TaskProgress struct {
+	Name      string `json:"name"`
+	Role      string `json:"role,omitempty"`
+	Play      string `json:"play,omitempty"`
+	Number    int    `json:"number"`
+	StartedAt string `json:"startedAt"`
+	// Total is the number of tasks in the playbook, or 0 if unknown.
+	Total int `json:"-"`
+}
+
+// RunProgress - how far a run has come, written to status.progress.
+type RunProgress struct {
+	Completed int `json:"completed"`
+	// Total is an estimate, as tasks of dynamic includes are only counted
+	// once they run. It is omitted if the playbook could not be counted.
+	Total       int    `json:"total,omitempty"`
+	CurrentTask string `json:"currentTask,omitempty"`
+}
+
+// NewRunProgress returns the progress of a run executing task t. If finished,
+// the run is over and every task it reached has completed.
+func NewRunProgress(t TaskProgress, finished bool) RunProgress {
+	p := RunProgress{Completed: t.Number - 1, Total: t.Total, CurrentTask: t.Name}
+	if finished {
+		p.Completed = t.Number
+		p.CurrentTask = ""
+	}
+	if p.Total > 0 && p.Completed > p.Total {
+		// handlers and included tasks are not counted in the total
+		p.Total = p.Completed
+	}
+	return p
+}
+
+func (p RunProgress) toMap() map[string]interface{} {
+	m := map[string]interface{}{"completed": int64(p.Completed)}
+	if p.Total > 0 {
+		m["total"] = int64(p.Total)
+	}
+	if p.CurrentTask != "" {
+		m["currentTask"] = p.CurrentTask
+	}
+	return m
+}
+
+// NewTaskProgressFromJobEvent returns the task progress reported by e. ok is
+// false if e is not a task progress event.
+func NewTaskProgressFromJobEvent(e eventapi.JobEvent) (TaskProgress, bool) {
+	if e.Event != eventapi.EventTaskProgress {
+		return TaskProgress{}, false
+	}
+	p := TaskProgress{StartedAt: e.Created.UTC().Format(time.RFC3339)}
+	p.Name, _ = e.EventData["task"].(string)
+	p.Role, _ = e.EventData["role"].(string)
+	p.Play, _ = e.EventData["play"].(string)
+	if n, ok := e.EventData["task_number"].(float64); ok {
+		p.Number = int(n)
+	}
+	if n, ok := e.EventData["total_tasks"].(float64); ok {
+		p.Total = int(n)
+	}
+	return p, true
+}
+
+func (p TaskProgress) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"name":      p.Name,
+		"number":    int64(p.Number),
+		"startedAt": p.StartedAt,
+	}
+	if p.Role != "" {
+		m["role"] = p.Role
+	}
+	if p.Play != "" {
+		m["play"] = p.Play
+	}
+	return m
 }
 
 func UpdateResourceStatus(sm map[string]interface{}, je eventapi.StatusJobEvent) (bool, ResourceStatus) {
@@ -94,18 +181,9 @@ func UpdateResourceStatus(sm map[string]interface{}, je eventapi.StatusJobEvent)
 		return false, ResourceStatus{}
 	}
 
-	history := []Status{}
-	h, ok := sm["history"]
-	if ok {
-		hi := h.([]interface{})
-		for _, m := range hi {
-			ma := m.(map[string]interface{})
-			history = append(history, NewStatusFromMap(ma))
-		}
-	}
-	history = append(history, oldStatus)
+	// the reconciler appends the run to the history
 	return true, ResourceStatus{
 		Status:  newStatus,
-		History: history,
+		History: runRecordsFromSlice(sm["history"]),
 	}
 }
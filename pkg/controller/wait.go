@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const (
+	// initialAvailabilityDelay is the first delay between two checks for a
+	// GVK that is not served yet. It doubles up to maxAvailabilityDelay.
+	initialAvailabilityDelay = 2 * time.Second
+	maxAvailabilityDelay     = 5 * time.Minute
+)
+
+// available reports whether the API server serves options.GVK. It is always
+// true if no RESTMapper was given, in which case a missing GVK fails the
+// controller's watch.
+func available(options Options) bool {
+	if options.RESTMapper == nil {
+		return true
+	}
+	ok, err := options.RESTMapper.Serves(options.GVK)
+	if err != nil {
+		logrus.Warningf("unable to check whether %v is served: %v", options.GVK, err)
+	}
+	return ok
+}
+
+// addWhenAvailable polls discovery with backoff until options.GVK is served,
+// and then creates its controller. It returns once the controller has been
+// added, or options.StopChannel is closed.
+func addWhenAvailable(mgr manager.Manager, options Options) {
+	delay := initialAvailabilityDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-options.StopChannel:
+			return
+		}
+		if err := options.RESTMapper.Reset(); err != nil {
+			logrus.Warningf("unable to refresh the API resources while waiting for %v: %v", options.GVK, err)
+		}
+		if available(options) {
+			logrus.Infof("%v is now served, starting its controller", options.GVK)
+			if _, err := add(mgr, options); err != nil {
+				logrus.Errorf("failed to start controller for %v: %v", options.GVK, err)
+			} else {
+				return
+			}
+		} else {
+			logrus.Warningf("%v is still not served by the API server, is its CRD installed? Retrying in %v", options.GVK, delay)
+		}
+		if delay *= 2; delay > maxAvailabilityDelay {
+			delay = maxAvailabilityDelay
+		}
+	}
+}
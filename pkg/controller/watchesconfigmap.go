@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// WatchesConfigMapKey is the key of the ConfigMap of AddWatchesConfigMap
+// holding the watches, in the format of the watches file.
+const WatchesConfigMapKey = "watches.yaml"
+
+// watchesConfigMapResync is how often the ConfigMap is applied again, to
+// retry the controllers that failed to start.
+const watchesConfigMapResync = time.Minute
+
+// WatchesConfigMapOptions - options for the controllers started from the
+// watches in a ConfigMap
+type WatchesConfigMapOptions struct {
+	// Template holds the options used for each controller started from the
+	// ConfigMap. Its GVK and Runner are set per watch.
+	Template Options
+	// Namespace and Name are those of the ConfigMap.
+	Namespace, Name string
+	// StaticGVKs are the GVKs watched otherwise, e.g. by Go controllers.
+	// The ConfigMap may not declare them.
+	StaticGVKs []schema.GroupVersionKind
+}
+
+// AddWatchesConfigMap starts an ansible controller for every watch in the
+// ConfigMap of options, and restarts and stops them as it changes: a
+// controller is restarted when its watch changes, including the defaults
+// merged into it, and stopped when its watch is removed or the ConfigMap is
+// deleted. While the ConfigMap does not parse, the controllers keep running
+// as they were.
+func AddWatchesConfigMap(mgr manager.Manager, options WatchesConfigMapOptions) error {
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	w := &watchesConfigMap{
+		mgr:       mgr,
+		clientset: clientset,
+		configMap: types.NamespacedName{Namespace: options.Namespace, Name: options.Name},
+		template:  options.Template,
+		static:    map[schema.GroupVersionKind]bool{},
+		active:    map[schema.GroupVersionKind]*dynamicController{},
+	}
+	for _, gvk := range options.StaticGVKs {
+		w.static[gvk] = true
+	}
+	return mgr.Add(w)
+}
+
+type watchesConfigMap struct {
+	mgr       manager.Manager
+	clientset kubernetes.Interface
+	configMap types.NamespacedName
+	template  Options
+	static    map[schema.GroupVersionKind]bool
+	mutex     sync.Mutex
+	active    map[schema.GroupVersionKind]*dynamicController
+}
+
+// Start implements manager.Runnable. It watches the ConfigMap until stop is
+// closed; the controllers started stop with the manager.
+func (w *watchesConfigMap) Start(stop <-chan struct{}) error {
+	lw := toolscache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "configmaps", w.configMap.Namespace,
+		fields.OneTermEqualSelector("metadata.name", w.configMap.Name))
+	_, informer := toolscache.NewInformer(lw, &corev1.ConfigMap{}, watchesConfigMapResync, toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { w.apply(obj) },
+		UpdateFunc: func(_, obj interface{}) { w.apply(obj) },
+		DeleteFunc: func(interface{}) { w.apply(nil) },
+	})
+	logrus.Infof("Reading the watches from ConfigMap %v", w.configMap)
+	informer.Run(stop)
+	return nil
+}
+
+// apply starts and stops controllers to match the watches of the ConfigMap
+// obj, nil if it was deleted.
+func (w *watchesConfigMap) apply(obj interface{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	data := ""
+	if cm, ok := obj.(*corev1.ConfigMap); ok {
+		data = cm.Data[WatchesConfigMapKey]
+	} else if len(w.active) > 0 {
+		logrus.Warningf("ConfigMap %v was deleted, stopping its watches", w.configMap)
+	}
+	entries, err := runner.SplitWatches([]byte(data))
+	if err != nil {
+		logrus.Errorf("Ignoring the watches in ConfigMap %v until they are fixed: %v", w.configMap, err)
+		return
+	}
+	desired := map[schema.GroupVersionKind]desiredWatch{}
+	for gvk, b := range entries {
+		if w.static[gvk] {
+			logrus.Errorf("Ignoring the watch of %v in ConfigMap %v: it is already watched by the operator", gvk, w.configMap)
+			continue
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(b))
+		if dc, ok := w.active[gvk]; ok && dc.hash == hash {
+			desired[gvk] = desiredWatch{hash: hash}
+			continue
+		}
+		runners, err := runner.NewFromWatchesData(b)
+		if err != nil {
+			logrus.Errorf("Ignoring the changes of the watch of %v in ConfigMap %v: %v", gvk, w.configMap, err)
+			if dc, ok := w.active[gvk]; ok {
+				// keeps running as it was
+				desired[gvk] = desiredWatch{hash: dc.hash}
+			}
+			continue
+		}
+		desired[gvk] = desiredWatch{runner: runners[gvk], hash: hash}
+	}
+
+	for gvk, dc := range w.active {
+		if dw, ok := desired[gvk]; ok && dw.hash == dc.hash {
+			continue
+		}
+		logrus.Infof("Stopping controller for %v from ConfigMap %v", gvk, w.configMap)
+		close(dc.stop)
+		delete(w.active, gvk)
+	}
+	for gvk, dw := range desired {
+		if _, ok := w.active[gvk]; ok {
+			continue
+		}
+		options := w.template
+		options.GVK = gvk
+		options.Runner = dw.runner
+		stop := make(chan struct{})
+		options.StopChannel = stop
+		if _, err := add(w.mgr, options); err != nil {
+			// retried as the ConfigMap is applied again
+			close(stop)
+			logrus.Errorf("failed to start controller for %v: %v", gvk, err)
+			continue
+		}
+		w.active[gvk] = &dynamicController{owner: w.configMap.String(), hash: dw.hash, stop: stop}
+	}
+}
@@ -0,0 +1,282 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ownedStatusFields are the fields of status written by the operator, as
+// opposed to those a playbook may set. Fields missing from it are dropped by
+// the resource writers, so the operator sets them with setStatusField, which
+// panics on those missing, and init checks those of ResourceStatus.
+var ownedStatusFields = []string{"ok", "changed", "skipped", "failures", "completion", "reason", "history", "lastTask", "progress", "lastDiff", "lastSuccessful", "failureStreak", "reconcileNow", "approved", "terminalFailure", "lastFailure", prunedStatusField}
+
+// sharedStatusFields are the fields of status the operator writes along with
+// playbooks. They are only written when set, and the operator sets them to
+// their latest value merged with its own entries.
+var sharedStatusFields = []string{"conditions"}
+
+func init() {
+	t := reflect.TypeOf(ResourceStatus{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" && !writtenStatusField(name) {
+			panic(fmt.Sprintf("status.%s of ResourceStatus is not written by the resource writers", name))
+		}
+	}
+}
+
+// writtenStatusField reports whether the resource writers write field of
+// status.
+func writtenStatusField(field string) bool {
+	for _, f := range append(ownedStatusFields, sharedStatusFields...) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// setStatusField sets field of status to value. It panics if the resource
+// writers would not write field, rather than dropping it silently.
+func setStatusField(status map[string]interface{}, field string, value interface{}) {
+	if !writtenStatusField(field) {
+		panic(fmt.Sprintf("status.%s is not in ownedStatusFields", field))
+	}
+	status[field] = value
+}
+
+// resourceWriter persists the status and finalizers the operator sets on a
+// resource being reconciled. Both update u to the resource as written.
+type resourceWriter interface {
+	// writeStatus writes the status fields the operator owns.
+	writeStatus(u *unstructured.Unstructured) error
+	// writeFinalizers adds or removes the operator's finalizer, as set on u.
+	writeFinalizers(u *unstructured.Unstructured) error
+}
+
+// patchWriter writes status with JSON merge patches of the fields the
+// operator owns, so that concurrent edits of the spec and status fields set
+// by playbooks are kept. Finalizers are patched with the resource version
+// they were read at, and patched again on a fresh copy on conflicts.
+type patchWriter struct {
+	client    rest.Interface
+	reader    client.Reader
+	resource  string
+	finalizer string
+}
+
+func newPatchWriter(c client.Reader, cfg *rest.Config, gvk schema.GroupVersionKind, mapper meta.RESTMapper, finalizer string) (*patchWriter, error) {
+	rc, resource, err := restClientFor(cfg, gvk, mapper)
+	if err != nil {
+		return nil, err
+	}
+	return &patchWriter{client: rc, reader: c, resource: resource, finalizer: finalizer}, nil
+}
+
+func (w *patchWriter) writeStatus(u *unstructured.Unstructured) error {
+	status, err := ownedStatus(u)
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{}
+	for _, f := range ownedStatusFields {
+		// null removes the fields the operator no longer sets
+		patch[f] = status[f]
+	}
+	for _, f := range sharedStatusFields {
+		if v, ok := status[f]; ok {
+			patch[f] = v
+		}
+	}
+	return w.patch(u, types.MergePatchType, map[string]interface{}{"status": patch})
+}
+
+func (w *patchWriter) writeFinalizers(u *unstructured.Unstructured) error {
+	if w.finalizer == "" {
+		return nil
+	}
+	present := contains(u.GetFinalizers(), w.finalizer)
+	current := u
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if current == nil {
+			current = &unstructured.Unstructured{}
+			current.SetGroupVersionKind(u.GroupVersionKind())
+			key := types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}
+			if err := w.reader.Get(context.TODO(), key, current); err != nil {
+				return err
+			}
+		}
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"finalizers":      toInterfaceSlice(withFinalizer(current.GetFinalizers(), w.finalizer, present)),
+				"resourceVersion": current.GetResourceVersion(),
+			},
+		}
+		err := w.patch(u, types.MergePatchType, patch)
+		if apierrors.IsConflict(err) {
+			current = nil
+		}
+		return err
+	})
+}
+
+// patch patches the resource u names, and updates u to the result.
+func (w *patchWriter) patch(u *unstructured.Unstructured, pt types.PatchType, patch map[string]interface{}) error {
+	return patchResource(w.client.Patch(pt), w.resource, u, patch)
+}
+
+func patchResource(req *rest.Request, resource string, u *unstructured.Unstructured, patch map[string]interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	result, err := req.
+		Namespace(u.GetNamespace()).
+		Resource(resource).
+		Name(u.GetName()).
+		Body(body).
+		Do().
+		Raw()
+	if err != nil {
+		return err
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(result, &obj); err != nil {
+		return err
+	}
+	u.Object = obj
+	return nil
+}
+
+// restClientFor returns a client for the API group version of gvk, and the
+// name of its resource. mapper may be nil, in which case the name is guessed
+// from the kind.
+func restClientFor(cfg *rest.Config, gvk schema.GroupVersionKind, mapper meta.RESTMapper) (rest.Interface, string, error) {
+	plural, _ := meta.UnsafeGuessKindToResource(gvk)
+	resource := plural.Resource
+	if mapper != nil {
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, "", err
+		}
+		resource = mapping.Resource
+	}
+	config := rest.CopyConfig(cfg)
+	config.ContentConfig = dynamic.ContentConfig()
+	config.GroupVersion = &schema.GroupVersion{Group: gvk.Group, Version: gvk.Version}
+	config.APIPath = "/apis"
+	if gvk.Group == "" {
+		config.APIPath = "/api"
+	}
+	rc, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, "", err
+	}
+	return rc, resource, nil
+}
+
+// updateWriter writes the whole resource with an update. If the resource
+// changed since it was read, the status and finalizer set by the operator
+// are copied to a fresh copy of it, and the update retried. It is used by
+// reconcilers that were not created by Add.
+type updateWriter struct {
+	client    client.Client
+	finalizer string
+}
+
+func (w updateWriter) writeStatus(u *unstructured.Unstructured) error {
+	return w.write(u)
+}
+
+func (w updateWriter) writeFinalizers(u *unstructured.Unstructured) error {
+	return w.write(u)
+}
+
+func (w updateWriter) write(u *unstructured.Unstructured) error {
+	err := w.client.Update(context.TODO(), u)
+	if !apierrors.IsConflict(err) {
+		return err
+	}
+	status, err := ownedStatus(u)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fresh := &unstructured.Unstructured{}
+		fresh.SetGroupVersionKind(u.GroupVersionKind())
+		key := types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}
+		if err := w.client.Get(context.TODO(), key, fresh); err != nil {
+			return err
+		}
+		if status != nil {
+			freshStatus, ok := fresh.Object["status"].(map[string]interface{})
+			if !ok {
+				freshStatus = map[string]interface{}{}
+			}
+			for k, v := range status {
+				freshStatus[k] = v
+			}
+			fresh.Object["status"] = freshStatus
+		}
+		if w.finalizer != "" {
+			fresh.SetFinalizers(withFinalizer(fresh.GetFinalizers(), w.finalizer, contains(u.GetFinalizers(), w.finalizer)))
+		}
+		if err := w.client.Update(context.TODO(), fresh); err != nil {
+			return err
+		}
+		u.Object = fresh.Object
+		return nil
+	})
+}
+
+// ownedStatus returns the fields of u's status the operator owns. u's status
+// may still be a ResourceStatus.
+func ownedStatus(u *unstructured.Unstructured) (map[string]interface{}, error) {
+	if u.Object["status"] == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(u.Object["status"])
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]interface{}{}
+	if err := json.Unmarshal(b, &status); err != nil {
+		return nil, err
+	}
+	owned := map[string]interface{}{}
+	for _, f := range append(ownedStatusFields, sharedStatusFields...) {
+		if v, ok := status[f]; ok {
+			owned[f] = v
+		}
+	}
+	return owned, nil
+}
+
+// withFinalizer adds finalizer to finalizers if present, and removes it
+// otherwise.
+func withFinalizer(finalizers []string, finalizer string, present bool) []string {
+	result := []string{}
+	for _, f := range finalizers {
+		if f != finalizer {
+			result = append(result, f)
+		}
+	}
+	if present {
+		result = append(result, finalizer)
+	}
+	return result
+}
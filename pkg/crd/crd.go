@@ -0,0 +1,143 @@
+package crd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EstablishedTimeout is how long Install waits for each CRD to be
+// established.
+const EstablishedTimeout = time.Minute
+
+// crdGVK is the kind of the CRDs of manifests that set no apiVersion.
+var crdGVK = schema.GroupVersionKind{
+	Group:   "apiextensions.k8s.io",
+	Version: "v1beta1",
+	Kind:    "CustomResourceDefinition",
+}
+
+// Install creates or updates the CustomResourceDefinitions in the manifests
+// in dir, and waits for them to be established. Other kinds of objects in the
+// manifests are skipped.
+//
+// It should be called before the manager is created, so that the manager's
+// RESTMapper knows about the installed kinds.
+func Install(cfg *rest.Config, dir string) error {
+	c, err := client.New(cfg, client.Options{})
+	if err != nil {
+		return err
+	}
+	crds, err := readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, crd := range crds {
+		if err := apply(c, crd); err != nil {
+			return fmt.Errorf("failed to install CRD %s: %v", crd.GetName(), err)
+		}
+	}
+	for _, crd := range crds {
+		if err := waitEstablished(c, crd.GroupVersionKind(), crd.GetName()); err != nil {
+			return fmt.Errorf("CRD %s was not established: %v", crd.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// readDir decodes the CRDs in the YAML or JSON files in dir.
+func readDir(dir string) ([]*unstructured.Unstructured, error) {
+	files := []string{}
+	for _, pattern := range []string{"*.yaml", "*.yml", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	crds := []*unstructured.Unstructured{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		d := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(b), 4096)
+		for {
+			u := &unstructured.Unstructured{}
+			err := d.Decode(&u.Object)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", f, err)
+			}
+			if u.Object == nil {
+				continue
+			}
+			if gvk := u.GroupVersionKind(); gvk.Kind != crdGVK.Kind || (gvk.Group != "" && gvk.Group != crdGVK.Group) {
+				logrus.Warnf("skipping %s %s %s in %s, only CRDs are installed", u.GetAPIVersion(), u.GetKind(), u.GetName(), f)
+				continue
+			}
+			if u.GetAPIVersion() == "" {
+				u.SetGroupVersionKind(crdGVK)
+			}
+			crds = append(crds, u)
+		}
+	}
+	return crds, nil
+}
+
+// apply creates crd, or replaces the spec of an existing CRD of that name,
+// in the version of the apiextensions API of crd.
+func apply(c client.Client, crd *unstructured.Unstructured) error {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(crd.GroupVersionKind())
+	err := c.Get(context.TODO(), types.NamespacedName{Name: crd.GetName()}, existing)
+	if apierrors.IsNotFound(err) {
+		logrus.Infof("Creating CRD %s", crd.GetName())
+		return c.Create(context.TODO(), crd)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Updating CRD %s", crd.GetName())
+	existing.Object["spec"] = crd.Object["spec"]
+	existing.SetLabels(crd.GetLabels())
+	existing.SetAnnotations(crd.GetAnnotations())
+	return c.Update(context.TODO(), existing)
+}
+
+func waitEstablished(c client.Client, gvk schema.GroupVersionKind, name string) error {
+	return wait.PollImmediate(time.Second, EstablishedTimeout, func() (bool, error) {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		if err := c.Get(context.TODO(), types.NamespacedName{Name: name}, u); err != nil {
+			return false, err
+		}
+		conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+		for _, cond := range conditions {
+			cm, ok := cond.(map[string]interface{})
+			if ok && cm["type"] == "Established" && cm["status"] == "True" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
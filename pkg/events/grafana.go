@@ -0,0 +1,157 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// grafanaTimeout bounds every request to the Grafana API.
+const grafanaTimeout = 10 * time.Second
+
+// GrafanaOptions - where and how the Grafana event handler posts
+// annotations.
+type GrafanaOptions struct {
+	// URL of Grafana, e.g. https://grafana.example.com.
+	URL string
+	// Token is the API or service account token the annotations are posted
+	// with, as a bearer token.
+	Token string
+	// DashboardUIDs are the dashboards every annotation is posted to. If
+	// empty, annotations are posted to the organization, and shown on the
+	// dashboards querying them by tag.
+	DashboardUIDs []string
+	// Tags are added to every annotation.
+	Tags []string
+}
+
+type grafanaEventHandler struct {
+	options GrafanaOptions
+	url     string
+	client  *http.Client
+	// started holds the start of the runs in progress, by playbook UUID.
+	started      map[string]time.Time
+	startedMutex sync.Mutex
+}
+
+// NewGrafanaEventHandler - Creates an Event Handler that posts an annotation
+// to Grafana as every run starts and finishes, so that changes made by the
+// operator show on the graphs of the dashboards.
+func NewGrafanaEventHandler(o GrafanaOptions) (EventHandler, error) {
+	u, err := url.Parse(o.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Grafana URL %q", o.URL)
+	}
+	return &grafanaEventHandler{
+		options: o,
+		url:     strings.TrimRight(o.URL, "/") + "/api/annotations",
+		client:  &http.Client{Timeout: grafanaTimeout},
+		started: map[string]time.Time{},
+	}, nil
+}
+
+// grafanaAnnotation is the body of a POST to /api/annotations.
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+func (g *grafanaEventHandler) Handle(u *unstructured.Unstructured, e eventapi.JobEvent) {
+	id, _ := e.EventData["playbook_uuid"].(string)
+	switch e.Event {
+	case EventPlaybookOnStart:
+		g.startedMutex.Lock()
+		g.started[id] = e.Created.Time
+		g.startedMutex.Unlock()
+		g.post(grafanaAnnotation{
+			Time: millis(e.Created.Time),
+			Tags: g.tags(u, "started"),
+			Text: fmt.Sprintf("Run %s of %s %s/%s started", e.RunnerIdent, u.GetKind(), u.GetNamespace(), u.GetName()),
+		})
+	case EventPlaybookOnStats:
+		result := "successful"
+		if runFailed(e) {
+			result = "failed"
+		}
+		text := fmt.Sprintf("Run %s of %s %s/%s %s", e.RunnerIdent, u.GetKind(), u.GetNamespace(), u.GetName(), result)
+		g.startedMutex.Lock()
+		start, found := g.started[id]
+		delete(g.started, id)
+		g.startedMutex.Unlock()
+		if found {
+			text += fmt.Sprintf(" after %s", e.Created.Sub(start).Round(time.Second))
+		}
+		g.post(grafanaAnnotation{
+			Time: millis(e.Created.Time),
+			Tags: g.tags(u, result),
+			Text: text,
+		})
+	}
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// tags returns the tags of an annotation of a run of u with the result.
+func (g *grafanaEventHandler) tags(u *unstructured.Unstructured, result string) []string {
+	return append([]string{
+		StatsdPrefix,
+		"kind:" + u.GetKind(),
+		"namespace:" + u.GetNamespace(),
+		"name:" + u.GetName(),
+		result,
+	}, g.options.Tags...)
+}
+
+// post posts a to every dashboard, or to the organization if none is set.
+func (g *grafanaEventHandler) post(a grafanaAnnotation) {
+	dashboards := g.options.DashboardUIDs
+	if len(dashboards) == 0 {
+		dashboards = []string{""}
+	}
+	for _, uid := range dashboards {
+		a.DashboardUID = uid
+		if err := g.send(a); err != nil {
+			logrus.Warningf("unable to post annotation to Grafana: %v", err)
+		}
+	}
+}
+
+func (g *grafanaEventHandler) send(a grafanaAnnotation) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, g.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.options.Token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -45,6 +45,8 @@ func (l loggingEventHandler) Handle(u *unstructured.Unstructured, e eventapi.Job
 		"namespace":  u.GetNamespace(),
 		"gvk":        u.GroupVersionKind().String(),
 		"event_type": e.Event,
+		"job":        e.RunnerIdent,
+		"uid":        string(u.GetUID()),
 	})
 
 	if l.LogLevel == Nothing {
@@ -0,0 +1,68 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/logging"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ndjsonEvent is a job event as written by the NDJSON event handler. Its
+// field names are stable, for log pipelines.
+type ndjsonEvent struct {
+	Time        string                 `json:"ts"`
+	Type        string                 `json:"type"`
+	Event       string                 `json:"event"`
+	UUID        string                 `json:"uuid"`
+	Counter     int                    `json:"counter"`
+	RunnerIdent string                 `json:"runner_ident"`
+	GVK         string                 `json:"gvk"`
+	Namespace   string                 `json:"namespace"`
+	Name        string                 `json:"name"`
+	UID         string                 `json:"uid"`
+	Task        interface{}            `json:"task,omitempty"`
+	TaskAction  interface{}            `json:"task_action,omitempty"`
+	Host        interface{}            `json:"host,omitempty"`
+	StdOut      string                 `json:"stdout,omitempty"`
+	EventData   map[string]interface{} `json:"event_data"`
+}
+
+type ndjsonEventHandler struct {
+	w io.Writer
+}
+
+// NewNDJSONEventHandler returns an EventHandler writing every job event to w
+// as a JSON object on a line of its own, with type "event", next to the log
+// lines written by logging.UseNDJSON. Each event is written with a single
+// Write, so w should be a logging.LockedWriter shared with the logs.
+func NewNDJSONEventHandler(w io.Writer) EventHandler {
+	return ndjsonEventHandler{w: w}
+}
+
+func (h ndjsonEventHandler) Handle(u *unstructured.Unstructured, e eventapi.JobEvent) {
+	b, err := json.Marshal(ndjsonEvent{
+		Time:        e.Created.Time.Format(logging.TimeFormat),
+		Type:        "event",
+		Event:       e.Event,
+		UUID:        e.UUID,
+		Counter:     e.Counter,
+		RunnerIdent: e.RunnerIdent,
+		GVK:         u.GroupVersionKind().String(),
+		Namespace:   u.GetNamespace(),
+		Name:        u.GetName(),
+		UID:         string(u.GetUID()),
+		Task:        e.EventData["task"],
+		TaskAction:  e.EventData["task_action"],
+		Host:        e.EventData["host"],
+		StdOut:      e.StdOut,
+		EventData:   e.EventData,
+	})
+	if err != nil {
+		logrus.Errorf("unable to marshal job event %s: %v", e.UUID, err)
+		return
+	}
+	h.w.Write(append(b, '\n'))
+}
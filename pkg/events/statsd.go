@@ -0,0 +1,168 @@
+package events
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// StatsdPrefix is prepended to the names of all metrics sent over StatsD.
+const StatsdPrefix = "ansible_operator"
+
+// Ansible events counted by the StatsD event handler.
+const (
+	EventPlaybookOnStart     = "playbook_on_start"
+	EventPlaybookOnStats     = "playbook_on_stats"
+	EventRunnerOnSkipped     = "runner_on_skipped"
+	EventRunnerOnUnreachable = "runner_on_unreachable"
+)
+
+// StatsdOptions - where and how the StatsD event handler sends metrics.
+type StatsdOptions struct {
+	// Address of the StatsD server, as host:port.
+	Address string
+	// DogStatsD adds tags for the kind, namespace and name of the resource
+	// to every metric, and sends an event for every failed task and run.
+	DogStatsD bool
+	// Tags are added to every metric, as key:value, if DogStatsD is set.
+	Tags []string
+}
+
+type statsdEventHandler struct {
+	conn    net.Conn
+	options StatsdOptions
+	// started holds the start of the runs in progress, by playbook UUID.
+	started      map[string]time.Time
+	startedMutex sync.Mutex
+}
+
+// NewStatsdEventHandler - Creates an Event Handler that sends counters and
+// timers of runs and tasks over StatsD, or DogStatsD.
+func NewStatsdEventHandler(o StatsdOptions) (EventHandler, error) {
+	conn, err := net.Dial("udp", o.Address)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach StatsD at %s: %v", o.Address, err)
+	}
+	return &statsdEventHandler{conn: conn, options: o, started: map[string]time.Time{}}, nil
+}
+
+func (s *statsdEventHandler) Handle(u *unstructured.Unstructured, e eventapi.JobEvent) {
+	tags := s.tags(u)
+	switch e.Event {
+	case EventPlaybookOnStart:
+		if id, ok := e.EventData["playbook_uuid"].(string); ok {
+			s.startedMutex.Lock()
+			s.started[id] = e.Created.Time
+			s.startedMutex.Unlock()
+		}
+	case EventRunnerOnOk, EventRunnerOnFailed, EventRunnerOnSkipped, EventRunnerOnUnreachable:
+		result := taskResult(e)
+		s.count("tasks."+result, tags)
+		if d, ok := e.EventData["duration"].(float64); ok {
+			s.send(fmt.Sprintf("%s.task.duration:%d|ms", StatsdPrefix, int64(d*1000)), tags)
+		}
+		if result == "failed" || result == "unreachable" {
+			task, _ := e.EventData["task"].(string)
+			s.event(fmt.Sprintf("%s task failed", u.GetKind()),
+				fmt.Sprintf("task %q of %s/%s failed", task, u.GetNamespace(), u.GetName()), s.eventTags(tags, u, e))
+		}
+	case EventPlaybookOnStats:
+		if runFailed(e) {
+			s.count("runs.failed", tags)
+			s.event(fmt.Sprintf("%s run failed", u.GetKind()),
+				fmt.Sprintf("the run of %s/%s failed", u.GetNamespace(), u.GetName()), s.eventTags(tags, u, e))
+		} else {
+			s.count("runs.successful", tags)
+		}
+		if id, ok := e.EventData["playbook_uuid"].(string); ok {
+			s.startedMutex.Lock()
+			start, found := s.started[id]
+			delete(s.started, id)
+			s.startedMutex.Unlock()
+			if found {
+				s.send(fmt.Sprintf("%s.run.duration:%d|ms", StatsdPrefix, e.Created.Sub(start).Nanoseconds()/int64(time.Millisecond)), tags)
+			}
+		}
+	}
+}
+
+// runFailed reports whether a host failed or was unreachable in the run
+// whose playbook_on_stats event is e.
+func runFailed(e eventapi.JobEvent) bool {
+	for _, key := range []string{"failures", "dark"} {
+		if counts, ok := e.EventData[key].(map[string]interface{}); ok {
+			for _, n := range counts {
+				if c, ok := n.(float64); ok && c > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// taskResult returns the outcome of the task that posted e.
+func taskResult(e eventapi.JobEvent) string {
+	switch e.Event {
+	case EventRunnerOnFailed:
+		if ignored, _ := e.EventData["ignore_errors"].(bool); ignored {
+			return "ignored"
+		}
+		return "failed"
+	case EventRunnerOnSkipped:
+		return "skipped"
+	case EventRunnerOnUnreachable:
+		return "unreachable"
+	}
+	if res, ok := e.EventData["res"].(map[string]interface{}); ok && res["changed"] == true {
+		return "changed"
+	}
+	return "ok"
+}
+
+func (s *statsdEventHandler) tags(u *unstructured.Unstructured) []string {
+	if !s.options.DogStatsD {
+		return nil
+	}
+	return append([]string{
+		"kind:" + u.GetKind(),
+		"namespace:" + u.GetNamespace(),
+		"name:" + u.GetName(),
+	}, s.options.Tags...)
+}
+
+// eventTags adds the ident of the run and the UID of the resource to tags,
+// for events. Metrics go without them, as every run would be a new series.
+func (s *statsdEventHandler) eventTags(tags []string, u *unstructured.Unstructured, e eventapi.JobEvent) []string {
+	if !s.options.DogStatsD {
+		return nil
+	}
+	return append(append([]string{}, tags...), "job:"+e.RunnerIdent, "uid:"+string(u.GetUID()))
+}
+
+func (s *statsdEventHandler) count(name string, tags []string) {
+	s.send(fmt.Sprintf("%s.%s:1|c", StatsdPrefix, name), tags)
+}
+
+// event sends a DogStatsD event; plain StatsD has none.
+func (s *statsdEventHandler) event(title, text string, tags []string) {
+	if !s.options.DogStatsD {
+		return
+	}
+	s.send(fmt.Sprintf("_e{%d,%d}:%s|%s|t:error", len(title), len(text), title, text), tags)
+}
+
+func (s *statsdEventHandler) send(datagram string, tags []string) {
+	if len(tags) > 0 {
+		datagram += "|#" + strings.Join(tags, ",")
+	}
+	if _, err := s.conn.Write([]byte(datagram)); err != nil {
+		logrus.Debugf("unable to send to StatsD: %v", err)
+	}
+}
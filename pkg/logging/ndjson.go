@@ -0,0 +1,132 @@
+// Package logging sets up the operator's log output.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/sirupsen/logrus"
+)
+
+// Field names of NDJSON log lines, which are kept stable for log pipelines.
+const (
+	FieldTime    = "ts"
+	FieldLevel   = "level"
+	FieldMessage = "msg"
+	// FieldType is "log" for log lines, and "event" for the job events of
+	// runs.
+	FieldType = "type"
+	// FieldLogger is the name of the controller-runtime logger of a line.
+	FieldLogger = "logger"
+	// FieldError is the error of a line logged with one.
+	FieldError = "error"
+)
+
+// TimeFormat is the format of FieldTime.
+const TimeFormat = time.RFC3339Nano
+
+// LockedWriter serializes writes to an io.Writer, so that lines written by
+// several goroutines with one Write each never interleave.
+type LockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewLockedWriter returns a LockedWriter writing to w.
+func NewLockedWriter(w io.Writer) *LockedWriter {
+	return &LockedWriter{w: w}
+}
+
+func (l *LockedWriter) Write(b []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.w.Write(b)
+}
+
+// UseNDJSON makes logrus write every log line to w as a JSON object on a line
+// of its own, with the field names above.
+func UseNDJSON(w io.Writer) {
+	logrus.SetOutput(w)
+	logrus.SetFormatter(&ndjsonFormatter{json: logrus.JSONFormatter{
+		TimestampFormat: TimeFormat,
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  FieldTime,
+			logrus.FieldKeyLevel: FieldLevel,
+			logrus.FieldKeyMsg:   FieldMessage,
+		},
+	}})
+}
+
+// ndjsonFormatter tags the lines of its JSONFormatter as logs.
+type ndjsonFormatter struct {
+	json logrus.JSONFormatter
+}
+
+func (f *ndjsonFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(e.Data)+1)
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	data[FieldType] = "log"
+	tagged := *e
+	tagged.Data = data
+	return f.json.Format(&tagged)
+}
+
+// Logr returns a logr.Logger writing to logrus, for the controller-runtime
+// logs to share the format of the operator's own.
+func Logr() logr.Logger {
+	return logrusLogr{entry: logrus.NewEntry(logrus.StandardLogger())}
+}
+
+type logrusLogr struct {
+	entry *logrus.Entry
+	name  string
+	// debug logs at the debug level, for the V levels above 0.
+	debug bool
+}
+
+func (l logrusLogr) with(keysAndValues []interface{}) *logrus.Entry {
+	fields := logrus.Fields{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	if l.name != "" {
+		fields[FieldLogger] = l.name
+	}
+	return l.entry.WithFields(fields)
+}
+
+func (l logrusLogr) Info(msg string, keysAndValues ...interface{}) {
+	if l.debug {
+		l.with(keysAndValues).Debug(msg)
+		return
+	}
+	l.with(keysAndValues).Info(msg)
+}
+
+func (l logrusLogr) Enabled() bool {
+	return !l.debug || logrus.GetLevel() >= logrus.DebugLevel
+}
+
+func (l logrusLogr) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.with(keysAndValues).WithField(FieldError, fmt.Sprint(err)).Error(msg)
+}
+
+func (l logrusLogr) V(level int) logr.InfoLogger {
+	return logrusLogr{entry: l.entry, name: l.name, debug: l.debug || level > 0}
+}
+
+func (l logrusLogr) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return logrusLogr{entry: l.with(keysAndValues), debug: l.debug, name: l.name}
+}
+
+func (l logrusLogr) WithName(name string) logr.Logger {
+	if l.name != "" {
+		name = l.name + "." + name
+	}
+	return logrusLogr{entry: l.entry, name: name, debug: l.debug}
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of
+// histograms of request latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramVec - a histogram with labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramSample
+}
+
+type histogramSample struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// NewHistogramVec returns a HistogramVec with the given bucket upper bounds,
+// sorted in increasing order, and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramSample{}}
+}
+
+// Name implements Collector.
+func (h *HistogramVec) Name() string {
+	return h.name
+}
+
+// Observe adds value to the sample with labelValues.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", h.name, h.labels, labelValues))
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSample{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Write implements Collector.
+func (h *HistogramVec) Write(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help), h.name); err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	names := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.values[key]
+		values := append(append([]string{}, s.labelValues...), "")
+		for i, upper := range h.buckets {
+			values[len(values)-1] = strconv.FormatFloat(upper, 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), s.counts[i]); err != nil {
+				return err
+			}
+		}
+		values[len(values)-1] = "+Inf"
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), s.count); err != nil {
+			return err
+		}
+		labels := formatLabels(h.labels, s.labelValues)
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, labels, strconv.FormatFloat(s.sum, 'g', -1, 64), h.name, labels, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
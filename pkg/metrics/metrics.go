@@ -0,0 +1,230 @@
+// Package metrics exposes the operator's metrics in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Collector - a metric family that can be written to a Registry.
+type Collector interface {
+	// Name is the name of the metric family, unique within a Registry.
+	Name() string
+	// Write writes the family in the text exposition format.
+	Write(w io.Writer) error
+}
+
+// Registry - a set of metric families, served over HTTP.
+type Registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]Collector
+}
+
+// DefaultRegistry is the registry served by Serve.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]Collector{}}
+}
+
+// MustRegister adds cs to r. It panics if a family of the same name was
+// registered before.
+func (r *Registry) MustRegister(cs ...Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, c := range cs {
+		if _, ok := r.collectors[c.Name()]; ok {
+			panic(fmt.Sprintf("metric %s registered twice", c.Name()))
+		}
+		r.collectors[c.Name()] = c
+	}
+}
+
+// ServeHTTP writes every registered family, sorted by name.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mutex.RLock()
+	names := []string{}
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		if err := r.collectors[name].Write(buf); err != nil {
+			logrus.Warningf("unable to write metric %s: %v", name, err)
+		}
+	}
+	r.mutex.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// Serve serves DefaultRegistry on addr at /metrics. It blocks until the
+// server fails.
+func Serve(addr string) error {
+	return ServeUntil(addr, nil)
+}
+
+// ServeUntil is Serve, closing the server and its listener once stop is
+// closed, so that addr can be served again. It then returns nil.
+func ServeUntil(addr string, stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultRegistry)
+	server := &http.Server{Addr: addr, Handler: mux}
+	logrus.Infof("Serving metrics on %s/metrics", addr)
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+		return server.Close()
+	}
+}
+
+// vec holds the samples of a family with labels.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func newVec(typ, name, help string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, values: map[string]*sample{}}
+}
+
+func (v *vec) Name() string {
+	return v.name
+}
+
+func (v *vec) get(labelValues []string) *sample {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", v.name, v.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+// Delete removes the sample with labelValues.
+func (v *vec) Delete(labelValues ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec) Write(w io.Writer) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ); err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.values[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), strconv.FormatFloat(s.value, 'g', -1, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeVec - a gauge with labels.
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec returns a GaugeVec with the given label names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newVec("gauge", name, help, labels)}
+}
+
+// Set sets the sample with labelValues to value.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value = value
+}
+
+// Add adds delta to the sample with labelValues.
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value += delta
+}
+
+// CounterVec - a counter with labels.
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec returns a CounterVec with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newVec("counter", name, help, labels)}
+}
+
+// Inc adds one to the sample with labelValues.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the sample with
+// labelValues.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.name))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.get(labelValues).value += delta
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", names[i], escapeLabel(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
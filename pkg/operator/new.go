@@ -0,0 +1,195 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/restmapper"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// The defaults of New, those of the ansible-operator image.
+const (
+	DefaultWatchesFile = "/opt/ansible/watches.yaml"
+	DefaultRolesDir    = "/opt/ansible/roles"
+	DefaultMetricsAddr = ":8383"
+	DefaultProxyPort   = 8888
+)
+
+// Option - configures the operator created by New.
+type Option func(*options)
+
+type options struct {
+	watchesFile         string
+	rolesDir            string
+	namespace           string
+	maxWorkers          int
+	metricsAddr         string
+	proxyPort           int
+	proxyRBAC           bool
+	noProxy             bool
+	trackingLabelPrefix string
+	syncPeriod          *time.Duration
+	builder             []func(*Builder) error
+}
+
+// WithWatchesFile reads the watches from path, DefaultWatchesFile by
+// default.
+func WithWatchesFile(path string) Option {
+	return func(o *options) { o.watchesFile = path }
+}
+
+// WithRolesDir discovers the roles in path, DefaultRolesDir by default, if
+// there is no watches file.
+func WithRolesDir(path string) Option {
+	return func(o *options) { o.rolesDir = path }
+}
+
+// WithNamespace sets the namespace the ansible controllers watch.
+func WithNamespace(namespace string) Option {
+	return func(o *options) { o.namespace = namespace }
+}
+
+// WithMaxWorkers sets the number of resources of each kind reconciled at
+// once, unless set in the watch; 1 by default.
+func WithMaxWorkers(n int) Option {
+	return func(o *options) { o.maxWorkers = n }
+}
+
+// WithMetricsAddr serves the metrics on addr, DefaultMetricsAddr by default;
+// empty disables them.
+func WithMetricsAddr(addr string) Option {
+	return func(o *options) { o.metricsAddr = addr }
+}
+
+// WithProxyPort sets the port of the proxy playbooks talk to the API server
+// through, DefaultProxyPort by default.
+func WithProxyPort(port int) Option {
+	return func(o *options) { o.proxyPort = port }
+}
+
+// WithProxyRBAC authorizes the requests of playbooks run as a ServiceAccount
+// with SubjectAccessReviews instead of impersonating it.
+func WithProxyRBAC() Option {
+	return func(o *options) { o.proxyRBAC = true }
+}
+
+// WithoutProxy runs the playbooks against the API server directly; see
+// Builder.WithoutProxy.
+func WithoutProxy(labelPrefix string) Option {
+	return func(o *options) {
+		o.noProxy = true
+		o.trackingLabelPrefix = labelPrefix
+	}
+}
+
+// WithSyncPeriod sets how often the manager's cache lists every watched
+// resource again, which reconciles them all.
+func WithSyncPeriod(d time.Duration) Option {
+	return func(o *options) { o.syncPeriod = &d }
+}
+
+// WithBuilder calls f with the Builder of the operator before its
+// controllers are built, to configure what the other options do not, e.g.
+// Go controllers or event handlers.
+func WithBuilder(f func(*Builder) error) Option {
+	return func(o *options) { o.builder = append(o.builder, f) }
+}
+
+// New returns a manager running the ansible operator against cfg, as the
+// ansible-operator binary does: the ansible controllers of the watches file,
+// or of the roles discovered if there is none, the proxy of the playbooks
+// and the metrics endpoint. They start with the manager, and stop with the
+// channel passed to its Start, which closes the servers of the proxy and the
+// metrics so that a manager created after this one can serve their ports.
+func New(cfg *rest.Config, opts ...Option) (manager.Manager, error) {
+	o := options{
+		watchesFile: DefaultWatchesFile,
+		rolesDir:    DefaultRolesDir,
+		namespace:   "default",
+		maxWorkers:  1,
+		metricsAddr: DefaultMetricsAddr,
+		proxyPort:   DefaultProxyPort,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.noProxy && o.proxyRBAC {
+		return nil, errors.New("enforcing RBAC in the proxy requires the proxy")
+	}
+
+	mapper, err := restmapper.NewDynamicRESTMapper(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mo := manager.Options{
+		MapperProvider: func(*rest.Config) (meta.RESTMapper, error) { return mapper, nil },
+		SyncPeriod:     o.syncPeriod,
+	}
+	mgr, err := manager.New(cfg, mo)
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewBuilder(mgr).WithNamespace(o.namespace).WithRESTMapper(mapper).WithMaxWorkers(o.maxWorkers)
+	if o.noProxy {
+		b.WithoutProxy(o.trackingLabelPrefix)
+	} else {
+		identities := proxy.NewIdentities()
+		b.WithProxyURL(fmt.Sprintf("http://localhost:%d", o.proxyPort)).WithProxyIdentities(identities)
+		po := proxy.Options{
+			Address:     "localhost",
+			Port:        o.proxyPort,
+			KubeConfig:  mgr.GetConfig(),
+			EnforceRBAC: o.proxyRBAC,
+			Identities:  identities,
+			Cache:       mgr.GetCache(),
+			RESTMapper:  mapper,
+		}
+		if err := mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+			return proxy.RunProxyUntil(po, stop)
+		})); err != nil {
+			return nil, err
+		}
+	}
+	if o.metricsAddr != "" {
+		if err := mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+			return metrics.ServeUntil(o.metricsAddr, stop)
+		})); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(o.watchesFile); os.IsNotExist(err) && o.rolesDir != "" {
+		if err := b.WithRolesDir(o.rolesDir); err != nil {
+			return nil, fmt.Errorf("failed to discover roles in %s: %v", o.rolesDir, err)
+		}
+	} else if err := b.WithWatchesFile(o.watchesFile); err != nil {
+		return nil, fmt.Errorf("failed to get watches from %s: %v", o.watchesFile, err)
+	}
+	for _, f := range o.builder {
+		if err := f(b); err != nil {
+			return nil, err
+		}
+	}
+
+	// the reconcile loops stop with the manager
+	stop := make(chan struct{})
+	if err := mgr.Add(manager.RunnableFunc(func(s <-chan struct{}) error {
+		<-s
+		close(stop)
+		return nil
+	})); err != nil {
+		return nil, err
+	}
+	if err := b.Build(stop); err != nil {
+		return nil, err
+	}
+	return mgr, nil
+}
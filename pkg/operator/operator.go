@@ -0,0 +1,630 @@
+package operator
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/controller"
+	"github.com/water-hole/ansible-operator/pkg/events"
+	"github.com/water-hole/ansible-operator/pkg/operatorcondition"
+	"github.com/water-hole/ansible-operator/pkg/proxy"
+	"github.com/water-hole/ansible-operator/pkg/restmapper"
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"github.com/water-hole/ansible-operator/pkg/tracing"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// GoController describes a native controller-runtime reconciler that is
+// registered on the same manager as the ansible controllers.
+type GoController struct {
+	// Name of the controller. Defaults to "<kind>-controller".
+	Name string
+	// Object is the primary type watched by the controller. It must either be
+	// registered with the manager's scheme, or be an Unstructured with its
+	// GroupVersionKind set.
+	Object runtime.Object
+	// Reconciler reconciles requests for Object.
+	Reconciler reconcile.Reconciler
+	// MaxConcurrentReconciles defaults to 1.
+	MaxConcurrentReconciles int
+}
+
+// Builder composes an operator out of watches.yaml entries, each backed by
+// ansible, and native Go reconcilers, all sharing a single manager and
+// scheme. A GVK handled by a Go controller takes precedence over a watch for
+// the same GVK, so a CRD can be migrated to Go without touching the watches
+// file.
+type Builder struct {
+	mgr           manager.Manager
+	namespace     string
+	namespaces    *controller.NamespaceList
+	runners       map[schema.GroupVersionKind]runner.Runner
+	goControllers []GoController
+	eventHandlers []events.EventHandler
+	loggingLevel  events.LogLevel
+	upgradeable   *operatorcondition.Tracker
+	dynamic       bool
+	directReads   bool
+	maxWorkers    int
+	restMapper    *restmapper.DynamicRESTMapper
+	artifacts     runner.ArtifactUploader
+	apply         bool
+	tracer        *tracing.Tracer
+	proxyURL      string
+	// relocateFrom and relocateTo move the paths of watches files; see
+	// WithRelocatedPaths.
+	relocateFrom, relocateTo string
+	reload                   time.Duration
+	lint                     *runner.LintOptions
+	noProxy                  bool
+	trackingLabelPrefix      string
+	addToScheme              []func(*runtime.Scheme) error
+	runDirs                  *runner.RunDirs
+	ara                      *runner.ARA
+	eventLimits              *eventapi.Limits
+	cachedKinds              *proxy.KindSet
+	identities               *proxy.Identities
+	middleware               []controller.Middleware
+	preReconcile             func(u *unstructured.Unstructured) error
+	postReconcile            func(u *unstructured.Unstructured, result controller.RunResult)
+	ansibleJobs              map[string]string
+	schedules                bool
+	handoff                  *controller.Handoff
+	runnables                []manager.Runnable
+	// watchesConfigMap, if set, is the ConfigMap the watches are read from.
+	watchesConfigMap *types.NamespacedName
+	// defaulting, if set, is the defaulting webhook served.
+	defaulting *controller.DefaultingWebhookOptions
+	// runsAPI, if set, is the runs API served.
+	runsAPI *controller.RunsAPIOptions
+}
+
+// NewBuilder returns a Builder that adds controllers to mgr.
+func NewBuilder(mgr manager.Manager) *Builder {
+	return &Builder{
+		mgr:     mgr,
+		runners: map[schema.GroupVersionKind]runner.Runner{},
+	}
+}
+
+// WithNamespace sets the namespace the ansible controllers watch.
+func (b *Builder) WithNamespace(namespace string) *Builder {
+	b.namespace = namespace
+	return b
+}
+
+// WithNamespaceList limits the resources the ansible controllers reconcile
+// to the namespaces in l.
+func (b *Builder) WithNamespaceList(l *controller.NamespaceList) *Builder {
+	b.namespaces = l
+	return b
+}
+
+// WithWatchesFile adds an ansible controller for every entry in the watches
+// file at path.
+func (b *Builder) WithWatchesFile(path string) error {
+	var watches map[schema.GroupVersionKind]runner.Runner
+	var err error
+	if b.relocateFrom != "" {
+		watches, err = runner.NewFromWatchesRelocated(path, b.relocateFrom, b.relocateTo)
+	} else {
+		watches, err = runner.NewFromWatches(path)
+	}
+	if err != nil {
+		return err
+	}
+	for gvk, r := range watches {
+		if err := b.WithRunner(gvk, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithRolesDir adds an ansible controller for every role under path that
+// declares its GVK in a runner.RoleMetadataFile.
+func (b *Builder) WithRolesDir(path string) error {
+	roles, err := runner.NewFromRolesDir(path)
+	if err != nil {
+		return err
+	}
+	for gvk, r := range roles {
+		if err := b.WithRunner(gvk, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithRunner adds an ansible controller for gvk backed by r.
+func (b *Builder) WithRunner(gvk schema.GroupVersionKind, r runner.Runner) error {
+	if _, ok := b.runners[gvk]; ok {
+		return fmt.Errorf("duplicate GVK: %v", gvk.String())
+	}
+	b.runners[gvk] = r
+	return nil
+}
+
+// WithGoController adds a native controller-runtime reconciler.
+func (b *Builder) WithGoController(c GoController) *Builder {
+	b.goControllers = append(b.goControllers, c)
+	return b
+}
+
+// WithAddToScheme registers Go types on the manager's scheme with funcs, such
+// as the AddToScheme of an API package, when Build is called and before any
+// controller is added. Go controllers and clients can then use those types.
+func (b *Builder) WithAddToScheme(funcs ...func(*runtime.Scheme) error) *Builder {
+	b.addToScheme = append(b.addToScheme, funcs...)
+	return b
+}
+
+// WithTypes registers objects as the types of their kinds in gv on the
+// manager's scheme, like WithAddToScheme.
+func (b *Builder) WithTypes(gv schema.GroupVersion, objects ...runtime.Object) *Builder {
+	return b.WithAddToScheme(func(s *runtime.Scheme) error {
+		s.AddKnownTypes(gv, objects...)
+		metav1.AddToGroupVersion(s, gv)
+		return nil
+	})
+}
+
+// WithEventHandlers adds handlers for the job events of every ansible run.
+func (b *Builder) WithEventHandlers(handlers ...events.EventHandler) *Builder {
+	b.eventHandlers = append(b.eventHandlers, handlers...)
+	return b
+}
+
+// WithLoggingLevel sets the level of the default logging event handler.
+func (b *Builder) WithLoggingLevel(l events.LogLevel) *Builder {
+	b.loggingLevel = l
+	return b
+}
+
+// WithUpgradeable reports runs to OLM through t.
+func (b *Builder) WithUpgradeable(t *operatorcondition.Tracker) *Builder {
+	b.upgradeable = t
+	return b
+}
+
+// WithDirectReads makes the ansible controllers read the resources they
+// reconcile from the API server rather than from the manager's cache.
+func (b *Builder) WithDirectReads() *Builder {
+	b.directReads = true
+	return b
+}
+
+// WithMaxWorkers sets the number of resources of each GVK reconciled at
+// once, for watches that do not set their own.
+func (b *Builder) WithMaxWorkers(n int) *Builder {
+	b.maxWorkers = n
+	return b
+}
+
+// WithRESTMapper sets the manager's RESTMapper. Controllers for watches whose
+// GVK is not served yet then wait for it instead of failing.
+func (b *Builder) WithRESTMapper(m *restmapper.DynamicRESTMapper) *Builder {
+	b.restMapper = m
+	return b
+}
+
+// WithServerSideApply makes the ansible controllers write status and
+// finalizers with server-side apply.
+func (b *Builder) WithServerSideApply() *Builder {
+	b.apply = true
+	return b
+}
+
+// WithTracer records spans of every ansible run with t.
+func (b *Builder) WithTracer(t *tracing.Tracer) *Builder {
+	b.tracer = t
+	return b
+}
+
+// WithArtifactUploader uploads the artifacts of every ansible run with u.
+func (b *Builder) WithArtifactUploader(u runner.ArtifactUploader) *Builder {
+	b.artifacts = u
+	return b
+}
+
+// WithRelocatedPaths makes WithWatchesFile move the paths of playbooks, roles
+// and other content below from to below to. It must be called before
+// WithWatchesFile.
+func (b *Builder) WithRelocatedPaths(from, to string) *Builder {
+	b.relocateFrom, b.relocateTo = from, to
+	return b
+}
+
+// WithContentLint makes Build check the playbooks and roles of every runner
+// with runner.Lint before adding any controller, and fail if any is broken.
+func (b *Builder) WithContentLint(o runner.LintOptions) *Builder {
+	b.lint = &o
+	return b
+}
+
+// WithoutProxy runs playbooks with a kubeconfig reaching the API server
+// directly rather than through the proxy. After each run, the resources it
+// applied are given an owner reference to their CR, or, in other namespaces,
+// the tracking labels below labelPrefix, if set.
+func (b *Builder) WithoutProxy(labelPrefix string) *Builder {
+	b.noProxy = true
+	b.trackingLabelPrefix = labelPrefix
+	return b
+}
+
+// WithReload makes the controllers check the playbooks and roles they run
+// for changes every interval, and reconcile all their resources when they
+// change.
+func (b *Builder) WithReload(interval time.Duration) *Builder {
+	b.reload = interval
+	return b
+}
+
+// WithMiddleware wraps the reconcilers of the ansible controllers with mw.
+// The first listed wraps all others.
+func (b *Builder) WithMiddleware(mw ...controller.Middleware) *Builder {
+	b.middleware = append(b.middleware, mw...)
+	return b
+}
+
+// WithPreReconcile calls f with the resource before every ansible run. If f
+// returns an error, the resource is not run and is requeued with backoff,
+// e.g. while a quota is exhausted.
+func (b *Builder) WithPreReconcile(f func(u *unstructured.Unstructured) error) *Builder {
+	b.preReconcile = f
+	return b
+}
+
+// WithPostReconcile calls f after every completed ansible run, with the
+// resource as written and the result of the run.
+func (b *Builder) WithPostReconcile(f func(u *unstructured.Unstructured, result controller.RunResult)) *Builder {
+	b.postReconcile = f
+	return b
+}
+
+// WithRunDirs makes the ansible controllers run in private data dirs as set
+// in d.
+func (b *Builder) WithRunDirs(d runner.RunDirs) *Builder {
+	b.runDirs = &d
+	return b
+}
+
+// WithCachedKinds adds the kinds the ansible controllers have informers
+// for to kinds, so the proxy can serve reads of them from the cache.
+func (b *Builder) WithCachedKinds(kinds *proxy.KindSet) *Builder {
+	b.cachedKinds = kinds
+	return b
+}
+
+// WithARA records every run of the ansible controllers to the ARA server of
+// a.
+func (b *Builder) WithARA(a runner.ARA) *Builder {
+	b.ara = &a
+	return b
+}
+
+// WithEventLimits bounds the size of the events of the runs of the ansible
+// controllers by l, instead of eventapi.DefaultLimits.
+func (b *Builder) WithEventLimits(l eventapi.Limits) *Builder {
+	b.eventLimits = &l
+	return b
+}
+
+// WithProxyIdentities issues the ServiceAccounts the runs of the ansible
+// controllers act as through ids, the Identities of the operator's proxy.
+// Watches with a serviceAccount fail to run without them.
+func (b *Builder) WithProxyIdentities(ids *proxy.Identities) *Builder {
+	b.identities = ids
+	return b
+}
+
+// WithProxyURL sets the URL of the operator's proxy, if it is not
+// controller.DefaultProxyURL.
+func (b *Builder) WithProxyURL(url string) *Builder {
+	b.proxyURL = url
+	return b
+}
+
+// WithDynamicWatches enables the AnsibleWatch controller, which adds and
+// removes ansible controllers at runtime as AnsibleWatch resources change.
+func (b *Builder) WithDynamicWatches() *Builder {
+	b.dynamic = true
+	return b
+}
+
+// WithAnsibleJobsDir enables the AnsibleJob controller, which runs the
+// playbook in dir an AnsibleJob names once.
+func (b *Builder) WithAnsibleJobsDir(dir string) error {
+	playbooks, err := controller.AnsibleJobPlaybooks(dir)
+	if err != nil {
+		return err
+	}
+	b.ansibleJobs = playbooks
+	return nil
+}
+
+// WithAnsibleSchedules enables the scheduler of AnsibleSchedule resources,
+// which run AnsibleJobs or resources of watches on cron schedules.
+func (b *Builder) WithAnsibleSchedules() *Builder {
+	b.schedules = true
+	return b
+}
+
+// WithHandoff records the work in flight of the ansible controllers with h,
+// and resumes that of the operator before this one.
+func (b *Builder) WithHandoff(h *controller.Handoff) *Builder {
+	b.handoff = h
+	return b
+}
+
+// WithWatchesConfigMap reads watches from the ConfigMap namespace/name, in
+// addition to those of watches files, and reconfigures their controllers as
+// it changes; see controller.AddWatchesConfigMap.
+func (b *Builder) WithWatchesConfigMap(namespace, name string) *Builder {
+	b.watchesConfigMap = &types.NamespacedName{Namespace: namespace, Name: name}
+	return b
+}
+
+// WithDefaultingWebhook serves a mutating admission webhook on addr, with
+// the certificate in certDir, that sets the defaults of the roles of the
+// watches in the spec of their resources; see
+// controller.AddDefaultingWebhook.
+func (b *Builder) WithDefaultingWebhook(addr, certDir string) *Builder {
+	b.defaulting = &controller.DefaultingWebhookOptions{Addr: addr, CertDir: certDir}
+	return b
+}
+
+// WithRunsAPI serves the last runs of the ansible controllers on addr, with
+// the certificate in certDir, to users allowed to get the non-resource URL
+// /runs; see controller.AddRunsAPI.
+func (b *Builder) WithRunsAPI(addr, certDir string) *Builder {
+	b.runsAPI = &controller.RunsAPIOptions{Addr: addr, CertDir: certDir}
+	return b
+}
+
+// WithRunnables adds runnables to the manager along with the controllers,
+// e.g. HTTP servers or pollers of an embedding operator. They are started
+// and stopped with the manager, with the stop channel it passes to the
+// controllers, and get the manager's client, cache, config and scheme
+// injected like them.
+func (b *Builder) WithRunnables(runnables ...manager.Runnable) *Builder {
+	b.runnables = append(b.runnables, runnables...)
+	return b
+}
+
+// Build registers all controllers with the manager. stop is passed to the
+// ansible controllers' reconcile loops and should be the channel later
+// passed to the manager's Start.
+func (b *Builder) Build(stop <-chan struct{}) error {
+	for _, addToScheme := range b.addToScheme {
+		if err := addToScheme(b.mgr.GetScheme()); err != nil {
+			return err
+		}
+	}
+	goGVKs := map[schema.GroupVersionKind]bool{}
+	for _, gc := range b.goControllers {
+		gvk, err := b.gvkFor(gc.Object)
+		if err != nil {
+			return err
+		}
+		if goGVKs[gvk] {
+			return fmt.Errorf("duplicate Go controller for GVK: %v", gvk.String())
+		}
+		goGVKs[gvk] = true
+		if err := b.addGoController(gvk, gc); err != nil {
+			return err
+		}
+	}
+
+	if b.lint != nil {
+		runners := []runner.Runner{}
+		for gvk, r := range b.runners {
+			if !goGVKs[gvk] {
+				runners = append(runners, r)
+			}
+		}
+		if err := runner.Lint(runners, *b.lint); err != nil {
+			return err
+		}
+	}
+
+	// ansible_operator_build_info, without holding up the controllers
+	go controller.ReportVersions()
+	if b.runsAPI != nil && b.runsAPI.Log == nil {
+		b.runsAPI.Log = controller.NewRunLog(b.artifacts)
+	}
+	template := b.template(stop)
+	staticGVKs := []schema.GroupVersionKind{}
+	for gvk := range goGVKs {
+		staticGVKs = append(staticGVKs, gvk)
+	}
+	for gvk, r := range b.runners {
+		if goGVKs[gvk] {
+			logrus.Infof("%v is reconciled by a Go controller, skipping its watch", gvk)
+			continue
+		}
+		options := template
+		options.GVK = gvk
+		options.Runner = r
+		if _, err := controller.Add(b.mgr, options); err != nil {
+			return fmt.Errorf("failed to add the controller for %v: %v", gvk, err)
+		}
+		staticGVKs = append(staticGVKs, gvk)
+	}
+
+	if b.defaulting != nil {
+		options := *b.defaulting
+		options.Runners = map[schema.GroupVersionKind]runner.Runner{}
+		for gvk, r := range b.runners {
+			if !goGVKs[gvk] {
+				options.Runners[gvk] = r
+			}
+		}
+		if err := controller.AddDefaultingWebhook(b.mgr, options); err != nil {
+			return err
+		}
+	}
+	if b.runsAPI != nil {
+		if err := controller.AddRunsAPI(b.mgr, *b.runsAPI); err != nil {
+			return err
+		}
+	}
+	if b.ansibleJobs != nil {
+		if err := controller.AddAnsibleJobController(b.mgr, controller.AnsibleJobOptions{
+			Template:  template,
+			Playbooks: b.ansibleJobs,
+		}); err != nil {
+			return err
+		}
+	}
+	if b.schedules {
+		if err := controller.AddAnsibleScheduler(b.mgr, controller.AnsibleScheduleOptions{
+			Namespace: b.namespace,
+		}); err != nil {
+			return err
+		}
+	}
+	if b.watchesConfigMap != nil {
+		if err := controller.AddWatchesConfigMap(b.mgr, controller.WatchesConfigMapOptions{
+			Template:   template,
+			Namespace:  b.watchesConfigMap.Namespace,
+			Name:       b.watchesConfigMap.Name,
+			StaticGVKs: staticGVKs,
+		}); err != nil {
+			return err
+		}
+	}
+	if b.dynamic {
+		if err := controller.AddAnsibleWatchController(b.mgr, controller.AnsibleWatchOptions{
+			Template:   template,
+			StaticGVKs: staticGVKs,
+		}); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.runnables {
+		if err := b.mgr.Add(r); err != nil {
+			return fmt.Errorf("failed to add runnable: %v", err)
+		}
+	}
+	return nil
+}
+
+// template returns the options shared by all ansible controllers.
+func (b *Builder) template(stop <-chan struct{}) controller.Options {
+	postReconcile := b.postReconcile
+	if b.runsAPI != nil && b.runsAPI.Log != nil {
+		log, next := b.runsAPI.Log, b.postReconcile
+		postReconcile = func(u *unstructured.Unstructured, result controller.RunResult) {
+			log.Record(u, result)
+			if next != nil {
+				next(u, result)
+			}
+		}
+	}
+	return controller.Options{
+		Namespace:        b.namespace,
+		Namespaces:       b.namespaces,
+		EventHandlers:    b.eventHandlers,
+		LoggingLevel:     b.loggingLevel,
+		Upgradeable:      b.upgradeable,
+		DirectReads:      b.directReads,
+		MaxWorkers:       b.maxWorkers,
+		RESTMapper:       b.restMapper,
+		ServerSideApply:  b.apply,
+		Tracer:           b.tracer,
+		ArtifactUploader: b.artifacts,
+		RunDirs:          b.runDirs,
+		ARA:              b.ara,
+		EventLimits:      b.eventLimits,
+		CachedKinds:      b.cachedKinds,
+		Middleware:       b.middleware,
+		ProxyURL:         b.proxyURL,
+		Identities:       b.identities,
+		ReloadInterval:   b.reload,
+		NoProxy:          b.noProxy,
+		Handoff:          b.handoff,
+		StopChannel:      stop,
+
+		PreReconcile:        b.preReconcile,
+		PostReconcile:       postReconcile,
+		TrackingLabelPrefix: b.trackingLabelPrefix,
+	}
+}
+
+// Cleanup runs the finalizer of every ansible watch for each resource that
+// still has it, and removes it, instead of starting the controllers. It is
+// meant to be run before uninstalling the operator; see controller.Cleanup.
+func (b *Builder) Cleanup() error {
+	goGVKs := map[schema.GroupVersionKind]bool{}
+	for _, gc := range b.goControllers {
+		if gvk, err := b.gvkFor(gc.Object); err == nil {
+			goGVKs[gvk] = true
+		}
+	}
+	template := b.template(nil)
+	failed := 0
+	for gvk, r := range b.runners {
+		if goGVKs[gvk] {
+			continue
+		}
+		options := template
+		options.GVK = gvk
+		options.Runner = r
+		if err := controller.Cleanup(b.mgr.GetConfig(), options); err != nil {
+			logrus.Error(err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("cleanup failed for %d kinds", failed)
+	}
+	return nil
+}
+
+func (b *Builder) addGoController(gvk schema.GroupVersionKind, gc GoController) error {
+	if gc.Reconciler == nil {
+		return fmt.Errorf("no reconciler given for Go controller of %v", gvk)
+	}
+	name := gc.Name
+	if name == "" {
+		name = fmt.Sprintf("%v-controller", strings.ToLower(gvk.Kind))
+	}
+	logrus.Infof("Watching %s/%v, %s with a Go controller", gvk.Group, gvk.Version, gvk.Kind)
+	c, err := crcontroller.New(name, b.mgr, crcontroller.Options{
+		Reconciler:              gc.Reconciler,
+		MaxConcurrentReconciles: gc.MaxConcurrentReconciles,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: gc.Object}, &crthandler.EnqueueRequestForObject{})
+}
+
+// gvkFor determines the GVK of a Go controller's primary type.
+func (b *Builder) gvkFor(obj runtime.Object) (schema.GroupVersionKind, error) {
+	if obj == nil {
+		return schema.GroupVersionKind{}, fmt.Errorf("no object given for Go controller")
+	}
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		gvk := u.GroupVersionKind()
+		if gvk.Kind == "" {
+			return gvk, fmt.Errorf("unstructured object for Go controller has no kind set")
+		}
+		return gvk, nil
+	}
+	return apiutil.GVKForObject(obj, b.mgr.GetScheme())
+}
@@ -0,0 +1,284 @@
+package operatorcondition
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// OperatorConditionNameEnvVar is set by OLM on the operator's deployment
+	// to the name of the OperatorCondition CR that belongs to it.
+	OperatorConditionNameEnvVar = "OPERATOR_CONDITION_NAME"
+
+	// OperatorNamespaceEnvVar may be set to the namespace the operator runs
+	// in. If unset, the service account namespace file is used.
+	OperatorNamespaceEnvVar = "OPERATOR_NAMESPACE"
+
+	// ConditionUpgradeable is the condition type OLM checks before upgrading.
+	ConditionUpgradeable = "Upgradeable"
+
+	// UpgradeableFact is the fact a playbook sets (with set_fact) to a boolean
+	// to declare whether the operator may be upgraded.
+	UpgradeableFact = "operator_upgradeable"
+	// UpgradeableMessageFact is an optional fact explaining UpgradeableFact.
+	UpgradeableMessageFact = "operator_upgradeable_message"
+
+	reasonReconcileInProgress = "ReconcileInProgress"
+	reasonPlaybookBlocked     = "PlaybookBlocked"
+	reasonUpgradeable         = "Upgradeable"
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var operatorConditionGVK = schema.GroupVersionKind{
+	Group:   "operators.coreos.com",
+	Version: "v2",
+	Kind:    "OperatorCondition",
+}
+
+// Tracker keeps the Upgradeable condition of the operator's OperatorCondition
+// CR in sync with in-flight runs and with what playbooks have requested. The
+// condition is written by a goroutine of its own, so that runs do not wait
+// on the API server to start and finish.
+type Tracker struct {
+	client   client.Client
+	key      types.NamespacedName
+	mutex    sync.Mutex
+	inFlight int
+	blockers map[string]string
+	// dirty is signalled when the condition may have changed.
+	dirty chan struct{}
+	// last is the condition most recently written, used to avoid needless
+	// API calls. Only the writer uses it.
+	last string
+}
+
+// NewTracker returns a Tracker for the OperatorCondition named by
+// OPERATOR_CONDITION_NAME. The bool is false if the operator is not running
+// under OLM, in which case no Tracker is needed.
+func NewTracker(c client.Client) (*Tracker, bool, error) {
+	name := os.Getenv(OperatorConditionNameEnvVar)
+	if name == "" {
+		return nil, false, nil
+	}
+	namespace, err := operatorNamespace()
+	if err != nil {
+		return nil, false, err
+	}
+	t := &Tracker{
+		client:   c,
+		key:      types.NamespacedName{Namespace: namespace, Name: name},
+		blockers: map[string]string{},
+		dirty:    make(chan struct{}, 1),
+	}
+	go t.write()
+	return t, true, nil
+}
+
+// RunStarted records that a run has started. The operator is not upgradeable
+// while any run is in flight.
+func (t *Tracker) RunStarted() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inFlight++
+	t.sync()
+}
+
+// RunFinished records that a run has finished.
+func (t *Tracker) RunFinished() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inFlight--
+	t.sync()
+}
+
+// SetBlocked records whether the playbook run for the resource identified by
+// key asked for upgrades to be held back. A block stays in place until a
+// later run of the same resource clears it or the resource is forgotten.
+func (t *Tracker) SetBlocked(key string, blocked bool, message string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if blocked {
+		t.blockers[key] = message
+	} else {
+		delete(t.blockers, key)
+	}
+	t.sync()
+}
+
+// Forget drops any upgrade block held by the resource identified by key, for
+// example once it has been deleted.
+func (t *Tracker) Forget(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.blockers[key]; !ok {
+		return
+	}
+	delete(t.blockers, key)
+	t.sync()
+}
+
+// sync has the writer write the condition, if it changed. It does not need
+// the mutex, which callers changing the condition hold.
+func (t *Tracker) sync() {
+	select {
+	case t.dirty <- struct{}{}:
+	default:
+		// the writer has yet to see the last change, and will see this one
+	}
+}
+
+// write writes the desired condition each time it may have changed, with
+// the mutex held only to compute it. Failed writes are retried with backoff.
+func (t *Tracker) write() {
+	backoff := time.Duration(0)
+	for range t.dirty {
+		t.mutex.Lock()
+		upgradeable, reason, message := t.desired()
+		t.mutex.Unlock()
+		state := fmt.Sprintf("%t/%s/%s", upgradeable, reason, message)
+		if state == t.last {
+			continue
+		}
+		if err := t.setUpgradeable(upgradeable, reason, message); err != nil {
+			backoff = nextWriteBackoff(backoff)
+			logrus.Errorf("failed to update OperatorCondition %v, retrying in %v: %v", t.key, backoff, err)
+			time.AfterFunc(backoff, t.sync)
+			continue
+		}
+		backoff = 0
+		t.last = state
+	}
+}
+
+// nextWriteBackoff returns the time to wait before retrying a write that
+// failed after waiting last, doubling from a second up to a minute.
+func nextWriteBackoff(last time.Duration) time.Duration {
+	if last == 0 {
+		return time.Second
+	}
+	if last *= 2; last > time.Minute {
+		return time.Minute
+	}
+	return last
+}
+
+// desired returns the condition the runs and blockers call for. The mutex
+// must be held.
+func (t *Tracker) desired() (upgradeable bool, reason, message string) {
+	upgradeable = true
+	reason = reasonUpgradeable
+	message = "The operator is upgradeable"
+	switch {
+	case t.inFlight > 0:
+		upgradeable = false
+		reason = reasonReconcileInProgress
+		message = "Ansible runs are in progress"
+	case len(t.blockers) > 0:
+		upgradeable = false
+		reason = reasonPlaybookBlocked
+		msgs := []string{}
+		for key, m := range t.blockers {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", key, m))
+		}
+		sort.Strings(msgs)
+		message = strings.Join(msgs, "; ")
+	}
+	return upgradeable, reason, message
+}
+
+func (t *Tracker) setUpgradeable(upgradeable bool, reason, message string) error {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(operatorConditionGVK)
+	if err := t.client.Get(context.TODO(), t.key, u); err != nil {
+		return err
+	}
+	status := "True"
+	if !upgradeable {
+		status = "False"
+	}
+	newCondition := map[string]interface{}{
+		"type":               ConditionUpgradeable,
+		"status":             status,
+		"reason":             reason,
+		"message":            message,
+		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	conditions, _, err := unstructured.NestedSlice(u.Object, "spec", "conditions")
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, c := range conditions {
+		cm, ok := c.(map[string]interface{})
+		if !ok || cm["type"] != ConditionUpgradeable {
+			continue
+		}
+		found = true
+		if cm["status"] == newCondition["status"] && cm["reason"] == reason && cm["message"] == message {
+			return nil
+		}
+		if cm["status"] == newCondition["status"] {
+			newCondition["lastTransitionTime"] = cm["lastTransitionTime"]
+		}
+		conditions[i] = newCondition
+	}
+	if !found {
+		conditions = append(conditions, newCondition)
+	}
+	if err := unstructured.SetNestedSlice(u.Object, conditions, "spec", "conditions"); err != nil {
+		return err
+	}
+	logrus.Infof("setting %s=%s on OperatorCondition %v: %s", ConditionUpgradeable, status, t.key, message)
+	return t.client.Update(context.TODO(), u)
+}
+
+// UpgradeableFromEvent inspects a set_fact result for UpgradeableFact. found
+// is false if the event did not set it.
+func UpgradeableFromEvent(e eventapi.JobEvent) (upgradeable bool, message string, found bool) {
+	if e.Event != "runner_on_ok" || e.EventData["task_action"] != "set_fact" {
+		return false, "", false
+	}
+	res, ok := e.EventData["res"].(map[string]interface{})
+	if !ok {
+		return false, "", false
+	}
+	facts, ok := res["ansible_facts"].(map[string]interface{})
+	if !ok {
+		return false, "", false
+	}
+	v, ok := facts[UpgradeableFact].(bool)
+	if !ok {
+		return false, "", false
+	}
+	message, _ = facts[UpgradeableMessageFact].(string)
+	if message == "" {
+		message = "upgrade blocked by playbook"
+	}
+	return v, message, true
+}
+
+func operatorNamespace() (string, error) {
+	if ns := os.Getenv(OperatorNamespaceEnvVar); ns != "" {
+		return ns, nil
+	}
+	b, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine operator namespace: %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
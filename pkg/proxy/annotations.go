@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/proxy/kubeconfig"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The tracking annotations, set instead of an owner reference on resources
+// created in another namespace than their owner's, or at cluster scope for
+// a namespaced owner, where owner references are not allowed.
+const (
+	// OwnerAnnotation holds Kind.group/namespace/name of the owner.
+	OwnerAnnotation = "operator.ansible.io/owner"
+	// OwnerUIDAnnotation holds the UID of the owner.
+	OwnerUIDAnnotation = "operator.ansible.io/owner-uid"
+)
+
+// TrackingAnnotations returns the annotations identifying owner on a
+// resource in another namespace, or at cluster scope.
+func TrackingAnnotations(owner kubeconfig.Owner) map[string]string {
+	return map[string]string{
+		OwnerAnnotation:    fmt.Sprintf("%s/%s/%s", ownerKind(owner), owner.Namespace, owner.Name),
+		OwnerUIDAnnotation: string(owner.UID),
+	}
+}
+
+// requestNamespace returns the namespace of the object created by req, from
+// its body or else its path. It is empty for cluster-scoped objects.
+func requestNamespace(req *http.Request, data *unstructured.Unstructured) string {
+	if ns := data.GetNamespace(); ns != "" {
+		return ns
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i := 0; i+2 < len(parts); i++ {
+		// namespaces/<namespace>/<resource>, as opposed to the creation of
+		// a Namespace at namespaces
+		if parts[i] == "namespaces" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// crossScope reports whether an object in namespace cannot have owner as
+// its owner reference, because owner is namespaced and the object is in
+// another namespace, or cluster-scoped.
+func crossScope(owner kubeconfig.Owner, namespace string) bool {
+	return owner.Namespace != "" && namespace != owner.Namespace
+}
+
+func setAnnotations(u *unstructured.Unstructured, annotations map[string]string) {
+	a := u.GetAnnotations()
+	if a == nil {
+		a = map[string]string{}
+	}
+	for k, v := range annotations {
+		a[k] = v
+	}
+	u.SetAnnotations(a)
+}
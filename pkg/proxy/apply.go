@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// ApplyPatchContentType is the content type of server-side apply requests,
+// e.g. those of the k8s module with apply: yes and server_side_apply set.
+const ApplyPatchContentType = "application/apply-patch+yaml"
+
+// DefaultFieldManager is the field manager the proxy sets on apply requests
+// that name none, as the API server rejects them.
+const DefaultFieldManager = "ansible-operator"
+
+// isApplyPatch reports whether req is a server-side apply.
+func isApplyPatch(req *http.Request) bool {
+	return req.Method == http.MethodPatch && strings.HasPrefix(req.Header.Get("Content-Type"), ApplyPatchContentType)
+}
+
+// mayCreate reports whether req may create the object in its body: a POST,
+// or an apply, which creates the object if it doesn't exist.
+func mayCreate(req *http.Request) bool {
+	return req.Method == http.MethodPost || isApplyPatch(req)
+}
+
+// decodeObject decodes the object in body, the body of req. Apply requests
+// are YAML or JSON; the object is re-encoded as JSON, which is valid YAML,
+// for them too.
+func decodeObject(req *http.Request, body []byte) (*unstructured.Unstructured, error) {
+	if isApplyPatch(req) {
+		b, err := yaml.ToJSON(body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	data := &unstructured.Unstructured{}
+	if err := json.Unmarshal(body, &data.Object); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ApplyPatchHandler will handle proxied apply requests that set no
+// fieldManager, and set it to DefaultFieldManager.
+func ApplyPatchHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isApplyPatch(req) {
+			q := req.URL.Query()
+			if q.Get("fieldManager") == "" {
+				q.Set("fieldManager", DefaultFieldManager)
+				req.URL.RawQuery = q.Encode()
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// authorizationTTL is how long the result of a SubjectAccessReview is reused
+// for identical requests.
+const authorizationTTL = 10 * time.Second
+
+// AuthorizationHandler will handle proxied requests whose basic auth password
+// was issued by identities, as written by kubeconfig.CreateImpersonating, and
+// forward them only if a SubjectAccessReview allows the ServiceAccount it was
+// issued for to make them. Requests of owners with an identity issued are
+// denied without it, and every request without an issued password once
+// identities require them; RunProxy does with EnforceRBAC. Unlike ImpersonationHandler the request is then made with the
+// operator's credentials, so the operator needs permission to create
+// SubjectAccessReviews rather than to impersonate. It must run before the
+// Authorization header is removed.
+func AuthorizationHandler(h http.Handler, cfg *rest.Config, identities *Identities) (http.Handler, error) {
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a := &authorizer{clientset: clientset, cache: map[string]cachedReview{}}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del("Impersonate-User")
+		req.Header.Del("Impersonate-Group")
+		user, err := identities.userFor(req)
+		if err != nil {
+			logrus.Warningf("proxy denied request: %v", err)
+			writeStatus(w, http.StatusForbidden, metav1.StatusReasonForbidden, err.Error())
+			return
+		}
+		if user == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+		attrs := requestAttributes(req)
+		allowed, reason, err := a.allowed(user, attrs)
+		if err != nil {
+			logrus.Errorf("unable to authorize %s %s for %s: %v", req.Method, req.URL.Path, user, err)
+			writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, "unable to authorize request: "+err.Error())
+			return
+		}
+		if !allowed {
+			msg := fmt.Sprintf("%s cannot %s", user, attrs.describe())
+			if reason != "" {
+				msg += ": " + reason
+			}
+			logrus.Warningf("proxy denied request: %s", msg)
+			writeStatus(w, http.StatusForbidden, metav1.StatusReasonForbidden, msg)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}), nil
+}
+
+type cachedReview struct {
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+type authorizer struct {
+	clientset kubernetes.Interface
+	mutex     sync.Mutex
+	cache     map[string]cachedReview
+}
+
+func (a *authorizer) allowed(user string, attrs attributes) (bool, string, error) {
+	key := user + " " + attrs.describe()
+	a.mutex.Lock()
+	c, ok := a.cache[key]
+	a.mutex.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.allowed, c.reason, nil
+	}
+
+	namespace := strings.Split(strings.TrimPrefix(user, serviceAccountUserPrefix), ":")[0]
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user,
+			Groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace, "system:authenticated"},
+		},
+	}
+	if attrs.resource == "" {
+		sar.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{Path: attrs.path, Verb: attrs.verb}
+	} else {
+		sar.Spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace:   attrs.namespace,
+			Verb:        attrs.verb,
+			Group:       attrs.group,
+			Version:     attrs.version,
+			Resource:    attrs.resource,
+			Subresource: attrs.subresource,
+			Name:        attrs.name,
+		}
+	}
+	result, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(sar)
+	if err != nil {
+		return false, "", err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	for k, c := range a.cache {
+		if now.After(c.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = cachedReview{allowed: result.Status.Allowed, reason: result.Status.Reason, expires: now.Add(authorizationTTL)}
+	return result.Status.Allowed, result.Status.Reason, nil
+}
+
+// attributes are what a request asks of the API server, as authorized by
+// RBAC.
+type attributes struct {
+	verb        string
+	path        string
+	namespace   string
+	group       string
+	version     string
+	resource    string
+	subresource string
+	name        string
+}
+
+func (a attributes) describe() string {
+	if a.resource == "" {
+		return fmt.Sprintf("%s %s", a.verb, a.path)
+	}
+	r := a.resource
+	if a.group != "" {
+		r += "." + a.group
+	}
+	if a.subresource != "" {
+		r += "/" + a.subresource
+	}
+	s := fmt.Sprintf("%s %s", a.verb, r)
+	if a.name != "" {
+		s += " " + a.name
+	}
+	if a.namespace != "" {
+		s += " in namespace " + a.namespace
+	}
+	return s
+}
+
+// requestAttributes parses req the way the API server does for
+// authorization: /api/v1/... and /apis/<group>/<version>/... are resource
+// requests, any other path is a non-resource request.
+func requestAttributes(req *http.Request) attributes {
+	attrs := attributes{path: req.URL.Path, verb: strings.ToLower(req.Method)}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		attrs.version = parts[1]
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		attrs.group = parts[1]
+		attrs.version = parts[2]
+		parts = parts[3:]
+	default:
+		return attrs
+	}
+	watch := false
+	if parts[0] == "watch" {
+		watch = true
+		parts = parts[1:]
+	}
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		if len(parts) == 2 {
+			// the namespace itself
+			attrs.resource = "namespaces"
+			attrs.name = parts[1]
+			parts = nil
+		} else {
+			attrs.namespace = parts[1]
+			parts = parts[2:]
+		}
+	}
+	if len(parts) > 0 {
+		attrs.resource = parts[0]
+	}
+	if len(parts) > 1 {
+		attrs.name = parts[1]
+	}
+	if len(parts) > 2 {
+		attrs.subresource = parts[2]
+	}
+	if q := req.URL.Query().Get("watch"); q == "true" || q == "1" {
+		watch = true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		switch {
+		case watch:
+			attrs.verb = "watch"
+		case attrs.name == "":
+			attrs.verb = "list"
+		default:
+			attrs.verb = "get"
+		}
+	case http.MethodPost:
+		attrs.verb = "create"
+	case http.MethodPut:
+		attrs.verb = "update"
+	case http.MethodPatch:
+		attrs.verb = "patch"
+	case http.MethodDelete:
+		attrs.verb = "delete"
+		if attrs.name == "" {
+			attrs.verb = "deletecollection"
+		}
+	}
+	return attrs
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/metrics"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The values of the cache label of proxied requests.
+const (
+	// CacheHit reads were served from the cache.
+	CacheHit = "hit"
+	// CacheMiss reads were of a cached kind, but not found in the cache, and
+	// forwarded.
+	CacheMiss = "miss"
+	// CacheBypass requests could not be served from the cache, e.g. writes,
+	// lists and reads of kinds not cached, and were forwarded.
+	CacheBypass = "bypass"
+)
+
+var (
+	proxyRequests = metrics.NewCounterVec("ansible_operator_proxy_requests_total",
+		"Requests of playbooks through the proxy, by resource kind, verb and whether they were served from the cache.",
+		"group", "version", "kind", "verb", "cache")
+	proxyCacheHitRatio = metrics.NewGaugeVec("ansible_operator_proxy_cache_hit_ratio",
+		"Share of the reads of a cached kind served from the cache.",
+		"group", "version", "kind")
+	proxyUpstreamDuration = metrics.NewHistogramVec("ansible_operator_proxy_upstream_request_duration_seconds",
+		"Time the API server took to answer the requests the proxy forwarded, watches excluded.",
+		metrics.DefaultBuckets, "group", "version", "kind", "verb")
+	proxyInFlight = metrics.NewGaugeVec("ansible_operator_proxy_in_flight_requests",
+		"Requests the proxy is serving, watches included.",
+		"group", "version", "kind", "verb")
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(proxyRequests, proxyCacheHitRatio, proxyUpstreamDuration, proxyInFlight)
+}
+
+// KindSet - the kinds the informer cache of the operator holds, which the
+// proxy may serve reads of from the cache. It is safe for concurrent use.
+type KindSet struct {
+	mutex sync.RWMutex
+	kinds map[schema.GroupVersionKind]bool
+}
+
+// NewKindSet returns an empty KindSet.
+func NewKindSet() *KindSet {
+	return &KindSet{kinds: map[schema.GroupVersionKind]bool{}}
+}
+
+// Add adds gvk to s. Adding to a nil KindSet does nothing.
+func (s *KindSet) Add(gvk schema.GroupVersionKind) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.kinds[gvk] = true
+}
+
+// Has reports whether gvk is in s. A nil KindSet has no kinds.
+func (s *KindSet) Has(gvk schema.GroupVersionKind) bool {
+	if s == nil {
+		return false
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.kinds[gvk]
+}
+
+// hitCounter keeps the hits and misses of each kind for the hit ratio.
+type hitCounter struct {
+	mutex  sync.Mutex
+	hits   map[schema.GroupVersionKind]float64
+	misses map[schema.GroupVersionKind]float64
+}
+
+func (c *hitCounter) record(gvk schema.GroupVersionKind, hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if hit {
+		c.hits[gvk]++
+	} else {
+		c.misses[gvk]++
+	}
+	proxyCacheHitRatio.Set(c.hits[gvk]/(c.hits[gvk]+c.misses[gvk]), gvk.Group, gvk.Version, gvk.Kind)
+}
+
+// CacheHandler will handle proxied requests, serve the reads of single
+// objects of the kinds in kinds from reader, if set, and forward the others
+// to h. Requests impersonating a user are always forwarded, as the cache
+// holds what the operator may read. It records the metrics of every request,
+// mapping resources to kinds with mapper. It must run after the
+// ImpersonationHandler.
+func CacheHandler(h http.Handler, reader client.Reader, kinds *KindSet, mapper meta.RESTMapper) http.Handler {
+	counter := &hitCounter{hits: map[schema.GroupVersionKind]float64{}, misses: map[schema.GroupVersionKind]float64{}}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attrs := requestAttributes(req)
+		gvk := schema.GroupVersionKind{Group: attrs.group, Version: attrs.version, Kind: attrs.resource}
+		if mapper != nil && attrs.resource != "" {
+			if k, err := mapper.KindFor(schema.GroupVersionResource{Group: attrs.group, Version: attrs.version, Resource: attrs.resource}); err == nil {
+				gvk = k
+			}
+		}
+		labels := []string{gvk.Group, gvk.Version, gvk.Kind, attrs.verb}
+		proxyInFlight.Add(1, labels...)
+		defer proxyInFlight.Add(-1, labels...)
+
+		result := CacheBypass
+		if reader != nil && kinds.Has(gvk) && cacheable(req, attrs) {
+			if serveFromCache(w, reader, gvk, attrs) {
+				counter.record(gvk, true)
+				proxyRequests.Inc(append(labels, CacheHit)...)
+				return
+			}
+			counter.record(gvk, false)
+			result = CacheMiss
+		}
+		proxyRequests.Inc(append(labels, result)...)
+		start := time.Now()
+		h.ServeHTTP(w, req)
+		if attrs.verb != "watch" {
+			proxyUpstreamDuration.Observe(time.Since(start).Seconds(), labels...)
+		}
+	})
+}
+
+// cacheable reports whether req is a plain read of a single object, which
+// the cache can answer the way the API server would.
+func cacheable(req *http.Request, attrs attributes) bool {
+	if attrs.verb != "get" || attrs.name == "" || attrs.subresource != "" {
+		return false
+	}
+	if req.Header.Get("Impersonate-User") != "" || len(req.URL.Query()) != 0 {
+		return false
+	}
+	// e.g. tables or partial object metadata
+	return !strings.Contains(req.Header.Get("Accept"), "as=")
+}
+
+// serveFromCache writes the object attrs name from reader. It returns false,
+// having written nothing, if reader does not hold it.
+func serveFromCache(w http.ResponseWriter, reader client.Reader, gvk schema.GroupVersionKind, attrs attributes) bool {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	err := reader.Get(context.TODO(), types.NamespacedName{Namespace: attrs.namespace, Name: attrs.name}, u)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logrus.Debugf("unable to read %v %s/%s from the cache: %v", gvk, attrs.namespace, attrs.name, err)
+		}
+		return false
+	}
+	b, err := json.Marshal(u.Object)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return true
+}
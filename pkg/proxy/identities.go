@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Identities - the ServiceAccounts the operator's runs act as, by the
+// password of the kubeconfig issued to each run. It is shared by the proxy
+// and the controllers that issue the kubeconfigs, and is safe for concurrent
+// use.
+type Identities struct {
+	mutex   sync.RWMutex
+	issued  map[string]identity
+	byOwner map[types.UID]int
+	// required, once set, has every run issued a password, and the proxy
+	// deny requests without one.
+	required bool
+}
+
+type identity struct {
+	owner types.UID
+	user  string
+}
+
+// NewIdentities returns Identities with none issued.
+func NewIdentities() *Identities {
+	return &Identities{issued: map[string]identity{}, byOwner: map[types.UID]int{}}
+}
+
+// RequireIssued has every run issued a password, those acting as the
+// operator included, and the proxy deny the requests of any other caller.
+func (i *Identities) RequireIssued() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.required = true
+}
+
+// Required reports whether every run must be issued a password; see
+// RequireIssued. A nil Identities requires none.
+func (i *Identities) Required() bool {
+	if i == nil {
+		return false
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.required
+}
+
+// Issue records that the run of owner acts as user, or as the operator if
+// user is empty, and returns the
+// password of its kubeconfig, valid until it is revoked.
+func (i *Identities) Issue(owner types.UID, user string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(b)
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.issued[password] = identity{owner: owner, user: user}
+	i.byOwner[owner]++
+	return password, nil
+}
+
+// Revoke forgets the identity issued with password.
+func (i *Identities) Revoke(password string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	id, ok := i.issued[password]
+	if !ok {
+		return
+	}
+	delete(i.issued, password)
+	if i.byOwner[id.owner]--; i.byOwner[id.owner] <= 0 {
+		delete(i.byOwner, id.owner)
+	}
+}
+
+// userFor returns the user the request acts as: the one issued with its
+// password, or none, for the operator's credentials. Requests of owners
+// with an identity issued must carry it, as must every request once issued
+// passwords are required. A nil Identities has none issued.
+func (i *Identities) userFor(req *http.Request) (string, error) {
+	required := i.Required()
+	_, password, ok := req.BasicAuth()
+	if !ok {
+		if required {
+			return "", fmt.Errorf("the proxy only serves runs with the credentials issued to them")
+		}
+		return "", nil
+	}
+	owner, err := ownerFromRequest(req)
+	if err != nil {
+		return "", err
+	}
+	id, issued := i.lookup(password)
+	bound := false
+	if i != nil {
+		i.mutex.RLock()
+		bound = i.byOwner[owner.UID] > 0
+		i.mutex.RUnlock()
+	}
+	switch {
+	case issued && id.owner == owner.UID:
+		return id.user, nil
+	case issued, bound:
+		return "", fmt.Errorf("the credentials of %s %s were not issued to this run", owner.Kind, owner.Name)
+	case required:
+		return "", fmt.Errorf("the proxy only serves runs with the credentials issued to them")
+	case strings.HasPrefix(password, serviceAccountUserPrefix):
+		return "", fmt.Errorf("the proxy only acts as the ServiceAccounts it issued kubeconfigs for")
+	}
+	return "", nil
+}
+
+// lookup returns the identity issued with password.
+func (i *Identities) lookup(password string) (identity, bool) {
+	if i == nil {
+		return identity{}, false
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	id, ok := i.issued[password]
+	return id, ok
+}
@@ -0,0 +1,55 @@
+package kubeconfig
+
+import (
+	"io/ioutil"
+	"os"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// CreateDirect writes a kubeconfig that reaches the API server of cfg
+// directly, with its credentials, rather than through the proxy. The
+// resources created with it are not given an owner.
+func CreateDirect(cfg *rest.Config, namespace string) (*os.File, error) {
+	config := clientcmdapi.NewConfig()
+	config.Clusters["cluster"] = &clientcmdapi.Cluster{
+		Server:                   cfg.Host,
+		CertificateAuthority:     cfg.CAFile,
+		CertificateAuthorityData: cfg.CAData,
+		InsecureSkipTLSVerify:    cfg.Insecure,
+	}
+	config.AuthInfos["operator"] = &clientcmdapi.AuthInfo{
+		ClientCertificate:     cfg.CertFile,
+		ClientCertificateData: cfg.CertData,
+		ClientKey:             cfg.KeyFile,
+		ClientKeyData:         cfg.KeyData,
+		Token:                 cfg.BearerToken,
+		Username:              cfg.Username,
+		Password:              cfg.Password,
+	}
+	config.Contexts["operator"] = &clientcmdapi.Context{
+		Cluster:   "cluster",
+		AuthInfo:  "operator",
+		Namespace: namespace,
+	}
+	config.CurrentContext = "operator"
+	b, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Write(b); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
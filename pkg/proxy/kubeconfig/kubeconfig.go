@@ -35,30 +35,53 @@ users:
 - name: admin/proxy-server
   user:
     username: {{.Username}}
-    password: unused
+    password: {{.Password}}
 `
 
 // values holds the data used to render the template
 type values struct {
 	Username  string
+	Password  string
 	ProxyURL  string
 	Namespace string
 }
 
+// Owner is encoded in the username of the kubeconfig, for the proxy to
+// inject into the resources created with it.
+type Owner struct {
+	metav1.OwnerReference
+	// Namespace of the owner, empty for cluster-scoped owners.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// unusedPassword is the password of kubeconfigs that do not impersonate.
+const unusedPassword = "unused"
+
 // Create renders a kubeconfig template and writes it to disk
 func Create(ownerRef metav1.OwnerReference, proxyURL string, namespace string) (*os.File, error) {
+	return CreateImpersonating(ownerRef, proxyURL, namespace, "")
+}
+
+// CreateImpersonating renders a kubeconfig like Create, with the password
+// issued by the proxy's Identities for the user the proxy impersonates. If
+// password is empty, the proxy uses its own credentials.
+func CreateImpersonating(ownerRef metav1.OwnerReference, proxyURL string, namespace string, password string) (*os.File, error) {
 	parsedURL, err := url.Parse(proxyURL)
 	if err != nil {
 		return nil, err
 	}
-	ownerRefJSON, err := json.Marshal(ownerRef)
+	ownerRefJSON, err := json.Marshal(Owner{OwnerReference: ownerRef, Namespace: namespace})
 	if err != nil {
 		return nil, err
 	}
 	username := base64.URLEncoding.EncodeToString([]byte(ownerRefJSON))
-	parsedURL.User = url.User(username)
+	if password == "" {
+		password = unusedPassword
+	}
+	parsedURL.User = url.UserPassword(username, password)
 	v := values{
 		Username:  username,
+		Password:  password,
 		ProxyURL:  parsedURL.String(),
 		Namespace: namespace,
 	}
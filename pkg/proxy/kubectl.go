@@ -208,8 +208,13 @@ func newServer(apiProxyPrefix string, cfg *rest.Config) (*server, error) {
 	proxy := k8sproxy.NewUpgradeAwareHandler(target, transport, false, false, responder)
 	proxy.UpgradeTransport = upgradeTransport
 	proxy.UseRequestLocation = true
+	// Watches stream events for as long as the client waits, so each event
+	// is flushed to the client as soon as it arrives.
+	watchProxy := k8sproxy.NewUpgradeAwareHandler(target, transport, false, false, responder)
+	watchProxy.UseRequestLocation = true
+	watchProxy.FlushInterval = -1
 
-	proxyServer := http.Handler(proxy)
+	proxyServer := WatchHandler(watchProxy, proxy)
 
 	if !strings.HasPrefix(apiProxyPrefix, "/api") {
 		proxyServer = stripLeaveSlash(apiProxyPrefix, proxyServer)
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/proxy/kubeconfig"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The names of the tracking labels, below a configurable prefix.
+const (
+	OwnerKindLabel          = "owner-kind"
+	OwnerNameLabel          = "owner-name"
+	OwnerNamespaceHashLabel = "owner-namespace-hash"
+)
+
+// maxLabelValue is the maximum length of a label value.
+const maxLabelValue = 63
+
+// TrackingLabels returns the labels identifying the owner of a resource,
+// with keys below prefix: the owner's kind and group, its name and a hash of
+// its namespace. Unlike owner references they may be set on resources in
+// other namespaces or cluster-scoped ones.
+func TrackingLabels(prefix string, owner kubeconfig.Owner) map[string]string {
+	labels := map[string]string{
+		prefix + "/" + OwnerKindLabel: labelValue(ownerKind(owner)),
+		prefix + "/" + OwnerNameLabel: labelValue(owner.Name),
+	}
+	if owner.Namespace != "" {
+		labels[prefix+"/"+OwnerNamespaceHashLabel] = NamespaceHash(owner.Namespace)
+	}
+	return labels
+}
+
+// NamespaceHash returns the value of the owner-namespace-hash label for
+// namespace.
+func NamespaceHash(namespace string) string {
+	h := sha256.Sum256([]byte(namespace))
+	return hex.EncodeToString(h[:])[:16]
+}
+
+// ownerKind returns Kind.group, or Kind for owners in the core group.
+func ownerKind(owner kubeconfig.Owner) string {
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil || gv.Group == "" {
+		return owner.Kind
+	}
+	return owner.Kind + "." + gv.Group
+}
+
+// labelValue shortens values too long for a label, keeping them unique with
+// a hash of the full value.
+func labelValue(v string) string {
+	if len(v) <= maxLabelValue {
+		return v
+	}
+	h := sha256.Sum256([]byte(v))
+	suffix := hex.EncodeToString(h[:])[:8]
+	return strings.TrimRight(v[:maxLabelValue-len(suffix)-1], "-_.") + "-" + suffix
+}
+
+// ownerFromRequest decodes the owner from the basic auth username of req, as
+// written by kubeconfig.Create.
+func ownerFromRequest(req *http.Request) (kubeconfig.Owner, error) {
+	owner := kubeconfig.Owner{}
+	user, _, ok := req.BasicAuth()
+	if !ok {
+		return owner, fmt.Errorf("basic auth header not found")
+	}
+	authString, err := base64.URLEncoding.DecodeString(user)
+	if err != nil {
+		// usernames written before kubeconfig used URL encoding
+		authString, err = base64.StdEncoding.DecodeString(user)
+		if err != nil {
+			return owner, fmt.Errorf("could not base64 decode username: %v", err)
+		}
+	}
+	if err := json.Unmarshal(authString, &owner); err != nil {
+		return owner, fmt.Errorf("could not decode owner: %v", err)
+	}
+	return owner, nil
+}
+
+// InjectTrackingLabelsHandler will handle proxied requests that create
+// resources, including server-side applies, and label them with the TrackingLabels of the owner found in
+// the authorization header, below prefix. It must run before the
+// Authorization header is removed.
+func InjectTrackingLabelsHandler(h http.Handler, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !mayCreate(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		owner, err := ownerFromRequest(req)
+		if err != nil {
+			logrus.Errorf("unable to inject tracking labels: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			m := "could not read request body"
+			logrus.Errorf("%s: %s", m, err.Error())
+			http.Error(w, m, http.StatusInternalServerError)
+			return
+		}
+		data, err := decodeObject(req, body)
+		if err != nil || data.GetKind() == "" {
+			// not an object, e.g. a review or eviction; forward it as is
+			req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+			h.ServeHTTP(w, req)
+			return
+		}
+		labels := data.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		for k, v := range TrackingLabels(prefix, owner) {
+			labels[k] = v
+		}
+		data.SetLabels(labels)
+		newBody, err := json.Marshal(data.Object)
+		if err != nil {
+			m := "could not serialize body"
+			logrus.Errorf("%s: %s", m, err.Error())
+			http.Error(w, m, http.StatusInternalServerError)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(newBody))
+		req.ContentLength = int64(len(newBody))
+		h.ServeHTTP(w, req)
+	})
+}
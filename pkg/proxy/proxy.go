@@ -5,72 +5,78 @@ package proxy
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // InjectOwnerReferenceHandler will handle proxied requests and inject the
-// owner refernece found in the authorization header. The Authorization is
-// then deleted so that the proxy can re-set with the correct authorization.
+// owner refernece found in the authorization header. Objects created in
+// another namespace than the owner's get its TrackingAnnotations instead. The
+// Authorization is then deleted so that the proxy can re-set with the
+// correct authorization.
 func InjectOwnerReferenceHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if req.Method == http.MethodPost {
+		if mayCreate(req) {
 			logrus.Info("injecting owner reference")
 			dump, _ := httputil.DumpRequest(req, false)
-			fmt.Println(string(dump))
+			logrus.Debug(string(dump))
 
-			user, _, ok := req.BasicAuth()
-			if !ok {
+			if _, _, ok := req.BasicAuth(); !ok {
 				logrus.Error("basic auth header not found")
 				w.Header().Set("WWW-Authenticate", "Basic realm=\"Operator Proxy\"")
 				http.Error(w, "", http.StatusUnauthorized)
 				return
 			}
-			authString, err := base64.StdEncoding.DecodeString(user)
+			owner, err := ownerFromRequest(req)
 			if err != nil {
-				m := "could not base64 decode username"
-				logrus.Errorf("%s: %s", err.Error())
-				http.Error(w, m, http.StatusBadRequest)
+				logrus.Errorf("unable to inject owner reference: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			owner := metav1.OwnerReference{}
-			json.Unmarshal(authString, &owner)
 
-			logrus.Printf("%#+v", owner)
+			logrus.Printf("%#+v", owner.OwnerReference)
 
 			body, err := ioutil.ReadAll(req.Body)
 			if err != nil {
 				m := "could not read request body"
-				logrus.Errorf("%s: %s", err.Error())
+				logrus.Errorf("%s: %s", m, err.Error())
 				http.Error(w, m, http.StatusInternalServerError)
 				return
 			}
-			data := &unstructured.Unstructured{}
-			err = json.Unmarshal(body, data)
+			data, err := decodeObject(req, body)
 			if err != nil {
 				m := "could not deserialize request body"
-				logrus.Errorf("%s: %s", err.Error())
+				logrus.Errorf("%s: %s", m, err.Error())
 				http.Error(w, m, http.StatusBadRequest)
 				return
 			}
-			data.SetOwnerReferences(append(data.GetOwnerReferences(), owner))
+			if crossScope(owner, requestNamespace(req, data)) {
+				// An owner reference to another namespace would have the
+				// garbage collector delete the object, and one from a
+				// cluster-scoped object to a namespaced owner is invalid.
+				setAnnotations(data, TrackingAnnotations(owner))
+			} else {
+				data.SetOwnerReferences(append(data.GetOwnerReferences(), owner.OwnerReference))
+			}
 			newBody, err := json.Marshal(data.Object)
 			if err != nil {
 				m := "could not serialize body"
-				logrus.Errorf("%s: %s", err.Error())
+				logrus.Errorf("%s: %s", m, err.Error())
 				http.Error(w, m, http.StatusInternalServerError)
 				return
 			}
-			logrus.Debugf(string(newBody))
+			logrus.Debug(string(newBody))
 			req.Body = ioutil.NopCloser(bytes.NewBuffer(newBody))
 			req.ContentLength = int64(len(newBody))
 		}
@@ -80,9 +86,75 @@ func InjectOwnerReferenceHandler(h http.Handler) http.Handler {
 	})
 }
 
+// serviceAccountUserPrefix is the prefix of the user names of
+// ServiceAccounts, the only users the proxy impersonates.
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// ImpersonationHandler will handle proxied requests whose basic auth password
+// was issued by identities, as written by kubeconfig.CreateImpersonating, and
+// have the API server act as the ServiceAccount it was issued for rather
+// than the operator. Requests of owners with an identity issued are denied
+// without it. It must run before the Authorization header is removed.
+func ImpersonationHandler(h http.Handler, identities *Identities) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del("Impersonate-User")
+		req.Header.Del("Impersonate-Group")
+		user, err := identities.userFor(req)
+		if err != nil {
+			logrus.Warningf("proxy denied request: %v", err)
+			writeStatus(w, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, err.Error())
+			return
+		}
+		if user != "" {
+			req.Header.Set("Impersonate-User", user)
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// WatchHandler will pass watch requests, which stream events until either
+// side closes them, to watch, and every other request to h.
+func WatchHandler(watch, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isWatchRequest(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		logrus.Debugf("watching %s", req.URL.String())
+		watch.ServeHTTP(w, req)
+		logrus.Debugf("watch of %s ended", req.URL.Path)
+	})
+}
+
+// isWatchRequest reports whether req is a watch, either with the watch
+// parameter or the deprecated /watch/ path prefix.
+func isWatchRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	switch req.URL.Query().Get("watch") {
+	case "true", "1":
+		return true
+	}
+	for _, prefix := range []string{"/api/v1/watch/", "/apis/"} {
+		if !strings.HasPrefix(req.URL.Path, prefix) {
+			continue
+		}
+		if prefix != "/apis/" {
+			return true
+		}
+		// /apis/<group>/<version>/watch/...
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 4)
+		return len(parts) == 4 && parts[2] == "watch"
+	}
+	return false
+}
+
 // HandlerChain will be used for users to pass defined handlers to the proxy.
 // The hander chain will be run after InjectingOwnerReference if it is added
 // and before the proxy handler.
+// Handlers that wrap the http.ResponseWriter must keep it an http.Flusher,
+// which watch requests rely on to stream events.
 type HandlerChain func(http.Handler) http.Handler
 
 // Options will be used by the user to specify the desired details
@@ -93,30 +165,93 @@ type Options struct {
 	Handler          HandlerChain
 	NoOwnerInjection bool
 	KubeConfig       *rest.Config
+	// TrackingLabelPrefix, if set, labels every resource created through
+	// the proxy with the TrackingLabels of its owner, below this prefix.
+	TrackingLabelPrefix string
+	// EnforceRBAC checks the requests of playbooks run as a ServiceAccount
+	// with a SubjectAccessReview, instead of impersonating it. Requests
+	// without a password issued by Identities, which it requires, are denied.
+	EnforceRBAC bool
+	// Identities are the ServiceAccounts the runs of the operator act as;
+	// without them, runs act as the operator.
+	Identities *Identities
+	// Cache, if set, serves the reads of single objects of the kinds in
+	// CachedKinds; see CacheHandler.
+	Cache       client.Reader
+	CachedKinds *KindSet
+	// RESTMapper, if set, maps the resources of requests to the kinds their
+	// metrics are labelled with.
+	RESTMapper meta.RESTMapper
 }
 
 // RunProxy will start a proxy server in a go routine and return on the error
 // channel if something is not correct on startup.
 func RunProxy(done chan error, o Options) {
-	server, err := newServer("/", o.KubeConfig)
+	server, l, err := listen(o)
 	if err != nil {
 		done <- err
 		return
 	}
+	go func() {
+		logrus.Infof("Starting to serve on %s\n", l.Addr().String())
+		done <- server.ServeOnListener(l)
+	}()
+}
+
+// RunProxyUntil serves the proxy like RunProxy until stop is closed, then
+// closes the server and its listener, so that the port can be served again,
+// and returns nil. It returns the error of the server otherwise.
+func RunProxyUntil(o Options, stop <-chan struct{}) error {
+	s, l, err := listen(o)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s.Handler}
+	logrus.Infof("Starting to serve on %s", l.Addr().String())
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(l) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+		return server.Close()
+	}
+}
+
+// listen returns the proxy server of o, with its handler chain, and its
+// listener.
+func listen(o Options) (*server, net.Listener, error) {
+	server, err := newServer("/", o.KubeConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	server.Handler = CacheHandler(server.Handler, o.Cache, o.CachedKinds, o.RESTMapper)
 	if o.Handler != nil {
 		server.Handler = o.Handler(server.Handler)
 	}
 
+	server.Handler = ApplyPatchHandler(server.Handler)
 	if !o.NoOwnerInjection {
 		server.Handler = InjectOwnerReferenceHandler(server.Handler)
 	}
+	if o.TrackingLabelPrefix != "" {
+		server.Handler = InjectTrackingLabelsHandler(server.Handler, o.TrackingLabelPrefix)
+	}
+	if o.EnforceRBAC {
+		if o.Identities == nil {
+			return nil, nil, fmt.Errorf("enforcing RBAC in the proxy requires its Identities")
+		}
+		o.Identities.RequireIssued()
+		server.Handler, err = AuthorizationHandler(server.Handler, o.KubeConfig, o.Identities)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		server.Handler = ImpersonationHandler(server.Handler, o.Identities)
+	}
 	l, err := server.Listen(o.Address, o.Port)
 	if err != nil {
-		done <- err
-		return
+		return nil, nil, err
 	}
-	go func() {
-		logrus.Infof("Starting to serve on %s\n", l.Addr().String())
-		done <- server.ServeOnListener(l)
-	}()
+	return server, l, nil
 }
@@ -0,0 +1,122 @@
+package rbac
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/runner"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	// verbs the operator itself needs on the resources it watches.
+	watchedVerbs = []string{"get", "list", "watch", "update", "patch"}
+	triggerVerbs = []string{"get", "list", "watch"}
+)
+
+// ScanWatches scans the playbooks and roles of every watch, and records what
+// the operator itself needs to reconcile them: the watched resources, their
+// triggers and the objects referenced from the watches file.
+func (s *Scanner) ScanWatches(watches map[schema.GroupVersionKind]runner.Runner) error {
+	if len(watches) > 0 {
+		// to skip the resources of terminating namespaces
+		s.Add(schema.GroupResource{Resource: "namespaces"}, "get")
+	}
+	for gvk, r := range watches {
+		s.AddKind(gvk, watchedVerbs, "status", "finalizers")
+		for _, t := range r.GetTriggers() {
+			s.AddKind(t.GroupVersionKind(), triggerVerbs)
+		}
+		for _, dgvk := range r.GetWatchedResources() {
+			s.AddKind(dgvk, triggerVerbs)
+		}
+		for _, source := range r.GetExtraVarsFrom() {
+			if source.ConfigMapRef != nil {
+				s.Add(schema.GroupResource{Resource: "configmaps"}, "get")
+			}
+			if source.SecretRef != nil {
+				s.Add(schema.GroupResource{Resource: "secrets"}, "get")
+			}
+		}
+		if _, ok := r.GetTargetCluster(); ok {
+			s.Add(schema.GroupResource{Resource: "secrets"}, "get")
+		}
+		if _, ok := r.GetCredentials(); ok {
+			s.Add(schema.GroupResource{Resource: "secrets"}, "get")
+		}
+		if _, ok := r.GetServiceAccount(); ok {
+			if s.ProxyRBAC {
+				s.Add(schema.GroupResource{Group: "authorization.k8s.io", Resource: "subjectaccessreviews"}, "create")
+			} else {
+				s.Add(schema.GroupResource{Resource: "serviceaccounts"}, "impersonate")
+			}
+		}
+		if _, ok := r.GetAnsibleRuns(); ok {
+			s.Add(schema.GroupResource{Group: "operator.ansible.io", Resource: "ansibleruns"}, "create", "list", "delete")
+		}
+		s.watchDependents = r.GetWatchDependentResources()
+		for _, path := range r.GetPaths() {
+			if err := s.ScanPath(path); err != nil {
+				return err
+			}
+		}
+		s.watchDependents = false
+	}
+	return nil
+}
+
+// Rules returns the policy rules granting the recorded verbs. Resources of
+// the same group that need the same verbs share a rule.
+func (s *Scanner) Rules() []rbacv1.PolicyRule {
+	type ruleKey struct {
+		group string
+		verbs string
+	}
+	resources := map[ruleKey][]string{}
+	for gr, verbs := range s.resources {
+		k := ruleKey{group: gr.Group, verbs: strings.Join(verbs.List(), ",")}
+		resources[k] = append(resources[k], gr.Resource)
+	}
+	rules := []rbacv1.PolicyRule{}
+	for k, res := range resources {
+		sort.Strings(res)
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{k.group},
+			Resources: res,
+			Verbs:     strings.Split(k.verbs, ","),
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].APIGroups[0] != rules[j].APIGroups[0] {
+			return rules[i].APIGroups[0] < rules[j].APIGroups[0]
+		}
+		return rules[i].Resources[0] < rules[j].Resources[0]
+	})
+	return rules
+}
+
+// ClusterRole returns a ClusterRole named name with the recorded rules.
+func (s *Scanner) ClusterRole(name string) *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Rules:      s.Rules(),
+	}
+}
+
+// Role returns a Role named name in namespace with the recorded rules.
+func (s *Scanner) Role(name, namespace string) *rbacv1.Role {
+	return &rbacv1.Role{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "Role",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Rules:      s.Rules(),
+	}
+}
@@ -0,0 +1,429 @@
+package rbac
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+var (
+	// verbs needed by the k8s modules.
+	applyVerbs  = []string{"get", "create", "update", "patch"}
+	deleteVerbs = []string{"get", "delete"}
+	readVerbs   = []string{"get", "list"}
+	scaleVerbs  = []string{"get", "update", "patch"}
+	statusVerbs = []string{"get", "update", "patch"}
+
+	// matches the top level apiVersion and kind of a manifest, which may be a
+	// template that is not valid YAML on its own.
+	apiVersionRegexp = regexp.MustCompile(`(?m)^apiVersion:\s*["']?([^\s"']+)`)
+	kindRegexp       = regexp.MustCompile(`(?m)^kind:\s*["']?([^\s"']+)`)
+	documentRegexp   = regexp.MustCompile(`(?m)^---`)
+)
+
+// Scanner collects the API resources that playbooks and roles manage with
+// the k8s modules, and the verbs they need on them.
+type Scanner struct {
+	// RolesPath is where roles referenced by name are looked up.
+	RolesPath string
+	// ProxyRBAC records what the operator needs when its proxy authorizes
+	// the requests of ServiceAccount watches with SubjectAccessReviews,
+	// instead of impersonating them.
+	ProxyRBAC bool
+	resources map[schema.GroupResource]sets.String
+	visited   map[string]bool
+	warnings  []string
+	// watchDependents adds the verbs needed to watch the resources applied
+	// with the k8s module.
+	watchDependents bool
+}
+
+// NewScanner returns a Scanner that looks up roles in rolesPath.
+func NewScanner(rolesPath string) *Scanner {
+	return &Scanner{
+		RolesPath: rolesPath,
+		resources: map[schema.GroupResource]sets.String{},
+		visited:   map[string]bool{},
+	}
+}
+
+// Add records that verbs are needed on resource.
+func (s *Scanner) Add(resource schema.GroupResource, verbs ...string) {
+	if _, ok := s.resources[resource]; !ok {
+		s.resources[resource] = sets.NewString()
+	}
+	s.resources[resource].Insert(verbs...)
+}
+
+// AddKind records that verbs are needed on the resource of gvk, and on its
+// subresources.
+func (s *Scanner) AddKind(gvk schema.GroupVersionKind, verbs []string, subresources ...string) {
+	plural, _ := meta.UnsafeGuessKindToResource(gvk)
+	s.Add(plural.GroupResource(), verbs...)
+	for _, sub := range subresources {
+		s.Add(schema.GroupResource{Group: plural.Group, Resource: plural.Resource + "/" + sub}, verbs...)
+	}
+}
+
+// Warnings returns the k8s module usages that could not be resolved, for
+// example because the kind is templated.
+func (s *Scanner) Warnings() []string {
+	return s.warnings
+}
+
+// ScanPath scans path as a role if it is a directory, and as a playbook
+// otherwise.
+func (s *Scanner) ScanPath(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return s.ScanRole(path)
+	}
+	return s.ScanPlaybook(path)
+}
+
+// ScanPlaybook scans the plays of the playbook at path and the roles they
+// use.
+func (s *Scanner) ScanPlaybook(path string) error {
+	if s.visited[path] {
+		return nil
+	}
+	s.visited[path] = true
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plays := []map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &plays); err != nil {
+		return fmt.Errorf("failed to parse playbook %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	for _, play := range plays {
+		if p, ok := play["import_playbook"].(string); ok {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			if err := s.ScanPlaybook(p); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, key := range []string{"pre_tasks", "tasks", "post_tasks", "handlers"} {
+			if tasks, ok := play[key].([]interface{}); ok {
+				if err := s.scanTasks(tasks, dir, dir); err != nil {
+					return err
+				}
+			}
+		}
+		if roles, ok := play["roles"].([]interface{}); ok {
+			for _, role := range roles {
+				if err := s.scanRoleRef(role, dir); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ScanRole scans the tasks and handlers of the role at path, and the roles
+// it depends on.
+func (s *Scanner) ScanRole(path string) error {
+	path = strings.TrimRight(path, "/")
+	if s.visited[path] {
+		return nil
+	}
+	s.visited[path] = true
+	for _, sub := range []string{"tasks", "handlers"} {
+		err := filepath.Walk(filepath.Join(path, sub), func(p string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() || !isYAML(p) {
+				return nil
+			}
+			return s.scanTasksFile(p, path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(path, "meta", "main.yml"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	roleMeta := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &roleMeta); err != nil {
+		return fmt.Errorf("failed to parse meta of role %s: %v", path, err)
+	}
+	if deps, ok := roleMeta["dependencies"].([]interface{}); ok {
+		for _, dep := range deps {
+			if err := s.scanRoleRef(dep, filepath.Dir(path)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Scanner) scanTasksFile(path, base string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tasks := []interface{}{}
+	if err := yaml.Unmarshal(b, &tasks); err != nil {
+		return fmt.Errorf("failed to parse tasks %s: %v", path, err)
+	}
+	return s.scanTasks(tasks, base, filepath.Dir(path))
+}
+
+// scanTasks scans a list of tasks. base is the directory of the role or
+// playbook the tasks belong to, and dir the directory of the tasks file.
+func (s *Scanner) scanTasks(tasks []interface{}, base, dir string) error {
+	for _, t := range tasks {
+		task, ok := t.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"block", "rescue", "always"} {
+			if block, ok := task[key].([]interface{}); ok {
+				if err := s.scanTasks(block, base, dir); err != nil {
+					return err
+				}
+			}
+		}
+		for k, args := range task {
+			key, ok := k.(string)
+			if !ok {
+				continue
+			}
+			switch moduleName(key) {
+			case "include_role", "import_role":
+				if err := s.scanRoleRef(args, filepath.Dir(base)); err != nil {
+					return err
+				}
+			default:
+				s.scanModule(moduleName(key), args, base)
+			}
+		}
+	}
+	return nil
+}
+
+// scanRoleRef scans a role referenced from a play, a role dependency or an
+// include_role task. ref is either the role's name or a map with its name.
+// Roles are looked up next to the referencing role, then in RolesPath.
+func (s *Scanner) scanRoleRef(ref interface{}, dir string) error {
+	name := ""
+	switch r := ref.(type) {
+	case string:
+		name = r
+	case map[interface{}]interface{}:
+		for _, key := range []string{"role", "name"} {
+			if n, ok := r[key].(string); ok {
+				name = n
+				break
+			}
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	if strings.Contains(name, "{{") {
+		s.warnings = append(s.warnings, fmt.Sprintf("skipping templated role %q", name))
+		return nil
+	}
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(dir, name), filepath.Join(s.RolesPath, name)}
+	}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.IsDir() {
+			return s.ScanRole(c)
+		}
+	}
+	s.warnings = append(s.warnings, fmt.Sprintf("role %q not found", name))
+	return nil
+}
+
+// scanModule records the resources a task using module manages.
+func (s *Scanner) scanModule(module string, a interface{}, base string) {
+	args, ok := a.(map[interface{}]interface{})
+	if !ok {
+		return
+	}
+	var verbs []string
+	subresource := ""
+	switch module {
+	case "k8s", "k8s_raw", "openshift_raw":
+		verbs = applyVerbs
+		if s.watchDependents {
+			verbs = append([]string{"list", "watch"}, applyVerbs...)
+		}
+		if args["state"] == "absent" {
+			verbs = deleteVerbs
+		}
+	case "k8s_info", "k8s_facts":
+		verbs = readVerbs
+	case "k8s_scale":
+		verbs = scaleVerbs
+		subresource = "scale"
+	case "k8s_status":
+		verbs = statusVerbs
+		subresource = "status"
+	case "k8s_exec":
+		s.Add(schema.GroupResource{Resource: "pods/exec"}, "create")
+		return
+	case "k8s_log":
+		s.Add(schema.GroupResource{Resource: "pods/log"}, "get")
+		return
+	default:
+		return
+	}
+
+	apiVersion := stringArg(args, "api_version", "apiVersion")
+	kind := stringArg(args, "kind")
+	if kind != "" {
+		s.addManifestKind(module, apiVersion, kind, verbs, subresource)
+		return
+	}
+
+	definition, ok := args["definition"]
+	if !ok {
+		definition, ok = args["resource_definition"]
+	}
+	if ok {
+		switch d := definition.(type) {
+		case map[interface{}]interface{}:
+			s.addManifestKind(module, stringArg(d, "apiVersion"), stringArg(d, "kind"), verbs, subresource)
+		case []interface{}:
+			for _, item := range d {
+				if m, ok := item.(map[interface{}]interface{}); ok {
+					s.addManifestKind(module, stringArg(m, "apiVersion"), stringArg(m, "kind"), verbs, subresource)
+				}
+			}
+		case string:
+			if strings.Contains(d, "{{") {
+				// most likely a lookup of a template or file of the role
+				s.scanManifestDirs(module, base, verbs, subresource)
+			} else {
+				s.scanManifests(module, d, verbs, subresource)
+			}
+		}
+		return
+	}
+
+	if src := stringArg(args, "src"); src != "" {
+		if strings.Contains(src, "{{") {
+			s.scanManifestDirs(module, base, verbs, subresource)
+			return
+		}
+		for _, p := range []string{src, filepath.Join(base, "files", src), filepath.Join(base, src)} {
+			if b, err := ioutil.ReadFile(p); err == nil {
+				s.scanManifests(module, string(b), verbs, subresource)
+				return
+			}
+		}
+		s.warnings = append(s.warnings, fmt.Sprintf("%s src %q not found", module, src))
+		return
+	}
+	s.warnings = append(s.warnings, fmt.Sprintf("%s task without kind or definition in %s", module, base))
+}
+
+// scanManifestDirs scans the templates and files of the role or playbook at
+// base for manifests.
+func (s *Scanner) scanManifestDirs(module, base string, verbs []string, subresource string) {
+	found := false
+	for _, sub := range []string{"templates", "files"} {
+		filepath.Walk(filepath.Join(base, sub), func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil
+			}
+			found = true
+			s.scanManifests(module, string(b), verbs, subresource)
+			return nil
+		})
+	}
+	if !found {
+		s.warnings = append(s.warnings, fmt.Sprintf("%s task with a templated definition in %s, but no templates or files found", module, base))
+	}
+}
+
+// scanManifests records the kinds of the manifests in content, which may be
+// a template holding several documents.
+func (s *Scanner) scanManifests(module, content string, verbs []string, subresource string) {
+	for _, doc := range documentRegexp.Split(content, -1) {
+		kind := kindRegexp.FindStringSubmatch(doc)
+		apiVersion := apiVersionRegexp.FindStringSubmatch(doc)
+		if kind == nil || apiVersion == nil {
+			continue
+		}
+		s.addManifestKind(module, apiVersion[1], kind[1], verbs, subresource)
+	}
+}
+
+func (s *Scanner) addManifestKind(module, apiVersion, kind string, verbs []string, subresource string) {
+	if apiVersion == "" {
+		apiVersion = "v1"
+	}
+	if kind == "" || strings.Contains(kind, "{{") || strings.Contains(apiVersion, "{{") {
+		s.warnings = append(s.warnings, fmt.Sprintf("skipping %s task with unresolved kind %q of %q", module, kind, apiVersion))
+		return
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		s.warnings = append(s.warnings, fmt.Sprintf("skipping %s task with invalid apiVersion %q", module, apiVersion))
+		return
+	}
+	gvk := gv.WithKind(kind)
+	if subresource == "" {
+		s.AddKind(gvk, verbs)
+		return
+	}
+	// the parent resource only needs to be read
+	s.AddKind(gvk, []string{"get"})
+	plural, _ := meta.UnsafeGuessKindToResource(gvk)
+	s.Add(schema.GroupResource{Group: plural.Group, Resource: plural.Resource + "/" + subresource}, verbs...)
+}
+
+// moduleName strips the collection from a fully qualified module name, e.g.
+// kubernetes.core.k8s.
+func moduleName(key string) string {
+	return key[strings.LastIndex(key, ".")+1:]
+}
+
+func stringArg(args map[interface{}]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := args[k].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yml" || ext == ".yaml"
+}
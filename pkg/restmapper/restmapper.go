@@ -0,0 +1,159 @@
+package restmapper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// MinResetInterval is the minimum time between two resets triggered by a
+// lookup that found no match.
+const MinResetInterval = 10 * time.Second
+
+// DynamicRESTMapper is a RESTMapper built from discovery that can be rebuilt
+// when the resources served by the API server change, for example once a CRD
+// is installed. The controller-runtime default is built once at startup.
+//
+// A lookup that finds no match resets the mapper from discovery and is
+// retried, at most once every MinResetInterval, so that fresh CRDs and
+// aggregated APIs that were unavailable at the last reset resolve without a
+// restart. The manager's client and cache only keep the mappings they
+// resolved, so they recover too.
+type DynamicRESTMapper struct {
+	mutex     sync.RWMutex
+	discovery discovery.DiscoveryInterface
+	delegate  meta.RESTMapper
+	lastReset time.Time
+}
+
+// NewDynamicRESTMapper returns a DynamicRESTMapper for the API server of cfg.
+func NewDynamicRESTMapper(cfg *rest.Config) (*DynamicRESTMapper, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m := &DynamicRESTMapper{discovery: dc}
+	if err := m.Reset(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reset rebuilds the mapper from discovery.
+func (m *DynamicRESTMapper) Reset() error {
+	gr, err := discovery.GetAPIGroupResources(m.discovery)
+	if err != nil {
+		return err
+	}
+	delegate := discovery.NewRESTMapper(gr, dynamic.VersionInterfaces)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.delegate = delegate
+	m.lastReset = time.Now()
+	return nil
+}
+
+// resetOnNoMatch resets the mapper if err is a no match error and the last
+// reset is old enough. It reports whether the lookup should be retried.
+func (m *DynamicRESTMapper) resetOnNoMatch(err error) bool {
+	if !meta.IsNoMatchError(err) {
+		return false
+	}
+	m.mutex.RLock()
+	recent := time.Since(m.lastReset) < MinResetInterval
+	m.mutex.RUnlock()
+	if recent {
+		return false
+	}
+	logrus.Infof("refreshing API resources: %v", err)
+	if err := m.Reset(); err != nil {
+		logrus.Warningf("unable to refresh API resources: %v", err)
+		return false
+	}
+	return true
+}
+
+// Serves reports whether the mapper knows gvk.
+func (m *DynamicRESTMapper) Serves(gvk schema.GroupVersionKind) (bool, error) {
+	_, err := m.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *DynamicRESTMapper) get() meta.RESTMapper {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.delegate
+}
+
+// KindFor implements meta.RESTMapper
+func (m *DynamicRESTMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	v, err := m.get().KindFor(resource)
+	if m.resetOnNoMatch(err) {
+		return m.get().KindFor(resource)
+	}
+	return v, err
+}
+
+// KindsFor implements meta.RESTMapper
+func (m *DynamicRESTMapper) KindsFor(resource schema.GroupVersionResource) ([]schema.GroupVersionKind, error) {
+	v, err := m.get().KindsFor(resource)
+	if m.resetOnNoMatch(err) {
+		return m.get().KindsFor(resource)
+	}
+	return v, err
+}
+
+// ResourceFor implements meta.RESTMapper
+func (m *DynamicRESTMapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	v, err := m.get().ResourceFor(input)
+	if m.resetOnNoMatch(err) {
+		return m.get().ResourceFor(input)
+	}
+	return v, err
+}
+
+// ResourcesFor implements meta.RESTMapper
+func (m *DynamicRESTMapper) ResourcesFor(input schema.GroupVersionResource) ([]schema.GroupVersionResource, error) {
+	v, err := m.get().ResourcesFor(input)
+	if m.resetOnNoMatch(err) {
+		return m.get().ResourcesFor(input)
+	}
+	return v, err
+}
+
+// RESTMapping implements meta.RESTMapper
+func (m *DynamicRESTMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	v, err := m.get().RESTMapping(gk, versions...)
+	if m.resetOnNoMatch(err) {
+		return m.get().RESTMapping(gk, versions...)
+	}
+	return v, err
+}
+
+// RESTMappings implements meta.RESTMapper
+func (m *DynamicRESTMapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
+	v, err := m.get().RESTMappings(gk, versions...)
+	if m.resetOnNoMatch(err) {
+		return m.get().RESTMappings(gk, versions...)
+	}
+	return v, err
+}
+
+// ResourceSingularizer implements meta.RESTMapper
+func (m *DynamicRESTMapper) ResourceSingularizer(resource string) (string, error) {
+	v, err := m.get().ResourceSingularizer(resource)
+	if m.resetOnNoMatch(err) {
+		return m.get().ResourceSingularizer(resource)
+	}
+	return v, err
+}
@@ -0,0 +1,139 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultAnsibleConfig is the configuration ansible reads when ANSIBLE_CONFIG
+// is not set, as in the operator's base image.
+const defaultAnsibleConfig = "/etc/ansible/ansible.cfg"
+
+// AnsibleConfig - the ansible.cfg the playbooks of a watch run with. Path
+// replaces the operator's configuration; Settings, given as sections of
+// keys, are merged into Path, or into the operator's configuration if Path
+// is not set.
+type AnsibleConfig struct {
+	Path     string                       `yaml:"path"`
+	Settings map[string]map[string]string `yaml:"settings"`
+}
+
+// render returns the content of the ansible.cfg to write for each run, or
+// nil if runs can use Path as is.
+func (c *AnsibleConfig) render() ([]byte, error) {
+	if len(c.Settings) == 0 {
+		return nil, nil
+	}
+	base := c.Path
+	if base == "" {
+		base = defaultAnsibleConfig
+	}
+	cfg, err := readINI(base)
+	if err != nil && (c.Path != "" || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	// sorted, so that the rendered file does not change between restarts
+	sections := []string{}
+	for section := range c.Settings {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		keys := []string{}
+		for k := range c.Settings[section] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			cfg.set(section, k, c.Settings[section][k])
+		}
+	}
+	return cfg.bytes(), nil
+}
+
+func (r *runner) addAnsibleConfig(c *AnsibleConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.Path != "" {
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("ansible config path must be absolute for %v", r.GVK)
+		}
+		if _, err := os.Stat(c.Path); err != nil {
+			return fmt.Errorf("ansible config for %v: %v", r.GVK, err)
+		}
+	}
+	rendered, err := c.render()
+	if err != nil {
+		return fmt.Errorf("unable to render ansible config for %v: %v", r.GVK, err)
+	}
+	r.ansibleConfigPath = c.Path
+	r.ansibleConfig = rendered
+	return nil
+}
+
+// iniFile is an ansible.cfg, keeping the order of its sections and keys.
+type iniFile struct {
+	sections []string
+	keys     map[string][]string
+	values   map[string]map[string]string
+}
+
+func readINI(path string) (*iniFile, error) {
+	f := &iniFile{keys: map[string][]string{}, values: map[string]map[string]string{}}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				kv = strings.SplitN(line, ":", 2)
+			}
+			if len(kv) != 2 {
+				return f, fmt.Errorf("%s: invalid line %q", path, line)
+			}
+			f.set(section, strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+	}
+	return f, scanner.Err()
+}
+
+func (f *iniFile) set(section, key, value string) {
+	if _, ok := f.values[section]; !ok {
+		f.sections = append(f.sections, section)
+		f.values[section] = map[string]string{}
+	}
+	if _, ok := f.values[section][key]; !ok {
+		f.keys[section] = append(f.keys[section], key)
+	}
+	f.values[section][key] = value
+}
+
+func (f *iniFile) bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, section := range f.sections {
+		if section != "" {
+			fmt.Fprintf(buf, "[%s]\n", section)
+		}
+		for _, k := range f.keys[section] {
+			fmt.Fprintf(buf, "%s = %s\n", k, f.values[section][k])
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
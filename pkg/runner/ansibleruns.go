@@ -0,0 +1,43 @@
+package runner
+
+import "fmt"
+
+// defaultAnsibleRunsLimit is the number of AnsibleRuns kept per resource,
+// unless the watch sets its own limit.
+const defaultAnsibleRunsLimit = 10
+
+// AnsibleRuns - settings of the AnsibleRun resources recording the runs of
+// a watch, one per run, for a history of its runs that can be queried
+// through the API.
+type AnsibleRuns struct {
+	// Limit is the number of AnsibleRuns kept per resource; older ones are
+	// deleted. It defaults to 10.
+	Limit int `yaml:"limit"`
+	// Namespace is where the AnsibleRuns of cluster-scoped resources are
+	// created; those of namespaced resources are created in theirs. The
+	// runs of cluster-scoped resources are not recorded without it.
+	Namespace string `yaml:"namespace"`
+}
+
+func (r *runner) addAnsibleRuns(a *AnsibleRuns) error {
+	if a == nil {
+		return nil
+	}
+	if a.Limit < 0 {
+		return fmt.Errorf("ansibleRuns limit must not be negative for %v", r.GVK)
+	}
+	if a.Limit == 0 {
+		a.Limit = defaultAnsibleRunsLimit
+	}
+	r.ansibleRuns = a
+	return nil
+}
+
+// GetAnsibleRuns returns the settings of the AnsibleRuns recording the runs
+// of the GVK, if they are recorded.
+func (r *runner) GetAnsibleRuns() (AnsibleRuns, bool) {
+	if r.ansibleRuns == nil {
+		return AnsibleRuns{}, false
+	}
+	return *r.ansibleRuns, true
+}
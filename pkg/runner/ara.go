@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// defaultCallbackPlugins are the callback plugin paths of ansible, where the
+// base image installs operator_progress, kept when ARA's is added.
+const defaultCallbackPlugins = "~/.ansible/plugins/callback:/usr/share/ansible/plugins/callback"
+
+// ARA - an ARA API server every run is recorded to by ARA's callback plugin,
+// for a web UI of the past runs of each resource. The credentials of the
+// server, if any, are read by the plugin from ARA_API_USERNAME and
+// ARA_API_PASSWORD in the operator's environment.
+type ARA struct {
+	// Server is the URL of the API server, e.g. http://ara.ara:8000.
+	Server string
+	// CallbackPlugins is the directory of ARA's callback plugin. Defaults
+	// to the output of python3 -m ara.setup.callback_plugins.
+	CallbackPlugins string
+}
+
+// SetARA makes r record its runs to the ARA server of a.
+func (r *runner) SetARA(a ARA) {
+	r.ara = &a
+}
+
+// ARACallbackPlugins returns the directory of the callback plugin of the
+// ara python package installed.
+func ARACallbackPlugins() (string, error) {
+	out, err := exec.Command("python3", "-m", "ara.setup.callback_plugins").Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to find the ARA callback plugin, is ara installed? %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// env returns the environment of the run ident for u that records it to the
+// server of a, labelled with the resource and the run.
+func (a ARA) env(u *unstructured.Unstructured, ident string) map[string]string {
+	plugins := os.Getenv("ANSIBLE_CALLBACK_PLUGINS")
+	if plugins == "" {
+		plugins = defaultCallbackPlugins
+	}
+	gvk := u.GroupVersionKind()
+	labels := []string{
+		"kind:" + gvk.Kind + "." + gvk.Group,
+		"namespace:" + u.GetNamespace(),
+		"name:" + u.GetName(),
+		"run:" + ident,
+	}
+	return map[string]string{
+		"ANSIBLE_CALLBACK_PLUGINS": plugins + ":" + a.CallbackPlugins,
+		"ARA_API_CLIENT":           "http",
+		"ARA_API_SERVER":           a.Server,
+		"ARA_DEFAULT_LABELS":       strings.Join(labels, ","),
+	}
+}
@@ -0,0 +1,240 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/paramconv"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ArgumentOption - an option of the argument spec of a role, as documented
+// in its meta/argument_specs.yml.
+type ArgumentOption struct {
+	Type     string                    `yaml:"type"`
+	Required bool                      `yaml:"required"`
+	Choices  []interface{}             `yaml:"choices"`
+	Elements string                    `yaml:"elements"`
+	Options  map[string]ArgumentOption `yaml:"options"`
+}
+
+// ArgumentSpec - the options of the main entry point of a role.
+type ArgumentSpec map[string]ArgumentOption
+
+type argumentSpecsFile struct {
+	ArgumentSpecs map[string]struct {
+		Options map[string]ArgumentOption `yaml:"options"`
+	} `yaml:"argument_specs"`
+}
+
+// LoadArgumentSpec reads the argument spec of the main entry point of the
+// role at rolePath. It returns nil if the role has none.
+func LoadArgumentSpec(rolePath string) (ArgumentSpec, error) {
+	var b []byte
+	var err error
+	for _, name := range []string{"argument_specs.yml", "argument_specs.yaml"} {
+		b, err = ioutil.ReadFile(filepath.Join(rolePath, "meta", name))
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := argumentSpecsFile{}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal argument spec of %s: %v", rolePath, err)
+	}
+	main, ok := f.ArgumentSpecs["main"]
+	if !ok {
+		return nil, nil
+	}
+	return ArgumentSpec(main.Options), nil
+}
+
+// Validate checks vars, the extra vars of a run, against s: that required
+// options are set, and that those set have the type and one of the choices
+// documented. Vars not in s are not checked. It returns an error listing
+// every problem found, naming options by their spec field.
+func (s ArgumentSpec) Validate(vars map[string]interface{}) error {
+	problems := validateOptions(s, vars, "spec")
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid spec: %s", strings.Join(problems, "; "))
+}
+
+func validateOptions(options map[string]ArgumentOption, vars map[string]interface{}, path string) []string {
+	problems := []string{}
+	for name, o := range options {
+		p := path + "." + paramconv.ToCamel(name)
+		v, ok := vars[name]
+		if !ok || v == nil {
+			if o.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", p))
+			}
+			continue
+		}
+		problems = append(problems, validateValue(o, o.Type, v, p)...)
+	}
+	return problems
+}
+
+func validateValue(o ArgumentOption, typ string, v interface{}, path string) []string {
+	if !hasType(typ, v) {
+		return []string{fmt.Sprintf("%s must be of type %s", path, typ)}
+	}
+	problems := []string{}
+	switch typ {
+	case "list":
+		items, _ := v.([]interface{})
+		for i, item := range items {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			if o.Elements != "" {
+				problems = append(problems, validateValue(ArgumentOption{Options: o.Options}, o.Elements, item, p)...)
+			}
+			if len(o.Choices) != 0 && !isChoice(o.Choices, item) {
+				problems = append(problems, fmt.Sprintf("%s must be one of %s", p, formatChoices(o.Choices)))
+			}
+		}
+		return problems
+	case "dict":
+		if m, ok := v.(map[string]interface{}); ok && len(o.Options) != 0 {
+			problems = append(problems, validateOptions(o.Options, m, path)...)
+		}
+	}
+	if len(o.Choices) != 0 && !isChoice(o.Choices, v) {
+		problems = append(problems, fmt.Sprintf("%s must be one of %s", path, formatChoices(o.Choices)))
+	}
+	return problems
+}
+
+// hasType reports whether v, as decoded from JSON, converts to typ the way
+// ansible converts it. Options without a type, and types without a check,
+// such as raw, accept any value.
+func hasType(typ string, v interface{}) bool {
+	switch typ {
+	case "str", "path":
+		switch v.(type) {
+		case []interface{}, map[string]interface{}:
+			return false
+		}
+		return true
+	case "int":
+		switch n := v.(type) {
+		case int64, int:
+			return true
+		case float64:
+			return n == float64(int64(n))
+		case string:
+			_, err := strconv.ParseInt(n, 10, 64)
+			return err == nil
+		}
+		return false
+	case "float":
+		switch n := v.(type) {
+		case int64, int, float64:
+			return true
+		case string:
+			_, err := strconv.ParseFloat(n, 64)
+			return err == nil
+		}
+		return false
+	case "bool":
+		switch b := v.(type) {
+		case bool:
+			return true
+		case string:
+			switch strings.ToLower(b) {
+			case "yes", "no", "true", "false", "on", "off", "y", "n", "1", "0":
+				return true
+			}
+		case int64:
+			return b == 0 || b == 1
+		}
+		return false
+	case "list":
+		switch v.(type) {
+		case []interface{}, string:
+			return true
+		}
+		return false
+	case "dict":
+		_, ok := v.(map[string]interface{})
+		return ok
+	}
+	return true
+}
+
+func isChoice(choices []interface{}, v interface{}) bool {
+	for _, c := range choices {
+		if fmt.Sprint(c) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatChoices(choices []interface{}) string {
+	s := make([]string, len(choices))
+	for i, c := range choices {
+		s[i] = fmt.Sprint(c)
+	}
+	return strings.Join(s, ", ")
+}
+
+// ValidateSpec checks the spec of u, with extraVars, against the argument
+// specs of the roles run for the GVK. It returns nil if none has one.
+func (r *runner) ValidateSpec(u *unstructured.Unstructured, extraVars map[string]interface{}) error {
+	if len(r.argumentSpecs) == 0 {
+		return nil
+	}
+	spec, _ := u.Object["spec"].(map[string]interface{})
+	vars := map[string]interface{}{}
+	for k, v := range extraVars {
+		vars[k] = v
+	}
+	for k, v := range paramconv.MapToSnake(spec) {
+		vars[k] = v
+	}
+	for _, s := range r.argumentSpecs {
+		if err := s.Validate(vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasArgumentSpecs reports whether a role run for the GVK has an argument
+// spec.
+func (r *runner) HasArgumentSpecs() bool {
+	return len(r.argumentSpecs) != 0
+}
+
+// loadArgumentSpecs sets the argument specs of the runner from the roles
+// among paths.
+func (r *runner) loadArgumentSpecs(paths ...string) error {
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			continue
+		}
+		s, err := LoadArgumentSpec(p)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			r.argumentSpecs = append(r.argumentSpecs, s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package runner
+
+import "fmt"
+
+// CheckModeEnv, set to "true" in the env of RunWithEnv, runs ansible in
+// check and diff mode, which reports what a run would change without
+// changing anything.
+const CheckModeEnv = "ANSIBLE_OPERATOR_CHECK_MODE"
+
+// Canary - settings of the check-mode run that precedes every run of a
+// watch. The run only proceeds if the check-mode run predicts at most
+// MaxChanges changed tasks; otherwise the resource waits for approval.
+type Canary struct {
+	MaxChanges int `yaml:"maxChanges"`
+}
+
+func (r *runner) addCanary(c *Canary) error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxChanges < 0 {
+		return fmt.Errorf("canary maxChanges must not be negative for %v", r.GVK)
+	}
+	r.canary = c
+	return nil
+}
+
+// GetCanary returns the settings of the check-mode runs of the GVK, if its
+// runs are preceded by one.
+func (r *runner) GetCanary() (Canary, bool) {
+	if r.canary == nil {
+		return Canary{}, false
+	}
+	return *r.canary, true
+}
@@ -0,0 +1,56 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// cancelGracePeriod is how long ansible-runner is given to stop after a run
+// is cancelled, before it is killed.
+const cancelGracePeriod = 10 * time.Second
+
+// StatusCanceled is the status ansible-runner records in the artifacts of a
+// cancelled run; the operator records it for the runs it cancels as well.
+const StatusCanceled = "canceled"
+
+// runCommand runs cmd until it exits, or until ctx is done. ansible-runner
+// then gets SIGTERM, and SIGKILL after cancelGracePeriod, as a process group
+// with the ansible processes it started.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	pgid := -cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(cancelGracePeriod):
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-done
+	}
+	return ctx.Err()
+}
+
+// markCanceled records StatusCanceled as the status of the run whose
+// artifacts are in dir.
+func markCanceled(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "status"), []byte(StatusCanceled), 0644)
+}
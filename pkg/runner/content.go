@@ -0,0 +1,77 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// contentDir holds the playbooks generated for watches with several content
+// items.
+var contentDir = filepath.Join(os.TempDir(), "ansible-operator", "content")
+
+// ContentItem - a playbook or role run as part of a watch's content.
+type ContentItem struct {
+	Playbook string `yaml:"playbook"`
+	Role     string `yaml:"role"`
+}
+
+// newForContent returns a runner that runs items in order, within a single
+// run, with a generated playbook importing each of them.
+func newForContent(items []ContentItem, gvk schema.GroupVersionKind, finalizer *Finalizer) (*runner, error) {
+	plays := []yaml.MapSlice{}
+	paths := []string{}
+	for _, item := range items {
+		switch {
+		case item.Playbook != "" && item.Role != "":
+			return nil, fmt.Errorf("content items must set either a playbook or a role for %v", gvk)
+		case item.Playbook != "":
+			if !filepath.IsAbs(item.Playbook) {
+				return nil, fmt.Errorf("playbook path must be absolute for %v", gvk)
+			}
+			plays = append(plays, yaml.MapSlice{{Key: "import_playbook", Value: item.Playbook}})
+			paths = append(paths, item.Playbook)
+		case item.Role != "":
+			if !filepath.IsAbs(item.Role) {
+				return nil, fmt.Errorf("role path must be absolute for %v", gvk)
+			}
+			role := strings.TrimRight(item.Role, "/")
+			plays = append(plays, yaml.MapSlice{
+				{Key: "hosts", Value: "localhost"},
+				{Key: "gather_facts", Value: false},
+				{Key: "roles", Value: []string{role}},
+			})
+			paths = append(paths, role)
+		default:
+			return nil, fmt.Errorf("content items must set either a playbook or a role for %v", gvk)
+		}
+	}
+	b, err := yaml.Marshal(plays)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(contentDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(contentDir, fmt.Sprintf("%s_%s_%s.yml", gvk.Group, gvk.Version, gvk.Kind))
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return nil, err
+	}
+	r, err := newForPlaybook(path, gvk, finalizer)
+	if err != nil {
+		return nil, err
+	}
+	r.contentPaths = paths
+	if err := r.loadArgumentSpecs(paths...); err != nil {
+		return nil, err
+	}
+	if err := r.loadRoleDefaults(paths...); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,149 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The keys of a credentials Secret, by default those of the Secret types
+// kubernetes.io/ssh-auth and kubernetes.io/basic-auth.
+const (
+	DefaultSSHPrivateKeyKey  = "ssh-privatekey"
+	DefaultUsernameKey       = "username"
+	DefaultPasswordKey       = "password"
+	DefaultBecomePasswordKey = "become-password"
+)
+
+// Credentials - a Secret holding what the playbooks of a watch log in to
+// external hosts with. It is read for every run, so that rotating the Secret
+// takes effect on the next run. The keys missing from the Secret are not
+// used.
+type Credentials struct {
+	// SecretName is the Secret used for every resource of the watch, unless
+	// SpecField names another one.
+	SecretName string `yaml:"secretName"`
+	// SecretNamespace defaults to the namespace of the resource.
+	SecretNamespace string `yaml:"secretNamespace"`
+	// SpecField is the dot separated path of a field in the resource, e.g.
+	// ".spec.credentialsSecret", holding the name of the Secret. Secrets it
+	// names are in the namespace of the resource, or in SecretNamespace for
+	// cluster-scoped resources.
+	SpecField string `yaml:"specField"`
+	// The keys of the Secret, which default to the Default*Key constants.
+	SSHPrivateKeyKey  string `yaml:"sshPrivateKeyKey"`
+	UsernameKey       string `yaml:"usernameKey"`
+	PasswordKey       string `yaml:"passwordKey"`
+	BecomePasswordKey string `yaml:"becomePasswordKey"`
+}
+
+// SpecFieldPath splits SpecField into its fields.
+func (c Credentials) SpecFieldPath() []string {
+	return strings.Split(strings.TrimPrefix(c.SpecField, "."), ".")
+}
+
+func (r *runner) addCredentials(c *Credentials) error {
+	if c == nil {
+		return nil
+	}
+	if c.SecretName == "" && strings.TrimPrefix(c.SpecField, ".") == "" {
+		return fmt.Errorf("credentials must set secretName or specField for %v", r.GVK)
+	}
+	if r.job != nil {
+		return fmt.Errorf("credentials cannot be combined with a job for %v", r.GVK)
+	}
+	for _, k := range []struct {
+		key *string
+		def string
+	}{
+		{&c.SSHPrivateKeyKey, DefaultSSHPrivateKeyKey},
+		{&c.UsernameKey, DefaultUsernameKey},
+		{&c.PasswordKey, DefaultPasswordKey},
+		{&c.BecomePasswordKey, DefaultBecomePasswordKey},
+	} {
+		if *k.key == "" {
+			*k.key = k.def
+		}
+	}
+	r.Credentials = c
+	return nil
+}
+
+// RunCredentials - the credentials of a run, as read from its Secret.
+type RunCredentials struct {
+	SSHPrivateKey  []byte
+	Username       string
+	Password       string
+	BecomePassword string
+}
+
+type credentialsKey struct{}
+
+// WithRunCredentials returns a copy of ctx passing c to the run started with
+// it.
+func WithRunCredentials(ctx context.Context, c RunCredentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, c)
+}
+
+func runCredentialsFrom(ctx context.Context) (RunCredentials, bool) {
+	c, ok := ctx.Value(credentialsKey{}).(RunCredentials)
+	return c, ok
+}
+
+// The files of the input dir of a run holding its credentials, which
+// ansible-runner loads the key into ssh-agent and answers the password
+// prompts of ansible-playbook from.
+var credentialFiles = []string{"env/ssh_key", "env/passwords"}
+
+// cmdline returns the arguments of ansible-playbook prompting for the
+// passwords of c.
+func (c RunCredentials) cmdline() []string {
+	args := []string{}
+	if c.Password != "" {
+		args = append(args, "--ask-pass")
+	}
+	if c.BecomePassword != "" {
+		args = append(args, "--ask-become-pass")
+	}
+	return args
+}
+
+// write writes the files of c to the input dir at dir, readable by the
+// operator only.
+func (c RunCredentials) write(dir string) error {
+	if len(c.SSHPrivateKey) != 0 {
+		if err := ioutil.WriteFile(filepath.Join(dir, "env", "ssh_key"), c.SSHPrivateKey, 0600); err != nil {
+			return err
+		}
+	}
+	passwords := map[string]string{}
+	if c.Password != "" {
+		passwords[`^SSH [pP]assword:\s*?$`] = c.Password
+	}
+	if c.BecomePassword != "" {
+		passwords[`^BECOME [pP]assword.*:\s*?$`] = c.BecomePassword
+	}
+	if len(passwords) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(passwords)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "env", "passwords"), b, 0600)
+}
+
+// removeCredentials removes the credentials of the last run from the input
+// dir at dir, so they are not left on disk after the run.
+func removeCredentials(dir string) error {
+	for _, f := range credentialFiles {
+		if err := os.Remove(filepath.Join(dir, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// addDefaultCR reads the manifest at path, a resource of the GVK of the
+// runner that is created at startup if none exists.
+func (r *runner) addDefaultCR(path string) error {
+	if path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("defaultCR path must be absolute for %v", r.GVK)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read defaultCR of %v: %v", r.GVK, err)
+	}
+	// Accept JSON as well as YAML, as the watches file does.
+	if b, err = yaml.ToJSON(b); err != nil {
+		return fmt.Errorf("failed to parse defaultCR of %v: %v", r.GVK, err)
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(b); err != nil {
+		return fmt.Errorf("failed to parse defaultCR of %v: %v", r.GVK, err)
+	}
+	if u.GroupVersionKind() != r.GVK {
+		return fmt.Errorf("defaultCR of %v is a %v", r.GVK, u.GroupVersionKind())
+	}
+	if u.GetName() == "" {
+		return fmt.Errorf("defaultCR of %v has no name", r.GVK)
+	}
+	r.defaultCR = u
+	return nil
+}
+
+// GetDefaultCR returns a copy of the resource created at startup if none of
+// the GVK exists.
+func (r *runner) GetDefaultCR() (*unstructured.Unstructured, bool) {
+	if r.defaultCR == nil {
+		return nil, false
+	}
+	return r.defaultCR.DeepCopy(), true
+}
@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// RoleMetadataFile is the file, relative to a role's directory, that declares
+// the GVK a role reconciles when roles are discovered rather than listed in a
+// watches file. It takes the fields of a watches file entry; role defaults to
+// the role's own directory.
+const RoleMetadataFile = "meta/operator.yml"
+
+// NewFromRolesDir builds a Runner for every role directly under path that has
+// a RoleMetadataFile. Roles without one are skipped.
+func NewFromRolesDir(path string) (map[schema.GroupVersionKind]Runner, error) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		logrus.Errorf("failed to read roles dir %v", err)
+		return nil, err
+	}
+	watches := []watch{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rolePath := filepath.Join(path, entry.Name())
+		b, err := ioutil.ReadFile(filepath.Join(rolePath, RoleMetadataFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		w := watch{}
+		if err := yaml.Unmarshal(b, &w); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s of role %s: %v", RoleMetadataFile, entry.Name(), err)
+		}
+		if w.Playbook == "" && w.Role == "" {
+			w.Role = rolePath
+		}
+		logrus.Infof("Discovered role %s for %s/%s, %s", entry.Name(), w.Group, w.Version, w.Kind)
+		watches = append(watches, w)
+	}
+	if len(watches) == 0 {
+		return nil, fmt.Errorf("no role under %s has a %s", path, RoleMetadataFile)
+	}
+	return newFromWatchList(watches)
+}
@@ -0,0 +1,137 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// ExecutionEnvironment - a container image ansible-runner is run in, with
+// ansible, its collections and python dependencies, instead of those of the
+// operator's image. The image must have ansible-runner and the
+// ansible-runner-http plugin installed, which report the run to the
+// operator.
+type ExecutionEnvironment struct {
+	Image string `yaml:"image"`
+	// PullPolicy is one of Always, IfNotPresent, the default, or Never.
+	PullPolicy string `yaml:"pullPolicy"`
+	// Engine is the container engine run, podman by default, or docker.
+	Engine string `yaml:"engine"`
+	// Mounts are added to those of the content, the run directory, which
+	// holds the kubeconfig, and the event socket of every run.
+	Mounts []Mount `yaml:"mounts"`
+}
+
+// Mount - a path of the operator's filesystem mounted into an execution
+// environment.
+type Mount struct {
+	HostPath string `yaml:"hostPath"`
+	// Path defaults to HostPath.
+	Path     string `yaml:"path"`
+	ReadOnly bool   `yaml:"readOnly"`
+}
+
+// pullPolicies maps the pull policies of an execution environment to the
+// --pull values of the engines.
+var pullPolicies = map[string]string{
+	"":             "missing",
+	"Always":       "always",
+	"IfNotPresent": "missing",
+	"Never":        "never",
+}
+
+func (r *runner) addExecutionEnvironment(ee *ExecutionEnvironment) error {
+	if ee == nil {
+		return nil
+	}
+	if ee.Image == "" {
+		return fmt.Errorf("executionEnvironment must set an image for %v", r.GVK)
+	}
+	if _, ok := pullPolicies[ee.PullPolicy]; !ok {
+		return fmt.Errorf("executionEnvironment pullPolicy must be one of Always, IfNotPresent or Never for %v", r.GVK)
+	}
+	switch ee.Engine {
+	case "":
+		ee.Engine = "podman"
+	case "podman", "docker":
+	default:
+		return fmt.Errorf("executionEnvironment engine must be podman or docker for %v", r.GVK)
+	}
+	for _, m := range ee.Mounts {
+		if !filepath.IsAbs(m.HostPath) || (m.Path != "" && !filepath.IsAbs(m.Path)) {
+			return fmt.Errorf("executionEnvironment mount paths must be absolute for %v", r.GVK)
+		}
+	}
+	r.executionEnvironment = ee
+	return nil
+}
+
+// command returns a Cmd running the ansible-runner command of cmd in the
+// execution environment, with paths, the files and directories the run
+// reads and writes, mounted at the same paths as in the operator.
+func (ee *ExecutionEnvironment) command(cmd *exec.Cmd, ident string, paths ...string) *exec.Cmd {
+	args := []string{
+		"run", "--rm",
+		"--name", "ansible-runner-" + ident,
+		"--pull", pullPolicies[ee.PullPolicy],
+		// the proxy listens on localhost
+		"--network", "host",
+	}
+	dirs := map[string]bool{}
+	for _, p := range paths {
+		if p != "" {
+			dirs[p] = true
+		}
+	}
+	mounted := []string{}
+	for p := range dirs {
+		mounted = append(mounted, p)
+	}
+	sort.Strings(mounted)
+	for _, p := range mounted {
+		args = append(args, "-v", p+":"+p)
+	}
+	for _, m := range ee.Mounts {
+		target := m.Path
+		if target == "" {
+			target = m.HostPath
+		}
+		v := m.HostPath + ":" + target
+		if m.ReadOnly {
+			v += ":ro"
+		}
+		args = append(args, "-v", v)
+	}
+	args = append(args, ee.Image)
+	args = append(args, cmd.Args...)
+	return exec.Command(ee.Engine, args...)
+}
+
+// mountPaths returns the paths the runs of r read besides the run directory:
+// the directories of its content, finalizer, hooks, ansible.cfg and ARA
+// callback plugin.
+func (r *runner) mountPaths() []string {
+	// The directory of a playbook or role, which holds the roles next to
+	// it.
+	dir := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		return filepath.Dir(p)
+	}
+	paths := []string{dir(r.Path), dir(r.Hooks.Pre), dir(r.Hooks.Post), dir(r.Hooks.OnFailure)}
+	for _, p := range r.contentPaths {
+		paths = append(paths, dir(p))
+	}
+	if r.Finalizer != nil {
+		paths = append(paths, dir(r.Finalizer.Playbook), dir(r.Finalizer.Role))
+	}
+	if r.ansibleConfigPath != "" {
+		paths = append(paths, filepath.Dir(r.ansibleConfigPath))
+	}
+	if r.ara != nil {
+		paths = append(paths, r.ara.CallbackPlugins)
+	}
+	return paths
+}
@@ -1,10 +1,8 @@
 package eventapi
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
@@ -45,9 +43,17 @@ type EventReceiver struct {
 
 	// logger holds a logger that has some fields already set
 	logger logrus.FieldLogger
+
+	// limits bound the size of the events received.
+	limits Limits
 }
 
 func New(ident string, errChan chan<- error) (*EventReceiver, error) {
+	return NewWithLimits(ident, errChan, DefaultLimits)
+}
+
+// NewWithLimits is New, with the events received bounded by limits.
+func NewWithLimits(ident string, errChan chan<- error, limits Limits) (*EventReceiver, error) {
 	sockPath := fmt.Sprintf("/tmp/ansibleoperator-%s", ident)
 	listener, err := net.Listen("unix", sockPath)
 	if err != nil {
@@ -59,6 +65,7 @@ func New(ident string, errChan chan<- error) (*EventReceiver, error) {
 		SocketPath: sockPath,
 		URLPath:    "/events/",
 		ident:      ident,
+		limits:     limits,
 		logger: logrus.WithFields(logrus.Fields{
 			"component": "eventapi",
 			"job":       ident,
@@ -115,7 +122,7 @@ func (e *EventReceiver) handleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, size, oversized, err := e.limits.read(r.Body)
 	if err != nil {
 		e.logger.WithFields(logrus.Fields{
 			"code": "500",
@@ -124,8 +131,7 @@ func (e *EventReceiver) handleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	event := JobEvent{}
-	err = json.Unmarshal(body, &event)
+	event, err := e.limits.Decode(body, size)
 	if err != nil {
 		e.logger.WithFields(logrus.Fields{
 			"code": "400",
@@ -134,6 +140,9 @@ func (e *EventReceiver) handleEvents(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Could not deserialize body as JSON"))
 		return
 	}
+	if oversized {
+		e.logger.Debugf("event %s of %d bytes is larger than %d bytes, keeping a summary", event.UUID, size, e.limits.MaxEventSize)
+	}
 
 	// Guarantee that the Events channel will not be written to if stopped ==
 	// true, because in that case the channel has been closed.
@@ -0,0 +1,136 @@
+package eventapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Limits bound the memory the events of a run take, as task results, e.g.
+// large registered variables or slurped files, are posted whole.
+type Limits struct {
+	// MaxEventSize is the size in bytes of the largest event decoded.
+	// Larger events are replaced with a summary of the task and host they
+	// are of. 0 is unlimited.
+	MaxEventSize int64
+	// MaxFieldSize is the length in bytes of the longest string kept in the
+	// stdout and the data of an event; longer ones are truncated. 0 is
+	// unlimited.
+	MaxFieldSize int
+}
+
+// DefaultLimits are the limits of the receivers New returns.
+var DefaultLimits = Limits{MaxEventSize: 10 << 20, MaxFieldSize: 1 << 20}
+
+// read reads body up to MaxEventSize. It returns the bytes read, and
+// whether the body was larger, having discarded the rest.
+func (l Limits) read(body io.Reader) ([]byte, int64, bool, error) {
+	if l.MaxEventSize <= 0 {
+		b, err := ioutil.ReadAll(body)
+		return b, int64(len(b)), false, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, l.MaxEventSize+1))
+	if err != nil || int64(len(b)) <= l.MaxEventSize {
+		return b, int64(len(b)), false, err
+	}
+	rest, err := io.Copy(ioutil.Discard, body)
+	return b[:l.MaxEventSize], int64(len(b)) + rest, true, err
+}
+
+// Decode decodes the event in b, the first bytes of an event of size bytes,
+// within l: an event larger than b, which was cut at MaxEventSize, is
+// replaced with its summary.
+func (l Limits) Decode(b []byte, size int64) (JobEvent, error) {
+	event := JobEvent{}
+	if size > int64(len(b)) {
+		event = summary(b, size)
+	} else if err := json.Unmarshal(b, &event); err != nil {
+		return event, err
+	}
+	l.Truncate(&event)
+	return event, nil
+}
+
+var (
+	summaryFields = []string{"uuid", "event", "runner_ident", "task", "task_action", "host"}
+	counterField  = regexp.MustCompile(`"counter":\s*(\d+)`)
+)
+
+// summary returns the event posted in an oversized body of size bytes, of
+// which prefix is the start, with only the fields identifying it. Its data
+// has truncated set and the size of the body.
+func summary(prefix []byte, size int64) JobEvent {
+	found := map[string]string{}
+	for _, name := range summaryFields {
+		re := regexp.MustCompile(`"` + name + `":\s*"((?:[^"\\]|\\.)*)"`)
+		if m := re.FindSubmatch(prefix); m != nil {
+			s, err := strconv.Unquote(`"` + string(m[1]) + `"`)
+			if err != nil {
+				s = string(m[1])
+			}
+			found[name] = s
+		}
+	}
+	event := JobEvent{
+		UUID:        found["uuid"],
+		Event:       found["event"],
+		RunnerIdent: found["runner_ident"],
+		EventData: map[string]interface{}{
+			"truncated": true,
+			"size":      size,
+		},
+	}
+	if m := counterField.FindSubmatch(prefix); m != nil {
+		event.Counter, _ = strconv.Atoi(string(m[1]))
+	}
+	for _, name := range []string{"task", "task_action", "host"} {
+		if v, ok := found[name]; ok {
+			event.EventData[name] = v
+		}
+	}
+	return event
+}
+
+// Truncate shortens the strings in the stdout and the data of e that are
+// longer than MaxFieldSize, keeping the structure of the data, so the
+// results of modules are still read.
+func (l Limits) Truncate(e *JobEvent) {
+	if l.MaxFieldSize <= 0 {
+		return
+	}
+	e.StdOut = l.truncateString(e.StdOut)
+	for k, v := range e.EventData {
+		e.EventData[k] = l.truncateValue(v)
+	}
+}
+
+func (l Limits) truncateValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return l.truncateString(v)
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = l.truncateValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = l.truncateValue(item)
+		}
+	}
+	return v
+}
+
+func (l Limits) truncateString(s string) string {
+	if len(s) <= l.MaxFieldSize {
+		return s
+	}
+	n := l.MaxFieldSize
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... [truncated %d bytes]", s[:n], len(s)-n)
+}
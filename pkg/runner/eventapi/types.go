@@ -36,6 +36,8 @@ type JobEvent struct {
 	EventData map[string]interface{} `json:"event_data"`
 	PID       int                    `json:"pid"`
 	Created   EventTime              `json:"created"`
+	// RunnerIdent is the ident of the ansible-runner run posting the event.
+	RunnerIdent string `json:"runner_ident"`
 }
 
 // StatusJobEvent - event of an ansible run.
@@ -60,3 +62,7 @@ type StatsEventData struct {
 	Failures     map[string]int `json:"failures"`
 	Skipped      map[string]int `json:"skipped"`
 }
+
+// EventTaskProgress is the event posted by the operator_progress callback
+// plugin at the start of every task.
+const EventTaskProgress = "operator_task_progress"
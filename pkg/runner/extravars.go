@@ -0,0 +1,43 @@
+package runner
+
+import (
+	"fmt"
+)
+
+// ExtraVarsSource - Expose a ConfigMap or Secret whose data is merged into
+// the extra vars of a run. Exactly one of ConfigMapRef and SecretRef must be
+// set.
+type ExtraVarsSource struct {
+	ConfigMapRef *ObjectRef `yaml:"configMapRef"`
+	SecretRef    *ObjectRef `yaml:"secretRef"`
+}
+
+// ObjectRef - Expose a reference to a namespaced object.
+type ObjectRef struct {
+	Name string `yaml:"name"`
+	// Namespace defaults to the namespace of the resource being reconciled.
+	Namespace string `yaml:"namespace"`
+	// Optional allows runs to proceed when the object does not exist.
+	Optional bool `yaml:"optional"`
+}
+
+func (r *runner) addExtraVarsFrom(sources []ExtraVarsSource) error {
+	for _, s := range sources {
+		var ref *ObjectRef
+		switch {
+		case s.ConfigMapRef != nil && s.SecretRef != nil:
+			return fmt.Errorf("extraVarsFrom entry must set only one of configMapRef and secretRef for %v", r.GVK)
+		case s.ConfigMapRef != nil:
+			ref = s.ConfigMapRef
+		case s.SecretRef != nil:
+			ref = s.SecretRef
+		default:
+			return fmt.Errorf("extraVarsFrom entry must set configMapRef or secretRef for %v", r.GVK)
+		}
+		if ref.Name == "" {
+			return fmt.Errorf("extraVarsFrom reference must set a name for %v", r.GVK)
+		}
+	}
+	r.ExtraVarsFrom = sources
+	return nil
+}
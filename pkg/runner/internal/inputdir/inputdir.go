@@ -16,7 +16,12 @@ type InputDir struct {
 	PlaybookPath string
 	Parameters   map[string]interface{}
 	EnvVars      map[string]string
-	Settings     map[string]string
+	Settings     map[string]interface{}
+	// Cmdline, if set, holds extra arguments of ansible-playbook, such as
+	// --check.
+	Cmdline string
+	// Inventory, if set, is a yaml inventory of hosts added to localhost.
+	Inventory []byte
 }
 
 // makeDirs creates the required directory structure.
@@ -74,6 +79,17 @@ func (i *InputDir) Write() error {
 	if err != nil {
 		return err
 	}
+	if i.Cmdline != "" {
+		err = i.addFile("env/cmdline", []byte(i.Cmdline))
+	} else {
+		err = os.Remove(filepath.Join(i.Path, "env/cmdline"))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
 
 	// If ansible-runner is running in a python virtual environment, propagate
 	// that to ansible.
@@ -86,6 +102,17 @@ func (i *InputDir) Write() error {
 	if err != nil {
 		return err
 	}
+	if i.Inventory != nil {
+		err = i.addFile("inventory/spec.yml", i.Inventory)
+	} else {
+		err = os.Remove(filepath.Join(i.Path, "inventory/spec.yml"))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
 
 	if i.PlaybookPath != "" {
 		f, err := os.Open(i.PlaybookPath)
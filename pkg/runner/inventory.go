@@ -0,0 +1,182 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DefaultInventorySpecField is the field of the resource holding its
+// inventory, unless the watch sets another one.
+const DefaultInventorySpecField = ".spec.inventory"
+
+// safeInventoryVars are the only variables of ansible a watch may let
+// resources set in their inventory; the others can run commands in the
+// operator, e.g. ansible_python_interpreter or ansible_ssh_common_args.
+var safeInventoryVars = map[string]bool{
+	"ansible_host": true,
+	"ansible_port": true,
+	"ansible_user": true,
+}
+
+// reservedInventoryNames are the groups and hosts of the inventory of every
+// run, which resources cannot add to.
+var reservedInventoryNames = map[string]bool{
+	"all":       true,
+	"ungrouped": true,
+	"localhost": true,
+	"127.0.0.1": true,
+	"::1":       true,
+}
+
+// Inventory - hosts and groups set in the resource, rendered into the
+// inventory of every run of the resource, alongside localhost. The field
+// holds an inventory in the format of ansible's yaml inventory plugin: groups
+// by name, each with hosts, vars and children.
+type Inventory struct {
+	// SpecField is the dot separated path of the field, DefaultInventorySpecField
+	// by default.
+	SpecField string `yaml:"specField"`
+	// Vars are the variables resources may set on their hosts and groups;
+	// inventories setting others fail the run. Of the variables of ansible,
+	// only ansible_host, ansible_port and ansible_user may be listed.
+	Vars []string `yaml:"vars"`
+}
+
+// SpecFieldPath splits SpecField into its fields.
+func (i Inventory) SpecFieldPath() []string {
+	return strings.Split(strings.TrimPrefix(i.SpecField, "."), ".")
+}
+
+func (r *runner) addInventory(i *Inventory) error {
+	if i == nil {
+		return nil
+	}
+	if strings.TrimPrefix(i.SpecField, ".") == "" {
+		i.SpecField = DefaultInventorySpecField
+	}
+	for _, v := range i.Vars {
+		if strings.HasPrefix(v, "ansible_") && !safeInventoryVars[v] {
+			return fmt.Errorf("inventory cannot let resources set %s for %v", v, r.GVK)
+		}
+	}
+	r.inventory = i
+	return nil
+}
+
+// allowedVar reports whether the inventory of a resource may set name.
+func (i Inventory) allowedVar(name string) bool {
+	for _, v := range i.Vars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// renderInventory returns the inventory file of the run of u, nil if u sets
+// no inventory.
+func (r *runner) renderInventory(u *unstructured.Unstructured) ([]byte, error) {
+	if r.inventory == nil {
+		return nil, nil
+	}
+	v, found, err := unstructured.NestedFieldCopy(u.Object, r.inventory.SpecFieldPath()...)
+	if err != nil || !found || v == nil {
+		return nil, err
+	}
+	groups, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("inventory %s is not a map of groups", r.inventory.SpecField)
+	}
+	if err := r.inventory.checkGroups(r.inventory.SpecField, groups); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(groups)
+}
+
+// checkGroups returns an error if groups, at path in the resource, is not a
+// map of groups ansible's yaml inventory plugin can read, or sets what the
+// resource may not: the reserved groups and hosts, variables the watch does
+// not list, and templated values, which ansible would evaluate in the
+// operator.
+func (i Inventory) checkGroups(path string, groups map[string]interface{}) error {
+	for name, g := range groups {
+		if err := checkInventoryName(path, name); err != nil {
+			return err
+		}
+		if g == nil {
+			continue
+		}
+		group, ok := g.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("inventory group %s.%s is not a map", path, name)
+		}
+		for k, v := range group {
+			if v == nil {
+				continue
+			}
+			field := fmt.Sprintf("%s.%s.%s", path, name, k)
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("inventory field %s is not a map", field)
+			}
+			switch k {
+			case "hosts":
+				for host, hv := range m {
+					if err := checkInventoryName(field, host); err != nil {
+						return err
+					}
+					if hv == nil {
+						continue
+					}
+					vars, ok := hv.(map[string]interface{})
+					if !ok {
+						return fmt.Errorf("inventory host %s.%s holds no map of vars", field, host)
+					}
+					if err := i.checkVars(field+"."+host, vars); err != nil {
+						return err
+					}
+				}
+			case "vars":
+				if err := i.checkVars(field, m); err != nil {
+					return err
+				}
+			case "children":
+				if err := i.checkGroups(field, m); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown inventory field %s, expected hosts, vars or children", field)
+			}
+		}
+	}
+	return nil
+}
+
+// checkInventoryName returns an error if name, of a group or host at path,
+// is reserved or templated.
+func checkInventoryName(path, name string) error {
+	if reservedInventoryNames[strings.ToLower(name)] {
+		return fmt.Errorf("inventory %s cannot set %s, which is reserved", path, name)
+	}
+	if isTemplated(name) {
+		return fmt.Errorf("inventory %s cannot set the templated name %s", path, name)
+	}
+	return nil
+}
+
+// checkVars returns an error if vars, at path, sets a variable the watch does
+// not list or a templated value.
+func (i Inventory) checkVars(path string, vars map[string]interface{}) error {
+	for k, v := range vars {
+		if !i.allowedVar(k) {
+			return fmt.Errorf("inventory %s cannot set %s; the watch lets it set %v", path, k, i.Vars)
+		}
+		if isTemplated(v) {
+			return fmt.Errorf("inventory variable %s.%s cannot be templated", path, k)
+		}
+	}
+	return nil
+}
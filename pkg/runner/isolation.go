@@ -0,0 +1,75 @@
+package runner
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// serviceAccountDir holds the token of the operator's ServiceAccount, which
+// isolated runs never see.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ProcessIsolation - runs ansible in a sandbox, with ansible-runner's
+// process isolation, so that untrusted roles cannot read the files of the
+// operator, such as its ServiceAccount token. The playbooks see the
+// filesystem of the operator but for the paths hidden; those the run needs,
+// its run directory, which holds its kubeconfig, and event socket among them,
+// stay visible.
+type ProcessIsolation struct {
+	// Executable is the sandbox, bwrap by default.
+	Executable string `yaml:"executable"`
+	// HidePaths are replaced by empty directories, in addition to the
+	// ServiceAccount token of the operator.
+	HidePaths []string `yaml:"hidePaths"`
+	// ReadOnlyPaths are mounted read-only.
+	ReadOnlyPaths []string `yaml:"readOnlyPaths"`
+	// ReadWritePaths are mounted read-write, e.g. below a hidden path.
+	ReadWritePaths []string `yaml:"readWritePaths"`
+	// TempDir is where the sandbox keeps its files, /tmp by default.
+	TempDir string `yaml:"tempDir"`
+}
+
+func (r *runner) addProcessIsolation(p *ProcessIsolation) error {
+	if p == nil {
+		return nil
+	}
+	if r.executionEnvironment != nil || r.job != nil {
+		return fmt.Errorf("processIsolation cannot be combined with an executionEnvironment or a job for %v", r.GVK)
+	}
+	if p.Executable == "" {
+		p.Executable = "bwrap"
+	}
+	paths := append(append(append([]string{}, p.HidePaths...), p.ReadOnlyPaths...), p.ReadWritePaths...)
+	if p.TempDir != "" {
+		paths = append(paths, p.TempDir)
+	}
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("processIsolation paths must be absolute for %v", r.GVK)
+		}
+	}
+	r.processIsolation = p
+	return nil
+}
+
+// settings returns the ansible-runner settings of a run isolated by p, which
+// needs paths visible whatever is hidden.
+func (p *ProcessIsolation) settings(paths ...string) map[string]interface{} {
+	show := append([]string{}, p.ReadWritePaths...)
+	for _, path := range paths {
+		if path != "" {
+			show = append(show, path)
+		}
+	}
+	s := map[string]interface{}{
+		"process_isolation":            true,
+		"process_isolation_executable": p.Executable,
+		"process_isolation_hide_paths": append([]string{serviceAccountDir}, p.HidePaths...),
+		"process_isolation_show_paths": show,
+		"process_isolation_ro_paths":   append([]string{}, p.ReadOnlyPaths...),
+	}
+	if p.TempDir != "" {
+		s["process_isolation_path"] = p.TempDir
+	}
+	return s
+}
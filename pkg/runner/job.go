@@ -0,0 +1,383 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+	yaml "gopkg.in/yaml.v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+)
+
+// JobRunLabel is set on the Jobs of runs to the ident of the run.
+const JobRunLabel = "operator.ansible.io/run"
+
+const (
+	// jobContainer is the container of the pod template that runs
+	// ansible-runner, if there is one of that name.
+	jobContainer = "ansible-runner"
+	// jobInputDir is where the input dir of a run is mounted in its pod.
+	jobInputDir = "/runner"
+	// jobArtifactsDir is where ansible-runner writes the artifacts of a run
+	// in its pod, as the input dir is read-only.
+	jobArtifactsDir = "/runner-artifacts"
+	// jobPollInterval is how often the pod and the Job are checked.
+	jobPollInterval = 2 * time.Second
+)
+
+// Job - runs of a watch as Kubernetes Jobs created from a pod template,
+// instead of ansible-runner processes of the operator, which spreads heavy
+// playbooks over the nodes of the cluster. The playbooks of a Job use the
+// credentials of its pod's ServiceAccount.
+type Job struct {
+	// Template is the pod template of the Jobs. Its container named
+	// ansible-runner, or its first, runs ansible-runner; its image must have
+	// the content of the watch at the same paths as the operator's.
+	Template interface{} `yaml:"template"`
+	// Namespace is the namespace the Jobs are created in. It defaults to
+	// that of the resource, and must be set for cluster-scoped resources.
+	Namespace string `yaml:"namespace"`
+	// ActiveDeadlineSeconds, if set, fails runs taking longer.
+	ActiveDeadlineSeconds *int64 `yaml:"activeDeadlineSeconds"`
+
+	template corev1.PodTemplateSpec
+	client   kubernetes.Interface
+}
+
+func (r *runner) addJob(j *Job) error {
+	if j == nil {
+		return nil
+	}
+	b, err := yaml.Marshal(j.Template)
+	if err != nil {
+		return err
+	}
+	b, err = k8syaml.ToJSON(b)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &j.template); err != nil {
+		return fmt.Errorf("invalid job template for %v: %v", r.GVK, err)
+	}
+	if len(j.template.Spec.Containers) == 0 {
+		return fmt.Errorf("job template must have a container for %v", r.GVK)
+	}
+	if r.executionEnvironment != nil {
+		return fmt.Errorf("job cannot be combined with an executionEnvironment for %v", r.GVK)
+	}
+	r.job = j
+	return nil
+}
+
+// RunsJobs reports whether the runs of r are Jobs, which need a client set
+// with SetJobClient.
+func (r *runner) RunsJobs() bool {
+	return r.job != nil
+}
+
+// SetJobClient sets the client the Jobs of runs are created with.
+func (r *runner) SetJobClient(c kubernetes.Interface) {
+	if r.job != nil {
+		r.job.client = c
+	}
+}
+
+// jobName returns the name of the Job of the run ident for u.
+func jobName(u *unstructured.Unstructured, ident string) string {
+	name := strings.ToLower(u.GetName())
+	if max := 63 - len(ident) - 1; len(name) > max {
+		name = strings.TrimRight(name[:max], "-.")
+	}
+	return name + "-" + ident
+}
+
+// run runs the ansible-runner command args, for the input dir at inputDir,
+// as a Job, and sends the events the run prints to events, bounded by
+// limits. A Job failing without reporting stats, e.g. as its pod was
+// evicted, sends stats of a failure, so the run is failed like one of the
+// operator. Once ctx is done, the Job is deleted, stopping its pod.
+func (j *Job) run(ctx context.Context, u *unstructured.Unstructured, ident, inputDir string, args []string, limits eventapi.Limits, events chan<- eventapi.JobEvent, logger logrus.FieldLogger) error {
+	if j.client == nil {
+		return fmt.Errorf("no client to create jobs with")
+	}
+	namespace := j.Namespace
+	if namespace == "" {
+		namespace = u.GetNamespace()
+	}
+	if namespace == "" {
+		return fmt.Errorf("job namespace must be set for cluster-scoped %v", u.GroupVersionKind())
+	}
+	name := jobName(u, ident)
+	files, items, err := jobInputFiles(inputDir)
+	if err != nil {
+		return err
+	}
+
+	tmpl := j.template.DeepCopy()
+	if tmpl.Labels == nil {
+		tmpl.Labels = map[string]string{}
+	}
+	tmpl.Labels[JobRunLabel] = ident
+	tmpl.Spec.RestartPolicy = corev1.RestartPolicyNever
+	c := &tmpl.Spec.Containers[0]
+	for i := range tmpl.Spec.Containers {
+		if tmpl.Spec.Containers[i].Name == jobContainer {
+			c = &tmpl.Spec.Containers[i]
+		}
+	}
+	// ... run <input dir> becomes --json --artifact-dir ... run /runner
+	c.Command = []string{args[0]}
+	c.Args = append(append([]string{}, args[1:len(args)-2]...), "--json", "--artifact-dir", jobArtifactsDir, "run", jobInputDir)
+	c.VolumeMounts = append(c.VolumeMounts,
+		corev1.VolumeMount{Name: "runner-input", MountPath: jobInputDir, ReadOnly: true},
+		corev1.VolumeMount{Name: "runner-artifacts", MountPath: jobArtifactsDir},
+	)
+	tmpl.Spec.Volumes = append(tmpl.Spec.Volumes,
+		corev1.Volume{Name: "runner-input", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: name, Items: items}}},
+		corev1.Volume{Name: "runner-artifacts", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	)
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{JobRunLabel: ident},
+		},
+		Spec: batchv1.JobSpec{
+			// failed runs are retried by the operator
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: j.ActiveDeadlineSeconds,
+			Template:              *tmpl,
+		},
+	}
+	job, err = j.client.BatchV1().Jobs(namespace).Create(job)
+	if err != nil {
+		return fmt.Errorf("unable to create job: %v", err)
+	}
+	logger.Infof("Created job %s/%s", namespace, name)
+	defer func() {
+		propagation := metav1.DeletePropagationBackground
+		if err := j.client.BatchV1().Jobs(namespace).Delete(name, &metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil {
+			logger.Errorf("unable to delete job %s/%s: %v", namespace, name, err)
+		}
+	}()
+	// The Secret is deleted with the Job; its pod waits for it.
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{JobRunLabel: ident},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       "Job",
+				Name:       job.GetName(),
+				UID:        job.GetUID(),
+			}},
+		},
+		Data: files,
+	}
+	if _, err := j.client.CoreV1().Secrets(namespace).Create(secret); err != nil {
+		return fmt.Errorf("unable to create the input secret of job: %v", err)
+	}
+
+	pod, err := j.waitForPod(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	sawStats := false
+	if pod != "" {
+		sawStats, err = j.streamEvents(ctx, namespace, pod, c.Name, limits, events, logger)
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("unable to stream the events of job %s/%s: %v", namespace, name, err)
+		}
+	}
+	err = j.waitForJob(ctx, namespace, name)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && !sawStats {
+		events <- eventapi.JobEvent{
+			Event:       "playbook_on_stats",
+			EventData:   map[string]interface{}{"failures": map[string]interface{}{"localhost": 1}},
+			RunnerIdent: ident,
+		}
+	}
+	return err
+}
+
+// jobInputFiles returns the files of the input dir at dir, with the paths
+// into it set to jobInputDir, as the data of a Secret and the items mounting
+// them at their paths.
+func jobInputFiles(dir string) (map[string][]byte, []corev1.KeyToPath, error) {
+	files := map[string][]byte{}
+	items := []corev1.KeyToPath{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if rel == "artifacts" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key := strings.Replace(rel, string(filepath.Separator), ".", -1)
+		files[key] = bytes.Replace(b, []byte(dir), []byte(jobInputDir), -1)
+		items = append(items, corev1.KeyToPath{Key: key, Path: rel})
+		return nil
+	})
+	return files, items, err
+}
+
+// waitForPod returns the name of the pod of the Job name once it runs, or
+// "" if the Job failed without one.
+func (j *Job) waitForPod(ctx context.Context, namespace, name string) (string, error) {
+	for {
+		pods, err := j.client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: "job-name=" + name})
+		if err != nil {
+			return "", err
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.Phase != corev1.PodPending {
+				return pod.GetName(), nil
+			}
+			for _, s := range pod.Status.ContainerStatuses {
+				if w := s.State.Waiting; w != nil {
+					switch w.Reason {
+					case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError":
+						return "", fmt.Errorf("pod %s/%s of job cannot start: %s: %s", namespace, pod.GetName(), w.Reason, w.Message)
+					}
+				}
+			}
+		}
+		job, err := j.client.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if job.Status.Failed > 0 {
+			return "", nil
+		}
+		if err := sleep(ctx, jobPollInterval); err != nil {
+			return "", err
+		}
+	}
+}
+
+// streamEvents follows the log of container of pod, sending the events
+// ansible-runner prints to events, bounded by limits, until ctx is done. It
+// reports whether the stats of the run were among them.
+func (j *Job) streamEvents(ctx context.Context, namespace, pod, container string, limits eventapi.Limits, events chan<- eventapi.JobEvent, logger logrus.FieldLogger) (bool, error) {
+	req := j.client.CoreV1().Pods(namespace).GetLogs(pod, &corev1.PodLogOptions{Container: container, Follow: true})
+	stream, err := req.Stream()
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks the read below
+			stream.Close()
+		case <-finished:
+		}
+	}()
+	sawStats := false
+	reader := bufio.NewReader(stream)
+	for {
+		line, size, err := readLine(reader, limits.MaxEventSize)
+		if err == io.EOF {
+			return sawStats, nil
+		}
+		if err != nil {
+			return sawStats, err
+		}
+		event, err := limits.Decode(line, size)
+		if err != nil || event.Event == "" {
+			logger.Debug(string(line))
+			continue
+		}
+		if event.Event == "playbook_on_stats" {
+			sawStats = true
+		}
+		events <- event
+	}
+}
+
+// readLine returns the next line of r, cut at max bytes if max is set, and
+// its size.
+func readLine(r *bufio.Reader, max int64) ([]byte, int64, error) {
+	line := []byte{}
+	size := int64(0)
+	for {
+		fragment, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(fragment))
+		if room := max - int64(len(line)); max <= 0 || room >= int64(len(fragment)) {
+			line = append(line, fragment...)
+		} else if room > 0 {
+			line = append(line, fragment[:room]...)
+		}
+		if !isPrefix {
+			return line, size, nil
+		}
+	}
+}
+
+// waitForJob waits for the Job name to finish, and returns an error if it
+// failed.
+func (j *Job) waitForJob(ctx context.Context, namespace, name string) error {
+	for {
+		job, err := j.client.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if job.Status.Succeeded > 0 {
+			return nil
+		}
+		if job.Status.Failed > 0 {
+			return fmt.Errorf("job %s/%s failed", namespace, name)
+		}
+		if err := sleep(ctx, jobPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, or returns the error of ctx once it is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
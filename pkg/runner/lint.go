@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LintOptions - what Lint checks the content of runners with.
+type LintOptions struct {
+	// AnsibleLint also runs ansible-lint on every playbook and role, in
+	// addition to ansible-playbook --syntax-check.
+	AnsibleLint bool
+}
+
+// Lint checks the playbooks and roles of runners, hooks and finalizers
+// included, with ansible-playbook --syntax-check, and ansible-lint if set in
+// o. Each path is checked once. It returns an error listing the paths that
+// failed, whose output is logged.
+func Lint(runners []Runner, o LintOptions) error {
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, r := range runners {
+		for _, p := range r.GetPaths() {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	failed := []string{}
+	for _, p := range paths {
+		if err := lintPath(p, o); err != nil {
+			logrus.Errorf("Content check of %s failed: %v", p, err)
+			failed = append(failed, p)
+			continue
+		}
+		logrus.Infof("Content check of %s passed", p)
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("content check failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func lintPath(path string, o LintOptions) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	playbook := path
+	env := os.Environ()
+	if fi.IsDir() {
+		// Roles are checked through a playbook that runs them.
+		rolesPath, name := filepath.Split(strings.TrimRight(path, "/"))
+		f, err := ioutil.TempFile("", "lint-*.yaml")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = fmt.Fprintf(f, "---\n- hosts: localhost\n  gather_facts: no\n  roles:\n  - %s\n", name)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		playbook = f.Name()
+		env = append(env, "ANSIBLE_ROLES_PATH="+rolesPath)
+	}
+	cmds := []*exec.Cmd{exec.Command("ansible-playbook", "--syntax-check", "-i", "localhost,", playbook)}
+	if o.AnsibleLint {
+		cmds = append(cmds, exec.Command("ansible-lint", path))
+	}
+	for _, cmd := range cmds {
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v\n%s", strings.Join(cmd.Args[:2], " "), err, out)
+		}
+	}
+	return nil
+}
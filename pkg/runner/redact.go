@@ -0,0 +1,215 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/water-hole/ansible-operator/pkg/paramconv"
+	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
+)
+
+// RedactedValue replaces the values redacted from the output and artifacts
+// of runs.
+const RedactedValue = "********"
+
+// minRedactedLength is the length of the shortest value redacted; shorter
+// values would mask unrelated output.
+const minRedactedLength = 4
+
+// Redaction - extra vars whose values are masked in the events, logs and
+// artifacts of the runs of a watch, in addition to those read from Secrets
+// and the credentials of the run, which always are.
+type Redaction struct {
+	// Keys are patterns matched with path.Match against the snake_case names
+	// of the vars, at any depth, ignoring case, e.g. "*password*". Every
+	// value beneath a matching var is masked.
+	Keys []string `yaml:"keys"`
+}
+
+func (r *runner) addRedaction(rd *Redaction) error {
+	if rd == nil {
+		return nil
+	}
+	for _, k := range rd.Keys {
+		if _, err := path.Match(k, ""); err != nil {
+			return fmt.Errorf("invalid redaction key %q for %v: %v", k, r.GVK, err)
+		}
+	}
+	r.redaction = rd
+	return nil
+}
+
+type redactedVarsKey struct{}
+
+// WithRedactedVars returns a copy of ctx masking the values of the extra vars
+// names in the run started with it, as if they matched the keys of the
+// redaction of the watch; the controller passes those read from Secrets.
+func WithRedactedVars(ctx context.Context, names ...string) context.Context {
+	return context.WithValue(ctx, redactedVarsKey{}, names)
+}
+
+// redactor masks the values of a run wherever its output is read or kept.
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+// newRedactor returns the redactor of a run with parameters, nil if the run
+// has no value to redact.
+func (r *runner) newRedactor(ctx context.Context, parameters map[string]interface{}) *redactor {
+	values := map[string]bool{}
+	names, _ := ctx.Value(redactedVarsKey{}).([]string)
+	for _, n := range names {
+		collectValues(parameters[n], values)
+	}
+	if r.redaction != nil {
+		r.collectRedacted(parameters, values)
+	}
+	if c, ok := runCredentialsFrom(ctx); ok {
+		for _, v := range []string{string(c.SSHPrivateKey), c.Password, c.BecomePassword} {
+			collectValues(v, values)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := []string{}
+	for v := range values {
+		sorted = append(sorted, v)
+		// values are also found escaped in JSON, e.g. in the job events
+		if b, err := json.Marshal(v); err == nil {
+			if escaped := string(b[1 : len(b)-1]); escaped != v {
+				sorted = append(sorted, escaped)
+			}
+		}
+	}
+	// the longest values first, so those containing others are masked whole
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := []string{}
+	for _, v := range sorted {
+		pairs = append(pairs, v, RedactedValue)
+	}
+	return &redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+// collectRedacted adds the values of the vars within v matching the keys of
+// the redaction of r to values.
+func (r *runner) collectRedacted(v interface{}, values map[string]bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if r.redacted(k) {
+				collectValues(e, values)
+			} else {
+				r.collectRedacted(e, values)
+			}
+		}
+	case []interface{}:
+		for _, e := range t {
+			r.collectRedacted(e, values)
+		}
+	}
+}
+
+func (r *runner) redacted(name string) bool {
+	name = strings.ToLower(paramconv.ToSnake(name))
+	for _, k := range r.redaction.Keys {
+		if ok, _ := path.Match(strings.ToLower(k), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectValues adds the strings of v, at any depth, to values.
+func collectValues(v interface{}, values map[string]bool) {
+	switch t := v.(type) {
+	case string:
+		if len(t) >= minRedactedLength {
+			values[t] = true
+		}
+	case map[string]interface{}:
+		for _, e := range t {
+			collectValues(e, values)
+		}
+	case []interface{}:
+		for _, e := range t {
+			collectValues(e, values)
+		}
+	}
+}
+
+func (rd *redactor) redact(s string) string {
+	return rd.replacer.Replace(s)
+}
+
+// redactValue returns a copy of v with its strings redacted.
+func (rd *redactor) redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return rd.redact(t)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = rd.redactValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = rd.redactValue(e)
+		}
+		return s
+	}
+	return v
+}
+
+// forward returns a channel of the events of in, redacted, closed once in
+// is.
+func (rd *redactor) forward(in chan eventapi.JobEvent) chan eventapi.JobEvent {
+	out := make(chan eventapi.JobEvent, cap(in))
+	go func() {
+		defer close(out)
+		for e := range in {
+			e.StdOut = rd.redact(e.StdOut)
+			if e.EventData != nil {
+				e.EventData = rd.redactValue(e.EventData).(map[string]interface{})
+			}
+			out <- e
+		}
+	}()
+	return out
+}
+
+// redactFiles redacts the files at paths, and those of the directories among
+// them.
+func (rd *redactor) redactFiles(paths ...string) error {
+	for _, p := range paths {
+		err := filepath.Walk(p, func(file string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if redacted := rd.redact(string(b)); redacted != string(b) {
+				return ioutil.WriteFile(file, []byte(redacted), fi.Mode().Perm())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package runner
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// NewFromWatchesRelocated reads the watches file at path like
+// NewFromWatches, with the paths of playbooks, roles and other content below
+// from moved below to. It lets a watches file written for the operator's
+// image, e.g. with paths below /opt/ansible, run from a checkout.
+func NewFromWatchesRelocated(path, from, to string) (map[schema.GroupVersionKind]Runner, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		logrus.Errorf("failed to get config file %v", err)
+		return nil, err
+	}
+	watches, err := parseWatches(b)
+	if err != nil {
+		logrus.Errorf("failed to unmarshal config %v", err)
+		return nil, err
+	}
+	relocate := func(p *string) {
+		rel, err := filepath.Rel(from, *p)
+		if *p == "" || err != nil || strings.HasPrefix(rel, "..") {
+			return
+		}
+		*p = filepath.Join(to, rel)
+	}
+	for i := range watches {
+		w := &watches[i]
+		relocate(&w.Playbook)
+		relocate(&w.Role)
+		if w.Finalizer != nil {
+			relocate(&w.Finalizer.Playbook)
+			relocate(&w.Finalizer.Role)
+		}
+		for j := range w.Content {
+			relocate(&w.Content[j].Playbook)
+			relocate(&w.Content[j].Role)
+		}
+		relocate(&w.Hooks.Pre)
+		relocate(&w.Hooks.Post)
+		relocate(&w.Hooks.OnFailure)
+		if w.AnsibleConfig != nil {
+			relocate(&w.AnsibleConfig.Path)
+		}
+		relocate(&w.DefaultCR)
+		if w.ExecutionEnvironment != nil {
+			for j := range w.ExecutionEnvironment.Mounts {
+				relocate(&w.ExecutionEnvironment.Mounts[j].HostPath)
+			}
+		}
+	}
+	return newFromWatchList(watches)
+}
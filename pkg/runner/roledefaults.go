@@ -0,0 +1,116 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/water-hole/ansible-operator/pkg/paramconv"
+)
+
+// LoadRoleDefaults reads the variables of defaults/main.yml of the role at
+// rolePath. It returns nil if the role has none.
+func LoadRoleDefaults(rolePath string) (map[string]interface{}, error) {
+	var b []byte
+	var err error
+	for _, name := range []string{"main.yml", "main.yaml"} {
+		b, err = ioutil.ReadFile(filepath.Join(rolePath, "defaults", name))
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal defaults of %s: %v", rolePath, err)
+	}
+	defaults := map[string]interface{}{}
+	if err := json.Unmarshal(j, &defaults); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal defaults of %s: %v", rolePath, err)
+	}
+	return defaults, nil
+}
+
+// loadRoleDefaults sets the role defaults of the runner from the roles among
+// paths. Defaults that are templated, and variables the roles default to
+// different values, are left out: their value is only known to ansible.
+func (r *runner) loadRoleDefaults(paths ...string) error {
+	defaults := map[string]interface{}{}
+	skipped := map[string]bool{}
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			continue
+		}
+		d, err := LoadRoleDefaults(p)
+		if err != nil {
+			return err
+		}
+		for k, v := range d {
+			if isTemplated(v) {
+				skipped[k] = true
+				continue
+			}
+			if prev, ok := defaults[k]; ok {
+				b1, _ := json.Marshal(prev)
+				b2, _ := json.Marshal(v)
+				if string(b1) != string(b2) {
+					skipped[k] = true
+				}
+				continue
+			}
+			defaults[k] = v
+		}
+	}
+	for k := range skipped {
+		delete(defaults, k)
+	}
+	if len(defaults) != 0 {
+		r.roleDefaults = defaults
+	}
+	return nil
+}
+
+// isTemplated reports whether v, or a value within it, is a Jinja template.
+func isTemplated(v interface{}) bool {
+	switch t := v.(type) {
+	case string:
+		return strings.Contains(t, "{{") || strings.Contains(t, "{%")
+	case []interface{}:
+		for _, e := range t {
+			if isTemplated(e) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range t {
+			if isTemplated(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SpecDefaults returns the defaults of the roles run for the GVK that spec
+// does not set, keyed by their camelCase spec field. Fields are matched by
+// their snake_case names, as passed to ansible.
+func (r *runner) SpecDefaults(spec map[string]interface{}) map[string]interface{} {
+	set := paramconv.MapToSnake(spec)
+	missing := map[string]interface{}{}
+	for k, v := range r.roleDefaults {
+		if _, ok := set[k]; ok {
+			continue
+		}
+		missing[k] = v
+	}
+	return paramconv.MapToCamel(missing)
+}
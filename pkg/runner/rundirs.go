@@ -0,0 +1,57 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RunDirs - where runs write their private data dirs: the inputs of
+// ansible-runner, such as extra vars and environment, and its artifacts.
+// Pointing Path at a memory-backed, size-capped volume keeps runs from
+// filling the node's disk, and the secrets they are given off it.
+type RunDirs struct {
+	// Path below which private data dirs are created. Defaults to
+	// os.TempDir().
+	Path string
+	// Remove gives every run its own private data dir, and removes it once
+	// the run has ended and its artifacts were uploaded.
+	Remove bool
+	// MaxBytes, if set, fails runs before they start while the private data
+	// dirs below Path hold more than MaxBytes.
+	MaxBytes int64
+}
+
+// SetRunDirs makes r run in private data dirs as set in d.
+func (r *runner) SetRunDirs(d RunDirs) {
+	r.runDirs = d
+}
+
+// root returns the directory holding the private data dirs of all
+// runners.
+func (d RunDirs) root() string {
+	path := d.Path
+	if path == "" {
+		path = os.TempDir()
+	}
+	return filepath.Join(path, "ansible-operator", "runner")
+}
+
+// checkSize returns an error if the private data dirs hold more than
+// MaxBytes.
+func (d RunDirs) checkSize() error {
+	if d.MaxBytes <= 0 {
+		return nil
+	}
+	var size int64
+	filepath.Walk(d.root(), func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if size > d.MaxBytes {
+		return fmt.Errorf("run directories in %s hold %d bytes, more than the %d allowed", d.root(), size, d.MaxBytes)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,32 +12,195 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/water-hole/ansible-operator/pkg/paramconv"
 	"github.com/water-hole/ansible-operator/pkg/runner/eventapi"
 	"github.com/water-hole/ansible-operator/pkg/runner/internal/inputdir"
-	yaml "gopkg.in/yaml.v2"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 // Runner - a runnable that should take the parameters and name and namespace
 // and run the correct code.
+//
+// The extra vars passed to Run are merged into the parameters sent to
+// ansible; values from the resource's spec take precedence over them. The
+// run is cancelled once ctx is done: ansible is stopped, and the run's
+// artifacts record it as cancelled.
 type Runner interface {
-	Run(*unstructured.Unstructured, string) (chan eventapi.JobEvent, error)
+	Run(ctx context.Context, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}) (chan eventapi.JobEvent, error)
 	GetFinalizer() (string, bool)
+	GetTriggers() []Trigger
+	GetExtraVarsFrom() []ExtraVarsSource
+	GetTargetCluster() (*TargetCluster, bool)
+	GetServiceAccount() (*ServiceAccount, bool)
+	GetCredentials() (*Credentials, bool)
+	GetPaths() []string
+	GetWatchDependentResources() bool
+	GetMaxWorkers() int
+	GetCooldown() time.Duration
+	GetFieldSelector() fields.Selector
+	GetRequireAnnotations() map[string]string
+	GetOneShot() bool
+	GetSuspendPeriodicAfter() int
+	GetMaxFailures() int
+	GetHooks() Hooks
+	GetHistoryLimit() int
+	GetDefaultCR() (*unstructured.Unstructured, bool)
+	GetPruneDependents() bool
+	GetPreemptStaleRuns() bool
+	GetWatchedResources() []schema.GroupVersionKind
+	GetAnnotationVarsPrefix() string
+	GetAnsibleRuns() (AnsibleRuns, bool)
+	GetCanary() (Canary, bool)
+	GetBackend() string
+}
+
+// ArtifactUploader stores the artifacts of finished runs, so they outlive
+// the operator's pod.
+type ArtifactUploader interface {
+	// Upload stores the artifacts in dir of the run ident of the resource
+	// namespace/name of kind gvk.
+	Upload(gvk schema.GroupVersionKind, namespace, name, ident, dir string) error
 }
 
 // watch holds data used to create a mapping of GVK to ansible playbook or role.
 // The mapping is used to compose an ansible operator.
 type watch struct {
-	Version   string     `yaml:"version"`
-	Group     string     `yaml:"group"`
-	Kind      string     `yaml:"kind"`
-	Playbook  string     `yaml:"playbook"`
-	Role      string     `yaml:"role"`
-	Finalizer *Finalizer `yaml:"finalizer"`
+	Version  string `yaml:"version"`
+	Group    string `yaml:"group"`
+	Kind     string `yaml:"kind"`
+	Playbook string `yaml:"playbook"`
+	Role     string `yaml:"role"`
+	// Content runs several playbooks and roles in order, within a single
+	// run. A watch setting both playbook and role runs the playbook first.
+	Content   []ContentItem `yaml:"content"`
+	Finalizer *Finalizer    `yaml:"finalizer"`
+	Triggers  []Trigger     `yaml:"triggers"`
+	// References are fields of the spec naming Secrets and ConfigMaps whose
+	// changes requeue the resource.
+	References []Reference `yaml:"references"`
+	// ExtraVarsFrom are resolved at reconcile time and merged into the extra
+	// vars of each run.
+	ExtraVarsFrom []ExtraVarsSource `yaml:"extraVarsFrom"`
+	// AnnotationVarsPrefix turns the annotations of a resource starting
+	// with it, e.g. "vars.ansible.operator/", into extra vars of its runs.
+	AnnotationVarsPrefix string         `yaml:"annotationVarsPrefix"`
+	TargetCluster        *TargetCluster `yaml:"targetCluster"`
+	// ServiceAccount is impersonated by the playbooks of the watch.
+	ServiceAccount *ServiceAccount `yaml:"serviceAccount"`
+	// Credentials are what the playbooks log in to external hosts with.
+	Credentials *Credentials `yaml:"credentials"`
+	// Inventory adds the hosts and groups of a field of the resource to the
+	// inventory of its runs.
+	Inventory *Inventory `yaml:"inventory"`
+	// Redact masks the values of extra vars in the output and artifacts of
+	// runs.
+	Redact *Redaction `yaml:"redact"`
+	// WatchDependentResources requeues a resource as soon as one of the
+	// resources its playbook created is changed or deleted.
+	WatchDependentResources bool `yaml:"watchDependentResources"`
+	// Diff runs ansible in diff mode, so that runs report what they changed.
+	Diff bool `yaml:"diff"`
+	// MaxWorkers is the number of resources of the GVK reconciled at once.
+	// It overrides the operator's default.
+	MaxWorkers int `yaml:"maxWorkers"`
+	// MaxRunnerConcurrency limits the number of ansible-runner processes
+	// running for the GVK at once, below MaxWorkers.
+	MaxRunnerConcurrency int `yaml:"maxRunnerConcurrency"`
+	// Strategy is the ansible strategy plugin the playbooks run with, e.g.
+	// linear or free.
+	Strategy string `yaml:"strategy"`
+	// Forks is the number of hosts ansible runs tasks on in parallel.
+	Forks int `yaml:"forks"`
+	// Cooldown is the minimum time between the end of a run for a resource
+	// and the start of its next run, e.g. "30s".
+	Cooldown time.Duration `yaml:"cooldown"`
+	// FieldSelector limits the resources of the GVK reconciled to those
+	// matching it, e.g. "metadata.namespace!=kube-system". Only the
+	// metadata.name and metadata.namespace fields are supported.
+	FieldSelector string `yaml:"fieldSelector"`
+	// RequireAnnotations limits the resources of the GVK reconciled to those
+	// carrying all of these annotations with the given values. An empty
+	// value only requires the annotation to be set.
+	RequireAnnotations map[string]string `yaml:"requireAnnotations"`
+	// OneShot runs the playbook for a resource until it succeeds once for
+	// each generation, instead of on every periodic reconcile, for job-like
+	// resources such as backups.
+	OneShot bool `yaml:"oneShot"`
+	// SuspendPeriodicAfter suspends the periodic reconcile of a resource
+	// after this many consecutive successful runs that changed nothing.
+	SuspendPeriodicAfter int `yaml:"suspendPeriodicAfter"`
+	// MaxFailures sets a resource Degraded, and stops retrying its runs,
+	// after this many consecutive failed runs for its current spec.
+	MaxFailures int `yaml:"maxFailures"`
+	// Become enables privilege escalation for the tasks of the playbook.
+	Become *Become `yaml:"become"`
+	// AnsibleConfig overrides the ansible.cfg of the operator for the
+	// playbooks of the watch.
+	AnsibleConfig *AnsibleConfig `yaml:"ansibleConfig"`
+	// Hooks are playbooks run around the content of the watch.
+	Hooks Hooks `yaml:"hooks"`
+	// HistoryLimit is the number of runs kept in the status.history of a
+	// resource; it defaults to 10.
+	HistoryLimit int `yaml:"historyLimit"`
+	// DefaultCR is the path to the manifest of a resource of the GVK that is
+	// created at startup if none exists, for operators that should work
+	// right after install.
+	DefaultCR string `yaml:"defaultCR"`
+	// PruneDependents deletes the resources a resource's runs created in
+	// other namespaces or at cluster scope, which owner references cannot
+	// point across, when the resource is deleted.
+	PruneDependents bool `yaml:"pruneDependents"`
+	// PreemptStaleRuns cancels the run of a resource in progress as its
+	// spec changes, and runs the new spec instead of finishing the old one.
+	PreemptStaleRuns bool `yaml:"preemptStaleRuns"`
+	// WatchedResources are kinds of dependents, e.g. "apps/v1 Deployment"
+	// or "v1 Service", whose changes requeue the resource owning them by an
+	// owner reference.
+	WatchedResources []string `yaml:"watchedResources"`
+	// ExecutionEnvironment runs ansible-runner in a container image, which
+	// provides ansible and its dependencies instead of the operator's.
+	ExecutionEnvironment *ExecutionEnvironment `yaml:"executionEnvironment"`
+	// Job runs ansible-runner in Kubernetes Jobs created from a pod
+	// template, rather than in the operator's pod.
+	Job *Job `yaml:"job"`
+	// ProcessIsolation runs ansible in a sandbox hiding the files of the
+	// operator, for untrusted roles.
+	ProcessIsolation *ProcessIsolation `yaml:"processIsolation"`
+	// Canary runs the playbooks in check mode before every run, and holds
+	// back runs predicted to change too much until they are approved.
+	Canary *Canary `yaml:"canary"`
+	// AnsibleRuns records every run of a resource as an AnsibleRun
+	// resource.
+	AnsibleRuns *AnsibleRuns `yaml:"ansibleRuns"`
+}
+
+// Hooks - short playbooks run in their own ansible runs around the content
+// of a watch, e.g. to quiesce an application before and verify its health
+// after. They do not run for finalizers.
+type Hooks struct {
+	// Pre runs before the content; if it fails, the content is not run.
+	Pre string `yaml:"pre"`
+	// Post runs after the content succeeded.
+	Post string `yaml:"post"`
+	// OnFailure runs after the pre hook, the content or the post hook
+	// failed.
+	OnFailure string `yaml:"onFailure"`
+}
+
+// Become - privilege escalation settings of a watch, as in ansible's become
+// keywords. The become password, if any, can be passed as the
+// ansible_become_password variable with extraVarsFrom.
+type Become struct {
+	// User defaults to root.
+	User string `yaml:"user"`
+	// Method defaults to sudo.
+	Method string `yaml:"method"`
+	Flags  string `yaml:"flags"`
 }
 
 // Finalizer - Expose finalizer to be used by a user.
@@ -54,13 +218,23 @@ func NewFromWatches(path string) (map[schema.GroupVersionKind]Runner, error) {
 		logrus.Errorf("failed to get config file %v", err)
 		return nil, err
 	}
-	watches := []watch{}
-	err = yaml.Unmarshal(b, &watches)
+	return NewFromWatchesData(b)
+}
+
+// NewFromWatchesData parses watches in the format of the operator's config
+// file from b. JSON is accepted as well as YAML, and the watches may be
+// given with defaults; see parseWatches.
+func NewFromWatchesData(b []byte) (map[schema.GroupVersionKind]Runner, error) {
+	watches, err := parseWatches(b)
 	if err != nil {
 		logrus.Errorf("failed to unmarshal config %v", err)
 		return nil, err
 	}
+	return newFromWatchList(watches)
+}
 
+func newFromWatchList(watches []watch) (map[schema.GroupVersionKind]Runner, error) {
+	var err error
 	m := map[schema.GroupVersionKind]Runner{}
 	for _, w := range watches {
 		s := schema.GroupVersionKind{
@@ -72,28 +246,123 @@ func NewFromWatches(path string) (map[schema.GroupVersionKind]Runner, error) {
 		if _, ok := m[s]; ok {
 			return nil, fmt.Errorf("duplicate GVK: %v", s.String())
 		}
+		var r *runner
 		switch {
-		case w.Playbook != "":
-			r, err := NewForPlaybook(w.Playbook, s, w.Finalizer)
-			if err != nil {
-				return nil, err
+		case len(w.Content) != 0:
+			if w.Playbook != "" || w.Role != "" {
+				return nil, fmt.Errorf("content cannot be combined with a playbook or role for %v", s)
 			}
-			m[s] = r
+			r, err = newForContent(w.Content, s, w.Finalizer)
+		case w.Playbook != "" && w.Role != "":
+			r, err = newForContent([]ContentItem{{Playbook: w.Playbook}, {Role: w.Role}}, s, w.Finalizer)
+		case w.Playbook != "":
+			r, err = newForPlaybook(w.Playbook, s, w.Finalizer)
 		case w.Role != "":
-			r, err := NewForRole(w.Role, s, w.Finalizer)
-			if err != nil {
-				return nil, err
-			}
-			m[s] = r
+			r, err = newForRole(w.Role, s, w.Finalizer)
 		default:
 			return nil, fmt.Errorf("Either playbook or role must be defined for %v", s)
 		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.addTriggers(w.Triggers); err != nil {
+			return nil, err
+		}
+		if err := r.addReferences(w.References); err != nil {
+			return nil, err
+		}
+		if err := r.addExtraVarsFrom(w.ExtraVarsFrom); err != nil {
+			return nil, err
+		}
+		r.AnnotationVarsPrefix = w.AnnotationVarsPrefix
+		if err := r.addTargetCluster(w.TargetCluster); err != nil {
+			return nil, err
+		}
+		if err := r.addServiceAccount(w.ServiceAccount); err != nil {
+			return nil, err
+		}
+		r.WatchDependentResources = w.WatchDependentResources
+		r.PruneDependents = w.PruneDependents
+		r.PreemptStaleRuns = w.PreemptStaleRuns
+		if err := r.addWatchedResources(w.WatchedResources); err != nil {
+			return nil, err
+		}
+		r.Diff = w.Diff
+		if err := r.addConcurrency(w.MaxWorkers, w.MaxRunnerConcurrency); err != nil {
+			return nil, err
+		}
+		if err := r.addExecution(w.Strategy, w.Forks); err != nil {
+			return nil, err
+		}
+		if w.Cooldown < 0 {
+			return nil, fmt.Errorf("cooldown must not be negative for %v", s)
+		}
+		r.Cooldown = w.Cooldown
+		if err := r.addFieldSelector(w.FieldSelector); err != nil {
+			return nil, err
+		}
+		r.RequireAnnotations = w.RequireAnnotations
+		r.OneShot = w.OneShot
+		if w.SuspendPeriodicAfter < 0 {
+			return nil, fmt.Errorf("suspendPeriodicAfter must not be negative for %v", s)
+		}
+		r.SuspendPeriodicAfter = w.SuspendPeriodicAfter
+		if w.MaxFailures < 0 {
+			return nil, fmt.Errorf("maxFailures must not be negative for %v", s)
+		}
+		r.MaxFailures = w.MaxFailures
+		r.Become = w.Become
+		if err := r.addAnsibleConfig(w.AnsibleConfig); err != nil {
+			return nil, err
+		}
+		for _, hook := range []string{w.Hooks.Pre, w.Hooks.Post, w.Hooks.OnFailure} {
+			if hook != "" && !filepath.IsAbs(hook) {
+				return nil, fmt.Errorf("hook playbook path must be absolute for %v", s)
+			}
+		}
+		r.Hooks = w.Hooks
+		if w.HistoryLimit < 0 {
+			return nil, fmt.Errorf("historyLimit must not be negative for %v", s)
+		}
+		r.HistoryLimit = w.HistoryLimit
+		if err := r.addDefaultCR(w.DefaultCR); err != nil {
+			return nil, err
+		}
+		if err := r.addExecutionEnvironment(w.ExecutionEnvironment); err != nil {
+			return nil, err
+		}
+		if err := r.addJob(w.Job); err != nil {
+			return nil, err
+		}
+		if err := r.addProcessIsolation(w.ProcessIsolation); err != nil {
+			return nil, err
+		}
+		if err := r.addCredentials(w.Credentials); err != nil {
+			return nil, err
+		}
+		if err := r.addInventory(w.Inventory); err != nil {
+			return nil, err
+		}
+		if err := r.addRedaction(w.Redact); err != nil {
+			return nil, err
+		}
+		if err := r.addAnsibleRuns(w.AnsibleRuns); err != nil {
+			return nil, err
+		}
+		if err := r.addCanary(w.Canary); err != nil {
+			return nil, err
+		}
+		m[s] = r
 	}
 	return m, nil
 }
 
 // NewForPlaybook returns a new Runner based on the path to an ansible playbook.
 func NewForPlaybook(path string, gvk schema.GroupVersionKind, finalizer *Finalizer) (Runner, error) {
+	return newForPlaybook(path, gvk, finalizer)
+}
+
+func newForPlaybook(path string, gvk schema.GroupVersionKind, finalizer *Finalizer) (*runner, error) {
 	if !filepath.IsAbs(path) {
 		return nil, fmt.Errorf("playbook path must be absolute for %v", gvk)
 	}
@@ -113,6 +382,10 @@ func NewForPlaybook(path string, gvk schema.GroupVersionKind, finalizer *Finaliz
 
 // NewForRole returns a new Runner based on the path to an ansible role.
 func NewForRole(path string, gvk schema.GroupVersionKind, finalizer *Finalizer) (Runner, error) {
+	return newForRole(path, gvk, finalizer)
+}
+
+func newForRole(path string, gvk schema.GroupVersionKind, finalizer *Finalizer) (*runner, error) {
 	if !filepath.IsAbs(path) {
 		return nil, fmt.Errorf("role path must be absolute for %v", gvk)
 	}
@@ -129,47 +402,239 @@ func NewForRole(path string, gvk schema.GroupVersionKind, finalizer *Finalizer)
 	if err != nil {
 		return nil, err
 	}
+	if err := r.loadArgumentSpecs(path); err != nil {
+		return nil, err
+	}
+	if err := r.loadRoleDefaults(path); err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
 // runner - implements the Runner interface for a GVK that's being watched.
 type runner struct {
-	Path             string                  // path on disk to a playbook or role depending on what cmdFunc expects
-	GVK              schema.GroupVersionKind // GVK being watched that corresponds to the Path
-	Finalizer        *Finalizer
+	Path           string                  // path on disk to a playbook or role depending on what cmdFunc expects
+	GVK            schema.GroupVersionKind // GVK being watched that corresponds to the Path
+	Finalizer      *Finalizer
+	Triggers       []Trigger
+	ExtraVarsFrom  []ExtraVarsSource
+	TargetCluster  *TargetCluster
+	ServiceAccount *ServiceAccount
+	Credentials    *Credentials
+	// WatchDependentResources enables requeueing on dependent drift.
+	WatchDependentResources bool
+	PruneDependents         bool
+	PreemptStaleRuns        bool
+	// WatchedResources are the kinds of dependents watched by owner
+	// reference.
+	WatchedResources []schema.GroupVersionKind
+	// AnnotationVarsPrefix is empty if annotations are not extra vars.
+	AnnotationVarsPrefix string
+	// Diff runs ansible in diff mode.
+	Diff       bool
+	MaxWorkers int
+	// Strategy and Forks, if set, override the ansible configuration.
+	Strategy string
+	Forks    int
+	Cooldown time.Duration
+	// FieldSelector is nil if all resources are reconciled.
+	FieldSelector fields.Selector
+	// RequireAnnotations is nil if all resources are reconciled.
+	RequireAnnotations map[string]string
+	OneShot            bool
+	// SuspendPeriodicAfter is 0 if the periodic reconcile is never
+	// suspended.
+	SuspendPeriodicAfter int
+	// MaxFailures is 0 if failed runs are retried forever.
+	MaxFailures int
+	Become      *Become
+	Hooks       Hooks
+	// HistoryLimit is 0 for the controller's default.
+	HistoryLimit int
+	// defaultCR, if set, is created at startup if no resource of the GVK
+	// exists.
+	defaultCR *unstructured.Unstructured
+	// ansibleConfig, if set, is written to the input dir of every run, and
+	// ansible pointed at it. Otherwise ansibleConfigPath, if set, is.
+	ansibleConfig     []byte
+	ansibleConfigPath string
+	// contentPaths, if set, are the playbooks and roles the generated
+	// playbook at Path runs.
+	contentPaths []string
+	// argumentSpecs are those of the roles run, checked by ValidateSpec.
+	argumentSpecs []ArgumentSpec
+	// roleDefaults are the defaults of the roles run, known before the run;
+	// see SpecDefaults.
+	roleDefaults map[string]interface{}
+	// runnerSlots, if set, holds a token for every ansible-runner process
+	// running for the GVK.
+	runnerSlots      chan struct{}
+	artifactUploader ArtifactUploader
+	runDirs          RunDirs
+	ara              *ARA
+	// executionEnvironment, if set, is the image ansible-runner runs in.
+	executionEnvironment *ExecutionEnvironment
+	// processIsolation, if set, sandboxes the ansible processes.
+	processIsolation *ProcessIsolation
+	// inventory, if set, is the field of the resource adding hosts to the
+	// inventory of its runs.
+	inventory *Inventory
+	// redaction, if set, masks the values of extra vars matching its keys.
+	redaction *Redaction
+	// job, if set, runs ansible-runner in Jobs.
+	job *Job
+	// eventLimits, if set, bound the events of runs instead of
+	// eventapi.DefaultLimits.
+	eventLimits *eventapi.Limits
+	// ansibleRuns, if set, records the runs as AnsibleRuns.
+	ansibleRuns *AnsibleRuns
+	// canary, if set, runs the playbooks in check mode before every run.
+	canary           *Canary
 	cmdFunc          func(ident, inputDirPath string) *exec.Cmd // returns a Cmd that runs ansible-runner
 	finalizerCmdFunc func(ident, inputDirPath string) *exec.Cmd
 }
 
-func (r *runner) Run(u *unstructured.Unstructured, kubeconfig string) (chan eventapi.JobEvent, error) {
+func (r *runner) Run(ctx context.Context, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}) (chan eventapi.JobEvent, error) {
+	return r.RunWithEnv(ctx, u, kubeconfig, extraVars, nil)
+}
+
+// RunWithEnv is Run with env added to the environment of ansible.
+func (r *runner) RunWithEnv(ctx context.Context, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}, env map[string]string) (chan eventapi.JobEvent, error) {
 	if u.GetDeletionTimestamp() != nil && !r.isFinalizerRun(u) {
 		return nil, errors.New("Resource has been deleted, but no finalizer was matched, skipping reconciliation")
 	}
-	ident := strconv.Itoa(rand.Int())
+	return r.run(ctx, u, kubeconfig, extraVars, env, "")
+}
+
+// RunHook runs the hook playbook at path for u, like RunWithEnv runs the
+// content of the watch.
+func (r *runner) RunHook(ctx context.Context, path string, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}, env map[string]string) (chan eventapi.JobEvent, error) {
+	return r.run(ctx, u, kubeconfig, extraVars, env, path)
+}
+
+// IdentEnv is the environment variable holding the ident of a run. Callers
+// of RunWithEnv may set it to choose the ident, e.g. to log it before the
+// run starts; it is set for the playbooks of every run.
+const IdentEnv = "ANSIBLE_OPERATOR_RUN_IDENT"
+
+// NewIdent returns a new ident for a run.
+func NewIdent() string {
+	return strconv.Itoa(rand.Int())
+}
+
+// run runs the content of the watch, its finalizer, or the hook playbook at
+// hook if set.
+func (r *runner) run(ctx context.Context, u *unstructured.Unstructured, kubeconfig string, extraVars map[string]interface{}, env map[string]string, hook string) (chan eventapi.JobEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ident := env[IdentEnv]
+	if ident == "" {
+		ident = NewIdent()
+	}
 	logger := logrus.WithFields(logrus.Fields{
 		"component": "runner",
 		"job":       ident,
 		"name":      u.GetName(),
 		"namespace": u.GetNamespace(),
+		"uid":       string(u.GetUID()),
 	})
+	if err := r.runDirs.checkSize(); err != nil {
+		return nil, err
+	}
 	// start the event receiver. We'll check errChan for an error after
 	// ansible-runner exits.
 	errChan := make(chan error, 1)
-	receiver, err := eventapi.New(ident, errChan)
+	receiver, err := eventapi.NewWithLimits(ident, errChan, r.limits())
 	if err != nil {
 		return nil, err
 	}
+	inputDirPath := filepath.Join(r.runDirs.root(), r.GVK.Group, r.GVK.Version, r.GVK.Kind, u.GetNamespace(), u.GetName())
+	if r.runDirs.Remove {
+		inputDirPath = filepath.Join(inputDirPath, ident)
+	}
 	inputDir := inputdir.InputDir{
-		Path:       filepath.Join("/tmp/ansible-operator/runner/", r.GVK.Group, r.GVK.Version, r.GVK.Kind, u.GetNamespace(), u.GetName()),
-		Parameters: r.makeParameters(u),
+		Path:       inputDirPath,
+		Parameters: r.makeParameters(u, extraVars),
 		EnvVars: map[string]string{
 			"K8S_AUTH_KUBECONFIG": kubeconfig,
+			// read by the operator_progress callback plugin
+			"ANSIBLE_OPERATOR_EVENT_SOCKET": receiver.SocketPath,
+			"ANSIBLE_OPERATOR_EVENT_PATH":   receiver.URLPath,
 		},
-		Settings: map[string]string{
+		Settings: map[string]interface{}{
 			"runner_http_url":  receiver.SocketPath,
 			"runner_http_path": receiver.URLPath,
 		},
 	}
+	rd := r.newRedactor(ctx, inputDir.Parameters)
+	if r.job != nil {
+		// The playbooks of a Job use its ServiceAccount, and the events
+		// are read from its log.
+		delete(inputDir.EnvVars, "K8S_AUTH_KUBECONFIG")
+		delete(inputDir.EnvVars, "ANSIBLE_OPERATOR_EVENT_SOCKET")
+		delete(inputDir.EnvVars, "ANSIBLE_OPERATOR_EVENT_PATH")
+		inputDir.Settings = map[string]interface{}{}
+		kubeconfig = ""
+	} else if kubeconfig != "" {
+		// The run reads its own copy, so that isolated runs see none of the
+		// other files next to the kubeconfig.
+		inputDir.EnvVars["K8S_AUTH_KUBECONFIG"] = runKubeconfigPath(inputDir.Path)
+	}
+	for k, v := range env {
+		inputDir.EnvVars[k] = v
+	}
+	if r.ara != nil {
+		for k, v := range r.ara.env(u, ident) {
+			inputDir.EnvVars[k] = v
+		}
+	}
+	inputDir.EnvVars[IdentEnv] = ident
+	if r.Diff {
+		inputDir.EnvVars["ANSIBLE_DIFF_ALWAYS"] = "True"
+	}
+	cmdline := []string{}
+	if env[CheckModeEnv] == "true" {
+		cmdline = append(cmdline, "--check", "--diff")
+	}
+	creds, hasCreds := runCredentialsFrom(ctx)
+	if hasCreds {
+		if creds.Username != "" {
+			inputDir.EnvVars["ANSIBLE_REMOTE_USER"] = creds.Username
+		}
+		cmdline = append(cmdline, creds.cmdline()...)
+	}
+	inputDir.Cmdline = strings.Join(cmdline, " ")
+	if r.Strategy != "" {
+		inputDir.EnvVars["ANSIBLE_STRATEGY"] = r.Strategy
+	}
+	if r.Forks > 0 {
+		inputDir.EnvVars["ANSIBLE_FORKS"] = strconv.Itoa(r.Forks)
+	}
+	if r.Become != nil {
+		inputDir.EnvVars["ANSIBLE_BECOME"] = "True"
+		if r.Become.User != "" {
+			inputDir.EnvVars["ANSIBLE_BECOME_USER"] = r.Become.User
+		}
+		if r.Become.Method != "" {
+			inputDir.EnvVars["ANSIBLE_BECOME_METHOD"] = r.Become.Method
+		}
+		if r.Become.Flags != "" {
+			inputDir.EnvVars["ANSIBLE_BECOME_FLAGS"] = r.Become.Flags
+		}
+	}
+	switch {
+	case r.ansibleConfig != nil:
+		inputDir.EnvVars["ANSIBLE_CONFIG"] = filepath.Join(inputDir.Path, "ansible.cfg")
+	case r.ansibleConfigPath != "":
+		inputDir.EnvVars["ANSIBLE_CONFIG"] = r.ansibleConfigPath
+	}
+	if p := r.processIsolation; p != nil {
+		paths := append(r.mountPaths(), inputDir.Path, receiver.SocketPath)
+		for k, v := range p.settings(paths...) {
+			inputDir.Settings[k] = v
+		}
+	}
 	// If Path is a dir, assume it is a role path. Otherwise assume it's a
 	// playbook path
 	fi, err := os.Lstat(r.Path)
@@ -179,22 +644,89 @@ func (r *runner) Run(u *unstructured.Unstructured, kubeconfig string) (chan even
 	if !fi.IsDir() {
 		inputDir.PlaybookPath = r.Path
 	}
+	if hook != "" {
+		inputDir.PlaybookPath = hook
+	}
+	inputDir.Inventory, err = r.renderInventory(u)
+	if err != nil {
+		return nil, err
+	}
 	err = inputDir.Write()
 	if err != nil {
 		return nil, err
 	}
+	if kubeconfig != "" {
+		if err := copyRunKubeconfig(kubeconfig, inputDir.Path); err != nil {
+			return nil, fmt.Errorf("unable to write the kubeconfig of the run: %v", err)
+		}
+	}
+	if hasCreds {
+		if err := creds.write(inputDir.Path); err != nil {
+			removeCredentials(inputDir.Path)
+			os.Remove(runKubeconfigPath(inputDir.Path))
+			return nil, fmt.Errorf("unable to write the credentials of the run: %v", err)
+		}
+	}
+	if r.ansibleConfig != nil {
+		if err := ioutil.WriteFile(inputDir.EnvVars["ANSIBLE_CONFIG"], r.ansibleConfig, 0644); err != nil {
+			return nil, err
+		}
+	}
 
 	go func() {
 		var dc *exec.Cmd
-		if r.isFinalizerRun(u) {
+		switch {
+		case hook != "":
+			logger.Debugf("Running hook %s", hook)
+			dc = exec.Command("ansible-runner", "-vv", "-p", hook, "-i", ident, "run", inputDir.Path)
+		case r.isFinalizerRun(u):
 			logger.Debugf("Resource is marked for deletion, running finalizer %s", r.Finalizer.Name)
 			dc = r.finalizerCmdFunc(ident, inputDir.Path)
-		} else {
+		default:
 			dc = r.cmdFunc(ident, inputDir.Path)
 		}
+		if ee := r.executionEnvironment; ee != nil {
+			paths := append(r.mountPaths(), inputDir.Path, receiver.SocketPath)
+			dc = ee.command(dc, ident, paths...)
+		}
 
-		err := dc.Run()
-		if err != nil {
+		var err error
+		acquired := false
+		if r.runnerSlots != nil {
+			select {
+			case r.runnerSlots <- struct{}{}:
+				acquired = true
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		switch {
+		case err != nil:
+		case r.job != nil:
+			err = r.job.run(ctx, u, ident, inputDir.Path, dc.Args, r.limits(), receiver.Events, logger)
+		default:
+			err = runCommand(ctx, dc)
+		}
+		if acquired {
+			<-r.runnerSlots
+		}
+		if hasCreds {
+			if err := removeCredentials(inputDir.Path); err != nil {
+				logger.Errorf("unable to remove the credentials of the run: %s", err.Error())
+			}
+		}
+		if kubeconfig != "" {
+			if err := os.Remove(runKubeconfigPath(inputDir.Path)); err != nil && !os.IsNotExist(err) {
+				logger.Errorf("unable to remove the kubeconfig of the run: %s", err.Error())
+			}
+		}
+		artifacts := filepath.Join(inputDir.Path, "artifacts", ident)
+		if ctx.Err() != nil {
+			logger.Info("Run cancelled, ansible-runner was stopped")
+			if err := markCanceled(artifacts); err != nil {
+				logger.Errorf("unable to mark the run as cancelled: %s", err.Error())
+			}
+		} else if err != nil {
 			logger.Errorf("error from ansible-runner: %s", err.Error())
 		} else {
 			logger.Info("ansible-runner exited successfully")
@@ -206,10 +738,46 @@ func (r *runner) Run(u *unstructured.Unstructured, kubeconfig string) (chan even
 		if err != nil && err != http.ErrServerClosed {
 			logger.Errorf("error from event api: %s", err.Error())
 		}
+		if rd != nil {
+			if err := rd.redactFiles(artifacts, filepath.Join(inputDir.Path, "env", "extravars")); err != nil {
+				logger.Errorf("unable to redact the artifacts of the run: %s", err.Error())
+			}
+		}
+		if r.artifactUploader != nil {
+			if err := r.artifactUploader.Upload(r.GVK, u.GetNamespace(), u.GetName(), ident, artifacts); err != nil {
+				logger.Errorf("unable to upload artifacts: %s", err.Error())
+			}
+		}
+		if r.runDirs.Remove {
+			if err := os.RemoveAll(inputDir.Path); err != nil {
+				logger.Errorf("unable to remove run directory: %s", err.Error())
+			}
+		}
 	}()
+	if rd != nil {
+		return rd.forward(receiver.Events), nil
+	}
 	return receiver.Events, nil
 }
 
+// SetEventLimits bounds the size of the events of the runs of r by l.
+func (r *runner) SetEventLimits(l eventapi.Limits) {
+	r.eventLimits = &l
+}
+
+func (r *runner) limits() eventapi.Limits {
+	if r.eventLimits != nil {
+		return *r.eventLimits
+	}
+	return eventapi.DefaultLimits
+}
+
+// SetArtifactUploader uploads the artifacts of every run of r with u once
+// it has finished.
+func (r *runner) SetArtifactUploader(u ArtifactUploader) {
+	r.artifactUploader = u
+}
+
 func (r *runner) GetFinalizer() (string, bool) {
 	if r.Finalizer != nil {
 		return r.Finalizer.Name, true
@@ -217,6 +785,208 @@ func (r *runner) GetFinalizer() (string, bool) {
 	return "", false
 }
 
+func (r *runner) GetTriggers() []Trigger {
+	return r.Triggers
+}
+
+func (r *runner) GetExtraVarsFrom() []ExtraVarsSource {
+	return r.ExtraVarsFrom
+}
+
+func (r *runner) GetTargetCluster() (*TargetCluster, bool) {
+	return r.TargetCluster, r.TargetCluster != nil
+}
+
+// runKubeconfigPath is where the run with the input dir at dir reads its
+// kubeconfig from.
+func runKubeconfigPath(dir string) string {
+	return filepath.Join(dir, "env", "kubeconfig")
+}
+
+// copyRunKubeconfig copies the kubeconfig at path into the input dir at dir,
+// readable only by the operator.
+func copyRunKubeconfig(path, dir string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(runKubeconfigPath(dir), b, 0600)
+}
+
+func (r *runner) GetServiceAccount() (*ServiceAccount, bool) {
+	return r.ServiceAccount, r.ServiceAccount != nil
+}
+
+func (r *runner) GetCredentials() (*Credentials, bool) {
+	return r.Credentials, r.Credentials != nil
+}
+
+func (r *runner) GetMaxWorkers() int {
+	return r.MaxWorkers
+}
+
+func (r *runner) GetCooldown() time.Duration {
+	return r.Cooldown
+}
+
+func (r *runner) GetHistoryLimit() int {
+	return r.HistoryLimit
+}
+
+func (r *runner) GetHooks() Hooks {
+	return r.Hooks
+}
+
+func (r *runner) GetMaxFailures() int {
+	return r.MaxFailures
+}
+
+func (r *runner) GetSuspendPeriodicAfter() int {
+	return r.SuspendPeriodicAfter
+}
+
+func (r *runner) GetOneShot() bool {
+	return r.OneShot
+}
+
+func (r *runner) GetFieldSelector() fields.Selector {
+	return r.FieldSelector
+}
+
+func (r *runner) GetRequireAnnotations() map[string]string {
+	return r.RequireAnnotations
+}
+
+// HasAnnotations reports whether u carries all of annotations; an empty value
+// only requires the annotation to be set.
+func HasAnnotations(u *unstructured.Unstructured, annotations map[string]string) bool {
+	actual := u.GetAnnotations()
+	for k, v := range annotations {
+		a, ok := actual[k]
+		if !ok || (v != "" && a != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectableFields are the fields a watch's field selector may match.
+var SelectableFields = []string{"metadata.name", "metadata.namespace"}
+
+func (r *runner) addFieldSelector(selector string) error {
+	if selector == "" {
+		return nil
+	}
+	sel, err := fields.ParseSelector(selector)
+	if err != nil {
+		return fmt.Errorf("invalid field selector for %v: %v", r.GVK, err)
+	}
+	for _, req := range sel.Requirements() {
+		supported := false
+		for _, f := range SelectableFields {
+			supported = supported || f == req.Field
+		}
+		if !supported {
+			return fmt.Errorf("field selector for %v matches %s, only %s are supported", r.GVK, req.Field, strings.Join(SelectableFields, " and "))
+		}
+	}
+	r.FieldSelector = sel
+	return nil
+}
+
+// ObjectFields returns the fields of u a field selector is matched against.
+func ObjectFields(u *unstructured.Unstructured) fields.Set {
+	return fields.Set{"metadata.name": u.GetName(), "metadata.namespace": u.GetNamespace()}
+}
+
+func (r *runner) GetWatchDependentResources() bool {
+	return r.WatchDependentResources
+}
+
+func (r *runner) GetPruneDependents() bool {
+	return r.PruneDependents
+}
+
+func (r *runner) GetPreemptStaleRuns() bool {
+	return r.PreemptStaleRuns
+}
+
+func (r *runner) GetWatchedResources() []schema.GroupVersionKind {
+	return r.WatchedResources
+}
+
+func (r *runner) GetAnnotationVarsPrefix() string {
+	return r.AnnotationVarsPrefix
+}
+
+// addWatchedResources parses the watchedResources of a watch, each an
+// apiVersion and a kind separated by a space.
+func (r *runner) addWatchedResources(resources []string) error {
+	seen := map[schema.GroupVersionKind]bool{}
+	for _, res := range resources {
+		f := strings.Fields(res)
+		if len(f) != 2 {
+			return fmt.Errorf("watched resource %q must be an apiVersion and a kind, e.g. \"apps/v1 Deployment\", for %v", res, r.GVK)
+		}
+		gv, err := schema.ParseGroupVersion(f[0])
+		if err != nil || gv.Version == "" {
+			return fmt.Errorf("invalid apiVersion of watched resource %q for %v", res, r.GVK)
+		}
+		gvk := gv.WithKind(f[1])
+		if gvk == r.GVK {
+			return fmt.Errorf("watch of %v cannot list its own kind in watchedResources", r.GVK)
+		}
+		if seen[gvk] {
+			return fmt.Errorf("duplicate watched resource %v for %v", gvk, r.GVK)
+		}
+		seen[gvk] = true
+		r.WatchedResources = append(r.WatchedResources, gvk)
+	}
+	return nil
+}
+
+// The backends runs of a GVK run ansible-runner with, as GetBackend returns.
+const (
+	BackendProcess              = "process"
+	BackendExecutionEnvironment = "executionEnvironment"
+	BackendJob                  = "job"
+)
+
+// GetBackend returns where the runs of the GVK run ansible-runner: in a
+// process of the operator, in the container of an execution environment,
+// or in a Kubernetes Job.
+func (r *runner) GetBackend() string {
+	switch {
+	case r.job != nil:
+		return BackendJob
+	case r.executionEnvironment != nil:
+		return BackendExecutionEnvironment
+	}
+	return BackendProcess
+}
+
+// GetPaths returns the playbooks and roles run for the GVK, including those
+// of the finalizer.
+func (r *runner) GetPaths() []string {
+	paths := []string{r.Path}
+	if len(r.contentPaths) != 0 {
+		paths = append([]string{}, r.contentPaths...)
+	}
+	for _, hook := range []string{r.Hooks.Pre, r.Hooks.Post, r.Hooks.OnFailure} {
+		if hook != "" {
+			paths = append(paths, hook)
+		}
+	}
+	if r.Finalizer != nil {
+		for _, p := range []string{r.Finalizer.Playbook, r.Finalizer.Role} {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
 func (r *runner) isFinalizerRun(u *unstructured.Unstructured) bool {
 	finalizersSet := r.Finalizer != nil && u.GetFinalizers() != nil
 	// The the resource is deleted and our finalizer is present, we need to run the finalizer
@@ -230,6 +1000,37 @@ func (r *runner) isFinalizerRun(u *unstructured.Unstructured) bool {
 	return false
 }
 
+func (r *runner) addConcurrency(maxWorkers, maxRunnerConcurrency int) error {
+	if maxWorkers < 0 || maxRunnerConcurrency < 0 {
+		return fmt.Errorf("maxWorkers and maxRunnerConcurrency must not be negative for %v", r.GVK)
+	}
+	r.MaxWorkers = maxWorkers
+	if maxRunnerConcurrency > 0 {
+		r.runnerSlots = make(chan struct{}, maxRunnerConcurrency)
+	}
+	return nil
+}
+
+// strategies are the strategy plugins shipped with ansible.
+var strategies = map[string]bool{
+	"linear":      true,
+	"free":        true,
+	"host_pinned": true,
+	"debug":       true,
+}
+
+func (r *runner) addExecution(strategy string, forks int) error {
+	if strategy != "" && !strategies[strategy] {
+		return fmt.Errorf("unknown strategy %q for %v", strategy, r.GVK)
+	}
+	if forks < 0 {
+		return fmt.Errorf("forks must not be negative for %v", r.GVK)
+	}
+	r.Strategy = strategy
+	r.Forks = forks
+	return nil
+}
+
 func (r *runner) addFinalizer(finalizer *Finalizer) error {
 	r.Finalizer = finalizer
 	switch {
@@ -256,15 +1057,43 @@ func (r *runner) addFinalizer(finalizer *Finalizer) error {
 	}
 	return nil
 }
-func (r *runner) makeParameters(u *unstructured.Unstructured) map[string]interface{} {
+
+// makeMeta returns the meta variable of a run of u: its name and namespace,
+// and whether and how it is being deleted, so that roles can branch their
+// cleanup logic on it.
+func (r *runner) makeMeta(u *unstructured.Unstructured) map[string]interface{} {
+	finalizers := []interface{}{}
+	for _, f := range u.GetFinalizers() {
+		finalizers = append(finalizers, f)
+	}
+	meta := map[string]interface{}{
+		"namespace":     u.GetNamespace(),
+		"name":          u.GetName(),
+		"deleting":      u.GetDeletionTimestamp() != nil,
+		"finalizer_run": r.isFinalizerRun(u),
+		"finalizers":    finalizers,
+	}
+	if t := u.GetDeletionTimestamp(); t != nil {
+		meta["deletion_timestamp"] = t.UTC().Format(time.RFC3339)
+	}
+	return meta
+}
+
+func (r *runner) makeParameters(u *unstructured.Unstructured, extraVars map[string]interface{}) map[string]interface{} {
 	s := u.Object["spec"]
 	spec, ok := s.(map[string]interface{})
 	if !ok {
 		logrus.Warnf("spec was not found for CR:%v - %v in %v", u.GroupVersionKind(), u.GetNamespace(), u.GetName())
 		spec = map[string]interface{}{}
 	}
-	parameters := paramconv.MapToSnake(spec)
-	parameters["meta"] = map[string]string{"namespace": u.GetNamespace(), "name": u.GetName()}
+	parameters := map[string]interface{}{}
+	for k, v := range extraVars {
+		parameters[k] = v
+	}
+	for k, v := range paramconv.MapToSnake(spec) {
+		parameters[k] = v
+	}
+	parameters["meta"] = r.makeMeta(u)
 	objectKey := fmt.Sprintf("_%v_%v", strings.Replace(r.GVK.Group, ".", "_", -1), strings.ToLower(r.GVK.Kind))
 	parameters[objectKey] = u.Object
 	if r.isFinalizerRun(u) {
@@ -0,0 +1,33 @@
+package runner
+
+import (
+	"fmt"
+)
+
+// ServiceAccount - Expose the ServiceAccount that runs for a watch act as
+// when talking to the API server through the operator's proxy.
+type ServiceAccount struct {
+	Name string `yaml:"name"`
+	// Namespace defaults to the namespace of the resource being reconciled.
+	Namespace string `yaml:"namespace"`
+}
+
+// Username returns the user name of the ServiceAccount, given the namespace
+// of the resource being reconciled.
+func (s ServiceAccount) Username(namespace string) string {
+	if s.Namespace != "" {
+		namespace = s.Namespace
+	}
+	return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, s.Name)
+}
+
+func (r *runner) addServiceAccount(s *ServiceAccount) error {
+	if s == nil {
+		return nil
+	}
+	if s.Name == "" {
+		return fmt.Errorf("serviceAccount name must be set for %v", r.GVK)
+	}
+	r.ServiceAccount = s
+	return nil
+}
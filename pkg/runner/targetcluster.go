@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultTargetClusterKey is the Secret key that holds the kubeconfig of a
+// target cluster if none is set.
+const DefaultTargetClusterKey = "kubeconfig"
+
+// TargetCluster - Expose the Secret holding the kubeconfig of the cluster
+// that runs for a watch should manage, instead of the cluster the resource
+// lives in.
+type TargetCluster struct {
+	// SecretName is the Secret used for every resource of the watch, unless
+	// SpecField names another one.
+	SecretName string `yaml:"secretName"`
+	// SecretNamespace defaults to the namespace of the resource.
+	SecretNamespace string `yaml:"secretNamespace"`
+	// Key is the key of the kubeconfig within the Secret.
+	Key string `yaml:"key"`
+	// SpecField is the dot separated path of a field in the resource, e.g.
+	// ".spec.clusterSecret", holding the name of the Secret, in the namespace
+	// of the resource, or in SecretNamespace for cluster-scoped resources.
+	// Resources that do not set the field use SecretName, or the local
+	// cluster if that is not set either.
+	SpecField string `yaml:"specField"`
+}
+
+// SpecFieldPath splits SpecField into its fields.
+func (t TargetCluster) SpecFieldPath() []string {
+	return strings.Split(strings.TrimPrefix(t.SpecField, "."), ".")
+}
+
+func (r *runner) addTargetCluster(t *TargetCluster) error {
+	if t == nil {
+		return nil
+	}
+	if t.SecretName == "" && strings.TrimPrefix(t.SpecField, ".") == "" {
+		return fmt.Errorf("targetCluster must set secretName or specField for %v", r.GVK)
+	}
+	if t.Key == "" {
+		t.Key = DefaultTargetClusterKey
+	}
+	r.TargetCluster = t
+	return nil
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// MappingSameName requeues the primary resource with the same name and
+	// namespace as the trigger.
+	MappingSameName = "sameName"
+	// MappingLabel requeues the primary resource named by the value of the
+	// trigger's Label.
+	MappingLabel = "label"
+	// MappingJSONPath requeues the primary resources whose field at JSONPath
+	// holds the name of the trigger.
+	MappingJSONPath = "jsonPath"
+)
+
+// Trigger - Expose a resource whose changes requeue primary resources.
+type Trigger struct {
+	Version string `yaml:"version"`
+	Group   string `yaml:"group"`
+	Kind    string `yaml:"kind"`
+	// Name restricts the trigger to resources with this name.
+	Name string `yaml:"name"`
+	// Selector restricts the trigger to resources matching this label
+	// selector, e.g. "app=database".
+	Selector string `yaml:"selector"`
+	// Mapping is one of sameName (the default), label or jsonPath.
+	Mapping string `yaml:"mapping"`
+	// Label is the label of the trigger that holds the primary's name, for
+	// the label mapping.
+	Label string `yaml:"label"`
+	// JSONPath is the dot separated path of the primary's field that holds
+	// the trigger's name, e.g. ".spec.secretName", for the jsonPath mapping.
+	JSONPath string `yaml:"jsonPath"`
+}
+
+// GroupVersionKind returns the GVK of the trigger resource.
+func (t Trigger) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: t.Group, Version: t.Version, Kind: t.Kind}
+}
+
+// LabelSelector parses Selector. It returns labels.Everything() if Selector
+// is empty.
+func (t Trigger) LabelSelector() (labels.Selector, error) {
+	if t.Selector == "" {
+		return labels.Everything(), nil
+	}
+	return labels.Parse(t.Selector)
+}
+
+// JSONPathFields splits JSONPath into its fields, without the [*] suffixes
+// of list fields.
+func (t Trigger) JSONPathFields() []string {
+	fields := strings.Split(strings.TrimPrefix(t.JSONPath, "."), ".")
+	for i, f := range fields {
+		fields[i] = strings.TrimSuffix(f, "[*]")
+	}
+	return fields
+}
+
+// JSONPathValues returns the values of obj at the fields of JSONPath,
+// formatted as strings. Lists along the path are searched element by
+// element, so ".spec.users.passwordSecret" returns the passwordSecret of
+// every user.
+func (t Trigger) JSONPathValues(obj map[string]interface{}) []string {
+	return valuesAt(obj, t.JSONPathFields())
+}
+
+func valuesAt(v interface{}, fields []string) []string {
+	switch o := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := []string{}
+		for _, item := range o {
+			values = append(values, valuesAt(item, fields)...)
+		}
+		return values
+	case map[string]interface{}:
+		if len(fields) == 0 {
+			return nil
+		}
+		return valuesAt(o[fields[0]], fields[1:])
+	}
+	if len(fields) != 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("%v", v)}
+}
+
+// Reference - a field of the spec of primary resources holding the name of
+// a Secret or ConfigMap in their namespace. Changes of the object requeue
+// the primaries referring to it, e.g. to roll out rotated credentials.
+type Reference struct {
+	// Kind is Secret or ConfigMap.
+	Kind string `yaml:"kind"`
+	// JSONPath is the dot separated path of the field, e.g.
+	// ".spec.credentialsSecret", as for jsonPath triggers.
+	JSONPath string `yaml:"jsonPath"`
+}
+
+// addReferences adds a jsonPath trigger for each of the references.
+func (r *runner) addReferences(references []Reference) error {
+	for _, ref := range references {
+		if ref.Kind != "Secret" && ref.Kind != "ConfigMap" {
+			return fmt.Errorf("reference kind must be Secret or ConfigMap for %v", r.GVK)
+		}
+		if strings.TrimPrefix(ref.JSONPath, ".") == "" {
+			return fmt.Errorf("reference to a %s must set jsonPath for %v", ref.Kind, r.GVK)
+		}
+		r.Triggers = append(r.Triggers, Trigger{
+			Version:  "v1",
+			Kind:     ref.Kind,
+			Mapping:  MappingJSONPath,
+			JSONPath: ref.JSONPath,
+		})
+	}
+	return nil
+}
+
+func (r *runner) addTriggers(triggers []Trigger) error {
+	for i := range triggers {
+		t := &triggers[i]
+		if t.Version == "" || t.Kind == "" {
+			return fmt.Errorf("trigger version and kind must be set for %v", r.GVK)
+		}
+		if _, err := t.LabelSelector(); err != nil {
+			return fmt.Errorf("invalid trigger selector %q for %v: %v", t.Selector, r.GVK, err)
+		}
+		switch t.Mapping {
+		case "":
+			t.Mapping = MappingSameName
+		case MappingSameName:
+		case MappingLabel:
+			if t.Label == "" {
+				return fmt.Errorf("trigger %v with mapping %s must set label for %v", t.GroupVersionKind(), t.Mapping, r.GVK)
+			}
+		case MappingJSONPath:
+			if strings.TrimPrefix(t.JSONPath, ".") == "" {
+				return fmt.Errorf("trigger %v with mapping %s must set jsonPath for %v", t.GroupVersionKind(), t.Mapping, r.GVK)
+			}
+		default:
+			return fmt.Errorf("unknown trigger mapping %q for %v", t.Mapping, r.GVK)
+		}
+	}
+	r.Triggers = triggers
+	return nil
+}
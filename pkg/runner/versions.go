@@ -0,0 +1,57 @@
+package runner
+
+import (
+	"encoding/json"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Versions - the versions of ansible, and its collections, the operator runs
+// playbooks with outside execution environments.
+type Versions struct {
+	Ansible       string
+	AnsibleRunner string
+	// Collections maps the names of the collections installed, e.g.
+	// kubernetes.core, to their versions.
+	Collections map[string]string
+}
+
+// ansibleVersion matches the version on the first line of ansible --version,
+// e.g. "ansible 2.9.6" or "ansible [core 2.12.1]".
+var ansibleVersion = regexp.MustCompile(`^ansible (?:\[core )?([^\s\]]+)`)
+
+// DetectVersions returns the versions of ansible, ansible-runner and the
+// collections installed. Versions that cannot be detected, e.g. of
+// collections with ansible before 2.10, are left empty.
+func DetectVersions() Versions {
+	v := Versions{Collections: map[string]string{}}
+	if out, err := exec.Command("ansible", "--version").Output(); err == nil {
+		if m := ansibleVersion.FindStringSubmatch(string(out)); m != nil {
+			v.Ansible = m[1]
+		}
+	}
+	if out, err := exec.Command("ansible-runner", "--version").Output(); err == nil {
+		v.AnsibleRunner = strings.TrimSpace(string(out))
+	}
+	out, err := exec.Command("ansible-galaxy", "collection", "list", "--format", "json").Output()
+	if err != nil {
+		return v
+	}
+	// {"/usr/share/ansible/collections/ansible_collections": {"kubernetes.core": {"version": "2.2.0"}}}
+	paths := map[string]map[string]struct {
+		Version string `json:"version"`
+	}{}
+	if err := json.Unmarshal(out, &paths); err != nil {
+		return v
+	}
+	for _, collections := range paths {
+		for name, c := range collections {
+			// the first path listed takes precedence, as in ansible
+			if _, ok := v.Collections[name]; !ok {
+				v.Collections[name] = c.Version
+			}
+		}
+	}
+	return v
+}
@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// parseWatches parses a watches file. It is either a list of watches, or a
+// mapping of the list under watches with a defaults block merged into every
+// watch; keys of the mapping starting with "x-" are ignored, for anchors
+// shared by the watches. Merge keys (<<) and aliases are resolved in both.
+func parseWatches(b []byte) ([]watch, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	watches := []watch{}
+	switch d := doc.(type) {
+	case nil:
+		return watches, nil
+	case []interface{}:
+		err := yaml.Unmarshal(b, &watches)
+		return watches, err
+	case map[interface{}]interface{}:
+		entries, err := withDefaults(d)
+		if err != nil {
+			return nil, err
+		}
+		out, err := yaml.Marshal(entries)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(out, &watches)
+		return watches, err
+	}
+	return nil, errWatchesFormat
+}
+
+var errWatchesFormat = fmt.Errorf("watches must be a list of watches, or a mapping of watches and defaults")
+
+// SplitWatches returns every watch of the watches file b as a watches file
+// of its own, by GVK, with the defaults of b merged into it. A GVK may only
+// be watched once.
+func SplitWatches(b []byte) (map[schema.GroupVersionKind][]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	var entries []interface{}
+	switch d := doc.(type) {
+	case nil:
+	case []interface{}:
+		entries = d
+	case map[interface{}]interface{}:
+		var err error
+		if entries, err = withDefaults(d); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errWatchesFormat
+	}
+	split := map[schema.GroupVersionKind][]byte{}
+	for i, e := range entries {
+		out, err := yaml.Marshal([]interface{}{e})
+		if err != nil {
+			return nil, err
+		}
+		watches := []watch{}
+		if err := yaml.Unmarshal(out, &watches); err != nil {
+			return nil, fmt.Errorf("watch %d: %v", i, err)
+		}
+		w := watches[0]
+		gvk := schema.GroupVersionKind{Group: w.Group, Version: w.Version, Kind: w.Kind}
+		if _, ok := split[gvk]; ok {
+			return nil, fmt.Errorf("duplicate GVK: %v", gvk)
+		}
+		split[gvk] = out
+	}
+	return split, nil
+}
+
+// withDefaults returns the watches of the mapping d, with its defaults
+// merged into each.
+func withDefaults(d map[interface{}]interface{}) ([]interface{}, error) {
+	defaults := map[interface{}]interface{}{}
+	entries := []interface{}{}
+	for k, v := range d {
+		key := fmt.Sprint(k)
+		switch {
+		case key == "defaults":
+			m, ok := v.(map[interface{}]interface{})
+			if !ok && v != nil {
+				return nil, fmt.Errorf("defaults must be a mapping")
+			}
+			if m != nil {
+				defaults = m
+			}
+		case key == "watches":
+			l, ok := v.([]interface{})
+			if !ok && v != nil {
+				return nil, fmt.Errorf("watches must be a list")
+			}
+			entries = l
+		case strings.HasPrefix(key, "x-"):
+		default:
+			return nil, fmt.Errorf("unknown key %q in watches; only defaults, watches and keys starting with x- are allowed", key)
+		}
+	}
+	if _, ok := defaults["kind"]; ok {
+		return nil, fmt.Errorf("defaults cannot set kind")
+	}
+	merged := []interface{}{}
+	for i, e := range entries {
+		m, ok := e.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("watch %d must be a mapping", i)
+		}
+		merged = append(merged, mergeDefaults(defaults, m))
+	}
+	return merged, nil
+}
+
+// mergeDefaults returns entry with the keys of defaults it does not set.
+// Mappings are merged key by key; other values of entry, including lists,
+// replace those of defaults.
+func mergeDefaults(defaults, entry map[interface{}]interface{}) map[interface{}]interface{} {
+	m := map[interface{}]interface{}{}
+	for k, v := range defaults {
+		m[k] = v
+	}
+	for k, v := range entry {
+		dm, dok := m[k].(map[interface{}]interface{})
+		em, eok := v.(map[interface{}]interface{})
+		if dok && eok {
+			m[k] = mergeDefaults(dm, em)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// WatchGVKs returns the GVKs of the watches in the watches file b, without
+// checking the content they run.
+func WatchGVKs(b []byte) ([]schema.GroupVersionKind, error) {
+	watches, err := parseWatches(b)
+	if err != nil {
+		return nil, err
+	}
+	gvks := []schema.GroupVersionKind{}
+	for _, w := range watches {
+		gvks = append(gvks, schema.GroupVersionKind{Group: w.Group, Version: w.Version, Kind: w.Kind})
+	}
+	return gvks, nil
+}
@@ -0,0 +1,275 @@
+// Package tracing records spans of reconciles and exports them with the
+// OTLP/HTTP JSON protocol, as accepted by OpenTelemetry collectors, Jaeger
+// and Tempo.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// exportInterval is the time between two exports of finished spans.
+	exportInterval = 5 * time.Second
+	// maxQueued is the number of finished spans kept while the endpoint is
+	// unavailable. Spans beyond it are dropped.
+	maxQueued = 2048
+)
+
+// Tracer - creates spans and exports them once finished. A nil Tracer
+// creates nil spans, on which every method is a no-op.
+type Tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mutex sync.Mutex
+	queue []*Span
+}
+
+// NewTracer returns a Tracer exporting to the OTLP/HTTP endpoint, e.g.
+// http://otel-collector:4318, as service. Spans are exported until stop is
+// closed.
+func NewTracer(endpoint, service string, stop <-chan struct{}) *Tracer {
+	t := &Tracer{
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	go func() {
+		ticker := time.NewTicker(exportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.export()
+			case <-stop:
+				t.export()
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Span - a timed operation of a trace.
+type Span struct {
+	tracer     *Tracer
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        string
+	ended      bool
+}
+
+// Start starts a span named name, now. It is a child of parent, if set, and
+// the root of a new trace otherwise.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	return t.StartAt(name, parent, time.Now())
+}
+
+// StartAt is Start for a span that started at start.
+func (t *Tracer) StartAt(name string, parent *Span, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer:     t,
+		spanID:     randomID(8),
+		name:       name,
+		start:      start,
+		attributes: map[string]string{},
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return s
+}
+
+// SetAttribute records key=value on s.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks s as failed with message.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.err = message
+}
+
+// End ends s now.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends s at end and queues it for export. Spans end only once.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.end = end
+	t := s.tracer
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.queue) >= maxQueued {
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// Traceparent returns s's context as a W3C traceparent header value, or ""
+// for a nil span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.traceID, s.spanID)
+}
+
+// TraceID returns the ID of s's trace, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceID
+}
+
+func (t *Tracer) export() {
+	t.mutex.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.mutex.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		logrus.Warningf("unable to encode spans: %v", err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logrus.Warningf("unable to export %d spans to %s: %v", len(spans), t.endpoint, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logrus.Warningf("unable to export %d spans to %s: %s", len(spans), t.endpoint, resp.Status)
+	}
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusOk         = 1
+	statusError      = 2
+)
+
+func (t *Tracer) request(spans []*Span) otlpRequest {
+	encoded := []otlpSpan{}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: statusOk},
+		}
+		for k, v := range s.attributes {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: statusError, Message: s.err}
+		}
+		encoded = append(encoded, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: t.service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/water-hole/ansible-operator"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}